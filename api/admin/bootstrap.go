@@ -0,0 +1,77 @@
+package adminapi
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	customerrors "github.com/alubhorta/goth/custom/errors"
+	"github.com/alubhorta/goth/db/dbclient"
+	authmodels "github.com/alubhorta/goth/models/auth"
+	usermodels "github.com/alubhorta/goth/models/user"
+	passwordutils "github.com/alubhorta/goth/utils/password"
+	rbacutils "github.com/alubhorta/goth/utils/rbac"
+	validationutils "github.com/alubhorta/goth/utils/validation"
+
+	"github.com/google/uuid"
+)
+
+// EnsureBootstrapAdmin makes sure the account configured by BOOTSTRAP_ADMIN_EMAIL
+// exists and has the admin role. it is a no-op when the env is not set.
+func EnsureBootstrapAdmin(dbclient *dbclient.MongoDbClient) {
+	email := os.Getenv("BOOTSTRAP_ADMIN_EMAIL")
+	if email == "" {
+		return
+	} else if email = validationutils.NormalizeEmail(email); email == "" {
+		log.Fatalln("BOOTSTRAP_ADMIN_EMAIL is not a valid email.")
+	}
+
+	authCred, err := dbclient.AuthAccess.GetAuthCredentialByEmail(email)
+	if err == nil {
+		if rbacutils.Contains(authCred.Roles, rbacutils.RoleAdmin) {
+			return
+		}
+		if err := dbclient.AuthAccess.AddRole(authCred.UserId, rbacutils.RoleAdmin); err != nil {
+			log.Fatalln("failed to grant admin role to bootstrap admin.", err)
+		}
+		log.Println("granted admin role to bootstrap admin with userId:", authCred.UserId)
+		return
+	} else if err != customerrors.ErrNotFound {
+		log.Fatalln("failed to lookup bootstrap admin.", err)
+	}
+
+	password := os.Getenv("BOOTSTRAP_ADMIN_PASSWORD")
+	if err := passwordutils.ValidatePolicy(password, email); err != nil {
+		log.Fatalln("BOOTSTRAP_ADMIN_PASSWORD is invalid to create the bootstrap admin.", err)
+	}
+	hashedPass, err := passwordutils.GetHashedPassword(password)
+	if err != nil {
+		log.Fatalln("could not hash bootstrap admin password.", err)
+	}
+
+	userId := fmt.Sprintf("%v", uuid.New())
+	now := time.Now()
+	err = dbclient.AuthAccess.CreateNewUserAuthCredential(&authmodels.UserAuthCredential{
+		Email:          email,
+		UserId:         userId,
+		HashedPassword: hashedPass,
+		Roles:          []string{rbacutils.RoleUser, rbacutils.RoleAdmin},
+		Permissions:    []string{},
+		CreatedAt:      now,
+		ModifiedAt:     now,
+	})
+	if err != nil {
+		log.Fatalln("failed to create bootstrap admin credentials.", err)
+	}
+	err = dbclient.UserAccess.CreateAUser(userId, &usermodels.CreateUserInfoInput{
+		Email:     email,
+		FirstName: "Admin",
+		LastName:  "User",
+	})
+	if err != nil {
+		log.Fatalln("failed to create bootstrap admin user.", err)
+	}
+
+	log.Println("created bootstrap admin with userId:", userId)
+}
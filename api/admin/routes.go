@@ -0,0 +1,685 @@
+package adminapi
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	customerrors "github.com/alubhorta/goth/custom/errors"
+	auditmodels "github.com/alubhorta/goth/models/audit"
+	authmodels "github.com/alubhorta/goth/models/auth"
+	commonmodels "github.com/alubhorta/goth/models/common"
+	oauthmodels "github.com/alubhorta/goth/models/oauth"
+	accountutils "github.com/alubhorta/goth/utils/account"
+	auditutils "github.com/alubhorta/goth/utils/audit"
+	paginationutils "github.com/alubhorta/goth/utils/pagination"
+	rbacutils "github.com/alubhorta/goth/utils/rbac"
+	sessionutils "github.com/alubhorta/goth/utils/session"
+	tokenutils "github.com/alubhorta/goth/utils/token"
+	validationutils "github.com/alubhorta/goth/utils/validation"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+func QueryAudit(c *fiber.Ctx) error {
+	query := &auditmodels.AuditQuery{
+		ActorId: c.Query("actorId"),
+		Email:   c.Query("email"),
+		Action:  c.Query("action"),
+		Outcome: c.Query("outcome"),
+		Ip:      c.Query("ip"),
+	}
+	if minRiskScore := c.Query("minRiskScore"); minRiskScore != "" {
+		score, err := strconv.Atoi(minRiskScore)
+		if err != nil {
+			msg := "invalid input - minRiskScore must be a number."
+			log.Println(msg, err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+		}
+		query.MinRiskScore = &score
+	}
+	if from := c.Query("from"); from != "" {
+		t, err := time.Parse(time.RFC3339, from)
+		if err != nil {
+			msg := "invalid input - from must be an RFC3339 timestamp."
+			log.Println(msg, err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+		}
+		query.From = &t
+	}
+	if to := c.Query("to"); to != "" {
+		t, err := time.Parse(time.RFC3339, to)
+		if err != nil {
+			msg := "invalid input - to must be an RFC3339 timestamp."
+			log.Println(msg, err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+		}
+		query.To = &t
+	}
+
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	dbclient := cc.DbClient
+
+	page, limit := paginationutils.GetPagination(c)
+	entries, total, err := dbclient.AuditAccess.QueryEntries(query, page, limit)
+	if err != nil {
+		msg := "failed to query audit log."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully queried audit log."
+	log.Println(msg)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": msg,
+		"payload": fiber.Map{
+			"entries": entries,
+			"page":    page,
+			"limit":   limit,
+			"total":   total,
+		},
+	})
+}
+
+func GrantRole(c *fiber.Ctx) error {
+	adminId := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).UserId
+	userId := c.Params("userId")
+
+	input := new(authmodels.GrantRoleInput)
+	if err := c.BodyParser(input); err != nil {
+		msg := "invalid input."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if !rbacutils.IsValidRole(input.Role) {
+		msg := "invalid input - unknown role."
+		log.Println(msg, input.Role)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	dbclient := cc.DbClient
+
+	err := dbclient.AuthAccess.AddRole(userId, input.Role)
+	if err == customerrors.ErrNotFound {
+		msg := "no such user found."
+		log.Println(msg, "id:", userId)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to grant role."
+		log.Println(msg, err, "id:", userId)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully granted role."
+	log.Println(msg, "role:", input.Role, "id:", userId, "by:", adminId)
+	auditutils.Record(c, auditmodels.ActionRoleGrant, auditmodels.OutcomeSuccess, adminId, "", "granted "+input.Role+" to "+userId)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": nil})
+}
+
+func RevokeRole(c *fiber.Ctx) error {
+	adminId := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).UserId
+	userId := c.Params("userId")
+	role := c.Params("role")
+
+	if !rbacutils.IsValidRole(role) {
+		msg := "invalid input - unknown role."
+		log.Println(msg, role)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if userId == adminId && role == rbacutils.RoleAdmin {
+		// prevents locking out the last admin by accident
+		msg := "invalid input - admins cannot revoke their own admin role."
+		log.Println(msg, "id:", userId)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	dbclient := cc.DbClient
+
+	err := dbclient.AuthAccess.RemoveRole(userId, role)
+	if err == customerrors.ErrNotFound {
+		msg := "no such user found."
+		log.Println(msg, "id:", userId)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to revoke role."
+		log.Println(msg, err, "id:", userId)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully revoked role."
+	log.Println(msg, "role:", role, "id:", userId, "by:", adminId)
+	auditutils.Record(c, auditmodels.ActionRoleRevoke, auditmodels.OutcomeSuccess, adminId, "", "revoked "+role+" from "+userId)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": nil})
+}
+
+func ListUsers(c *fiber.Ctx) error {
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	dbclient := cc.DbClient
+
+	page, limit := paginationutils.GetPagination(c)
+	users, total, err := dbclient.UserAccess.SearchUsers(c.Query("q"), page, limit)
+	if err != nil {
+		msg := "failed to list users."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully listed users."
+	log.Println(msg)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": msg,
+		"payload": fiber.Map{
+			"users": users,
+			"page":  page,
+			"limit": limit,
+			"total": total,
+		},
+	})
+}
+
+func GetUser(c *fiber.Ctx) error {
+	userId := c.Params("userId")
+
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	dbclient := cc.DbClient
+
+	userInfo, err := dbclient.UserAccess.GetAUser(userId)
+	if err == customerrors.ErrNotFound {
+		msg := "no such user found."
+		log.Println(msg, "id:", userId)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to get user."
+		log.Println(msg, err, "id:", userId)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	authCred, err := dbclient.AuthAccess.GetAuthCredentialByUserId(userId)
+	if err == customerrors.ErrNotFound {
+		msg := "no such user credential found."
+		log.Println(msg, "id:", userId)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to get user credential."
+		log.Println(msg, err, "id:", userId)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully retrieved user."
+	log.Println(msg, "id:", userId)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": msg,
+		"payload": fiber.Map{
+			"userInfo": userInfo,
+			// never expose the password hash, even to admins
+			"credential": fiber.Map{
+				"email":                 authCred.Email,
+				"roles":                 rbacutils.GetEffectiveRoles(authCred.Roles),
+				"permissions":           authCred.Permissions,
+				"disabled":              authCred.Disabled,
+				"passwordResetRequired": authCred.PasswordResetRequired,
+				"createdAt":             authCred.CreatedAt,
+				"modifiedAt":            authCred.ModifiedAt,
+			},
+		},
+	})
+}
+
+func DisableUser(c *fiber.Ctx) error {
+	return setUserDisabled(c, true)
+}
+
+func EnableUser(c *fiber.Ctx) error {
+	return setUserDisabled(c, false)
+}
+
+func setUserDisabled(c *fiber.Ctx, disabled bool) error {
+	adminId := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).UserId
+	userId := c.Params("userId")
+
+	if disabled && userId == adminId {
+		msg := "invalid input - admins cannot disable their own account."
+		log.Println(msg, "id:", userId)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	dbclient := cc.DbClient
+	cacheClient := cc.CacheClient
+
+	err := dbclient.AuthAccess.SetDisabled(userId, disabled)
+	if err == customerrors.ErrNotFound {
+		msg := "no such user found."
+		log.Println(msg, "id:", userId)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to update user credential."
+		log.Println(msg, err, "id:", userId)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	action := auditmodels.ActionAccountEnable
+	msg := "successfully enabled user."
+	if disabled {
+		action = auditmodels.ActionAccountDisable
+		msg = "successfully disabled user."
+		err = sessionutils.MarkUserDisabled(cacheClient, userId)
+	} else {
+		err = sessionutils.UnmarkUserDisabled(cacheClient, userId)
+	}
+	if err != nil {
+		msg := "failed to update cache."
+		log.Println(msg, err, "id:", userId)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	log.Println(msg, "id:", userId, "by:", adminId)
+	auditutils.Record(c, action, auditmodels.OutcomeSuccess, adminId, "", "target "+userId)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": nil})
+}
+
+func ForcePasswordReset(c *fiber.Ctx) error {
+	adminId := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).UserId
+	userId := c.Params("userId")
+
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	dbclient := cc.DbClient
+
+	err := dbclient.AuthAccess.RequirePasswordReset(userId)
+	if err == customerrors.ErrNotFound {
+		msg := "no such user found."
+		log.Println(msg, "id:", userId)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to update user credential."
+		log.Println(msg, err, "id:", userId)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	// a forced reset is pointless if existing sessions stay valid
+	if err := sessionutils.RevokeAllSessions(cc.CacheClient, userId); err != nil {
+		msg := "failed to revoke sessions."
+		log.Println(msg, err, "id:", userId)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully required password reset."
+	log.Println(msg, "id:", userId, "by:", adminId)
+	auditutils.Record(c, auditmodels.ActionForceReset, auditmodels.OutcomeSuccess, adminId, "", "target "+userId)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": nil})
+}
+
+func RevokeSessions(c *fiber.Ctx) error {
+	adminId := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).UserId
+	userId := c.Params("userId")
+
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	dbclient := cc.DbClient
+
+	_, err := dbclient.AuthAccess.GetAuthCredentialByUserId(userId)
+	if err == customerrors.ErrNotFound {
+		msg := "no such user found."
+		log.Println(msg, "id:", userId)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to get user credential."
+		log.Println(msg, err, "id:", userId)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	if err := sessionutils.RevokeAllSessions(cc.CacheClient, userId); err != nil {
+		msg := "failed to revoke sessions."
+		log.Println(msg, err, "id:", userId)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully revoked all sessions."
+	log.Println(msg, "id:", userId, "by:", adminId)
+	auditutils.Record(c, auditmodels.ActionRevokeSessions, auditmodels.OutcomeSuccess, adminId, "", "target "+userId)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": nil})
+}
+
+func DeleteUser(c *fiber.Ctx) error {
+	adminId := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).UserId
+	userId := c.Params("userId")
+
+	if userId == adminId {
+		msg := "invalid input - use the account deletion endpoint to delete your own account."
+		log.Println(msg, "id:", userId)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	dbclient := cc.DbClient
+
+	soleOwned, err := accountutils.GetSoleOwnedOrgs(dbclient.OrgAccess, userId)
+	if err != nil {
+		msg := "failed to read from database."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if len(soleOwned) > 0 {
+		msg := "the user is the only owner of orgs - transfer their ownership or delete them first."
+		log.Println(msg, "id:", userId, "orgIds:", soleOwned)
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"message": msg, "payload": fiber.Map{"orgIds": soleOwned}})
+	}
+
+	err = accountutils.DeleteAccount(cc, userId)
+	if err == customerrors.ErrNotFound {
+		msg := "no such user credential found for deletion."
+		log.Println(msg, err, "id:", userId)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to delete user."
+		log.Println(msg, err, "id:", userId)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully deleted user."
+	log.Println(msg, "id:", userId, "by:", adminId)
+	auditutils.Record(c, auditmodels.ActionAccountDelete, auditmodels.OutcomeSuccess, adminId, "", "deleted by admin, target "+userId)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": nil})
+}
+
+func CreateSignupInvite(c *fiber.Ctx) error {
+	adminId := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).UserId
+
+	input := new(authmodels.CreateSignupInviteInput)
+	if err := c.BodyParser(input); err != nil {
+		msg := "invalid input."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if input.Email != "" && !validationutils.IsValidEmail(input.Email) {
+		msg := "invalid email provided."
+		log.Println(msg)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if input.Role != "" && !rbacutils.IsValidRole(input.Role) {
+		msg := "invalid input - unknown role."
+		log.Println(msg, input.Role)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	input.Email = validationutils.NormalizeEmail(input.Email)
+	if input.ExpiresInHours <= 0 {
+		input.ExpiresInHours = 72
+	}
+
+	code, err := tokenutils.GenerateOpaqueToken(16)
+	if err != nil {
+		msg := "failed to generate invite code."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	dbclient := cc.DbClient
+
+	now := time.Now()
+	invite := &authmodels.SignupInvite{
+		InviteId:   fmt.Sprintf("%v", uuid.New()),
+		HashedCode: tokenutils.HashOpaqueToken(code),
+		Email:      input.Email,
+		Role:       input.Role,
+		CreatedBy:  adminId,
+		ExpiresAt:  now.Add(time.Hour * time.Duration(input.ExpiresInHours)),
+		CreatedAt:  now,
+	}
+	if err := dbclient.SignupInviteAccess.CreateInvite(invite); err != nil {
+		msg := "failed to create invite."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully created invite. the code is only shown once."
+	log.Println(msg, "inviteId:", invite.InviteId, "by:", adminId)
+	auditutils.Record(c, auditmodels.ActionInviteCreate, auditmodels.OutcomeSuccess, adminId, input.Email, "invite "+invite.InviteId)
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": msg,
+		"payload": fiber.Map{
+			"invite": invite,
+			"code":   code,
+			"link":   os.Getenv("SIGNUP_INVITE_URL") + code,
+		},
+	})
+}
+
+func ListSignupInvites(c *fiber.Ctx) error {
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	dbclient := cc.DbClient
+
+	invites, err := dbclient.SignupInviteAccess.ListPendingInvites()
+	if err != nil {
+		msg := "failed to list invites."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully listed invites."
+	log.Println(msg)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": fiber.Map{"invites": invites}})
+}
+
+func RevokeSignupInvite(c *fiber.Ctx) error {
+	adminId := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).UserId
+	inviteId := c.Params("inviteId")
+
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	dbclient := cc.DbClient
+
+	err := dbclient.SignupInviteAccess.DeleteInvite(inviteId)
+	if err == customerrors.ErrNotFound {
+		msg := "no such invite found."
+		log.Println(msg, "inviteId:", inviteId)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to revoke invite."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully revoked invite."
+	log.Println(msg, "inviteId:", inviteId, "by:", adminId)
+	auditutils.Record(c, auditmodels.ActionInviteRevoke, auditmodels.OutcomeSuccess, adminId, "", "invite "+inviteId)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": nil})
+}
+
+func CreateOauthClient(c *fiber.Ctx) error {
+	adminId := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).UserId
+
+	input := new(oauthmodels.CreateOauthClientInput)
+	if err := c.BodyParser(input); err != nil {
+		msg := "invalid input."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	if len(input.GrantTypes) == 0 {
+		input.GrantTypes = []string{oauthmodels.GrantAuthorizationCode, oauthmodels.GrantRefreshToken}
+	}
+	for _, grantType := range input.GrantTypes {
+		if !rbacutils.Contains(oauthmodels.GrantTypes, grantType) {
+			msg := "invalid input - unknown grant type."
+			log.Println(msg, grantType)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+		}
+	}
+	for _, scope := range input.Scopes {
+		if !rbacutils.IsValidPermission(scope) {
+			msg := "invalid input - client scopes must be known permissions."
+			log.Println(msg, scope)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+		}
+	}
+	usesRedirect := rbacutils.Contains(input.GrantTypes, oauthmodels.GrantAuthorizationCode)
+	if input.Name == "" || (usesRedirect && len(input.RedirectUris) == 0) {
+		msg := "invalid input - missing required fields."
+		log.Println(msg)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if input.Public && rbacutils.Contains(input.GrantTypes, oauthmodels.GrantClientCredentials) {
+		msg := "invalid input - public clients can not use the client credentials grant."
+		log.Println(msg)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	if input.RedirectUris == nil {
+		input.RedirectUris = []string{}
+	}
+	if input.Scopes == nil {
+		input.Scopes = []string{}
+	}
+	for _, redirectUri := range input.RedirectUris {
+		parsed, err := url.Parse(redirectUri)
+		if err != nil || !parsed.IsAbs() || parsed.Fragment != "" {
+			msg := "invalid input - redirect uris must be absolute and without a fragment."
+			log.Println(msg, redirectUri)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+		}
+	}
+
+	client := &oauthmodels.OauthClient{
+		ClientId:     fmt.Sprintf("%v", uuid.New()),
+		Name:         input.Name,
+		RedirectUris: input.RedirectUris,
+		Public:       input.Public,
+		GrantTypes:   input.GrantTypes,
+		Scopes:       input.Scopes,
+		CreatedBy:    adminId,
+		CreatedAt:    time.Now(),
+	}
+	clientSecret := ""
+	if !client.Public {
+		secret, err := tokenutils.GenerateOpaqueToken(32)
+		if err != nil {
+			msg := "failed to generate client secret."
+			log.Println(msg, err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+		}
+		clientSecret = secret
+		client.HashedSecret = tokenutils.HashOpaqueToken(secret)
+	}
+
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	dbclient := cc.DbClient
+
+	if err := dbclient.OauthClientAccess.CreateClient(client); err != nil {
+		msg := "failed to create oauth client."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully created oauth client. the secret is only shown once."
+	log.Println(msg, "clientId:", client.ClientId, "by:", adminId)
+	auditutils.Record(c, auditmodels.ActionClientCreate, auditmodels.OutcomeSuccess, adminId, "", "client "+client.ClientId)
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": msg,
+		"payload": fiber.Map{
+			"client":       client,
+			"clientSecret": clientSecret,
+		},
+	})
+}
+
+func ListOauthClients(c *fiber.Ctx) error {
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	dbclient := cc.DbClient
+
+	clients, err := dbclient.OauthClientAccess.ListClients()
+	if err != nil {
+		msg := "failed to list oauth clients."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully listed oauth clients."
+	log.Println(msg)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": fiber.Map{"clients": clients}})
+}
+
+// UpdateOauthClientScopes replaces the scopes a machine client may request.
+// when scopes are taken away, the tokens issued so far are revoked, as they
+// may carry them.
+func UpdateOauthClientScopes(c *fiber.Ctx) error {
+	adminId := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).UserId
+	clientId := c.Params("clientId")
+
+	input := new(oauthmodels.UpdateOauthClientScopesInput)
+	if err := c.BodyParser(input); err != nil || input.Scopes == nil {
+		msg := "invalid input."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	for _, scope := range input.Scopes {
+		if !rbacutils.IsValidPermission(scope) {
+			msg := "invalid input - client scopes must be known permissions."
+			log.Println(msg, scope)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+		}
+	}
+
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	dbclient := cc.DbClient
+
+	client, err := dbclient.OauthClientAccess.GetClient(clientId)
+	if err == customerrors.ErrNotFound {
+		msg := "no such oauth client found."
+		log.Println(msg, "clientId:", clientId)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to read oauth client."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	if err := dbclient.OauthClientAccess.UpdateClientScopes(clientId, input.Scopes); err == customerrors.ErrNotFound {
+		msg := "no such oauth client found."
+		log.Println(msg, "clientId:", clientId)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to update oauth client."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	if !rbacutils.ContainsAll(input.Scopes, client.Scopes) {
+		if err := sessionutils.RevokeClientTokens(cc.CacheClient, clientId); err != nil {
+			msg := "updated oauth client, but failed to revoke its tokens."
+			log.Println(msg, err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+		}
+	}
+	client.Scopes = input.Scopes
+
+	msg := "successfully updated oauth client scopes."
+	log.Println(msg, "clientId:", clientId, "by:", adminId)
+	auditutils.Record(c, auditmodels.ActionClientScopes, auditmodels.OutcomeSuccess, adminId, "", "client "+clientId+": "+strings.Join(input.Scopes, " "))
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": fiber.Map{"client": client}})
+}
+
+func DeleteOauthClient(c *fiber.Ctx) error {
+	adminId := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).UserId
+	clientId := c.Params("clientId")
+
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	dbclient := cc.DbClient
+
+	err := dbclient.OauthClientAccess.DeleteClient(clientId)
+	if err == customerrors.ErrNotFound {
+		msg := "no such oauth client found."
+		log.Println(msg, "clientId:", clientId)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to delete oauth client."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	if err := sessionutils.RevokeClientTokens(cc.CacheClient, clientId); err != nil {
+		msg := "deleted oauth client, but failed to revoke its tokens."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully deleted oauth client."
+	log.Println(msg, "clientId:", clientId, "by:", adminId)
+	auditutils.Record(c, auditmodels.ActionClientDelete, auditmodels.OutcomeSuccess, adminId, "", "client "+clientId)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": nil})
+}
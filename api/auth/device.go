@@ -0,0 +1,126 @@
+package authapi
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	customerrors "github.com/alubhorta/goth/custom/errors"
+	auditmodels "github.com/alubhorta/goth/models/audit"
+	authmodels "github.com/alubhorta/goth/models/auth"
+	commonmodels "github.com/alubhorta/goth/models/common"
+	auditutils "github.com/alubhorta/goth/utils/audit"
+	emailutils "github.com/alubhorta/goth/utils/email"
+	otputils "github.com/alubhorta/goth/utils/otp"
+	sessionutils "github.com/alubhorta/goth/utils/session"
+	tokenutils "github.com/alubhorta/goth/utils/token"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ReportDevice handles the "this wasn't me" link of a new device mail, sent by
+// loginutils.CheckDevice. it signs out all sessions, forgets the device and
+// requires a password reset before the next login.
+func ReportDevice(c *fiber.Ctx) error {
+	input := new(authmodels.ReportDeviceInput)
+	if err := c.BodyParser(input); err != nil || input.Token == "" {
+		msg := "invalid input."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	dbclient := cc.DbClient
+
+	val, err := cc.CacheClient.Take("deviceReport:" + tokenutils.HashOpaqueToken(input.Token))
+	if err == customerrors.ErrNotFound {
+		msg := "not found - invalid or expired token."
+		log.Println(msg)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to read from cache."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	report := new(authmodels.PendingDeviceReport)
+	if err := json.Unmarshal([]byte(val), report); err != nil {
+		msg := "failed to read from cache."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	authCred, err := dbclient.AuthAccess.GetAuthCredentialByUserId(report.UserId)
+	if err == customerrors.ErrNotFound {
+		msg := "no such user found."
+		log.Println(msg)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to get user credential."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	if err := sessionutils.RevokeAllSessions(cc.CacheClient, authCred.UserId); err != nil {
+		msg := "failed to revoke sessions."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	if err := dbclient.DeviceAccess.DeleteDevice(authCred.UserId, report.DeviceId); err != nil && err != customerrors.ErrNotFound {
+		log.Println("failed to forget reported device.", err)
+	}
+
+	// whoever used the device may have added their own ways in, so only the
+	// email is left to get back into the account
+	if err := dbclient.ApiKeyAccess.DeleteApiKeysOfUser(authCred.UserId); err != nil {
+		msg := "sessions revoked, but failed to delete api keys."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	if err := dbclient.IdentityAccess.DeleteIdentitiesOfUser(authCred.UserId); err != nil {
+		msg := "sessions revoked, but failed to unlink social logins."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	if err := dbclient.PasskeyAccess.DeletePasskeysOfUser(authCred.UserId); err != nil {
+		msg := "sessions revoked, but failed to delete passkeys."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	// a phone is a way to reset the password as well
+	if authCred.Phone != "" {
+		if err := dbclient.AuthAccess.UpdatePhone(authCred.UserId, authCred.Phone, ""); err != nil {
+			msg := "sessions revoked, but failed to remove the phone number."
+			log.Println(msg, err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+		}
+	}
+	if err := dbclient.AuthAccess.RequirePasswordReset(authCred.UserId); err != nil {
+		msg := "sessions revoked, but failed to require a password reset."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	// start the reset right away, like /api/v1/auth/reset/init by email
+	otp, err := otputils.GenerateOTP(6)
+	if err != nil {
+		msg := "failed to generate otp."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	if err := cc.CacheClient.Set("resetOTP:"+authCred.Email, otp, time.Second*120); err != nil {
+		msg := "failed to write to cache."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	if err := emailutils.SendOtpMail(authCred.Email, otp); err != nil {
+		msg := "failed to send otp via mail."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "signed out all sessions, and removed api keys, passkeys, social logins and the phone number. a verification code (otp) is sent to your email, reset your password within the next 2 minutes to sign in again."
+	log.Println(msg, "userId:", authCred.UserId)
+	auditutils.Record(c, auditmodels.ActionDeviceReport, auditmodels.OutcomeSuccess, authCred.UserId, authCred.Email, report.DeviceId)
+	auditutils.Record(c, auditmodels.ActionResetInit, auditmodels.OutcomeSuccess, authCred.UserId, authCred.Email, "device report")
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": fiber.Map{"email": authCred.Email}})
+}
@@ -0,0 +1,415 @@
+package authapi
+
+import (
+	"encoding/base64"
+	"log"
+	"strings"
+	"time"
+
+	customerrors "github.com/alubhorta/goth/custom/errors"
+	"github.com/alubhorta/goth/db/cacheclient"
+	auditmodels "github.com/alubhorta/goth/models/audit"
+	authmodels "github.com/alubhorta/goth/models/auth"
+	commonmodels "github.com/alubhorta/goth/models/common"
+	auditutils "github.com/alubhorta/goth/utils/audit"
+	loginutils "github.com/alubhorta/goth/utils/login"
+	tokenutils "github.com/alubhorta/goth/utils/token"
+	webauthnutils "github.com/alubhorta/goth/utils/webauthn"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const mfaTokenMaxAge = 5 * time.Minute
+
+// createMfaToken is handed out after a correct password when mfa is enabled,
+// and is traded in at the passkey login along with an assertion.
+func createMfaToken(cacheClient *cacheclient.RedisClient, userId string) (string, error) {
+	mfaToken, err := tokenutils.GenerateOpaqueToken(32)
+	if err != nil {
+		return "", err
+	}
+	if err := cacheClient.Set("mfaPending:"+tokenutils.HashOpaqueToken(mfaToken), userId, mfaTokenMaxAge); err != nil {
+		return "", err
+	}
+	return mfaToken, nil
+}
+
+func RegisterPasskeyBegin(c *fiber.Ctx) error {
+	commonCtx := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx)
+	dbclient := commonCtx.Clients.DbClient
+	if commonCtx.ApiKeyId != "" {
+		msg := "api keys can not register passkeys."
+		log.Println(msg, "keyId:", commonCtx.ApiKeyId)
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	userInfo, err := dbclient.UserAccess.GetAUser(commonCtx.UserId)
+	if err != nil {
+		msg := "failed to read user."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	passkeys, err := dbclient.PasskeyAccess.ListPasskeysOfUser(commonCtx.UserId)
+	if err != nil {
+		msg := "failed to read passkeys."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	challenge, err := loginutils.StartCeremony(commonCtx.Clients.CacheClient, &authmodels.WebauthnCeremony{Type: loginutils.CeremonyRegister, UserId: commonCtx.UserId})
+	if err != nil {
+		msg := "failed to start passkey registration."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	credentialParams := []fiber.Map{}
+	for _, alg := range webauthnutils.SupportedAlgorithms {
+		credentialParams = append(credentialParams, fiber.Map{"type": "public-key", "alg": alg})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "success",
+		"payload": fiber.Map{
+			"publicKey": fiber.Map{
+				"challenge": challenge,
+				"rp":        fiber.Map{"id": webauthnutils.GetRpId(), "name": webauthnutils.GetRpName()},
+				"user": fiber.Map{
+					"id":          base64.RawURLEncoding.EncodeToString([]byte(commonCtx.UserId)),
+					"name":        userInfo.Email,
+					"displayName": strings.TrimSpace(userInfo.FirstName + " " + userInfo.LastName),
+				},
+				"pubKeyCredParams":       credentialParams,
+				"timeout":                loginutils.CeremonyMaxAge.Milliseconds(),
+				"attestation":            "none",
+				"excludeCredentials":     loginutils.GetCredentialDescriptors(passkeys),
+				"authenticatorSelection": fiber.Map{"residentKey": "preferred", "userVerification": "preferred"},
+			},
+		},
+	})
+}
+
+func RegisterPasskey(c *fiber.Ctx) error {
+	commonCtx := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx)
+	dbclient := commonCtx.Clients.DbClient
+
+	input := new(authmodels.RegisterPasskeyInput)
+	if err := c.BodyParser(input); err != nil {
+		msg := "invalid input."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	clientDataJSON, err := webauthnutils.DecodeBase64Url(input.Credential.Response.ClientDataJSON)
+	if err != nil {
+		msg := "invalid client data."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	attestationObject, err := webauthnutils.DecodeBase64Url(input.Credential.Response.AttestationObject)
+	if err != nil {
+		msg := "invalid attestation object."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	ceremony, challenge, err := loginutils.FinishCeremony(commonCtx.Clients.CacheClient, clientDataJSON, loginutils.CeremonyRegister)
+	if err != nil || ceremony.UserId != commonCtx.UserId {
+		msg := "invalid or expired passkey registration."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	credential, err := webauthnutils.VerifyRegistration(clientDataJSON, attestationObject, challenge)
+	if err != nil {
+		msg := "failed to verify passkey."
+		log.Println(msg, err)
+		auditutils.Record(c, auditmodels.ActionPasskeyAdd, auditmodels.OutcomeFailure, commonCtx.UserId, "", err.Error())
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	name := strings.TrimSpace(input.Name)
+	if name == "" {
+		name = "passkey"
+	}
+	passkey := &authmodels.Passkey{
+		PasskeyId: base64.RawURLEncoding.EncodeToString(credential.Id),
+		UserId:    commonCtx.UserId,
+		Name:      name,
+		PublicKey: credential.PublicKey,
+		SignCount: credential.SignCount,
+		CreatedAt: time.Now(),
+	}
+	err = dbclient.PasskeyAccess.CreatePasskey(passkey)
+	if err == customerrors.ErrDuplicateKey {
+		msg := "passkey is already registered."
+		log.Println(msg)
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to save passkey."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully registered passkey."
+	log.Println(msg, "userId:", commonCtx.UserId, "passkeyId:", passkey.PasskeyId)
+	auditutils.Record(c, auditmodels.ActionPasskeyAdd, auditmodels.OutcomeSuccess, commonCtx.UserId, "", "passkey "+passkey.Name)
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"message": msg, "payload": passkey})
+}
+
+func ListPasskeys(c *fiber.Ctx) error {
+	commonCtx := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx)
+
+	passkeys, err := commonCtx.Clients.DbClient.PasskeyAccess.ListPasskeysOfUser(commonCtx.UserId)
+	if err != nil {
+		msg := "failed to read passkeys."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "success", "payload": passkeys})
+}
+
+// DeletePasskey also turns mfa off when the last passkey is removed, so the
+// account can't be locked out.
+func DeletePasskey(c *fiber.Ctx) error {
+	commonCtx := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx)
+	dbclient := commonCtx.Clients.DbClient
+	passkeyId := c.Params("passkeyId")
+
+	err := dbclient.PasskeyAccess.DeletePasskey(commonCtx.UserId, passkeyId)
+	if err == customerrors.ErrNotFound {
+		msg := "no such passkey found."
+		log.Println(msg, "passkeyId:", passkeyId)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to delete passkey."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	auditutils.Record(c, auditmodels.ActionPasskeyRemove, auditmodels.OutcomeSuccess, commonCtx.UserId, "", "passkey "+passkeyId)
+
+	passkeys, err := dbclient.PasskeyAccess.ListPasskeysOfUser(commonCtx.UserId)
+	if err != nil {
+		log.Println("failed to read passkeys.", err)
+	} else if len(passkeys) == 0 {
+		authCred, err := dbclient.AuthAccess.GetAuthCredentialByUserId(commonCtx.UserId)
+		if err == nil && authCred.MfaEnabled {
+			if err := dbclient.AuthAccess.SetMfaEnabled(commonCtx.UserId, false); err != nil {
+				log.Println("failed to disable mfa.", err)
+			} else {
+				auditutils.Record(c, auditmodels.ActionMfaDisable, auditmodels.OutcomeSuccess, commonCtx.UserId, "", "last passkey removed")
+			}
+		}
+	}
+
+	msg := "successfully deleted passkey."
+	log.Println(msg, "userId:", commonCtx.UserId, "passkeyId:", passkeyId)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": nil})
+}
+
+// UpdateMfa turns passkeys as a second factor after password login on or
+// off. turning it on needs a registered passkey.
+func UpdateMfa(c *fiber.Ctx) error {
+	commonCtx := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx)
+	dbclient := commonCtx.Clients.DbClient
+	if commonCtx.ApiKeyId != "" {
+		msg := "api keys can not change mfa settings."
+		log.Println(msg, "keyId:", commonCtx.ApiKeyId)
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	input := new(authmodels.UpdateMfaInput)
+	if err := c.BodyParser(input); err != nil {
+		msg := "invalid input."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	if input.Enabled {
+		passkeys, err := dbclient.PasskeyAccess.ListPasskeysOfUser(commonCtx.UserId)
+		if err != nil {
+			msg := "failed to read passkeys."
+			log.Println(msg, err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+		} else if len(passkeys) == 0 {
+			msg := "register a passkey before enabling mfa."
+			log.Println(msg, "userId:", commonCtx.UserId)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+		}
+	}
+
+	err := dbclient.AuthAccess.SetMfaEnabled(commonCtx.UserId, input.Enabled)
+	if err == customerrors.ErrNotFound {
+		msg := "no such user credential found."
+		log.Println(msg, "userId:", commonCtx.UserId)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to update mfa."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	action := auditmodels.ActionMfaDisable
+	if input.Enabled {
+		action = auditmodels.ActionMfaEnable
+	}
+	msg := "successfully updated mfa."
+	log.Println(msg, "userId:", commonCtx.UserId, "enabled:", input.Enabled)
+	auditutils.Record(c, action, auditmodels.OutcomeSuccess, commonCtx.UserId, "", "")
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": fiber.Map{"mfaEnabled": input.Enabled}})
+}
+
+// PasskeyLoginBegin starts a passwordless login with a discoverable passkey,
+// or with an mfaToken, the second factor of a password login.
+func PasskeyLoginBegin(c *fiber.Ctx) error {
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+
+	input := new(authmodels.PasskeyLoginBeginInput)
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(input); err != nil {
+			msg := "invalid input."
+			log.Println(msg, err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+		}
+	}
+
+	ceremony := &authmodels.WebauthnCeremony{Type: loginutils.CeremonyLogin}
+	allowCredentials := []fiber.Map{}
+	userVerification := "required"
+	if input.MfaToken != "" {
+		userId, err := cc.CacheClient.Get("mfaPending:" + tokenutils.HashOpaqueToken(input.MfaToken))
+		if err == customerrors.ErrNotFound {
+			msg := "invalid or expired mfa token."
+			log.Println(msg)
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": msg, "payload": nil})
+		} else if err != nil {
+			msg := "failed to lookup cache."
+			log.Println(msg, err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+		}
+		passkeys, err := cc.DbClient.PasskeyAccess.ListPasskeysOfUser(userId)
+		if err != nil {
+			msg := "failed to read passkeys."
+			log.Println(msg, err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+		}
+		ceremony.UserId, ceremony.Mfa = userId, true
+		allowCredentials = loginutils.GetCredentialDescriptors(passkeys)
+		// the password was the first factor already
+		userVerification = "discouraged"
+	}
+
+	challenge, err := loginutils.StartCeremony(cc.CacheClient, ceremony)
+	if err != nil {
+		msg := "failed to start passkey login."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "success",
+		"payload": fiber.Map{
+			"publicKey": fiber.Map{
+				"challenge":        challenge,
+				"rpId":             webauthnutils.GetRpId(),
+				"timeout":          loginutils.CeremonyMaxAge.Milliseconds(),
+				"userVerification": userVerification,
+				"allowCredentials": allowCredentials,
+			},
+		},
+	})
+}
+
+func PasskeyLogin(c *fiber.Ctx) error {
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	dbclient := cc.DbClient
+
+	input := new(authmodels.PasskeyLoginInput)
+	if err := c.BodyParser(input); err != nil {
+		msg := "invalid input."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	response := input.Credential.Response
+	credentialId, err1 := webauthnutils.DecodeBase64Url(input.Credential.Id)
+	clientDataJSON, err2 := webauthnutils.DecodeBase64Url(response.ClientDataJSON)
+	authenticatorData, err3 := webauthnutils.DecodeBase64Url(response.AuthenticatorData)
+	signature, err4 := webauthnutils.DecodeBase64Url(response.Signature)
+	userHandle, err5 := webauthnutils.DecodeBase64Url(response.UserHandle)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil || err5 != nil {
+		msg := "invalid passkey credential."
+		log.Println(msg)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	ceremony, challenge, err := loginutils.FinishCeremony(cc.CacheClient, clientDataJSON, loginutils.CeremonyLogin)
+	if err != nil {
+		msg := "invalid or expired passkey login."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	fail := func(userId, reason string) error {
+		msg := "invalid passkey."
+		log.Println(msg, reason)
+		auditutils.Record(c, auditmodels.ActionLogin, auditmodels.OutcomeFailure, userId, "", reason)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	passkey, err := dbclient.PasskeyAccess.GetPasskey(base64.RawURLEncoding.EncodeToString(credentialId))
+	if err == customerrors.ErrNotFound {
+		return fail(ceremony.UserId, "unknown passkey")
+	} else if err != nil {
+		msg := "failed to read passkey."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	if ceremony.Mfa {
+		// the mfa token is single-use, a failed assertion means a new login
+		userId, err := cc.CacheClient.Take("mfaPending:" + tokenutils.HashOpaqueToken(input.MfaToken))
+		if err != nil || userId != ceremony.UserId {
+			msg := "invalid or expired mfa token."
+			log.Println(msg, err)
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": msg, "payload": nil})
+		} else if passkey.UserId != userId {
+			return fail(userId, "passkey of another user")
+		}
+	} else if len(userHandle) > 0 && string(userHandle) != passkey.UserId {
+		return fail(passkey.UserId, "user handle does not match passkey")
+	}
+
+	credential := &webauthnutils.Credential{Id: credentialId, PublicKey: passkey.PublicKey, SignCount: passkey.SignCount}
+	signCount, err := webauthnutils.VerifyAssertion(clientDataJSON, authenticatorData, signature, challenge, credential, !ceremony.Mfa)
+	if err != nil {
+		return fail(passkey.UserId, "passkey assertion failed: "+err.Error())
+	}
+	err = dbclient.PasskeyAccess.UpdateSignCount(passkey.PasskeyId, passkey.SignCount, signCount, time.Now())
+	if err == customerrors.ErrNotFound {
+		return fail(passkey.UserId, "passkey was used concurrently")
+	} else if err != nil {
+		msg := "failed to update passkey."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	authCred, err := dbclient.AuthAccess.GetAuthCredentialByUserId(passkey.UserId)
+	if err != nil {
+		msg := "failed to login."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if authCred.Disabled {
+		msg := "account is disabled."
+		log.Println(msg, "userId:", authCred.UserId)
+		auditutils.Record(c, auditmodels.ActionLogin, auditmodels.OutcomeFailure, authCred.UserId, authCred.Email, "account disabled")
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if authCred.PasswordResetRequired {
+		msg := "password reset required - reset your password to continue."
+		log.Println(msg, "userId:", authCred.UserId)
+		auditutils.Record(c, auditmodels.ActionLogin, auditmodels.OutcomeFailure, authCred.UserId, authCred.Email, "password reset required")
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	reason, amr := "passkey "+passkey.Name, []string{tokenutils.AmrPasskey}
+	if ceremony.Mfa {
+		reason, amr = "password and passkey "+passkey.Name, []string{tokenutils.AmrPassword, tokenutils.AmrPasskey, tokenutils.AmrMfa}
+	}
+	auditutils.Record(c, auditmodels.ActionLogin, auditmodels.OutcomeSuccess, authCred.UserId, authCred.Email, reason)
+	return respondWithTokens(c, authCred, amr...)
+}
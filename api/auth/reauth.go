@@ -0,0 +1,173 @@
+package authapi
+
+import (
+	"encoding/base64"
+	"log"
+	"time"
+
+	customerrors "github.com/alubhorta/goth/custom/errors"
+	auditmodels "github.com/alubhorta/goth/models/audit"
+	authmodels "github.com/alubhorta/goth/models/auth"
+	commonmodels "github.com/alubhorta/goth/models/common"
+	auditutils "github.com/alubhorta/goth/utils/audit"
+	loginutils "github.com/alubhorta/goth/utils/login"
+	passwordutils "github.com/alubhorta/goth/utils/password"
+	tokenutils "github.com/alubhorta/goth/utils/token"
+	webauthnutils "github.com/alubhorta/goth/utils/webauthn"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// how long the elevated token of a re-authentication is valid, which should
+// not be less than the max age of RequiresRecentAuth
+const reauthTokenMaxAge = 5 * time.Minute
+
+// ReauthPasskeyBegin starts a re-authentication with one of the user's passkeys.
+func ReauthPasskeyBegin(c *fiber.Ctx) error {
+	commonCtx := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx)
+	if commonCtx.ApiKeyId != "" {
+		msg := "api keys can not reauthenticate."
+		log.Println(msg, "keyId:", commonCtx.ApiKeyId)
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	cc := commonCtx.Clients
+
+	passkeys, err := cc.DbClient.PasskeyAccess.ListPasskeysOfUser(commonCtx.UserId)
+	if err != nil {
+		msg := "failed to read passkeys."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if len(passkeys) == 0 {
+		msg := "no passkeys registered."
+		log.Println(msg, "userId:", commonCtx.UserId)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	challenge, err := loginutils.StartCeremony(cc.CacheClient, &authmodels.WebauthnCeremony{Type: loginutils.CeremonyReauth, UserId: commonCtx.UserId})
+	if err != nil {
+		msg := "failed to start passkey reauthentication."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "success",
+		"payload": fiber.Map{
+			"publicKey": fiber.Map{
+				"challenge":        challenge,
+				"rpId":             webauthnutils.GetRpId(),
+				"timeout":          loginutils.CeremonyMaxAge.Milliseconds(),
+				"userVerification": "required",
+				"allowCredentials": loginutils.GetCredentialDescriptors(passkeys),
+			},
+		},
+	})
+}
+
+// Reauth verifies the password or a passkey of the signed in user once more,
+// and issues a short-lived access token which passes RequiresRecentAuth.
+func Reauth(c *fiber.Ctx) error {
+	commonCtx := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx)
+	if commonCtx.ApiKeyId != "" {
+		msg := "api keys can not reauthenticate."
+		log.Println(msg, "keyId:", commonCtx.ApiKeyId)
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	cc := commonCtx.Clients
+	dbclient := cc.DbClient
+
+	input := new(authmodels.ReauthInput)
+	if err := c.BodyParser(input); err != nil || (input.Password == "" && input.Credential == nil) {
+		msg := "invalid input."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	authCred, err := dbclient.AuthAccess.GetAuthCredentialByUserId(commonCtx.UserId)
+	if err != nil {
+		msg := "failed to get user credential."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	fail := func(reason string) error {
+		msg := "reauthentication failed."
+		log.Println(msg, reason, "userId:", authCred.UserId)
+		auditutils.Record(c, auditmodels.ActionReauth, auditmodels.OutcomeFailure, authCred.UserId, authCred.Email, reason)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	var amr []string
+	if input.Password != "" {
+		if authCred.HashedPassword == "" {
+			msg := "no password set - reauthenticate with a passkey."
+			log.Println(msg, "userId:", authCred.UserId)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+		} else if !passwordutils.DoesPasswordMatchHash(authCred.HashedPassword, input.Password) {
+			return fail("invalid password")
+		}
+		amr = []string{tokenutils.AmrPassword}
+	} else {
+		response := input.Credential.Response
+		credentialId, err1 := webauthnutils.DecodeBase64Url(input.Credential.Id)
+		clientDataJSON, err2 := webauthnutils.DecodeBase64Url(response.ClientDataJSON)
+		authenticatorData, err3 := webauthnutils.DecodeBase64Url(response.AuthenticatorData)
+		signature, err4 := webauthnutils.DecodeBase64Url(response.Signature)
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+			msg := "invalid passkey credential."
+			log.Println(msg)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+		}
+
+		ceremony, challenge, err := loginutils.FinishCeremony(cc.CacheClient, clientDataJSON, loginutils.CeremonyReauth)
+		if err != nil || ceremony.UserId != authCred.UserId {
+			msg := "invalid or expired passkey reauthentication."
+			log.Println(msg, err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+		}
+
+		passkey, err := dbclient.PasskeyAccess.GetPasskey(base64.RawURLEncoding.EncodeToString(credentialId))
+		if err == customerrors.ErrNotFound {
+			return fail("unknown passkey")
+		} else if err != nil {
+			msg := "failed to read passkey."
+			log.Println(msg, err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+		} else if passkey.UserId != authCred.UserId {
+			return fail("passkey of another user")
+		}
+
+		credential := &webauthnutils.Credential{Id: credentialId, PublicKey: passkey.PublicKey, SignCount: passkey.SignCount}
+		signCount, err := webauthnutils.VerifyAssertion(clientDataJSON, authenticatorData, signature, challenge, credential, true)
+		if err != nil {
+			return fail("passkey assertion failed: " + err.Error())
+		}
+		err = dbclient.PasskeyAccess.UpdateSignCount(passkey.PasskeyId, passkey.SignCount, signCount, time.Now())
+		if err == customerrors.ErrNotFound {
+			return fail("passkey was used concurrently")
+		} else if err != nil {
+			msg := "failed to update passkey."
+			log.Println(msg, err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+		}
+		amr = []string{tokenutils.AmrPasskey}
+	}
+
+	accessClaims := tokenutils.MergeClaims(tokenutils.GetUserClaims(authCred), tokenutils.GetAuthClaims(time.Now(), amr...))
+	accessToken, err := tokenutils.CreateNewElevatedAccessToken(authCred.UserId, accessClaims, reauthTokenMaxAge)
+	if err != nil {
+		msg := "failed to generate access token."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully reauthenticated."
+	log.Println(msg, "userId:", authCred.UserId)
+	auditutils.Record(c, auditmodels.ActionReauth, auditmodels.OutcomeSuccess, authCred.UserId, authCred.Email, amr[0])
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": msg,
+		"payload": fiber.Map{
+			"accessToken": accessToken,
+			"expiresIn":   int(reauthTokenMaxAge.Seconds()),
+		},
+	})
+}
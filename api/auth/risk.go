@@ -0,0 +1,172 @@
+package authapi
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"time"
+
+	customerrors "github.com/alubhorta/goth/custom/errors"
+	"github.com/alubhorta/goth/db/cacheclient"
+	auditmodels "github.com/alubhorta/goth/models/audit"
+	authmodels "github.com/alubhorta/goth/models/auth"
+	commonmodels "github.com/alubhorta/goth/models/common"
+	auditutils "github.com/alubhorta/goth/utils/audit"
+	emailutils "github.com/alubhorta/goth/utils/email"
+	otputils "github.com/alubhorta/goth/utils/otp"
+	riskutils "github.com/alubhorta/goth/utils/risk"
+	tokenutils "github.com/alubhorta/goth/utils/token"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+const loginChallengeMaxAge = 10 * time.Minute
+const loginChallengeMaxAttempts = 5
+
+// assessRefresh risk scores a token refresh, nil like for loginutils.Assess.
+func assessRefresh(c *fiber.Ctx, userId string) *riskutils.Assessment {
+	if !riskutils.GetPolicy().Enabled {
+		return nil
+	}
+	dbclient := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients.DbClient
+
+	devices, err := dbclient.DeviceAccess.ListDevicesOfUser(userId)
+	if err != nil {
+		log.Println("failed to list known devices for risk scoring.", err)
+		return nil
+	}
+	assessment := riskutils.AssessRefresh(c.IP(), c.Get(fiber.HeaderUserAgent), devices)
+	log.Println("assessed refresh.", assessment, "decision:", assessment.Decision, "userId:", userId)
+	return assessment
+}
+
+// createLoginChallenge mails a code that completes a risky login, and returns
+// the token to send it back with.
+func createLoginChallenge(cacheClient *cacheclient.RedisClient, authCred *authmodels.UserAuthCredential, riskScore int) (string, error) {
+	challengeToken, err := tokenutils.GenerateOpaqueToken(32)
+	if err != nil {
+		return "", err
+	}
+	code, err := otputils.GenerateOTP(6)
+	if err != nil {
+		return "", err
+	}
+	pending := &authmodels.PendingLoginChallenge{
+		UserId:    authCred.UserId,
+		Code:      code,
+		RiskScore: riskScore,
+		ExpiresAt: time.Now().Add(loginChallengeMaxAge).Unix(),
+	}
+	val, err := json.Marshal(pending)
+	if err != nil {
+		return "", err
+	}
+	if err := cacheClient.Set("loginChallenge:"+tokenutils.HashOpaqueToken(challengeToken), string(val), loginChallengeMaxAge); err != nil {
+		return "", err
+	}
+
+	email := utils.CopyString(authCred.Email)
+	go func() {
+		if err := emailutils.SendLoginChallengeMail(email, code); err != nil {
+			log.Println("failed to send login challenge mail.", err)
+		}
+	}()
+	return challengeToken, nil
+}
+
+// LoginChallenge completes a login that risk scoring challenged, with the
+// code mailed to the user. after too many wrong codes, the login has to be
+// started again.
+func LoginChallenge(c *fiber.Ctx) error {
+	input := new(authmodels.LoginChallengeInput)
+	if err := c.BodyParser(input); err != nil || input.ChallengeToken == "" || input.Code == "" {
+		msg := "invalid input."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+
+	key := "loginChallenge:" + tokenutils.HashOpaqueToken(input.ChallengeToken)
+	val, err := cc.CacheClient.Get(key)
+	if err == customerrors.ErrNotFound {
+		msg := "not found - no pending login or expired code."
+		log.Println(msg)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to read from cache."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	pending := new(authmodels.PendingLoginChallenge)
+	if err := json.Unmarshal([]byte(val), pending); err != nil {
+		msg := "failed to read from cache."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	// counted before comparing, so concurrent guesses can't exceed the limit
+	attemptsKey := "loginChallengeAttempts:" + tokenutils.HashOpaqueToken(input.ChallengeToken)
+	attempts, err := cc.CacheClient.Incr(attemptsKey, loginChallengeMaxAge)
+	if err != nil {
+		msg := "failed to write to cache."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if attempts > loginChallengeMaxAttempts {
+		if err := cc.CacheClient.Del(key); err != nil {
+			log.Println("failed to write to cache.", err)
+		}
+		msg := "too many attempts - start the login again."
+		log.Println(msg, "userId:", pending.UserId)
+		auditutils.RecordRisk(c, auditmodels.ActionLogin, auditmodels.OutcomeFailure, pending.UserId, "", "too many login challenge attempts", pending.RiskScore)
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	if subtle.ConstantTimeCompare([]byte(input.Code), []byte(pending.Code)) != 1 {
+		msg := "invalid input - code mismatch."
+		log.Println(msg, "userId:", pending.UserId)
+		auditutils.RecordRisk(c, auditmodels.ActionLogin, auditmodels.OutcomeFailure, pending.UserId, "", "login challenge code mismatch", pending.RiskScore)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	// a concurrent try with the same code may have used it up already
+	if _, err := cc.CacheClient.Take(key); err == customerrors.ErrNotFound {
+		msg := "not found - no pending login or expired code."
+		log.Println(msg)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to write to cache."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	cc.CacheClient.Del(attemptsKey)
+
+	// the account may have changed since the challenge was sent
+	authCred, err := cc.DbClient.AuthAccess.GetAuthCredentialByUserId(pending.UserId)
+	if err == customerrors.ErrNotFound {
+		msg := "no such user found."
+		log.Println(msg)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to login."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	if authCred.Disabled {
+		msg := "account is disabled."
+		log.Println(msg, "userId:", authCred.UserId)
+		auditutils.Record(c, auditmodels.ActionLogin, auditmodels.OutcomeFailure, authCred.UserId, authCred.Email, "account disabled")
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if authCred.PasswordResetRequired {
+		msg := "password reset required - reset your password to continue."
+		log.Println(msg, "userId:", authCred.UserId)
+		auditutils.Record(c, auditmodels.ActionLogin, auditmodels.OutcomeFailure, authCred.UserId, authCred.Email, "password reset required")
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	if err := riskutils.ClearFailures(cc.CacheClient, authCred.UserId); err != nil {
+		log.Println("failed to clear login failures.", err)
+	}
+	auditutils.RecordRisk(c, auditmodels.ActionLogin, auditmodels.OutcomeSuccess, authCred.UserId, authCred.Email, "login challenge", pending.RiskScore)
+	return respondWithTokens(c, authCred, tokenutils.AmrPassword, tokenutils.AmrOtp, tokenutils.AmrMfa)
+}
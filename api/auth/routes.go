@@ -1,6 +1,7 @@
 package authapi
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"log"
 	"os"
@@ -8,16 +9,29 @@ import (
 	"time"
 
 	customerrors "github.com/alubhorta/goth/custom/errors"
+	"github.com/alubhorta/goth/db/dbclient"
+	auditmodels "github.com/alubhorta/goth/models/audit"
 	authmodels "github.com/alubhorta/goth/models/auth"
 	commonmodels "github.com/alubhorta/goth/models/common"
 	usermodels "github.com/alubhorta/goth/models/user"
+	accountutils "github.com/alubhorta/goth/utils/account"
+	auditutils "github.com/alubhorta/goth/utils/audit"
 	emailutils "github.com/alubhorta/goth/utils/email"
+	enumerationutils "github.com/alubhorta/goth/utils/enumeration"
+	loginutils "github.com/alubhorta/goth/utils/login"
 	otputils "github.com/alubhorta/goth/utils/otp"
 	passwordutils "github.com/alubhorta/goth/utils/password"
+	rbacutils "github.com/alubhorta/goth/utils/rbac"
+	riskutils "github.com/alubhorta/goth/utils/risk"
+	sessionutils "github.com/alubhorta/goth/utils/session"
+	signuputils "github.com/alubhorta/goth/utils/signup"
+	smsutils "github.com/alubhorta/goth/utils/sms"
 	tokenutils "github.com/alubhorta/goth/utils/token"
+	usernameutils "github.com/alubhorta/goth/utils/username"
 	validationutils "github.com/alubhorta/goth/utils/validation"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/google/uuid"
 )
@@ -37,10 +51,42 @@ func Signup(c *fiber.Ctx) error {
 		msg := "invalid email provided."
 		log.Println(msg)
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
-	} else if len(input.Password) < 6 {
-		msg := "invalid input - password must be at least 6 characters."
+	}
+	input.Email = validationutils.NormalizeEmail(input.Email)
+	if input.Username != "" {
+		input.Username = usernameutils.Normalize(input.Username)
+		if err := usernameutils.GetPolicy().Validate(input.Username); err != nil {
+			msg := "invalid input - " + err.Error() + "."
+			log.Println(msg)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+		}
+	}
+	if err := passwordutils.ValidatePolicy(input.Password, input.Email, input.Username, input.FirstName, input.LastName); err != nil {
+		msg := "invalid input - " + err.Error() + "."
 		log.Println(msg)
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": fiber.Map{"violations": passwordutils.GetViolations(err)}})
+	}
+
+	// enforce signup policy
+	signupPolicy := signuputils.GetPolicy()
+	if err := signupPolicy.CheckEmailDomain(input.Email); err != nil {
+		msg := "signup not allowed - " + err.Error() + "."
+		log.Println(msg, input.Email)
+		auditutils.Record(c, auditmodels.ActionSignup, auditmodels.OutcomeFailure, "", input.Email, err.Error())
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if signupPolicy.RequiresInvite() && input.InviteCode == "" {
+		msg := "signup not allowed - an invite code is required."
+		log.Println(msg)
+		auditutils.Record(c, auditmodels.ActionSignup, auditmodels.OutcomeFailure, "", input.Email, "missing invite code")
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	// in enumeration-safe mode, signups of new and registered emails get the
+	// same answer without tokens, the outcome is mailed to the email instead
+	safeMode := enumerationutils.IsSafeMode()
+	safeMsg := "signup received - check your email, then sign in."
+	if safeMode {
+		defer enumerationutils.PadResponse(time.Now())
 	}
 
 	// hash password
@@ -54,69 +100,182 @@ func Signup(c *fiber.Ctx) error {
 	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
 	dbclient := cc.DbClient
 
-	// create auth credential
+	// usernames are public handles, so a taken one is told even in enumeration-safe mode
+	if input.Username != "" {
+		if taken, err := dbclient.AuthAccess.IsUsernameTaken(input.Username, ""); err != nil {
+			msg := "failed to read from database."
+			log.Println(msg, err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+		} else if taken {
+			msg := "username is already taken."
+			log.Println(msg)
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"message": msg, "payload": nil})
+		}
+	}
+
 	userId := fmt.Sprintf("%v", uuid.New())
+	roles := []string{rbacutils.RoleUser}
+
+	// invite codes are single-use, so consume it before creating anything
+	var invite *authmodels.SignupInvite
+	if input.InviteCode != "" {
+		invite, err = dbclient.SignupInviteAccess.ConsumeInvite(tokenutils.HashOpaqueToken(input.InviteCode), input.Email, userId)
+		if err == customerrors.ErrNotFound {
+			msg := "signup not allowed - invalid, expired or already used invite code."
+			log.Println(msg)
+			auditutils.Record(c, auditmodels.ActionSignup, auditmodels.OutcomeFailure, "", input.Email, "invalid invite code")
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+		} else if err != nil {
+			msg := "failed to verify invite code."
+			log.Println(msg, err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+		}
+		if invite.Role != "" && invite.Role != rbacutils.RoleUser {
+			roles = append(roles, invite.Role)
+		}
+	}
+	releaseInvite := func() {
+		if invite == nil {
+			return
+		}
+		if err := dbclient.SignupInviteAccess.ReleaseInvite(invite.InviteId); err != nil {
+			log.Println("failed to release invite.", err, "inviteId:", invite.InviteId)
+		}
+	}
+	// a failed signup leaves nothing behind, so it can be retried with the same invite
+	credentialCreated, userCreated := false, false
+	rollback := func() {
+		if userCreated {
+			if err := dbclient.UserAccess.DeleteAUser(userId); err != nil {
+				log.Println("failed to roll back user of failed signup.", err, "userId:", userId)
+			}
+		}
+		if credentialCreated {
+			if err := dbclient.AuthAccess.DeleteAnAuthCredential(userId); err != nil {
+				log.Println("failed to roll back auth credential of failed signup.", err, "userId:", userId)
+			}
+		}
+		releaseInvite()
+	}
+	// a duplicate key is a registered email unless the username was taken
+	// meanwhile, which is told even in enumeration-safe mode like above
+	respondDuplicate := func(err error) error {
+		if input.Username != "" {
+			if taken, lookupErr := dbclient.AuthAccess.IsUsernameTaken(input.Username, userId); lookupErr != nil {
+				log.Println("failed to read from database.", lookupErr)
+			} else if taken {
+				msg := "username is already taken."
+				log.Println(msg, err)
+				auditutils.Record(c, auditmodels.ActionSignup, auditmodels.OutcomeFailure, "", input.Email, "username already taken")
+				return c.Status(fiber.StatusConflict).JSON(fiber.Map{"message": msg, "payload": nil})
+			}
+		}
+
+		msg := "failed to create auth credentials - duplicate key."
+		log.Println(msg, err)
+		auditutils.Record(c, auditmodels.ActionSignup, auditmodels.OutcomeFailure, "", input.Email, "email already registered")
+		if safeMode {
+			// the request buffers are reused once the handler returns
+			email := utils.CopyString(input.Email)
+			go func() {
+				if err := emailutils.SendSignupAttemptMail(email); err != nil {
+					log.Println("failed to send signup attempt mail.", err)
+				}
+			}()
+			return c.Status(fiber.StatusAccepted).JSON(fiber.Map{"message": safeMsg, "payload": nil})
+		}
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	// create auth credential
 	now := time.Now()
 	authCred := &authmodels.UserAuthCredential{
 		Email:          input.Email,
+		Username:       input.Username,
 		UserId:         userId,
 		HashedPassword: hasedPass,
+		Roles:          roles,
+		Permissions:    []string{},
 		CreatedAt:      now,
 		ModifiedAt:     now,
 	}
 	err = dbclient.AuthAccess.CreateNewUserAuthCredential(authCred)
 	if err == customerrors.ErrDuplicateKey {
-		msg := "failed to create auth credentials - duplicate key."
-		log.Println(msg, err)
-		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"message": msg, "payload": nil})
+		rollback()
+		return respondDuplicate(err)
 	} else if err != nil {
+		rollback()
 		msg := "failed to create auth credentials."
 		log.Println(msg, err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
 	}
+	credentialCreated = true
 
 	// create minimal model for userInfo
 	createUserInput := &usermodels.CreateUserInfoInput{
 		Email:     input.Email,
+		Username:  input.Username,
 		FirstName: input.FirstName,
 		LastName:  input.LastName,
 	}
 	err = dbclient.UserAccess.CreateAUser(userId, createUserInput)
 	if err == customerrors.ErrDuplicateKey {
-		msg := "failed to create user - duplicate key."
-		log.Println(msg, err)
-		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"message": msg, "payload": nil})
+		rollback()
+		return respondDuplicate(err)
 	} else if err != nil {
+		rollback()
 		msg := "failed to create user."
 		log.Println(msg, err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
 	}
+	userCreated = true
+
+	if safeMode {
+		log.Println("successful signup completed.", "userId:", userId)
+		auditutils.Record(c, auditmodels.ActionSignup, auditmodels.OutcomeSuccess, userId, input.Email, "")
+		email := utils.CopyString(input.Email)
+		go func() {
+			if err := emailutils.SendWelcomeMail(email); err != nil {
+				log.Println("failed to send welcome mail.", err)
+			}
+		}()
+		return c.Status(fiber.StatusAccepted).JSON(fiber.Map{"message": safeMsg, "payload": nil})
+	}
 
 	// generate new token pair
-	accessToken, err := tokenutils.CreateNewAccessToken(userId)
+	authClaims := tokenutils.GetAuthClaims(time.Now(), tokenutils.AmrPassword)
+	accessToken, err := tokenutils.CreateNewAccessToken(userId, tokenutils.MergeClaims(tokenutils.GetUserClaims(authCred), authClaims))
 	if err != nil {
+		rollback()
 		msg := "failed to generate access token."
 		log.Println(msg, err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
 	}
-	refreshToken, err := tokenutils.CreateNewRefreshToken(userId)
+	refreshToken, err := tokenutils.CreateNewRefreshToken(userId, authClaims)
 	if err != nil {
+		rollback()
 		msg := "failed to generate refresh token."
 		log.Println(msg, err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
 	}
 
+	tokens, err := sessionutils.GetTokensPayload(c, accessToken, refreshToken)
+	if err != nil {
+		rollback()
+		msg := "failed to set session cookie."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
 	msg := "successful signup completed."
 	log.Println(msg, "userId:", userId)
+	auditutils.Record(c, auditmodels.ActionSignup, auditmodels.OutcomeSuccess, userId, input.Email, "")
 
 	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
 		"message": msg,
 		"payload": fiber.Map{
 			"userId": userId,
-			"tokens": fiber.Map{
-				"access":  accessToken,
-				"refresh": refreshToken,
-			},
+			"tokens": tokens,
 		},
 	})
 }
@@ -127,7 +286,7 @@ func Login(c *fiber.Ctx) error {
 		msg := "invalid input."
 		log.Println(msg, err)
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
-	} else if !validationutils.IsValidEmail(input.Email) {
+	} else if input.Username == "" && !validationutils.IsValidEmail(input.Email) {
 		msg := "invalid email provided."
 		log.Println(msg)
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
@@ -136,57 +295,212 @@ func Login(c *fiber.Ctx) error {
 	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
 	dbclient := cc.DbClient
 
-	authCred, err := dbclient.AuthAccess.GetAuthCredentialByEmail(input.Email)
-	if err == customerrors.ErrNotFound || (err == nil && authCred == nil) {
+	// in enumeration-safe mode, unknown emails and wrong passwords get the same
+	// answer after the same time spent on hashing
+	safeMode := enumerationutils.IsSafeMode()
+
+	// users with a username can login with it in place of the email
+	var authCred *authmodels.UserAuthCredential
+	var err error
+	identifierKind, identifier := "email", validationutils.NormalizeEmail(input.Email)
+	if input.Username != "" {
+		identifierKind, identifier = "username", usernameutils.Normalize(input.Username)
+		authCred, err = dbclient.AuthAccess.GetAuthCredentialByUsername(identifier)
+	} else {
+		authCred, err = dbclient.AuthAccess.GetAuthCredentialByEmail(identifier)
+	}
+	if safeMode && (err == customerrors.ErrNotFound || (err == nil && authCred == nil)) {
+		passwordutils.SimulateVerify(input.Password)
+		msg := "invalid " + identifierKind + " or password."
+		log.Println(msg, "unknown "+identifierKind)
+		loginutils.RecordFailure(c, "", identifier)
+		auditutils.Record(c, auditmodels.ActionLogin, auditmodels.OutcomeFailure, "", identifier, "unknown "+identifierKind)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err == customerrors.ErrNotFound || (err == nil && authCred == nil) {
 		msg := "no such user found."
 		log.Println(msg)
+		loginutils.RecordFailure(c, "", identifier)
+		auditutils.Record(c, auditmodels.ActionLogin, auditmodels.OutcomeFailure, "", identifier, "unknown "+identifierKind)
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
 	} else if err != nil {
 		msg := "failed to login."
 		log.Println(msg, err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
 	}
+	input.Email = authCred.Email
+	if safeMode && authCred.HashedPassword == "" {
+		// accounts without a password would fail without hashing
+		passwordutils.SimulateVerify(input.Password)
+	}
 	matches := passwordutils.DoesPasswordMatchHash(authCred.HashedPassword, input.Password)
 	if !matches {
 		msg := "invalid password provided."
+		if safeMode {
+			msg = "invalid " + identifierKind + " or password."
+		}
 		log.Println(msg, "input password does not match hashed password")
+		loginutils.RecordFailure(c, authCred.UserId, identifier)
+		auditutils.Record(c, auditmodels.ActionLogin, auditmodels.OutcomeFailure, authCred.UserId, input.Email, "invalid password")
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": msg, "payload": nil})
 	}
+	// only now the plain password is at hand to upgrade an outdated hash
+	if passwordutils.NeedsRehash(authCred.HashedPassword) {
+		rehashPassword(dbclient, authCred, input.Password)
+	}
+	if authCred.Disabled {
+		msg := "account is disabled."
+		log.Println(msg, "userId:", authCred.UserId)
+		auditutils.Record(c, auditmodels.ActionLogin, auditmodels.OutcomeFailure, authCred.UserId, input.Email, "account disabled")
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if authCred.PasswordResetRequired {
+		msg := "password reset required - reset your password to continue."
+		log.Println(msg, "userId:", authCred.UserId)
+		auditutils.Record(c, auditmodels.ActionLogin, auditmodels.OutcomeFailure, authCred.UserId, input.Email, "password reset required")
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	// risky logins need a second factor, mfa or else a code by email, or are refused
+	assessment := loginutils.Assess(c, authCred, identifier)
+	if assessment != nil && assessment.Decision == riskutils.DecisionBlock {
+		msg := "login blocked due to unusual activity - try again later or reset your password."
+		log.Println(msg, "userId:", authCred.UserId)
+		auditutils.RecordRisk(c, auditmodels.ActionLogin, auditmodels.OutcomeFailure, authCred.UserId, input.Email, assessment.String(), assessment.Score)
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	// with mfa, the password only gets a token for the passkey login
+	if authCred.MfaEnabled {
+		mfaToken, err := createMfaToken(cc.CacheClient, authCred.UserId)
+		if err != nil {
+			msg := "failed to login."
+			log.Println(msg, err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+		}
+		msg := "second factor required."
+		log.Println(msg, "userId:", authCred.UserId)
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{
+			"message": msg,
+			"payload": fiber.Map{"mfaRequired": true, "mfaToken": mfaToken},
+		})
+	}
+
+	if assessment != nil && assessment.Decision == riskutils.DecisionChallenge {
+		challengeToken, err := createLoginChallenge(cc.CacheClient, authCred, assessment.Score)
+		if err != nil {
+			msg := "failed to login."
+			log.Println(msg, err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+		}
+		msg := "unusual login - confirm it with the code sent to your email."
+		log.Println(msg, "userId:", authCred.UserId)
+		auditutils.RecordRisk(c, auditmodels.ActionLogin, auditmodels.OutcomeChallenge, authCred.UserId, input.Email, assessment.String(), assessment.Score)
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{
+			"message": msg,
+			"payload": fiber.Map{"challengeRequired": true, "challengeToken": challengeToken},
+		})
+	}
+
+	if assessment == nil {
+		auditutils.Record(c, auditmodels.ActionLogin, auditmodels.OutcomeSuccess, authCred.UserId, input.Email, "")
+	} else {
+		if err := riskutils.ClearFailures(cc.CacheClient, authCred.UserId); err != nil {
+			log.Println("failed to clear login failures.", err)
+		}
+		auditutils.RecordRisk(c, auditmodels.ActionLogin, auditmodels.OutcomeSuccess, authCred.UserId, input.Email, assessment.String(), assessment.Score)
+	}
+	return respondWithTokens(c, authCred, tokenutils.AmrPassword)
+}
+
+// rehashPassword upgrades the hash of a password that just matched, a failure
+// is only logged as the old hash keeps working.
+func rehashPassword(dbclient *dbclient.MongoDbClient, authCred *authmodels.UserAuthCredential, password string) {
+	newHashedPass, err := passwordutils.GetHashedPassword(password)
+	if err != nil {
+		log.Println("could not rehash password.", err)
+		return
+	}
+	if err := dbclient.AuthAccess.RehashPassword(authCred.UserId, authCred.HashedPassword, newHashedPass); err != nil {
+		log.Println("failed to store rehashed password.", err, "userId:", authCred.UserId)
+		return
+	}
+	authCred.HashedPassword = newHashedPass
+	log.Println("rehashed password with the current parameters, userId:", authCred.UserId)
+}
+
+// validateNewPassword checks a new password of an existing account against the
+// password policy, including the names of the user and the password history.
+func validateNewPassword(dbclient *dbclient.MongoDbClient, authCred *authmodels.UserAuthCredential, password string) error {
+	userInputs := []string{authCred.Email, authCred.Username}
+	if user, err := dbclient.UserAccess.GetAUser(authCred.UserId); err == nil {
+		userInputs = append(userInputs, user.FirstName, user.LastName)
+	} else if err != customerrors.ErrNotFound {
+		// the names are only one of the checks, so go on without them
+		log.Println("failed to get user info for password policy.", err)
+	}
+	if err := passwordutils.ValidatePolicy(password, userInputs...); err != nil {
+		return err
+	}
+
+	if historySize := passwordutils.GetPolicy().HistorySize; historySize > 0 {
+		history := authCred.PasswordHistory
+		if len(history) > historySize {
+			history = history[len(history)-historySize:]
+		}
+		return passwordutils.CheckReuse(password, append([]string{authCred.HashedPassword}, history...)...)
+	}
+	return nil
+}
+
+// respondWithTokens completes a login with a new token pair for authCred,
+// authenticated by the amr methods.
+func respondWithTokens(c *fiber.Ctx, authCred *authmodels.UserAuthCredential, amr ...string) error {
+	loginutils.CheckDevice(c, authCred)
 
-	accessToken, err := tokenutils.CreateNewAccessToken(authCred.UserId)
+	authClaims := tokenutils.GetAuthClaims(time.Now(), amr...)
+	accessToken, err := tokenutils.CreateNewAccessToken(authCred.UserId, tokenutils.MergeClaims(tokenutils.GetUserClaims(authCred), authClaims))
 	if err != nil {
 		msg := "failed to generate access token."
 		log.Println(msg, err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
 	}
-	refreshToken, err := tokenutils.CreateNewRefreshToken(authCred.UserId)
+	refreshToken, err := tokenutils.CreateNewRefreshToken(authCred.UserId, authClaims)
 	if err != nil {
 		msg := "failed to generate refresh token."
 		log.Println(msg, err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
 	}
 
+	tokens, err := sessionutils.GetTokensPayload(c, accessToken, refreshToken)
+	if err != nil {
+		msg := "failed to set session cookie."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
 	msg := "successfully logged in user."
 	log.Println(msg, authCred.UserId)
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"message": msg,
 		"payload": fiber.Map{
 			"userId": authCred.UserId,
-			"tokens": fiber.Map{
-				"access":  accessToken,
-				"refresh": refreshToken,
-			},
+			"tokens": tokens,
 		},
 	})
 }
 
 func Logout(c *fiber.Ctx) error {
 	input := new(authmodels.LogoutInput)
-	if err := c.BodyParser(input); err != nil {
-		msg := "invalid input."
-		log.Println(msg, err)
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(input); err != nil {
+			msg := "invalid input."
+			log.Println(msg, err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+		}
 	}
+	if input.RefreshToken == "" {
+		input.RefreshToken = sessionutils.GetRefreshCookie(c)
+	}
+	sessionutils.ClearCookies(c)
 
 	if input.AccessToken == "" && input.RefreshToken == "" {
 		msg := "invalid tokens provided."
@@ -212,18 +526,32 @@ func Logout(c *fiber.Ctx) error {
 		cacheClient.Set(input.AccessToken, "blacklist:access", time.Second*time.Duration(accessMaxAgeInSeconds))
 		cacheClient.Set(input.RefreshToken, "blacklist:refresh", time.Second*time.Duration(refreshMaxAgeInSeconds))
 
+		// the tokens may already be expired, so the actor is best effort
+		actorId := ""
+		if claims, err := tokenutils.ParseToken(input.AccessToken, "ACCESS_TOKEN_SIGNING_KEY"); err == nil {
+			actorId, _ = claims["userId"].(string)
+		} else if claims, err := tokenutils.ParseToken(input.RefreshToken, "REFRESH_TOKEN_SIGNING_KEY"); err == nil {
+			actorId, _ = claims["userId"].(string)
+		}
+
 		msg := "successfully logged out."
 		log.Println(msg)
+		auditutils.Record(c, auditmodels.ActionLogout, auditmodels.OutcomeSuccess, actorId, "", "")
 		return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": nil})
 	}
 }
 
 func Refresh(c *fiber.Ctx) error {
 	input := new(authmodels.RefreshInput)
-	if err := c.BodyParser(input); err != nil {
-		msg := "invalid input."
-		log.Println(msg, err)
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(input); err != nil {
+			msg := "invalid input."
+			log.Println(msg, err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+		}
+	}
+	if input.RefreshToken == "" {
+		input.RefreshToken = sessionutils.GetRefreshCookie(c)
 	}
 
 	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
@@ -237,6 +565,7 @@ func Refresh(c *fiber.Ctx) error {
 	} else if res == "blacklist:refresh" {
 		msg := "blacklisted token used."
 		log.Println(msg)
+		auditutils.Record(c, auditmodels.ActionRefresh, auditmodels.OutcomeFailure, "", "", "blacklisted refresh token")
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": msg, "payload": nil})
 	}
 
@@ -251,6 +580,7 @@ func Refresh(c *fiber.Ctx) error {
 	if err != nil {
 		msg := "failed to parse or validate token."
 		log.Println(msg, err)
+		auditutils.Record(c, auditmodels.ActionRefresh, auditmodels.OutcomeFailure, "", "", "invalid refresh token")
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
 	}
 
@@ -261,30 +591,106 @@ func Refresh(c *fiber.Ctx) error {
 			msg := "invalid user id provided in claim."
 			log.Println(msg, err)
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+		} else if clientId, ok := claims["client_id"].(string); ok {
+			// tokens of oauth clients are scoped, they are refreshed at /oauth/token
+			msg := "refresh token was issued to an oauth client."
+			log.Println(msg, "clientId:", clientId)
+			auditutils.Record(c, auditmodels.ActionRefresh, auditmodels.OutcomeFailure, userId, "", "oauth client refresh token")
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+		}
+
+		// re-read the credential so that role changes are picked up
+		dbclient := cc.DbClient
+		authCred, err := dbclient.AuthAccess.GetAuthCredentialByUserId(userId)
+		if err == customerrors.ErrNotFound {
+			msg := "no such user found."
+			log.Println(msg, "userId:", userId)
+			auditutils.Record(c, auditmodels.ActionRefresh, auditmodels.OutcomeFailure, userId, "", "unknown user")
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": msg, "payload": nil})
+		} else if err != nil {
+			msg := "failed to read from database."
+			log.Println(msg, err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+		} else if authCred.Disabled {
+			msg := "account is disabled."
+			log.Println(msg, "userId:", userId)
+			auditutils.Record(c, auditmodels.ActionRefresh, auditmodels.OutcomeFailure, userId, "", "account disabled")
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+		}
+
+		issuedAt, _ := claims["iat"].(float64)
+		revoked, err := sessionutils.IsSessionRevoked(cacheClient, userId, int64(issuedAt))
+		if err != nil {
+			msg := "failed to lookup cache."
+			log.Println(msg, err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+		} else if revoked {
+			msg := "revoked token used."
+			log.Println(msg, "userId:", userId)
+			auditutils.Record(c, auditmodels.ActionRefresh, auditmodels.OutcomeFailure, userId, "", "session revoked")
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": msg, "payload": nil})
+		}
+
+		// a refresh from an unusual place has to login again, and pass the risk scoring of the login
+		assessment := assessRefresh(c, userId)
+		if assessment != nil && assessment.Decision == riskutils.DecisionBlock {
+			msg := "refresh blocked due to unusual activity - login again to continue."
+			log.Println(msg, "userId:", userId)
+			auditutils.RecordRisk(c, auditmodels.ActionRefresh, auditmodels.OutcomeFailure, userId, "", assessment.String(), assessment.Score)
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": fiber.Map{"loginRequired": true}})
+		} else if assessment != nil && assessment.Decision == riskutils.DecisionChallenge {
+			msg := "unusual refresh - login again to continue."
+			log.Println(msg, "userId:", userId)
+			auditutils.RecordRisk(c, auditmodels.ActionRefresh, auditmodels.OutcomeChallenge, userId, "", assessment.String(), assessment.Score)
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": msg, "payload": fiber.Map{"loginRequired": true}})
+		}
+
+		// keep the active org, unless the user is no longer a member of it
+		accessClaims := tokenutils.MergeClaims(tokenutils.GetUserClaims(authCred), tokenutils.CopyAuthClaims(claims))
+		refreshClaims := tokenutils.CopyAuthClaims(claims)
+		if orgId, ok := claims["orgId"].(string); ok && orgId != "" {
+			membership, err := dbclient.OrgAccess.GetMembership(orgId, userId)
+			if err == nil {
+				accessClaims = tokenutils.MergeClaims(accessClaims, tokenutils.GetOrgClaims(membership))
+				refreshClaims["orgId"] = orgId
+			} else if err != customerrors.ErrNotFound {
+				msg := "failed to read from database."
+				log.Println(msg, err)
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+			}
 		}
 
-		accessToken, err := tokenutils.CreateNewAccessToken(userId)
+		accessToken, err := tokenutils.CreateNewAccessToken(userId, accessClaims)
 		if err != nil {
 			msg := "failed to generate access token."
 			log.Println(msg, err)
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
 		}
-		refreshToken, err := tokenutils.CreateNewRefreshToken(userId)
+		refreshToken, err := tokenutils.CreateNewRefreshToken(userId, refreshClaims)
 		if err != nil {
 			msg := "failed to generate refresh token."
 			log.Println(msg, err)
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
 		}
 
+		tokens, err := sessionutils.GetTokensPayload(c, accessToken, refreshToken)
+		if err != nil {
+			msg := "failed to set session cookie."
+			log.Println(msg, err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+		}
+
 		msg := "successfully refreshed tokens."
 		log.Println(msg, "for userId: ", userId)
+		if assessment == nil {
+			auditutils.Record(c, auditmodels.ActionRefresh, auditmodels.OutcomeSuccess, userId, "", "")
+		} else {
+			auditutils.RecordRisk(c, auditmodels.ActionRefresh, auditmodels.OutcomeSuccess, userId, "", assessment.String(), assessment.Score)
+		}
 		return c.Status(fiber.StatusOK).JSON(fiber.Map{
 			"message": msg,
 			"payload": fiber.Map{
-				"tokens": fiber.Map{
-					"access":  accessToken,
-					"refresh": refreshToken,
-				},
+				"tokens": tokens,
 			},
 		})
 	} else {
@@ -295,27 +701,54 @@ func Refresh(c *fiber.Ctx) error {
 }
 
 func ResetPasswordInit(c *fiber.Ctx) error {
-	// parse email input from request
+	// parse email or phone input from request
 	input := new(authmodels.ResetInitInput)
 	err := c.BodyParser(input)
-	if err != nil || input.Email == "" {
+	if err != nil || (input.Email == "" && input.Phone == "") {
 		msg := "invalid input."
 		log.Println(msg, err)
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
-	} else if !validationutils.IsValidEmail(input.Email) {
-		msg := "invalid email provided."
-		log.Println(msg)
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	channel, errMsg := getResetChannel(input.Email, input.Phone)
+	if errMsg != "" {
+		log.Println(errMsg)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": errMsg, "payload": nil})
 	}
 
 	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
 	dbClient := cc.DbClient
 
-	// send 404 if email doesn't exist
-	_, err = dbClient.AuthAccess.GetAuthCredentialByEmail(input.Email)
+	// codes by sms are limited before the lookup, to answer alike for unknown
+	// phone numbers
+	if channel.via == "sms" {
+		if err := smsutils.CheckSendLimits(cc.CacheClient, channel.identifier, c.IP()); err == smsutils.ErrResendTooSoon {
+			msg := "a code was sent just now - wait a minute before requesting another."
+			log.Println(msg)
+			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"message": msg, "payload": nil})
+		} else if err == smsutils.ErrTooManySends {
+			msg := "too many codes sent - try again later."
+			log.Println(msg, "ip:", c.IP())
+			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"message": msg, "payload": nil})
+		} else if err != nil {
+			msg := "failed to write to cache."
+			log.Println(msg, err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+		}
+	}
+
+	// in enumeration-safe mode, every valid request gets the same answer, and
+	// the code is sent in the background to not take longer for known ones
+	if enumerationutils.IsSafeMode() {
+		defer enumerationutils.PadResponse(time.Now())
+		return resetPasswordInitSafely(c, channel)
+	}
+
+	// send 404 if email or phone number doesn't exist
+	authCred, err := channel.getAuthCredential(dbClient)
 	if err == customerrors.ErrNotFound {
-		msg := "email does not exist."
+		msg := channel.kind + " does not exist."
 		log.Println(msg, err)
+		auditutils.Record(c, auditmodels.ActionResetInit, auditmodels.OutcomeFailure, "", channel.identifier, "unknown "+channel.kind)
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
 	} else if err != nil {
 		msg := "failed to read from database."
@@ -324,15 +757,16 @@ func ResetPasswordInit(c *fiber.Ctx) error {
 	}
 
 	cacheClient := cc.CacheClient
-	cacheKey := "resetOTP:" + input.Email
+	cacheKey := "resetOTP:" + channel.identifier
 	exists, err := cacheClient.Exists(cacheKey)
 	if err != nil {
 		msg := "failed to read cache."
 		log.Println(msg, err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
 	} else if exists {
-		msg := "password reset already initiated for this email. check your email or try after 2 minutes."
+		msg := "password reset already initiated for this " + channel.kind + ". check your " + channel.inbox + " or try after 2 minutes."
 		log.Println(msg)
+		auditutils.Record(c, auditmodels.ActionResetInit, auditmodels.OutcomeFailure, authCred.UserId, channel.identifier, "reset already in progress")
 		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
 	} // else carry on
 
@@ -344,59 +778,214 @@ func ResetPasswordInit(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
 	}
 	cacheClient.Set(cacheKey, otp, time.Second*120)
-	log.Println("otp generated:", otp, "\tcacheKey: ", cacheKey)
+	log.Println("otp generated.", "cacheKey:", cacheKey)
 
-	err = emailutils.SendOtpMail(input.Email, otp)
+	err = channel.sendOtp(otp)
 	if err != nil {
-		msg := "failed to send otp via mail."
+		msg := "failed to send otp via " + channel.via + "."
 		log.Println(msg, err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
 	}
 
-	msg := "a verification code (otp) is sent to your email. reset your password within the next 2 minutes."
+	msg := "a verification code (otp) is sent to your " + channel.inbox + ". reset your password within the next 2 minutes."
 	log.Println(msg)
+	auditutils.Record(c, auditmodels.ActionResetInit, auditmodels.OutcomeSuccess, authCred.UserId, channel.identifier, "")
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"message": msg,
 		"payload": nil,
 	})
 }
 
+// resetChannel is where the reset code goes, the email or by sms the verified
+// phone number of the account.
+type resetChannel struct {
+	kind       string
+	inbox      string
+	via        string
+	identifier string
+}
+
+// getResetChannel validates the email, or the phone number when given in its
+// place, returning an error message for invalid input.
+func getResetChannel(email, phone string) (*resetChannel, string) {
+	if phone == "" {
+		if !validationutils.IsValidEmail(email) {
+			return nil, "invalid email provided."
+		}
+		return &resetChannel{kind: "email", inbox: "email", via: "mail", identifier: validationutils.NormalizeEmail(email)}, ""
+	}
+
+	if !smsutils.IsEnabled() {
+		return nil, "invalid input - sms is not enabled."
+	} else if !validationutils.IsValidPhone(phone) {
+		return nil, "invalid phone number provided, expected the E.164 format like +14155550123."
+	}
+	return &resetChannel{kind: "phone number", inbox: "phone", via: "sms", identifier: validationutils.NormalizePhone(phone)}, ""
+}
+
+func (rc *resetChannel) getAuthCredential(dbclient *dbclient.MongoDbClient) (*authmodels.UserAuthCredential, error) {
+	if rc.via == "sms" {
+		return dbclient.AuthAccess.GetAuthCredentialByPhone(rc.identifier)
+	}
+	return dbclient.AuthAccess.GetAuthCredentialByEmail(rc.identifier)
+}
+
+func (rc *resetChannel) sendOtp(otp string) error {
+	if rc.via == "sms" {
+		return smsutils.SendCodeSms(rc.identifier, otp)
+	}
+	return emailutils.SendOtpMail(rc.identifier, otp)
+}
+
+func resetPasswordInitSafely(c *fiber.Ctx, channel *resetChannel) error {
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+
+	msg := "if an account exists for this " + channel.kind + ", a verification code (otp) is sent to it. reset your password within the next 2 minutes."
+	respond := func() error {
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	authCred, err := channel.getAuthCredential(cc.DbClient)
+	if err == customerrors.ErrNotFound {
+		log.Println("reset requested for unknown " + channel.kind + ".")
+		auditutils.Record(c, auditmodels.ActionResetInit, auditmodels.OutcomeFailure, "", channel.identifier, "unknown "+channel.kind)
+		return respond()
+	} else if err != nil {
+		msg := "failed to read from database."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	cacheKey := "resetOTP:" + channel.identifier
+	exists, err := cc.CacheClient.Exists(cacheKey)
+	if err != nil {
+		msg := "failed to read cache."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if exists {
+		log.Println("password reset already initiated for this " + channel.kind + ".")
+		auditutils.Record(c, auditmodels.ActionResetInit, auditmodels.OutcomeFailure, authCred.UserId, channel.identifier, "reset already in progress")
+		return respond()
+	}
+
+	otp, err := otputils.GenerateOTP(6)
+	if err != nil {
+		msg := "failed to generate otp."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	cc.CacheClient.Set(cacheKey, otp, time.Second*120)
+	// the request buffers are reused once the handler returns
+	channel.identifier = utils.CopyString(channel.identifier)
+	go func() {
+		if err := channel.sendOtp(otp); err != nil {
+			log.Println("failed to send otp via "+channel.via+".", err)
+		}
+	}()
+
+	log.Println(msg)
+	auditutils.Record(c, auditmodels.ActionResetInit, auditmodels.OutcomeSuccess, authCred.UserId, channel.identifier, "")
+	return respond()
+}
+
+// wrong reset codes are counted per email or phone number
+const (
+	resetMaxAttempts   = 5
+	resetAttemptWindow = time.Hour
+)
+
 func ResetPasswordVerify(c *fiber.Ctx) error {
 	input := new(authmodels.ResetVerifyInput)
 	err := c.BodyParser(input)
-	if err != nil || input.Email == "" || input.Otp == "" || input.NewPassword == "" {
+	if err != nil || (input.Email == "" && input.Phone == "") || input.Otp == "" || input.NewPassword == "" {
 		msg := "invalid input."
 		log.Println(msg, err)
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
-	} else if !validationutils.IsValidEmail(input.Email) {
-		msg := "invalid email provided."
-		log.Println(msg)
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
-	} else if len(input.NewPassword) < 6 {
-		msg := "invalid input - password must be at least 6 characters."
-		log.Println(msg)
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	channel, errMsg := getResetChannel(input.Email, input.Phone)
+	if errMsg != "" {
+		log.Println(errMsg)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": errMsg, "payload": nil})
 	}
 
-	cacheKey := "resetOTP:" + input.Email
+	cacheKey := "resetOTP:" + channel.identifier
 
 	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
 	cacheClient := cc.CacheClient
 
+	// failures are attributed to the account of the email or phone, if any
+	recordFailure := func(reason string) {
+		actorId := ""
+		if authCred, err := channel.getAuthCredential(cc.DbClient); err == nil {
+			actorId = authCred.UserId
+		}
+		auditutils.Record(c, auditmodels.ActionResetVerify, auditmodels.OutcomeFailure, actorId, channel.identifier, reason)
+	}
+
 	val, err := cacheClient.Get(cacheKey)
 	if err == customerrors.ErrNotFound {
 		msg := "not found - invalid input or expired key."
 		log.Println(msg)
+		recordFailure("no pending reset")
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
 	} else if err != nil {
 		msg := "failed to read from cache."
 		log.Println(msg, err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
-	} else if val != input.Otp {
+	}
+
+	// counted before comparing, so concurrent guesses can't exceed the limit.
+	// a new code doesn't reset them
+	attemptsKey := "resetAttempts:" + channel.identifier
+	attempts, err := cacheClient.Incr(attemptsKey, resetAttemptWindow)
+	if err != nil {
+		msg := "failed to write to cache."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if attempts > resetMaxAttempts {
+		msg := "too many attempts - try again later."
+		log.Println(msg)
+		recordFailure("too many attempts")
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	if subtle.ConstantTimeCompare([]byte(input.Otp), []byte(val)) != 1 {
 		msg := "invalid input - otp mismatch."
 		log.Println(msg)
+		recordFailure("otp mismatch")
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
-	} // else all good, change the password
+	}
+
+	dbclient := cc.DbClient
+	authCred, err := channel.getAuthCredential(dbclient)
+	if err == customerrors.ErrNotFound {
+		msg := "no such user found."
+		log.Println(msg, "with "+channel.kind+":", channel.identifier)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to get user credential."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	if err := validateNewPassword(dbclient, authCred, input.NewPassword); err != nil {
+		msg := "invalid input - " + err.Error() + "."
+		log.Println(msg)
+		auditutils.Record(c, auditmodels.ActionResetVerify, auditmodels.OutcomeFailure, authCred.UserId, authCred.Email, "password policy")
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": fiber.Map{"violations": passwordutils.GetViolations(err)}})
+	}
+
+	// codes are single-use, a concurrent try with the same code may have
+	// used it up already
+	if _, err := cacheClient.Take(cacheKey); err == customerrors.ErrNotFound {
+		msg := "not found - invalid input or expired key."
+		log.Println(msg)
+		recordFailure("no pending reset")
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to write to cache."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	cacheClient.Del(attemptsKey)
 
 	newHasedPass, err := passwordutils.GetHashedPassword(input.NewPassword)
 	if err != nil {
@@ -405,11 +994,10 @@ func ResetPasswordVerify(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
 	}
 
-	dbclient := cc.DbClient
-	err = dbclient.AuthAccess.UpdateUserAuthPassword(input.Email, newHasedPass)
+	err = dbclient.AuthAccess.UpdateUserAuthPassword(authCred.Email, newHasedPass, passwordutils.GetPolicy().HistorySize)
 	if err == customerrors.ErrNotFound {
 		msg := "no such user found."
-		log.Println(msg, "with email:", input.Email)
+		log.Println(msg, "with email:", authCred.Email)
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
 	} else if err != nil {
 		msg := "failed to update password."
@@ -418,13 +1006,127 @@ func ResetPasswordVerify(c *fiber.Ctx) error {
 	}
 
 	msg := "password successfully reset."
-	log.Println(msg, "for user with email:", input.Email)
+	log.Println(msg, "for user with email:", authCred.Email)
+	auditutils.Record(c, auditmodels.ActionResetVerify, auditmodels.OutcomeSuccess, authCred.UserId, authCred.Email, "")
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"message": msg,
 		"payload": nil,
 	})
 }
 
+// ChangePassword changes the password of the logged in user, who has to
+// confirm the current one. revoking other sessions also revokes the token used
+// here, so a new token pair is returned in that case.
+func ChangePassword(c *fiber.Ctx) error {
+	commonCtx := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx)
+	if commonCtx.ApiKeyId != "" {
+		msg := "api keys can not change passwords."
+		log.Println(msg, "keyId:", commonCtx.ApiKeyId)
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	input := new(authmodels.ChangePasswordInput)
+	if err := c.BodyParser(input); err != nil || input.CurrentPassword == "" || input.NewPassword == "" {
+		msg := "invalid input."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if input.NewPassword == input.CurrentPassword {
+		msg := "invalid input - new password must differ from the current one."
+		log.Println(msg)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	cc := commonCtx.Clients
+	dbclient := cc.DbClient
+
+	authCred, err := dbclient.AuthAccess.GetAuthCredentialByUserId(commonCtx.UserId)
+	if err == customerrors.ErrNotFound {
+		msg := "no such user found."
+		log.Println(msg, "userId:", commonCtx.UserId)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to get user credential."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if authCred.HashedPassword == "" {
+		msg := "account has no password - use password reset to set one."
+		log.Println(msg, "userId:", authCred.UserId)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if !passwordutils.DoesPasswordMatchHash(authCred.HashedPassword, input.CurrentPassword) {
+		msg := "invalid current password provided."
+		log.Println(msg, "userId:", authCred.UserId)
+		auditutils.Record(c, auditmodels.ActionPasswordChange, auditmodels.OutcomeFailure, authCred.UserId, authCred.Email, "invalid current password")
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	if err := validateNewPassword(dbclient, authCred, input.NewPassword); err != nil {
+		msg := "invalid input - " + err.Error() + "."
+		log.Println(msg)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": fiber.Map{"violations": passwordutils.GetViolations(err)}})
+	}
+
+	newHashedPass, err := passwordutils.GetHashedPassword(input.NewPassword)
+	if err != nil {
+		msg := "could not hash password."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	if err := dbclient.AuthAccess.UpdateUserAuthPassword(authCred.Email, newHashedPass, passwordutils.GetPolicy().HistorySize); err != nil {
+		msg := "failed to update password."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	auditutils.Record(c, auditmodels.ActionPasswordChange, auditmodels.OutcomeSuccess, authCred.UserId, authCred.Email, "")
+
+	// the password is changed already, a failed notice only gets logged
+	if err := emailutils.SendPasswordChangedMail(authCred.Email); err != nil {
+		log.Println("failed to send password changed mail.", err)
+	}
+
+	if !input.RevokeOtherSessions {
+		msg := "password successfully changed."
+		log.Println(msg, "userId:", authCred.UserId)
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	if err := sessionutils.RevokeAllSessions(cc.CacheClient, authCred.UserId); err != nil {
+		msg := "password changed, but failed to revoke sessions."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	auditutils.Record(c, auditmodels.ActionRevokeSessions, auditmodels.OutcomeSuccess, authCred.UserId, authCred.Email, "password change")
+
+	// the current password was just verified
+	authClaims := tokenutils.GetAuthClaims(time.Now(), tokenutils.AmrPassword)
+	accessToken, err := tokenutils.CreateNewAccessToken(authCred.UserId, tokenutils.MergeClaims(tokenutils.GetUserClaims(authCred), authClaims))
+	if err != nil {
+		msg := "failed to generate access token."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	refreshToken, err := tokenutils.CreateNewRefreshToken(authCred.UserId, authClaims)
+	if err != nil {
+		msg := "failed to generate refresh token."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	tokens, err := sessionutils.GetTokensPayload(c, accessToken, refreshToken)
+	if err != nil {
+		msg := "failed to set session cookie."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "password successfully changed and other sessions revoked."
+	log.Println(msg, "userId:", authCred.UserId)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": msg,
+		"payload": fiber.Map{
+			"userId": authCred.UserId,
+			"tokens": tokens,
+		},
+	})
+}
+
 func DeleteAccount(c *fiber.Ctx) error {
 	userId := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).UserId
 	if userId == "" {
@@ -436,30 +1138,30 @@ func DeleteAccount(c *fiber.Ctx) error {
 	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
 	dbclient := cc.DbClient
 
-	// TODO: [transaction safety] - find out a way to delete  both documents atomically
-	err := dbclient.AuthAccess.DeleteAnAuthCredential(userId)
-	if err == customerrors.ErrNotFound {
-		msg := "no such user credential found for deletion."
-		log.Println(msg, err, "id:", userId)
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
-	} else if err != nil {
-		msg := "failed to delete user credential."
-		log.Println(msg, err, "id:", userId)
+	soleOwned, err := accountutils.GetSoleOwnedOrgs(dbclient.OrgAccess, userId)
+	if err != nil {
+		msg := "failed to read from database."
+		log.Println(msg, err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if len(soleOwned) > 0 {
+		msg := "you are the only owner of orgs - transfer their ownership or delete them first."
+		log.Println(msg, "id:", userId, "orgIds:", soleOwned)
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"message": msg, "payload": fiber.Map{"orgIds": soleOwned}})
 	}
 
-	err = dbclient.UserAccess.DeleteAUser(userId)
+	err = accountutils.DeleteAccount(cc, userId)
 	if err == customerrors.ErrNotFound {
-		msg := "no such user found for deletion."
+		msg := "no such user credential found for deletion."
 		log.Println(msg, err, "id:", userId)
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
 	} else if err != nil {
 		msg := "failed to delete user."
-		log.Println(msg, "id:", userId, err)
+		log.Println(msg, err, "id:", userId)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
 	}
 
 	msg := "successfully deleted user."
 	log.Println(msg, "id:", userId)
+	auditutils.Record(c, auditmodels.ActionAccountDelete, auditmodels.OutcomeSuccess, userId, "", "")
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": nil})
 }
@@ -0,0 +1,195 @@
+package authapi
+
+import (
+	"log"
+	"time"
+
+	customerrors "github.com/alubhorta/goth/custom/errors"
+	auditmodels "github.com/alubhorta/goth/models/audit"
+	authmodels "github.com/alubhorta/goth/models/auth"
+	commonmodels "github.com/alubhorta/goth/models/common"
+	auditutils "github.com/alubhorta/goth/utils/audit"
+	enumerationutils "github.com/alubhorta/goth/utils/enumeration"
+	smsutils "github.com/alubhorta/goth/utils/sms"
+	tokenutils "github.com/alubhorta/goth/utils/token"
+	validationutils "github.com/alubhorta/goth/utils/validation"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+const smsLoginMaxAge = 5 * time.Minute
+
+// SmsLoginBegin sends a login code by sms to a verified phone number.
+func SmsLoginBegin(c *fiber.Ctx) error {
+	if !smsutils.IsEnabled() {
+		msg := "sms is not enabled."
+		log.Println(msg)
+		return c.Status(fiber.StatusNotImplemented).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	input := new(authmodels.SmsLoginBeginInput)
+	if err := c.BodyParser(input); err != nil {
+		msg := "invalid input."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if !validationutils.IsValidPhone(input.Phone) {
+		msg := "invalid phone number provided, expected the E.164 format like +14155550123."
+		log.Println(msg)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	input.Phone = validationutils.NormalizePhone(input.Phone)
+
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+
+	// in enumeration-safe mode, known and unknown phone numbers get the same
+	// answer, and the code is sent in the background
+	safeMode := enumerationutils.IsSafeMode()
+	safeMsg := "if an account has this phone number, a login code is sent to it."
+	if safeMode {
+		defer enumerationutils.PadResponse(time.Now())
+	}
+
+	// limited before the lookup, to answer alike for unknown phone numbers
+	if err := smsutils.CheckSendLimits(cc.CacheClient, input.Phone, c.IP()); err == smsutils.ErrResendTooSoon {
+		msg := "a code was sent just now - wait a minute before requesting another."
+		log.Println(msg)
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err == smsutils.ErrTooManySends {
+		msg := "too many codes sent - try again later."
+		log.Println(msg, "ip:", c.IP())
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to write to cache."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	authCred, err := cc.DbClient.AuthAccess.GetAuthCredentialByPhone(input.Phone)
+	if err == customerrors.ErrNotFound {
+		msg := "phone number does not exist."
+		log.Println(msg)
+		auditutils.Record(c, auditmodels.ActionLogin, auditmodels.OutcomeFailure, "", input.Phone, "unknown phone number")
+		if safeMode {
+			return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": safeMsg, "payload": nil})
+		}
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to read from database."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	code, err := smsutils.CreateCode(cc.CacheClient, "smsLogin:"+authCred.Phone, authCred.Phone, smsLoginMaxAge)
+	if err == smsutils.ErrTooManyAttempts {
+		msg := "too many wrong codes - try again later."
+		log.Println(msg, "userId:", authCred.UserId)
+		if safeMode {
+			return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": safeMsg, "payload": nil})
+		}
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to write to cache."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	if safeMode {
+		phone := utils.CopyString(authCred.Phone)
+		go func() {
+			if err := smsutils.SendCodeSms(phone, code); err != nil {
+				log.Println("failed to send code via sms.", err)
+			}
+		}()
+		log.Println("sent login code via sms.", "userId:", authCred.UserId)
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": safeMsg, "payload": nil})
+	} else if err := smsutils.SendCodeSms(authCred.Phone, code); err != nil {
+		msg := "failed to send code via sms."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "a login code is sent to your phone. login within the next 5 minutes."
+	log.Println(msg, "userId:", authCred.UserId)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": nil})
+}
+
+// SmsLogin trades a code sent by SmsLoginBegin in for a token pair, or for an
+// mfaToken when mfa is enabled, like a password login.
+func SmsLogin(c *fiber.Ctx) error {
+	input := new(authmodels.SmsLoginInput)
+	if err := c.BodyParser(input); err != nil || input.Code == "" {
+		msg := "invalid input."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if !validationutils.IsValidPhone(input.Phone) {
+		msg := "invalid phone number provided, expected the E.164 format like +14155550123."
+		log.Println(msg)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	input.Phone = validationutils.NormalizePhone(input.Phone)
+
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+
+	_, err := smsutils.VerifyCode(cc.CacheClient, "smsLogin:"+input.Phone, input.Code)
+	if err == customerrors.ErrNotFound {
+		msg := "not found - no pending login or expired code."
+		log.Println(msg)
+		auditutils.Record(c, auditmodels.ActionLogin, auditmodels.OutcomeFailure, "", input.Phone, "no pending sms login")
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err == smsutils.ErrCodeMismatch {
+		msg := "invalid input - code mismatch."
+		log.Println(msg)
+		auditutils.Record(c, auditmodels.ActionLogin, auditmodels.OutcomeFailure, "", input.Phone, "sms code mismatch")
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err == smsutils.ErrTooManyAttempts {
+		msg := "too many wrong codes - try again later."
+		log.Println(msg)
+		auditutils.Record(c, auditmodels.ActionLogin, auditmodels.OutcomeFailure, "", input.Phone, "too many sms code attempts")
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to read from cache."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	// the phone number may have been removed since the code was sent
+	authCred, err := cc.DbClient.AuthAccess.GetAuthCredentialByPhone(input.Phone)
+	if err == customerrors.ErrNotFound {
+		msg := "no such user found."
+		log.Println(msg)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to login."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	if authCred.Disabled {
+		msg := "account is disabled."
+		log.Println(msg, "userId:", authCred.UserId)
+		auditutils.Record(c, auditmodels.ActionLogin, auditmodels.OutcomeFailure, authCred.UserId, authCred.Email, "account disabled")
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if authCred.PasswordResetRequired {
+		msg := "password reset required - reset your password to continue."
+		log.Println(msg, "userId:", authCred.UserId)
+		auditutils.Record(c, auditmodels.ActionLogin, auditmodels.OutcomeFailure, authCred.UserId, authCred.Email, "password reset required")
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	if authCred.MfaEnabled {
+		mfaToken, err := createMfaToken(cc.CacheClient, authCred.UserId)
+		if err != nil {
+			msg := "failed to login."
+			log.Println(msg, err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+		}
+		msg := "second factor required."
+		log.Println(msg, "userId:", authCred.UserId)
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{
+			"message": msg,
+			"payload": fiber.Map{"mfaRequired": true, "mfaToken": mfaToken},
+		})
+	}
+
+	auditutils.Record(c, auditmodels.ActionLogin, auditmodels.OutcomeSuccess, authCred.UserId, authCred.Email, "sms")
+	return respondWithTokens(c, authCred, tokenutils.AmrSms)
+}
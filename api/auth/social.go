@@ -0,0 +1,441 @@
+package authapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	customerrors "github.com/alubhorta/goth/custom/errors"
+	identityaccess "github.com/alubhorta/goth/db/access/identity"
+	"github.com/alubhorta/goth/db/cacheclient"
+	auditmodels "github.com/alubhorta/goth/models/audit"
+	authmodels "github.com/alubhorta/goth/models/auth"
+	commonmodels "github.com/alubhorta/goth/models/common"
+	usermodels "github.com/alubhorta/goth/models/user"
+	auditutils "github.com/alubhorta/goth/utils/audit"
+	loginutils "github.com/alubhorta/goth/utils/login"
+	oauthutils "github.com/alubhorta/goth/utils/oauth"
+	rbacutils "github.com/alubhorta/goth/utils/rbac"
+	sessionutils "github.com/alubhorta/goth/utils/session"
+	signuputils "github.com/alubhorta/goth/utils/signup"
+	tokenutils "github.com/alubhorta/goth/utils/token"
+	validationutils "github.com/alubhorta/goth/utils/validation"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+const oauthStateMaxAge = 10 * time.Minute
+
+// oauthState is kept in the cache between the redirect to the provider and
+// its callback. LinkUserId is set when an existing account links a provider.
+type oauthState struct {
+	Provider     string `json:"provider"`
+	CodeVerifier string `json:"codeVerifier"`
+	LinkUserId   string `json:"linkUserId"`
+}
+
+func createOauthState(cacheClient *cacheclient.RedisClient, provider *oauthutils.Provider, linkUserId string) (string, error) {
+	state, err := tokenutils.GenerateOpaqueToken(24)
+	if err != nil {
+		return "", err
+	}
+	codeVerifier, err := tokenutils.GenerateOpaqueToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	val, err := json.Marshal(&oauthState{Provider: provider.Name, CodeVerifier: codeVerifier, LinkUserId: linkUserId})
+	if err != nil {
+		return "", err
+	}
+	if err := cacheClient.Set("oauthState:"+state, string(val), oauthStateMaxAge); err != nil {
+		return "", err
+	}
+	return provider.GetAuthorizeUrl(state, codeVerifier), nil
+}
+
+func getOauthProvider(c *fiber.Ctx) (*oauthutils.Provider, error) {
+	provider, err := oauthutils.GetProvider(strings.ToLower(c.Params("provider")))
+	if err == oauthutils.ErrUnknownProvider {
+		msg := "unknown oauth provider."
+		log.Println(msg, c.Params("provider"))
+		return nil, c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "oauth provider is unavailable."
+		log.Println(msg, err)
+		return nil, c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	return provider, nil
+}
+
+func OauthAuthorize(c *fiber.Ctx) error {
+	provider, err := getOauthProvider(c)
+	if provider == nil {
+		return err
+	}
+
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	authorizeUrl, err := createOauthState(cc.CacheClient, provider, "")
+	if err != nil {
+		msg := "failed to start oauth login."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	return c.Redirect(authorizeUrl, fiber.StatusFound)
+}
+
+func OauthCallback(c *fiber.Ctx) error {
+	provider, err := getOauthProvider(c)
+	if provider == nil {
+		return err
+	}
+
+	if errCode := c.Query("error"); errCode != "" {
+		msg := "oauth login was not completed - " + errCode + "."
+		log.Println(msg, c.Query("error_description"))
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if c.Query("state") == "" || c.Query("code") == "" {
+		msg := "invalid input - missing state or code."
+		log.Println(msg)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	dbclient := cc.DbClient
+
+	// states are single-use
+	val, err := cc.CacheClient.Take("oauthState:" + c.Query("state"))
+	if err == customerrors.ErrNotFound {
+		msg := "invalid or expired oauth state."
+		log.Println(msg)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to read from cache."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	state := new(oauthState)
+	if err := json.Unmarshal([]byte(val), state); err != nil || state.Provider != provider.Name {
+		msg := "invalid or expired oauth state."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	providerToken, err := provider.ExchangeCode(c.Query("code"), state.CodeVerifier)
+	if err != nil {
+		msg := "failed to exchange authorization code."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	identity, err := provider.FetchIdentity(providerToken)
+	if err != nil {
+		msg := "failed to fetch identity from oauth provider."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	if state.LinkUserId != "" {
+		return linkIdentity(c, provider, identity, state.LinkUserId)
+	}
+
+	// find the linked user, or create one on first login
+	var authCred *authmodels.UserAuthCredential
+	linked, err := dbclient.IdentityAccess.GetIdentity(provider.Name, identity.Subject)
+	if err == nil {
+		authCred, err = dbclient.AuthAccess.GetAuthCredentialByUserId(linked.UserId)
+		if err != nil {
+			msg := "failed to read user credential."
+			log.Println(msg, err, "userId:", linked.UserId)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+		}
+	} else if err == customerrors.ErrNotFound {
+		var errResponse error
+		authCred, errResponse = signupWithIdentity(c, provider, identity)
+		if authCred == nil {
+			return errResponse
+		}
+	} else {
+		msg := "failed to read from database."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	if authCred.Disabled {
+		msg := "account is disabled."
+		log.Println(msg, "userId:", authCred.UserId)
+		auditutils.Record(c, auditmodels.ActionOauthLogin, auditmodels.OutcomeFailure, authCred.UserId, authCred.Email, "account disabled")
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if authCred.PasswordResetRequired {
+		msg := "password reset required - reset your password to continue."
+		log.Println(msg, "userId:", authCred.UserId)
+		auditutils.Record(c, auditmodels.ActionOauthLogin, auditmodels.OutcomeFailure, authCred.UserId, authCred.Email, "password reset required")
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	loginutils.CheckDevice(c, authCred)
+
+	authClaims := tokenutils.GetAuthClaims(time.Now(), tokenutils.AmrFederated)
+	accessToken, err := tokenutils.CreateNewAccessToken(authCred.UserId, tokenutils.MergeClaims(tokenutils.GetUserClaims(authCred), authClaims))
+	if err != nil {
+		msg := "failed to generate access token."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	refreshToken, err := tokenutils.CreateNewRefreshToken(authCred.UserId, authClaims)
+	if err != nil {
+		msg := "failed to generate refresh token."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	tokens, err := sessionutils.GetTokensPayload(c, accessToken, refreshToken)
+	if err != nil {
+		msg := "failed to set session cookie."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully logged in user."
+	log.Println(msg, "userId:", authCred.UserId, "provider:", provider.Name)
+	auditutils.Record(c, auditmodels.ActionOauthLogin, auditmodels.OutcomeSuccess, authCred.UserId, authCred.Email, "provider "+provider.Name)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": msg,
+		"payload": fiber.Map{
+			"userId": authCred.UserId,
+			"tokens": tokens,
+		},
+	})
+}
+
+// signupWithIdentity creates the credential, user info and identity link of a
+// first time oauth login. it returns a nil credential after writing an error
+// response.
+func signupWithIdentity(c *fiber.Ctx, provider *oauthutils.Provider, identity *oauthutils.Identity) (*authmodels.UserAuthCredential, error) {
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	dbclient := cc.DbClient
+
+	// stored and compared like the emails of a password signup
+	providerEmail := identity.Email
+	identity.Email = validationutils.NormalizeEmail(identity.Email)
+	if identity.Email == "" || !identity.EmailVerified {
+		msg := "signup not allowed - the provider did not return a valid, verified email."
+		log.Println(msg, "provider:", provider.Name)
+		auditutils.Record(c, auditmodels.ActionSignup, auditmodels.OutcomeFailure, "", providerEmail, "invalid or unverified provider email")
+		return nil, c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	// there is no way to pass an invite code through the provider redirect
+	signupPolicy := signuputils.GetPolicy()
+	if err := signupPolicy.CheckEmailDomain(identity.Email); err != nil {
+		msg := "signup not allowed - " + err.Error() + "."
+		log.Println(msg, identity.Email)
+		auditutils.Record(c, auditmodels.ActionSignup, auditmodels.OutcomeFailure, "", identity.Email, err.Error())
+		return nil, c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if signupPolicy.RequiresInvite() {
+		msg := "signup not allowed - an invite code is required."
+		log.Println(msg)
+		auditutils.Record(c, auditmodels.ActionSignup, auditmodels.OutcomeFailure, "", identity.Email, "missing invite code")
+		return nil, c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	// never link by email implicitly, the existing account has to opt in
+	existing, err := dbclient.AuthAccess.GetAuthCredentialByEmail(identity.Email)
+	if err == nil && existing != nil {
+		msg := "an account with this email already exists - login and link the provider instead."
+		log.Println(msg, "provider:", provider.Name)
+		auditutils.Record(c, auditmodels.ActionOauthLogin, auditmodels.OutcomeFailure, existing.UserId, identity.Email, "email registered but not linked")
+		return nil, c.Status(fiber.StatusConflict).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil && err != customerrors.ErrNotFound {
+		msg := "failed to read from database."
+		log.Println(msg, err)
+		return nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	// no password is set, one can be added later through a password reset
+	userId := fmt.Sprintf("%v", uuid.New())
+	now := time.Now()
+	authCred := &authmodels.UserAuthCredential{
+		Email:       identity.Email,
+		UserId:      userId,
+		Roles:       []string{rbacutils.RoleUser},
+		Permissions: []string{},
+		CreatedAt:   now,
+		ModifiedAt:  now,
+	}
+	err = dbclient.AuthAccess.CreateNewUserAuthCredential(authCred)
+	if err == customerrors.ErrDuplicateKey {
+		msg := "failed to create auth credentials - duplicate key."
+		log.Println(msg, err)
+		return nil, c.Status(fiber.StatusConflict).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to create auth credentials."
+		log.Println(msg, err)
+		return nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	firstName, lastName := identity.FirstName, identity.LastName
+	if firstName == "" {
+		firstName = strings.Split(identity.Email, "@")[0]
+	}
+	createUserInput := &usermodels.CreateUserInfoInput{
+		Email:     identity.Email,
+		FirstName: firstName,
+		LastName:  lastName,
+	}
+	err = dbclient.UserAccess.CreateAUser(userId, createUserInput)
+	if err != nil {
+		msg := "failed to create user."
+		log.Println(msg, err)
+		return nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	err = dbclient.IdentityAccess.CreateIdentity(&authmodels.UserIdentity{
+		IdentityId: identityaccess.GetIdentityId(provider.Name, identity.Subject),
+		UserId:     userId,
+		Provider:   provider.Name,
+		Subject:    identity.Subject,
+		Email:      identity.Email,
+		CreatedAt:  now,
+	})
+	if err != nil {
+		msg := "failed to link oauth identity."
+		log.Println(msg, err)
+		return nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	log.Println("successful signup completed.", "userId:", userId, "provider:", provider.Name)
+	auditutils.Record(c, auditmodels.ActionSignup, auditmodels.OutcomeSuccess, userId, identity.Email, "provider "+provider.Name)
+	return authCred, nil
+}
+
+func linkIdentity(c *fiber.Ctx, provider *oauthutils.Provider, identity *oauthutils.Identity, userId string) error {
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	dbclient := cc.DbClient
+
+	err := dbclient.IdentityAccess.CreateIdentity(&authmodels.UserIdentity{
+		IdentityId: identityaccess.GetIdentityId(provider.Name, identity.Subject),
+		UserId:     userId,
+		Provider:   provider.Name,
+		Subject:    identity.Subject,
+		Email:      identity.Email,
+		CreatedAt:  time.Now(),
+	})
+	if err == customerrors.ErrDuplicateKey {
+		msg := "this provider account is already linked, or a " + provider.Name + " account is linked already."
+		log.Println(msg, "userId:", userId)
+		auditutils.Record(c, auditmodels.ActionOauthLink, auditmodels.OutcomeFailure, userId, identity.Email, "already linked")
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to link oauth identity."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully linked " + provider.Name + " account."
+	log.Println(msg, "userId:", userId)
+	auditutils.Record(c, auditmodels.ActionOauthLink, auditmodels.OutcomeSuccess, userId, identity.Email, "provider "+provider.Name)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": nil})
+}
+
+func OauthLink(c *fiber.Ctx) error {
+	commonCtx := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx)
+	userId := commonCtx.UserId
+	if userId == "" {
+		msg := "invalid user id provided."
+		log.Println(msg, "userId not found in user context.")
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if commonCtx.ApiKeyId != "" {
+		msg := "api keys can not link social logins."
+		log.Println(msg, "keyId:", commonCtx.ApiKeyId)
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	provider, err := getOauthProvider(c)
+	if provider == nil {
+		return err
+	}
+
+	cc := commonCtx.Clients
+	authorizeUrl, err := createOauthState(cc.CacheClient, provider, userId)
+	if err != nil {
+		msg := "failed to start oauth linking."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "continue at the authorize url to link the account."
+	log.Println(msg, "userId:", userId, "provider:", provider.Name)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": fiber.Map{"authorizeUrl": authorizeUrl}})
+}
+
+func OauthUnlink(c *fiber.Ctx) error {
+	userId := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).UserId
+	if userId == "" {
+		msg := "invalid user id provided."
+		log.Println(msg, "userId not found in user context.")
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	providerName := strings.ToLower(c.Params("provider"))
+
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	dbclient := cc.DbClient
+
+	// don't let a user without a password remove their last way to login
+	authCred, err := dbclient.AuthAccess.GetAuthCredentialByUserId(userId)
+	if err != nil {
+		msg := "failed to read user credential."
+		log.Println(msg, err, "userId:", userId)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	identities, err := dbclient.IdentityAccess.ListIdentitiesOfUser(userId)
+	if err != nil {
+		msg := "failed to read from database."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	if authCred.HashedPassword == "" && len(identities) <= 1 {
+		msg := "cannot unlink the only login method - set a password first."
+		log.Println(msg, "userId:", userId)
+		auditutils.Record(c, auditmodels.ActionOauthUnlink, auditmodels.OutcomeFailure, userId, "", "last login method")
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	err = dbclient.IdentityAccess.DeleteIdentity(userId, providerName)
+	if err == customerrors.ErrNotFound {
+		msg := "no linked account found for this provider."
+		log.Println(msg, "userId:", userId, "provider:", providerName)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to unlink oauth identity."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully unlinked " + providerName + " account."
+	log.Println(msg, "userId:", userId)
+	auditutils.Record(c, auditmodels.ActionOauthUnlink, auditmodels.OutcomeSuccess, userId, "", "provider "+providerName)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": nil})
+}
+
+func ListIdentities(c *fiber.Ctx) error {
+	userId := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).UserId
+	if userId == "" {
+		msg := "invalid user id provided."
+		log.Println(msg, "userId not found in user context.")
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	identities, err := cc.DbClient.IdentityAccess.ListIdentitiesOfUser(userId)
+	if err != nil {
+		msg := "failed to read from database."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully fetched linked accounts."
+	log.Println(msg, "userId:", userId)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": identities})
+}
@@ -0,0 +1,444 @@
+package oauthapi
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	customerrors "github.com/alubhorta/goth/custom/errors"
+	"github.com/alubhorta/goth/db/cacheclient"
+	auditmodels "github.com/alubhorta/goth/models/audit"
+	authmodels "github.com/alubhorta/goth/models/auth"
+	commonmodels "github.com/alubhorta/goth/models/common"
+	oauthmodels "github.com/alubhorta/goth/models/oauth"
+	auditutils "github.com/alubhorta/goth/utils/audit"
+	loginutils "github.com/alubhorta/goth/utils/login"
+	tokenutils "github.com/alubhorta/goth/utils/token"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const deviceCodeMaxAge = 10 * time.Minute
+const devicePollInterval = 5
+
+// user codes avoid vowels and look-alike characters, so they are easy to type
+// and never spell words
+const userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+const userCodeLength = 8
+
+func generateUserCode() (string, error) {
+	code := make([]byte, 0, userCodeLength)
+	buffer := make([]byte, 1)
+	for len(code) < userCodeLength {
+		if _, err := rand.Read(buffer); err != nil {
+			return "", err
+		}
+		// reject bytes that would bias the modulo
+		if int(buffer[0]) >= 256-256%len(userCodeAlphabet) {
+			continue
+		}
+		code = append(code, userCodeAlphabet[int(buffer[0])%len(userCodeAlphabet)])
+	}
+	return string(code), nil
+}
+
+// normalizeUserCode accepts user codes typed in lower case, with or without
+// the dash.
+func normalizeUserCode(userCode string) string {
+	userCode = strings.ToUpper(userCode)
+	return strings.NewReplacer("-", "", " ", "").Replace(userCode)
+}
+
+func formatUserCode(userCode string) string {
+	return userCode[:4] + "-" + userCode[4:]
+}
+
+// GetVerificationUri is the DEVICE_VERIFICATION_URL env, falling back to
+// goth's own device page.
+func GetVerificationUri(c *fiber.Ctx) string {
+	if verificationUrl := os.Getenv("DEVICE_VERIFICATION_URL"); verificationUrl != "" {
+		return verificationUrl
+	}
+	return GetIssuer(c) + "/oauth/device"
+}
+
+// DeviceAuthorization implements RFC 8628 section 3.1. public clients are
+// allowed, as devices can't keep a secret.
+func DeviceAuthorization(c *fiber.Ctx) error {
+	client, ok := authenticateClient(c)
+	if !ok {
+		c.Set(fiber.HeaderWWWAuthenticate, `Basic realm="goth"`)
+		return oauthError(c, fiber.StatusUnauthorized, "invalid_client", "client authentication failed")
+	} else if !allowsGrantType(client, oauthmodels.GrantDeviceCode) {
+		return oauthError(c, fiber.StatusBadRequest, "unauthorized_client", "client is not allowed to use the device authorization grant")
+	}
+
+	deviceCode, err := tokenutils.GenerateOpaqueToken(32)
+	if err != nil {
+		log.Println("failed to generate device code.", err)
+		return oauthError(c, fiber.StatusInternalServerError, "server_error", "failed to generate device code")
+	}
+	userCode, err := generateUserCode()
+	if err != nil {
+		log.Println("failed to generate user code.", err)
+		return oauthError(c, fiber.StatusInternalServerError, "server_error", "failed to generate user code")
+	}
+
+	deviceCodeHash := tokenutils.HashOpaqueToken(deviceCode)
+	deviceAuth := &oauthmodels.DeviceAuthorization{
+		ClientId:  client.ClientId,
+		UserCode:  userCode,
+		Status:    oauthmodels.DeviceStatusPending,
+		ExpiresAt: time.Now().Add(deviceCodeMaxAge).Unix(),
+	}
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	if err := saveDeviceAuthorization(cc.CacheClient, deviceCodeHash, deviceAuth); err != nil {
+		log.Println("failed to write to cache.", err)
+		return oauthError(c, fiber.StatusInternalServerError, "server_error", "failed to start device authorization")
+	}
+	if err := cc.CacheClient.Set("deviceUserCode:"+userCode, deviceCodeHash, deviceCodeMaxAge); err != nil {
+		log.Println("failed to write to cache.", err)
+		return oauthError(c, fiber.StatusInternalServerError, "server_error", "failed to start device authorization")
+	}
+
+	verificationUri := GetVerificationUri(c)
+	log.Println("started device authorization.", "clientId:", client.ClientId)
+	c.Set("Cache-Control", "no-store")
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"device_code":               deviceCode,
+		"user_code":                 formatUserCode(userCode),
+		"verification_uri":          verificationUri,
+		"verification_uri_complete": verificationUri + "?" + url.Values{"user_code": {formatUserCode(userCode)}}.Encode(),
+		"expires_in":                int(deviceCodeMaxAge.Seconds()),
+		"interval":                  devicePollInterval,
+	})
+}
+
+// saveDeviceAuthorization keeps the record until its original expiry, so
+// updates don't extend its lifetime.
+func saveDeviceAuthorization(cacheClient *cacheclient.RedisClient, deviceCodeHash string, deviceAuth *oauthmodels.DeviceAuthorization) error {
+	ttl := time.Until(time.Unix(deviceAuth.ExpiresAt, 0))
+	if ttl <= 0 {
+		return customerrors.ErrNotFound
+	}
+	val, err := json.Marshal(deviceAuth)
+	if err != nil {
+		return err
+	}
+	return cacheClient.Set("deviceCode:"+deviceCodeHash, string(val), ttl)
+}
+
+func getDeviceAuthorization(cacheClient *cacheclient.RedisClient, deviceCodeHash string) (*oauthmodels.DeviceAuthorization, error) {
+	val, err := cacheClient.Get("deviceCode:" + deviceCodeHash)
+	if err != nil {
+		return nil, err
+	}
+	deviceAuth := new(oauthmodels.DeviceAuthorization)
+	if err := json.Unmarshal([]byte(val), deviceAuth); err != nil {
+		return nil, err
+	}
+	return deviceAuth, nil
+}
+
+// getDeviceAuthorizationByUserCode returns customerrors.ErrNotFound for
+// unknown, expired and already decided user codes.
+func getDeviceAuthorizationByUserCode(cacheClient *cacheclient.RedisClient, userCode string) (string, *oauthmodels.DeviceAuthorization, error) {
+	userCode = normalizeUserCode(userCode)
+	if len(userCode) != userCodeLength {
+		return "", nil, customerrors.ErrNotFound
+	}
+	deviceCodeHash, err := cacheClient.Get("deviceUserCode:" + userCode)
+	if err != nil {
+		return "", nil, err
+	}
+	deviceAuth, err := getDeviceAuthorization(cacheClient, deviceCodeHash)
+	if err != nil {
+		return "", nil, err
+	} else if deviceAuth.Status != oauthmodels.DeviceStatusPending {
+		return "", nil, customerrors.ErrNotFound
+	}
+	return deviceCodeHash, deviceAuth, nil
+}
+
+// decideDevice approves or denies a pending device authorization for userId.
+// the user code stops working either way. taking the user code is what moves
+// the authorization out of pending, so of concurrent decisions only one wins.
+func decideDevice(c *fiber.Ctx, userCode, userId string, approve bool) (*oauthmodels.DeviceAuthorization, error) {
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+
+	userCode = normalizeUserCode(userCode)
+	if len(userCode) != userCodeLength {
+		return nil, customerrors.ErrNotFound
+	}
+	deviceCodeHash, err := cc.CacheClient.Take("deviceUserCode:" + userCode)
+	if err != nil {
+		return nil, err
+	}
+	deviceAuth, err := getDeviceAuthorization(cc.CacheClient, deviceCodeHash)
+	if err != nil {
+		return nil, err
+	} else if deviceAuth.Status != oauthmodels.DeviceStatusPending {
+		return nil, customerrors.ErrNotFound
+	}
+	deviceAuth.UserId = userId
+	if approve {
+		deviceAuth.Status = oauthmodels.DeviceStatusApproved
+	} else {
+		deviceAuth.Status = oauthmodels.DeviceStatusDenied
+	}
+	if err := saveDeviceAuthorization(cc.CacheClient, deviceCodeHash, deviceAuth); err != nil {
+		return nil, err
+	}
+
+	if approve {
+		auditutils.Record(c, auditmodels.ActionDeviceApprove, auditmodels.OutcomeSuccess, userId, "", "oauth client "+deviceAuth.ClientId)
+	} else {
+		auditutils.Record(c, auditmodels.ActionDeviceDeny, auditmodels.OutcomeSuccess, userId, "", "oauth client "+deviceAuth.ClientId)
+	}
+	return deviceAuth, nil
+}
+
+func DevicePage(c *fiber.Ctx) error {
+	return renderPage(c, fiber.StatusOK, devicePage, &pageData{Title: "Connect a device", RequestId: c.Query("user_code")})
+}
+
+// DeviceVerify handles the device page, where users sign in with their
+// password to decide on a user code. accounts with mfa confirm with their
+// passkey first, see DevicePasskey.
+func DeviceVerify(c *fiber.Ctx) error {
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+
+	userCode, email := c.FormValue("user_code"), c.FormValue("email")
+	retry := func(status int, msg string) error {
+		return renderPage(c, status, devicePage, &pageData{Title: "Connect a device", RequestId: userCode, Email: email, Error: msg})
+	}
+
+	_, deviceAuth, err := getDeviceAuthorizationByUserCode(cc.CacheClient, userCode)
+	if err == customerrors.ErrNotFound {
+		return retry(fiber.StatusBadRequest, "invalid or expired code.")
+	} else if err != nil {
+		log.Println("failed to read from cache.", err)
+		return retry(fiber.StatusInternalServerError, "failed to look up code.")
+	}
+
+	authCred, needsPasskey, status, msg := checkCredentials(c, email, c.FormValue("password"), deviceAuth.ClientId)
+	if authCred == nil {
+		return retry(status, msg)
+	}
+
+	decision := c.FormValue("decision")
+	if needsPasskey {
+		return renderPasskeyPage(c, authCred.UserId, &pageData{
+			ClientName: getDeviceClientName(c, deviceAuth.ClientId),
+			RequestId:  userCode,
+			Email:      authCred.Email,
+			Action:     "/oauth/device/passkey",
+			Decision:   decision,
+		})
+	}
+	return finishDeviceVerify(c, userCode, deviceAuth.ClientId, authCred, decision == "allow", retry)
+}
+
+// DevicePasskey handles the passkey page of DeviceVerify for accounts with mfa.
+func DevicePasskey(c *fiber.Ctx) error {
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+
+	userCode := c.FormValue("user_code")
+	retry := func(status int, msg string) error {
+		return renderPage(c, status, devicePage, &pageData{Title: "Connect a device", RequestId: userCode, Error: msg})
+	}
+
+	_, deviceAuth, err := getDeviceAuthorizationByUserCode(cc.CacheClient, userCode)
+	if err == customerrors.ErrNotFound {
+		return retry(fiber.StatusBadRequest, "invalid or expired code.")
+	} else if err != nil {
+		log.Println("failed to read from cache.", err)
+		return retry(fiber.StatusInternalServerError, "failed to look up code.")
+	}
+
+	authCred, status, msg := checkPasskey(c, deviceAuth.ClientId)
+	if authCred == nil {
+		return retry(status, msg)
+	}
+	return finishDeviceVerify(c, userCode, deviceAuth.ClientId, authCred, c.FormValue("decision") == "allow", retry)
+}
+
+// finishDeviceVerify saves the decision of a signed in user on a user code.
+func finishDeviceVerify(c *fiber.Ctx, userCode, clientId string, authCred *authmodels.UserAuthCredential, approve bool, retry func(int, string) error) error {
+	if _, err := decideDevice(c, userCode, authCred.UserId, approve); err == customerrors.ErrNotFound {
+		return retry(fiber.StatusBadRequest, "invalid or expired code.")
+	} else if err != nil {
+		log.Println("failed to save device decision.", err)
+		return retry(fiber.StatusInternalServerError, "failed to save decision.")
+	}
+
+	title := "Device connected"
+	if !approve {
+		title = "Device denied"
+	}
+	return renderPage(c, fiber.StatusOK, deviceDonePage, &pageData{Title: title, ClientName: getDeviceClientName(c, clientId)})
+}
+
+func getDeviceClientName(c *fiber.Ctx, clientId string) string {
+	dbclient := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients.DbClient
+	if client, err := dbclient.OauthClientAccess.GetClient(clientId); err == nil {
+		return client.Name
+	}
+	return "your device"
+}
+
+// GetDevice lets a logged in user see which client a user code belongs to
+// before deciding on it.
+func GetDevice(c *fiber.Ctx) error {
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+
+	_, deviceAuth, err := getDeviceAuthorizationByUserCode(cc.CacheClient, c.Query("userCode"))
+	if err == customerrors.ErrNotFound {
+		msg := "invalid or expired code."
+		log.Println(msg)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to look up code."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	client, err := cc.DbClient.OauthClientAccess.GetClient(deviceAuth.ClientId)
+	if err != nil {
+		msg := "failed to read oauth client."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "success",
+		"payload": fiber.Map{
+			"clientId":   client.ClientId,
+			"clientName": client.Name,
+			"expiresAt":  deviceAuth.ExpiresAt,
+		},
+	})
+}
+
+// DecideDevice approves or denies a user code for the logged in user.
+func DecideDevice(c *fiber.Ctx) error {
+	commonCtx := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx)
+	if commonCtx.ApiKeyId != "" {
+		msg := "api keys can not approve devices."
+		log.Println(msg, "keyId:", commonCtx.ApiKeyId)
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	input := new(oauthmodels.DeviceDecisionInput)
+	if err := c.BodyParser(input); err != nil || input.UserCode == "" {
+		msg := "invalid input."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	if _, err := decideDevice(c, input.UserCode, commonCtx.UserId, input.Approve); err == customerrors.ErrNotFound {
+		msg := "invalid or expired code."
+		log.Println(msg)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to save decision."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": "success", "payload": nil})
+}
+
+// exchangeDeviceCode answers the device's polling. polling faster than the
+// interval gets slow_down, and each one adds 5 seconds to the interval.
+func exchangeDeviceCode(c *fiber.Ctx, client *oauthmodels.OauthClient) error {
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	deviceCodeHash := tokenutils.HashOpaqueToken(c.FormValue("device_code"))
+
+	deviceAuth, err := getDeviceAuthorization(cc.CacheClient, deviceCodeHash)
+	if err == customerrors.ErrNotFound {
+		return oauthError(c, fiber.StatusBadRequest, "expired_token", "device code is invalid or expired")
+	} else if err != nil {
+		log.Println("failed to read from cache.", err)
+		return oauthError(c, fiber.StatusInternalServerError, "server_error", "failed to read device code")
+	} else if deviceAuth.ClientId != client.ClientId {
+		return oauthError(c, fiber.StatusBadRequest, "invalid_grant", "device code was issued to another client")
+	}
+
+	switch deviceAuth.Status {
+	case oauthmodels.DeviceStatusPending:
+		return pollDeviceCode(c, deviceCodeHash)
+	case oauthmodels.DeviceStatusDenied:
+		cc.CacheClient.Del("deviceCode:" + deviceCodeHash)
+		return oauthError(c, fiber.StatusBadRequest, "access_denied", "the user denied the request")
+	}
+
+	// device codes are single-use
+	if _, err := cc.CacheClient.Take("deviceCode:" + deviceCodeHash); err == customerrors.ErrNotFound {
+		return oauthError(c, fiber.StatusBadRequest, "expired_token", "device code is invalid or expired")
+	} else if err != nil {
+		log.Println("failed to read from cache.", err)
+		return oauthError(c, fiber.StatusInternalServerError, "server_error", "failed to read device code")
+	}
+
+	authCred, err := cc.DbClient.AuthAccess.GetAuthCredentialByUserId(deviceAuth.UserId)
+	if err != nil {
+		log.Println("failed to read user credential.", err)
+		return oauthError(c, fiber.StatusBadRequest, "invalid_grant", "user not found")
+	} else if authCred.Disabled {
+		return oauthError(c, fiber.StatusBadRequest, "invalid_grant", "account is disabled")
+	} else if authCred.PasswordResetRequired {
+		return oauthError(c, fiber.StatusBadRequest, "invalid_grant", "password reset required")
+	}
+
+	// the device gets a regular goth session, usable with the whole api, so
+	// it is remembered and mailed about like the device of any other login
+	loginutils.CheckDevice(c, authCred)
+	accessToken, err := tokenutils.CreateNewAccessToken(authCred.UserId, tokenutils.GetUserClaims(authCred))
+	if err != nil {
+		log.Println("failed to generate access token.", err)
+		return oauthError(c, fiber.StatusInternalServerError, "server_error", "failed to generate access token")
+	}
+	refreshToken, err := tokenutils.CreateNewRefreshToken(authCred.UserId, nil)
+	if err != nil {
+		log.Println("failed to generate refresh token.", err)
+		return oauthError(c, fiber.StatusInternalServerError, "server_error", "failed to generate refresh token")
+	}
+	expiresIn, _ := strconv.Atoi(os.Getenv("ACCESS_TOKEN_MAX_AGE_IN_SECONDS"))
+
+	log.Println("issued device tokens.", "userId:", authCred.UserId, "clientId:", client.ClientId)
+	c.Set("Cache-Control", "no-store")
+	c.Set("Pragma", "no-cache")
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"access_token":  accessToken,
+		"token_type":    "Bearer",
+		"expires_in":    expiresIn,
+		"refresh_token": refreshToken,
+	})
+}
+
+// pollDeviceCode tracks the current interval in a key that lives as long as
+// the interval, so its existence means the device polled too early.
+func pollDeviceCode(c *fiber.Ctx, deviceCodeHash string) error {
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	pollKey := "deviceCodePoll:" + deviceCodeHash
+
+	val, err := cc.CacheClient.Get(pollKey)
+	if err != nil && err != customerrors.ErrNotFound {
+		log.Println("failed to read from cache.", err)
+		return oauthError(c, fiber.StatusInternalServerError, "server_error", "failed to read device code")
+	}
+	if err == customerrors.ErrNotFound {
+		cc.CacheClient.Set(pollKey, strconv.Itoa(devicePollInterval), time.Second*devicePollInterval)
+		return oauthError(c, fiber.StatusBadRequest, "authorization_pending", "the user has not decided yet")
+	}
+
+	interval, _ := strconv.Atoi(val)
+	interval += devicePollInterval
+	cc.CacheClient.Set(pollKey, strconv.Itoa(interval), time.Second*time.Duration(interval))
+	return oauthError(c, fiber.StatusBadRequest, "slow_down", "polling too fast, wait "+strconv.Itoa(interval)+" seconds")
+}
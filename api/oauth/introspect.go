@@ -0,0 +1,232 @@
+package oauthapi
+
+import (
+	"crypto/subtle"
+	"log"
+	"time"
+
+	customerrors "github.com/alubhorta/goth/custom/errors"
+	commonmodels "github.com/alubhorta/goth/models/common"
+	rbacutils "github.com/alubhorta/goth/utils/rbac"
+	sessionutils "github.com/alubhorta/goth/utils/session"
+	tokenutils "github.com/alubhorta/goth/utils/token"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	tokenTypeAccess  = "access_token"
+	tokenTypeRefresh = "refresh_token"
+)
+
+// findTokenClaims parses token as an access or refresh token, trying the
+// hinted type first. it returns nil claims for tokens goth didn't sign.
+func findTokenClaims(token, hint string) (jwt.MapClaims, string) {
+	types := []string{tokenTypeAccess, tokenTypeRefresh}
+	if hint == tokenTypeRefresh {
+		types = []string{tokenTypeRefresh, tokenTypeAccess}
+	}
+
+	for _, tokenType := range types {
+		signingKeyEnv := "ACCESS_TOKEN_SIGNING_KEY"
+		if tokenType == tokenTypeRefresh {
+			signingKeyEnv = "REFRESH_TOKEN_SIGNING_KEY"
+		}
+		if claims, err := tokenutils.ParseToken(token, signingKeyEnv); err == nil {
+			return claims, tokenType
+		}
+	}
+	return nil, ""
+}
+
+// Introspect implements RFC 7662. it applies the same checks as RequiresAuth:
+// signature and expiry, the logout blacklist, disabled accounts, revoked
+// sessions, clients and grants. api keys can be introspected as well, refresh
+// tokens only by the client they were issued to.
+func Introspect(c *fiber.Ctx) error {
+	client, ok := authenticateClient(c)
+	if !ok || client.Public {
+		c.Set(fiber.HeaderWWWAuthenticate, `Basic realm="goth"`)
+		return oauthError(c, fiber.StatusUnauthorized, "invalid_client", "client authentication failed")
+	}
+	c.Set("Cache-Control", "no-store")
+
+	token := c.FormValue("token")
+	if token == "" {
+		return oauthError(c, fiber.StatusBadRequest, "invalid_request", "missing token")
+	}
+	inactive := fiber.Map{"active": false}
+
+	if tokenutils.IsApiKey(token) {
+		return introspectApiKey(c, token)
+	}
+
+	claims, tokenType := findTokenClaims(token, c.FormValue("token_type_hint"))
+	if claims == nil {
+		return c.Status(fiber.StatusOK).JSON(inactive)
+	}
+	// resource servers are only shown access tokens, a refresh token is only
+	// active to the client it was issued to
+	if clientId, _ := claims["client_id"].(string); tokenType == tokenTypeRefresh && clientId != client.ClientId {
+		return c.Status(fiber.StatusOK).JSON(inactive)
+	}
+
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	res, err := cc.CacheClient.Get(token)
+	if err != nil && err != customerrors.ErrNotFound {
+		log.Println("failed to lookup cache.", err)
+		return oauthError(c, fiber.StatusInternalServerError, "server_error", "failed to lookup cache")
+	} else if res == "blacklist:access" || res == "blacklist:refresh" {
+		return c.Status(fiber.StatusOK).JSON(inactive)
+	}
+
+	userId, _ := claims["userId"].(string)
+	issuedAt, _ := claims["iat"].(float64)
+	if userId != "" {
+		disabled, err := sessionutils.IsUserDisabled(cc.CacheClient, userId)
+		if err != nil {
+			log.Println("failed to lookup cache.", err)
+			return oauthError(c, fiber.StatusInternalServerError, "server_error", "failed to lookup cache")
+		}
+		revoked, err := sessionutils.IsSessionRevoked(cc.CacheClient, userId, int64(issuedAt))
+		if err != nil {
+			log.Println("failed to lookup cache.", err)
+			return oauthError(c, fiber.StatusInternalServerError, "server_error", "failed to lookup cache")
+		}
+		if disabled || revoked {
+			return c.Status(fiber.StatusOK).JSON(inactive)
+		}
+	}
+
+	if clientId, _ := claims["client_id"].(string); clientId != "" {
+		revoked, err := sessionutils.IsClientTokenRevoked(cc.CacheClient, clientId, int64(issuedAt))
+		if err != nil {
+			log.Println("failed to lookup cache.", err)
+			return oauthError(c, fiber.StatusInternalServerError, "server_error", "failed to lookup cache")
+		} else if revoked {
+			return c.Status(fiber.StatusOK).JSON(inactive)
+		}
+	}
+
+	if grantId, _ := claims["grant_id"].(string); grantId != "" {
+		revoked, err := sessionutils.IsGrantRevoked(cc.CacheClient, grantId)
+		if err != nil {
+			log.Println("failed to lookup cache.", err)
+			return oauthError(c, fiber.StatusInternalServerError, "server_error", "failed to lookup cache")
+		} else if revoked {
+			return c.Status(fiber.StatusOK).JSON(inactive)
+		}
+	}
+
+	body := fiber.Map{
+		"active":     true,
+		"token_type": tokenType,
+		"iss":        GetIssuer(c),
+		"iat":        claims["iat"],
+		"exp":        claims["exp"],
+	}
+	if userId != "" {
+		body["sub"] = userId
+	} else {
+		body["sub"] = claims["client_id"]
+	}
+	for _, key := range []string{"client_id", "scope", "roles", "permissions", "orgId", "orgRole"} {
+		if val, ok := claims[key]; ok {
+			body[key] = val
+		}
+	}
+
+	log.Println("introspected token.", "by clientId:", client.ClientId)
+	return c.Status(fiber.StatusOK).JSON(body)
+}
+
+func introspectApiKey(c *fiber.Ctx, key string) error {
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	inactive := fiber.Map{"active": false}
+
+	prefix, ok := tokenutils.GetApiKeyPrefix(key)
+	if !ok {
+		return c.Status(fiber.StatusOK).JSON(inactive)
+	}
+	apiKey, err := cc.DbClient.ApiKeyAccess.GetApiKeyByPrefix(prefix)
+	if err == customerrors.ErrNotFound {
+		return c.Status(fiber.StatusOK).JSON(inactive)
+	} else if err != nil {
+		log.Println("failed to read from database.", err)
+		return oauthError(c, fiber.StatusInternalServerError, "server_error", "failed to read api key")
+	}
+	if subtle.ConstantTimeCompare([]byte(tokenutils.HashOpaqueToken(key)), []byte(apiKey.HashedKey)) != 1 ||
+		(apiKey.ExpiresAt != nil && apiKey.ExpiresAt.Before(time.Now())) {
+		return c.Status(fiber.StatusOK).JSON(inactive)
+	}
+
+	authCred, err := cc.DbClient.AuthAccess.GetAuthCredentialByUserId(apiKey.UserId)
+	if err != nil || authCred.Disabled || authCred.PasswordResetRequired {
+		return c.Status(fiber.StatusOK).JSON(inactive)
+	}
+	roles, permissions := rbacutils.GetScopedAccess(authCred.Roles, authCred.Permissions, apiKey.Scopes)
+
+	body := fiber.Map{
+		"active":      true,
+		"token_type":  "api_key",
+		"iss":         GetIssuer(c),
+		"sub":         apiKey.UserId,
+		"iat":         apiKey.CreatedAt.Unix(),
+		"roles":       roles,
+		"permissions": permissions,
+	}
+	if apiKey.ExpiresAt != nil {
+		body["exp"] = apiKey.ExpiresAt.Unix()
+	}
+	return c.Status(fiber.StatusOK).JSON(body)
+}
+
+// Revoke implements RFC 7009 for tokens issued to the calling client. unknown
+// and already invalid tokens are accepted silently, as the RFC requires.
+func Revoke(c *fiber.Ctx) error {
+	client, ok := authenticateClient(c)
+	if !ok {
+		c.Set(fiber.HeaderWWWAuthenticate, `Basic realm="goth"`)
+		return oauthError(c, fiber.StatusUnauthorized, "invalid_client", "client authentication failed")
+	}
+
+	token := c.FormValue("token")
+	if token == "" {
+		return oauthError(c, fiber.StatusBadRequest, "invalid_request", "missing token")
+	}
+
+	claims, tokenType := findTokenClaims(token, c.FormValue("token_type_hint"))
+	if claims == nil {
+		return c.SendStatus(fiber.StatusOK)
+	}
+	if clientId, _ := claims["client_id"].(string); clientId != client.ClientId {
+		return oauthError(c, fiber.StatusBadRequest, "unauthorized_client", "token was not issued to this client")
+	}
+
+	// blacklisted until it would have expired anyway
+	expiresAt, _ := claims["exp"].(float64)
+	ttl := time.Until(time.Unix(int64(expiresAt), 0))
+	if ttl <= 0 {
+		return c.SendStatus(fiber.StatusOK)
+	}
+	val := "blacklist:access"
+	if tokenType == tokenTypeRefresh {
+		val = "blacklist:refresh"
+	}
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	if err := cc.CacheClient.Set(token, val, ttl); err != nil {
+		log.Println("failed to write to cache.", err)
+		return oauthError(c, fiber.StatusServiceUnavailable, "server_error", "failed to revoke token")
+	}
+	// the access tokens issued along with a refresh token go with it
+	if grantId, _ := claims["grant_id"].(string); tokenType == tokenTypeRefresh && grantId != "" {
+		if err := sessionutils.RevokeGrant(cc.CacheClient, grantId); err != nil {
+			log.Println("failed to write to cache.", err)
+			return oauthError(c, fiber.StatusServiceUnavailable, "server_error", "failed to revoke token")
+		}
+	}
+
+	log.Println("revoked token.", "clientId:", client.ClientId, "type:", tokenType)
+	return c.SendStatus(fiber.StatusOK)
+}
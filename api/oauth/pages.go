@@ -0,0 +1,156 @@
+package oauthapi
+
+import (
+	"bytes"
+	"html/template"
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const pageLayout = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}} - goth</title>
+<style>
+body { font-family: sans-serif; background: #f4f4f5; display: flex; justify-content: center; padding-top: 10vh; }
+main { background: #fff; padding: 2em; border-radius: 8px; width: 22em; box-shadow: 0 1px 4px rgba(0,0,0,.1); }
+input { display: block; width: 100%; box-sizing: border-box; margin: .4em 0 1em; padding: .5em; }
+button { padding: .6em 1.2em; margin-right: .5em; }
+.error { color: #b91c1c; }
+</style>
+</head>
+<body><main>{{template "content" .}}</main></body>
+</html>`
+
+var loginPage = template.Must(template.Must(template.New("login").Parse(pageLayout)).Parse(`{{define "content"}}
+<h2>Sign in to continue to {{.ClientName}}</h2>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<form method="post" action="/oauth/authorize/login">
+<input type="hidden" name="request" value="{{.RequestId}}">
+<label>Email<input type="email" name="email" value="{{.Email}}" required autofocus></label>
+<label>Password<input type="password" name="password" required></label>
+<button type="submit">Sign in</button>
+</form>
+{{end}}`))
+
+var consentPage = template.Must(template.Must(template.New("consent").Parse(pageLayout)).Parse(`{{define "content"}}
+<h2>{{.ClientName}} wants to access your account</h2>
+<p>signed in as {{.Email}}. it will be able to:</p>
+<ul>{{range .Scopes}}<li>{{.}}</li>{{end}}</ul>
+<form method="post" action="/oauth/authorize/consent">
+<input type="hidden" name="request" value="{{.RequestId}}">
+<button type="submit" name="decision" value="allow">Allow</button>
+<button type="submit" name="decision" value="deny">Deny</button>
+</form>
+{{end}}`))
+
+var errorPage = template.Must(template.Must(template.New("error").Parse(pageLayout)).Parse(`{{define "content"}}
+<h2>Something went wrong</h2>
+<p class="error">{{.Error}}</p>
+{{end}}`))
+
+// scopeDescriptions are shown on the consent page.
+var scopeDescriptions = map[string]string{
+	"openid":  "sign you in with your goth account",
+	"profile": "see your name",
+	"email":   "see your email address",
+}
+
+type pageData struct {
+	Title      string
+	ClientName string
+	RequestId  string
+	Email      string
+	Scopes     []string
+	Error      string
+	// the passkey page posts to Action, and continues a device decision when
+	// Decision is set
+	Action    string
+	Decision  string
+	PublicKey fiber.Map
+}
+
+func renderPage(c *fiber.Ctx, status int, page *template.Template, data *pageData) error {
+	buffer := new(bytes.Buffer)
+	if err := page.Execute(buffer, data); err != nil {
+		log.Println("failed to render page.", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	// the pages must not be framed by other sites
+	c.Set("X-Frame-Options", "DENY")
+	c.Set("Content-Security-Policy", "frame-ancestors 'none'")
+	c.Set("Cache-Control", "no-store")
+	c.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+	return c.Status(status).Send(buffer.Bytes())
+}
+
+func renderErrorPage(c *fiber.Ctx, status int, msg string) error {
+	log.Println(msg)
+	return renderPage(c, status, errorPage, &pageData{Title: "Error", Error: msg})
+}
+
+var devicePage = template.Must(template.Must(template.New("device").Parse(pageLayout)).Parse(`{{define "content"}}
+<h2>Connect a device</h2>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<p>enter the code shown on your device and sign in to approve it.</p>
+<form method="post" action="/oauth/device">
+<label>Code<input type="text" name="user_code" value="{{.RequestId}}" required autocomplete="off"></label>
+<label>Email<input type="email" name="email" value="{{.Email}}" required></label>
+<label>Password<input type="password" name="password" required></label>
+<button type="submit" name="decision" value="allow">Approve</button>
+<button type="submit" name="decision" value="deny">Deny</button>
+</form>
+{{end}}`))
+
+var deviceDonePage = template.Must(template.Must(template.New("deviceDone").Parse(pageLayout)).Parse(`{{define "content"}}
+<h2>{{.Title}}</h2>
+<p>you can close this window and return to {{.ClientName}}.</p>
+{{end}}`))
+
+// passkeyPage is the second factor of accounts with mfa, the options in
+// PublicKey are like those of /api/v1/auth/passkeys/login/begin with an
+// mfaToken.
+var passkeyPage = template.Must(template.Must(template.New("passkey").Parse(pageLayout)).Parse(`{{define "content"}}
+<h2>Confirm it's you</h2>
+<p class="error" id="error">{{.Error}}</p>
+<p>signed in as {{.Email}}. use your passkey to continue to {{.ClientName}}.</p>
+<form method="post" action="{{.Action}}" id="passkey">
+{{if .Decision}}<input type="hidden" name="user_code" value="{{.RequestId}}">
+<input type="hidden" name="decision" value="{{.Decision}}">
+{{else}}<input type="hidden" name="request" value="{{.RequestId}}">
+{{end}}<input type="hidden" name="credential" id="credential">
+<button type="button" id="use-passkey">Use passkey</button>
+</form>
+<script>
+const publicKey = {{.PublicKey}};
+const decode = value => Uint8Array.from(atob(value.replace(/-/g, "+").replace(/_/g, "/")), c => c.charCodeAt(0));
+const encode = buffer => btoa(String.fromCharCode(...new Uint8Array(buffer))).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+document.getElementById("use-passkey").addEventListener("click", async () => {
+	try {
+		const credential = await navigator.credentials.get({publicKey: {
+			...publicKey,
+			challenge: decode(publicKey.challenge),
+			allowCredentials: publicKey.allowCredentials.map(descriptor => ({...descriptor, id: decode(descriptor.id)})),
+		}});
+		const response = credential.response;
+		document.getElementById("credential").value = JSON.stringify({
+			id: credential.id,
+			type: credential.type,
+			response: {
+				clientDataJSON: encode(response.clientDataJSON),
+				authenticatorData: encode(response.authenticatorData),
+				signature: encode(response.signature),
+				userHandle: response.userHandle ? encode(response.userHandle) : "",
+			},
+		});
+		document.getElementById("passkey").submit();
+	} catch (err) {
+		document.getElementById("error").textContent = "the passkey was not used, try again.";
+	}
+});
+</script>
+{{end}}`))
@@ -0,0 +1,120 @@
+package oauthapi
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"time"
+
+	customerrors "github.com/alubhorta/goth/custom/errors"
+	auditmodels "github.com/alubhorta/goth/models/audit"
+	authmodels "github.com/alubhorta/goth/models/auth"
+	commonmodels "github.com/alubhorta/goth/models/common"
+	auditutils "github.com/alubhorta/goth/utils/audit"
+	loginutils "github.com/alubhorta/goth/utils/login"
+	webauthnutils "github.com/alubhorta/goth/utils/webauthn"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// renderPasskeyPage asks an account with mfa for one of its passkeys once the
+// password was right. the ceremony is only started here, so finishing it
+// proves the password as well. data says where the page posts to.
+func renderPasskeyPage(c *fiber.Ctx, userId string, data *pageData) error {
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+
+	passkeys, err := cc.DbClient.PasskeyAccess.ListPasskeysOfUser(userId)
+	if err != nil {
+		log.Println("failed to read passkeys.", err)
+		return renderErrorPage(c, fiber.StatusInternalServerError, "failed to sign in.")
+	}
+	challenge, err := loginutils.StartCeremony(cc.CacheClient, &authmodels.WebauthnCeremony{Type: loginutils.CeremonyLogin, UserId: userId, Mfa: true})
+	if err != nil {
+		log.Println("failed to start passkey login.", err)
+		return renderErrorPage(c, fiber.StatusInternalServerError, "failed to sign in.")
+	}
+
+	data.Title = "Confirm it's you"
+	data.PublicKey = fiber.Map{
+		"challenge":        challenge,
+		"rpId":             webauthnutils.GetRpId(),
+		"timeout":          loginutils.CeremonyMaxAge.Milliseconds(),
+		"userVerification": "discouraged",
+		"allowCredentials": loginutils.GetCredentialDescriptors(passkeys),
+	}
+	return renderPage(c, fiber.StatusOK, passkeyPage, data)
+}
+
+// checkPasskey verifies the assertion posted by the passkey page, and records
+// the login in the audit log. the ceremony is used up either way, so on
+// failure, when it returns a nil credential with the status and message to
+// show, the user has to sign in again.
+func checkPasskey(c *fiber.Ctx, clientId string) (*authmodels.UserAuthCredential, int, string) {
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	dbclient := cc.DbClient
+
+	fail := func(status int, reason, msg string, userId string) (*authmodels.UserAuthCredential, int, string) {
+		log.Println(msg, reason)
+		auditutils.Record(c, auditmodels.ActionLogin, auditmodels.OutcomeFailure, userId, "", reason+", oauth client "+clientId)
+		return nil, status, msg
+	}
+
+	input := new(authmodels.PublicKeyCredential)
+	if err := json.Unmarshal([]byte(c.FormValue("credential")), input); err != nil {
+		log.Println("invalid passkey credential.", err)
+		return nil, fiber.StatusBadRequest, "invalid passkey - sign in again."
+	}
+	response := input.Response
+	credentialId, err1 := webauthnutils.DecodeBase64Url(input.Id)
+	clientDataJSON, err2 := webauthnutils.DecodeBase64Url(response.ClientDataJSON)
+	authenticatorData, err3 := webauthnutils.DecodeBase64Url(response.AuthenticatorData)
+	signature, err4 := webauthnutils.DecodeBase64Url(response.Signature)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		log.Println("invalid passkey credential.")
+		return nil, fiber.StatusBadRequest, "invalid passkey - sign in again."
+	}
+
+	// only ceremonies started after a correct password are mfa ceremonies
+	ceremony, challenge, err := loginutils.FinishCeremony(cc.CacheClient, clientDataJSON, loginutils.CeremonyLogin)
+	if err != nil || !ceremony.Mfa {
+		log.Println("invalid or expired passkey login.", err)
+		return nil, fiber.StatusBadRequest, "the sign in expired, sign in again."
+	}
+
+	passkey, err := dbclient.PasskeyAccess.GetPasskey(base64.RawURLEncoding.EncodeToString(credentialId))
+	if err == customerrors.ErrNotFound {
+		return fail(fiber.StatusUnauthorized, "unknown passkey", "invalid passkey - sign in again.", ceremony.UserId)
+	} else if err != nil {
+		log.Println("failed to read passkey.", err)
+		return nil, fiber.StatusInternalServerError, "failed to sign in."
+	} else if passkey.UserId != ceremony.UserId {
+		return fail(fiber.StatusUnauthorized, "passkey of another user", "invalid passkey - sign in again.", ceremony.UserId)
+	}
+
+	credential := &webauthnutils.Credential{Id: credentialId, PublicKey: passkey.PublicKey, SignCount: passkey.SignCount}
+	signCount, err := webauthnutils.VerifyAssertion(clientDataJSON, authenticatorData, signature, challenge, credential, false)
+	if err != nil {
+		return fail(fiber.StatusUnauthorized, "passkey assertion failed: "+err.Error(), "invalid passkey - sign in again.", passkey.UserId)
+	}
+	err = dbclient.PasskeyAccess.UpdateSignCount(passkey.PasskeyId, passkey.SignCount, signCount, time.Now())
+	if err == customerrors.ErrNotFound {
+		return fail(fiber.StatusUnauthorized, "passkey was used concurrently", "invalid passkey - sign in again.", passkey.UserId)
+	} else if err != nil {
+		log.Println("failed to update passkey.", err)
+		return nil, fiber.StatusInternalServerError, "failed to sign in."
+	}
+
+	// the account may have changed since the password was checked
+	authCred, err := dbclient.AuthAccess.GetAuthCredentialByUserId(passkey.UserId)
+	if err != nil {
+		log.Println("failed to read user credential.", err)
+		return nil, fiber.StatusInternalServerError, "failed to sign in."
+	} else if authCred.Disabled {
+		return fail(fiber.StatusForbidden, "account disabled", "account is disabled.", authCred.UserId)
+	} else if authCred.PasswordResetRequired {
+		return fail(fiber.StatusForbidden, "password reset required", "password reset required - reset your password to continue.", authCred.UserId)
+	}
+
+	recordSignIn(c, authCred, nil, "password and passkey "+passkey.Name+", oauth client "+clientId)
+	return authCred, fiber.StatusOK, ""
+}
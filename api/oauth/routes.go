@@ -0,0 +1,709 @@
+package oauthapi
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	customerrors "github.com/alubhorta/goth/custom/errors"
+	"github.com/alubhorta/goth/db/cacheclient"
+	auditmodels "github.com/alubhorta/goth/models/audit"
+	authmodels "github.com/alubhorta/goth/models/auth"
+	commonmodels "github.com/alubhorta/goth/models/common"
+	oauthmodels "github.com/alubhorta/goth/models/oauth"
+	auditutils "github.com/alubhorta/goth/utils/audit"
+	enumerationutils "github.com/alubhorta/goth/utils/enumeration"
+	loginutils "github.com/alubhorta/goth/utils/login"
+	oauthutils "github.com/alubhorta/goth/utils/oauth"
+	oidcutils "github.com/alubhorta/goth/utils/oidc"
+	passwordutils "github.com/alubhorta/goth/utils/password"
+	rbacutils "github.com/alubhorta/goth/utils/rbac"
+	riskutils "github.com/alubhorta/goth/utils/risk"
+	sessionutils "github.com/alubhorta/goth/utils/session"
+	tokenutils "github.com/alubhorta/goth/utils/token"
+	validationutils "github.com/alubhorta/goth/utils/validation"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const authRequestMaxAge = 10 * time.Minute
+const authCodeMaxAge = time.Minute
+
+var supportedScopes = []string{oauthmodels.ScopeOpenId, oauthmodels.ScopeProfile, oauthmodels.ScopeEmail}
+
+// GetIssuer is the OIDC_ISSUER env, falling back to the url goth is reached at.
+func GetIssuer(c *fiber.Ctx) string {
+	if issuer := os.Getenv("OIDC_ISSUER"); issuer != "" {
+		return strings.TrimSuffix(issuer, "/")
+	}
+	return c.BaseURL()
+}
+
+// oauthError responds in the error format of RFC 6749 section 5.2.
+func oauthError(c *fiber.Ctx, status int, code, description string) error {
+	log.Println("oauth error:", code, description)
+	c.Set("Cache-Control", "no-store")
+	return c.Status(status).JSON(fiber.Map{"error": code, "error_description": description})
+}
+
+func redirectWithParams(c *fiber.Ctx, redirectUri string, params url.Values) error {
+	separator := "?"
+	if strings.Contains(redirectUri, "?") {
+		separator = "&"
+	}
+	return c.Redirect(redirectUri+separator+params.Encode(), fiber.StatusSeeOther)
+}
+
+func Discovery(c *fiber.Ctx) error {
+	issuer := GetIssuer(c)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/oauth/authorize",
+		"token_endpoint":                        issuer + "/oauth/token",
+		"userinfo_endpoint":                     issuer + "/oauth/userinfo",
+		"jwks_uri":                              issuer + "/oauth/jwks",
+		"introspection_endpoint":                issuer + "/oauth/introspect",
+		"revocation_endpoint":                   issuer + "/oauth/revoke",
+		"device_authorization_endpoint":         issuer + "/oauth/device_authorization",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 oauthmodels.GrantTypes,
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"scopes_supported":                      supportedScopes,
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported":                      []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "email", "name", "given_name", "family_name", "picture"},
+	})
+}
+
+func Jwks(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusOK).JSON(oidcutils.GetJwks())
+}
+
+func Authorize(c *fiber.Ctx) error {
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	dbclient := cc.DbClient
+
+	// without a valid client and redirect uri, errors can't be sent back
+	client, err := dbclient.OauthClientAccess.GetClient(c.Query("client_id"))
+	if err == customerrors.ErrNotFound {
+		return renderErrorPage(c, fiber.StatusBadRequest, "unknown client.")
+	} else if err != nil {
+		log.Println("failed to read from database.", err)
+		return renderErrorPage(c, fiber.StatusInternalServerError, "failed to read from database.")
+	}
+	redirectUri := c.Query("redirect_uri")
+	if redirectUri == "" && len(client.RedirectUris) == 1 {
+		redirectUri = client.RedirectUris[0]
+	}
+	if !rbacutils.Contains(client.RedirectUris, redirectUri) {
+		return renderErrorPage(c, fiber.StatusBadRequest, "redirect uri is not registered for this client.")
+	}
+	if !allowsGrantType(client, oauthmodels.GrantAuthorizationCode) {
+		return renderErrorPage(c, fiber.StatusBadRequest, "client is not allowed to use the authorization code flow.")
+	}
+
+	state := c.Query("state")
+	fail := func(code, description string) error {
+		log.Println("authorization request rejected.", code, description)
+		params := url.Values{"error": {code}, "error_description": {description}}
+		if state != "" {
+			params.Set("state", state)
+		}
+		return redirectWithParams(c, redirectUri, params)
+	}
+
+	if c.Query("response_type") != "code" {
+		return fail("unsupported_response_type", "only the code response type is supported")
+	} else if c.Query("code_challenge") == "" || c.Query("code_challenge_method") != "S256" {
+		return fail("invalid_request", "PKCE with the S256 method is required")
+	}
+	scopes := strings.Fields(c.Query("scope"))
+	for _, scope := range scopes {
+		if !rbacutils.Contains(supportedScopes, scope) {
+			return fail("invalid_scope", "unsupported scope "+scope)
+		}
+	}
+
+	authRequest := &oauthmodels.AuthorizationRequest{
+		ClientId:      client.ClientId,
+		RedirectUri:   redirectUri,
+		Scopes:        scopes,
+		State:         state,
+		Nonce:         c.Query("nonce"),
+		CodeChallenge: c.Query("code_challenge"),
+	}
+	requestId, err := tokenutils.GenerateOpaqueToken(24)
+	if err != nil {
+		log.Println("failed to generate request id.", err)
+		return renderErrorPage(c, fiber.StatusInternalServerError, "failed to start authorization.")
+	}
+	if err := saveAuthRequest(cc.CacheClient, requestId, authRequest); err != nil {
+		log.Println("failed to write to cache.", err)
+		return renderErrorPage(c, fiber.StatusInternalServerError, "failed to start authorization.")
+	}
+
+	return renderPage(c, fiber.StatusOK, loginPage, &pageData{Title: "Sign in", ClientName: client.Name, RequestId: requestId})
+}
+
+func saveAuthRequest(cacheClient *cacheclient.RedisClient, requestId string, authRequest *oauthmodels.AuthorizationRequest) error {
+	val, err := json.Marshal(authRequest)
+	if err != nil {
+		return err
+	}
+	return cacheClient.Set("oauthAuthRequest:"+requestId, string(val), authRequestMaxAge)
+}
+
+func getAuthRequest(cacheClient *cacheclient.RedisClient, requestId string) (*oauthmodels.AuthorizationRequest, error) {
+	val, err := cacheClient.Get("oauthAuthRequest:" + requestId)
+	if err != nil {
+		return nil, err
+	}
+	authRequest := new(oauthmodels.AuthorizationRequest)
+	if err := json.Unmarshal([]byte(val), authRequest); err != nil {
+		return nil, err
+	}
+	return authRequest, nil
+}
+
+// checkCredentials verifies a login on one of the html pages and records it in
+// the audit log. it is risk scored like /api/v1/auth/login, but the pages
+// can't send a code by email, so a challenged login is refused as well. for
+// accounts with mfa it returns true, they go on to the passkey page and their
+// login is recorded by checkPasskey. on failure it returns a nil credential,
+// with the status and message to show.
+func checkCredentials(c *fiber.Ctx, email, password, clientId string) (*authmodels.UserAuthCredential, bool, int, string) {
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	account := validationutils.NormalizeEmail(email)
+
+	fail := func(status int, reason, msg string, userId string) (*authmodels.UserAuthCredential, bool, int, string) {
+		log.Println(msg, reason)
+		auditutils.Record(c, auditmodels.ActionLogin, auditmodels.OutcomeFailure, userId, email, reason+", oauth client "+clientId)
+		return nil, false, status, msg
+	}
+
+	authCred, err := cc.DbClient.AuthAccess.GetAuthCredentialByEmail(email)
+	if err == customerrors.ErrNotFound || (err == nil && authCred == nil) {
+		if enumerationutils.IsSafeMode() {
+			passwordutils.SimulateVerify(password)
+		}
+		loginutils.RecordFailure(c, "", account)
+		return fail(fiber.StatusUnauthorized, "unknown email", "invalid email or password.", "")
+	} else if err != nil {
+		log.Println("failed to read from database.", err)
+		return nil, false, fiber.StatusInternalServerError, "failed to sign in."
+	} else if !passwordutils.DoesPasswordMatchHash(authCred.HashedPassword, password) {
+		loginutils.RecordFailure(c, authCred.UserId, account)
+		return fail(fiber.StatusUnauthorized, "invalid password", "invalid email or password.", authCred.UserId)
+	} else if authCred.Disabled {
+		return fail(fiber.StatusForbidden, "account disabled", "account is disabled.", authCred.UserId)
+	} else if authCred.PasswordResetRequired {
+		return fail(fiber.StatusForbidden, "password reset required", "password reset required - reset your password to continue.", authCred.UserId)
+	}
+
+	assessment := loginutils.Assess(c, authCred, account)
+	if assessment != nil && assessment.Decision == riskutils.DecisionBlock {
+		msg := "sign in blocked due to unusual activity - try again later or reset your password."
+		log.Println(msg, "userId:", authCred.UserId)
+		auditutils.RecordRisk(c, auditmodels.ActionLogin, auditmodels.OutcomeFailure, authCred.UserId, email, assessment.String()+", oauth client "+clientId, assessment.Score)
+		return nil, false, fiber.StatusForbidden, msg
+	}
+
+	// the passkey is the second factor of a challenged login as well
+	if authCred.MfaEnabled {
+		return authCred, true, fiber.StatusOK, ""
+	}
+
+	if assessment != nil && assessment.Decision == riskutils.DecisionChallenge {
+		msg := "unusual sign in - sign in to your account directly and confirm it with the code sent to your email, then try again."
+		log.Println(msg, "userId:", authCred.UserId)
+		auditutils.RecordRisk(c, auditmodels.ActionLogin, auditmodels.OutcomeChallenge, authCred.UserId, email, assessment.String()+", oauth client "+clientId, assessment.Score)
+		return nil, false, fiber.StatusForbidden, msg
+	}
+
+	recordSignIn(c, authCred, assessment, "oauth client "+clientId)
+	return authCred, false, fiber.StatusOK, ""
+}
+
+// recordSignIn records a completed login on one of the html pages in the
+// audit log, and remembers the device it came from.
+func recordSignIn(c *fiber.Ctx, authCred *authmodels.UserAuthCredential, assessment *riskutils.Assessment, reason string) {
+	if assessment == nil {
+		auditutils.Record(c, auditmodels.ActionLogin, auditmodels.OutcomeSuccess, authCred.UserId, authCred.Email, reason)
+	} else {
+		cacheClient := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients.CacheClient
+		if err := riskutils.ClearFailures(cacheClient, authCred.UserId); err != nil {
+			log.Println("failed to clear login failures.", err)
+		}
+		auditutils.RecordRisk(c, auditmodels.ActionLogin, auditmodels.OutcomeSuccess, authCred.UserId, authCred.Email, assessment.String()+", "+reason, assessment.Score)
+	}
+	loginutils.CheckDevice(c, authCred)
+}
+
+func AuthorizeLogin(c *fiber.Ctx) error {
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	dbclient := cc.DbClient
+
+	requestId := c.FormValue("request")
+	authRequest, err := getAuthRequest(cc.CacheClient, requestId)
+	if err != nil {
+		log.Println("failed to load authorization request.", err)
+		return renderErrorPage(c, fiber.StatusBadRequest, "the sign in request expired, go back and try again.")
+	}
+	client, err := dbclient.OauthClientAccess.GetClient(authRequest.ClientId)
+	if err != nil {
+		log.Println("failed to read oauth client.", err)
+		return renderErrorPage(c, fiber.StatusBadRequest, "unknown client.")
+	}
+
+	email := c.FormValue("email")
+	authCred, needsPasskey, status, msg := checkCredentials(c, email, c.FormValue("password"), client.ClientId)
+	if authCred == nil {
+		return renderPage(c, status, loginPage, &pageData{Title: "Sign in", ClientName: client.Name, RequestId: requestId, Email: email, Error: msg})
+	} else if needsPasskey {
+		return renderPasskeyPage(c, authCred.UserId, &pageData{ClientName: client.Name, RequestId: requestId, Email: authCred.Email, Action: "/oauth/authorize/passkey"})
+	}
+	return continueAuthorization(c, client, requestId, authRequest, authCred)
+}
+
+// AuthorizePasskey completes the login of AuthorizeLogin for accounts with mfa.
+func AuthorizePasskey(c *fiber.Ctx) error {
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+
+	requestId := c.FormValue("request")
+	authRequest, err := getAuthRequest(cc.CacheClient, requestId)
+	if err != nil {
+		log.Println("failed to load authorization request.", err)
+		return renderErrorPage(c, fiber.StatusBadRequest, "the sign in request expired, go back and try again.")
+	}
+	client, err := cc.DbClient.OauthClientAccess.GetClient(authRequest.ClientId)
+	if err != nil {
+		log.Println("failed to read oauth client.", err)
+		return renderErrorPage(c, fiber.StatusBadRequest, "unknown client.")
+	}
+
+	authCred, status, msg := checkPasskey(c, client.ClientId)
+	if authCred == nil {
+		return renderPage(c, status, loginPage, &pageData{Title: "Sign in", ClientName: client.Name, RequestId: requestId, Error: msg})
+	}
+	return continueAuthorization(c, client, requestId, authRequest, authCred)
+}
+
+// continueAuthorization goes on to the consent page after the login, or right
+// back to the client if everything requested was granted before.
+func continueAuthorization(c *fiber.Ctx, client *oauthmodels.OauthClient, requestId string, authRequest *oauthmodels.AuthorizationRequest, authCred *authmodels.UserAuthCredential) error {
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	dbclient := cc.DbClient
+
+	authRequest.UserId = authCred.UserId
+	authRequest.AuthTime = time.Now().Unix()
+
+	consent, err := dbclient.OauthClientAccess.GetConsent(client.ClientId, authCred.UserId)
+	if err != nil && err != customerrors.ErrNotFound {
+		log.Println("failed to read from database.", err)
+		return renderErrorPage(c, fiber.StatusInternalServerError, "failed to sign in.")
+	}
+	if consent != nil && containsAll(consent.Scopes, authRequest.Scopes) {
+		cc.CacheClient.Del("oauthAuthRequest:" + requestId)
+		return completeAuthorization(c, authRequest)
+	}
+
+	if err := saveAuthRequest(cc.CacheClient, requestId, authRequest); err != nil {
+		log.Println("failed to write to cache.", err)
+		return renderErrorPage(c, fiber.StatusInternalServerError, "failed to sign in.")
+	}
+	descriptions := []string{}
+	for _, scope := range authRequest.Scopes {
+		descriptions = append(descriptions, scopeDescriptions[scope])
+	}
+	return renderPage(c, fiber.StatusOK, consentPage, &pageData{
+		Title:      "Consent",
+		ClientName: client.Name,
+		RequestId:  requestId,
+		Email:      authCred.Email,
+		Scopes:     descriptions,
+	})
+}
+
+func AuthorizeConsent(c *fiber.Ctx) error {
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	dbclient := cc.DbClient
+
+	authRequest, err := getAuthRequest(cc.CacheClient, c.FormValue("request"))
+	if err != nil || authRequest.UserId == "" {
+		log.Println("failed to load authorization request.", err)
+		return renderErrorPage(c, fiber.StatusBadRequest, "the sign in request expired, go back and try again.")
+	}
+	cc.CacheClient.Del("oauthAuthRequest:" + c.FormValue("request"))
+
+	if c.FormValue("decision") != "allow" {
+		auditutils.Record(c, auditmodels.ActionOauthConsent, auditmodels.OutcomeFailure, authRequest.UserId, "", "denied to oauth client "+authRequest.ClientId)
+		params := url.Values{"error": {"access_denied"}, "error_description": {"the user denied the request"}}
+		if authRequest.State != "" {
+			params.Set("state", authRequest.State)
+		}
+		return redirectWithParams(c, authRequest.RedirectUri, params)
+	}
+
+	if err := dbclient.OauthClientAccess.SaveConsent(authRequest.ClientId, authRequest.UserId, authRequest.Scopes); err != nil {
+		log.Println("failed to save consent.", err)
+		return renderErrorPage(c, fiber.StatusInternalServerError, "failed to save consent.")
+	}
+	auditutils.Record(c, auditmodels.ActionOauthConsent, auditmodels.OutcomeSuccess, authRequest.UserId, "", "granted "+strings.Join(authRequest.Scopes, " ")+" to oauth client "+authRequest.ClientId)
+	return completeAuthorization(c, authRequest)
+}
+
+// completeAuthorization issues a single-use authorization code for a logged
+// in and consented request and sends the user back to the client.
+func completeAuthorization(c *fiber.Ctx, authRequest *oauthmodels.AuthorizationRequest) error {
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+
+	code, err := tokenutils.GenerateOpaqueToken(32)
+	if err != nil {
+		log.Println("failed to generate authorization code.", err)
+		return renderErrorPage(c, fiber.StatusInternalServerError, "failed to complete sign in.")
+	}
+	val, err := json.Marshal(authRequest)
+	if err != nil {
+		log.Println("failed to encode authorization request.", err)
+		return renderErrorPage(c, fiber.StatusInternalServerError, "failed to complete sign in.")
+	}
+	if err := cc.CacheClient.Set("oauthCode:"+tokenutils.HashOpaqueToken(code), string(val), authCodeMaxAge); err != nil {
+		log.Println("failed to write to cache.", err)
+		return renderErrorPage(c, fiber.StatusInternalServerError, "failed to complete sign in.")
+	}
+
+	log.Println("issued authorization code.", "userId:", authRequest.UserId, "clientId:", authRequest.ClientId)
+	params := url.Values{"code": {code}}
+	if authRequest.State != "" {
+		params.Set("state", authRequest.State)
+	}
+	return redirectWithParams(c, authRequest.RedirectUri, params)
+}
+
+// authenticateClient reads client credentials from basic auth or the form.
+// public clients only identify themselves, confidential ones need their secret.
+func authenticateClient(c *fiber.Ctx) (*oauthmodels.OauthClient, bool) {
+	clientId, clientSecret := c.FormValue("client_id"), c.FormValue("client_secret")
+	if authHeader := c.Get(fiber.HeaderAuthorization); strings.HasPrefix(authHeader, "Basic ") {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(authHeader, "Basic "))
+		if err != nil {
+			return nil, false
+		}
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) != 2 {
+			return nil, false
+		}
+		clientId, _ = url.QueryUnescape(parts[0])
+		clientSecret, _ = url.QueryUnescape(parts[1])
+	}
+	if clientId == "" {
+		return nil, false
+	}
+
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	client, err := cc.DbClient.OauthClientAccess.GetClient(clientId)
+	if err != nil {
+		log.Println("failed to read oauth client.", err, "clientId:", clientId)
+		return nil, false
+	}
+
+	if client.Public {
+		return client, clientSecret == ""
+	}
+	hashedSecret := tokenutils.HashOpaqueToken(clientSecret)
+	return client, subtle.ConstantTimeCompare([]byte(hashedSecret), []byte(client.HashedSecret)) == 1
+}
+
+func Token(c *fiber.Ctx) error {
+	client, ok := authenticateClient(c)
+	if !ok {
+		c.Set(fiber.HeaderWWWAuthenticate, `Basic realm="goth"`)
+		return oauthError(c, fiber.StatusUnauthorized, "invalid_client", "client authentication failed")
+	}
+
+	grantType := c.FormValue("grant_type")
+	if !allowsGrantType(client, grantType) {
+		return oauthError(c, fiber.StatusBadRequest, "unauthorized_client", "client is not allowed to use this grant type")
+	}
+
+	switch grantType {
+	case oauthmodels.GrantAuthorizationCode:
+		return exchangeAuthorizationCode(c, client)
+	case oauthmodels.GrantRefreshToken:
+		return exchangeRefreshToken(c, client)
+	case oauthmodels.GrantClientCredentials:
+		return exchangeClientCredentials(c, client)
+	case oauthmodels.GrantDeviceCode:
+		return exchangeDeviceCode(c, client)
+	default:
+		return oauthError(c, fiber.StatusBadRequest, "unsupported_grant_type", "grant type is not supported")
+	}
+}
+
+// allowsGrantType falls back to the interactive grants for clients registered
+// before grant types existed.
+func allowsGrantType(client *oauthmodels.OauthClient, grantType string) bool {
+	if len(client.GrantTypes) == 0 {
+		return grantType == oauthmodels.GrantAuthorizationCode || grantType == oauthmodels.GrantRefreshToken
+	}
+	return rbacutils.Contains(client.GrantTypes, grantType)
+}
+
+// exchangeClientCredentials issues a token to a machine client for itself.
+// the requested scopes must be a subset of the client's, and default to all.
+func exchangeClientCredentials(c *fiber.Ctx, client *oauthmodels.OauthClient) error {
+	if client.Public {
+		return oauthError(c, fiber.StatusBadRequest, "unauthorized_client", "public clients can not use the client credentials grant")
+	}
+
+	scopes := strings.Fields(c.FormValue("scope"))
+	if len(scopes) == 0 {
+		scopes = client.Scopes
+	}
+	for _, scope := range scopes {
+		if !rbacutils.Contains(client.Scopes, scope) {
+			return oauthError(c, fiber.StatusBadRequest, "invalid_scope", "scope "+scope+" is not granted to this client")
+		}
+	}
+
+	accessToken, err := tokenutils.CreateNewClientAccessToken(client.ClientId, scopes)
+	if err != nil {
+		log.Println("failed to generate access token.", err)
+		return oauthError(c, fiber.StatusInternalServerError, "server_error", "failed to generate access token")
+	}
+	expiresIn, _ := strconv.Atoi(os.Getenv("ACCESS_TOKEN_MAX_AGE_IN_SECONDS"))
+
+	log.Println("issued client credentials token.", "clientId:", client.ClientId)
+	c.Set("Cache-Control", "no-store")
+	c.Set("Pragma", "no-cache")
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   expiresIn,
+		"scope":        strings.Join(scopes, " "),
+	})
+}
+
+func exchangeAuthorizationCode(c *fiber.Ctx, client *oauthmodels.OauthClient) error {
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+
+	// codes are single-use
+	val, err := cc.CacheClient.Take("oauthCode:" + tokenutils.HashOpaqueToken(c.FormValue("code")))
+	if err == customerrors.ErrNotFound {
+		return oauthError(c, fiber.StatusBadRequest, "invalid_grant", "invalid or expired authorization code")
+	} else if err != nil {
+		log.Println("failed to read from cache.", err)
+		return oauthError(c, fiber.StatusInternalServerError, "server_error", "failed to read authorization code")
+	}
+	authRequest := new(oauthmodels.AuthorizationRequest)
+	if err := json.Unmarshal([]byte(val), authRequest); err != nil {
+		log.Println("failed to decode authorization request.", err)
+		return oauthError(c, fiber.StatusInternalServerError, "server_error", "failed to read authorization code")
+	}
+
+	if authRequest.ClientId != client.ClientId {
+		return oauthError(c, fiber.StatusBadRequest, "invalid_grant", "authorization code was issued to another client")
+	} else if c.FormValue("redirect_uri") != authRequest.RedirectUri {
+		return oauthError(c, fiber.StatusBadRequest, "invalid_grant", "redirect uri does not match the authorization request")
+	} else if oauthutils.GetPkceChallenge(c.FormValue("code_verifier")) != authRequest.CodeChallenge {
+		return oauthError(c, fiber.StatusBadRequest, "invalid_grant", "code verifier does not match the code challenge")
+	}
+
+	authCred, err := cc.DbClient.AuthAccess.GetAuthCredentialByUserId(authRequest.UserId)
+	if err != nil {
+		log.Println("failed to read user credential.", err)
+		return oauthError(c, fiber.StatusBadRequest, "invalid_grant", "user not found")
+	} else if authCred.Disabled {
+		return oauthError(c, fiber.StatusBadRequest, "invalid_grant", "account is disabled")
+	} else if authCred.PasswordResetRequired {
+		return oauthError(c, fiber.StatusBadRequest, "invalid_grant", "password reset required")
+	}
+
+	// each authorization is a grant, kept through the rotations of its refresh token
+	grantId, err := tokenutils.GenerateOpaqueToken(16)
+	if err != nil {
+		log.Println("failed to generate grant id.", err)
+		return oauthError(c, fiber.StatusInternalServerError, "server_error", "failed to generate grant id")
+	}
+	return issueTokens(c, client, authCred.UserId, authRequest.Scopes, authRequest.Nonce, authRequest.AuthTime, grantId)
+}
+
+func exchangeRefreshToken(c *fiber.Ctx, client *oauthmodels.OauthClient) error {
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	refreshToken := c.FormValue("refresh_token")
+
+	res, err := cc.CacheClient.Get(refreshToken)
+	if err != nil && err != customerrors.ErrNotFound {
+		log.Println("failed to lookup cache.", err)
+		return oauthError(c, fiber.StatusInternalServerError, "server_error", "failed to lookup cache")
+	} else if res == "blacklist:refresh" {
+		return oauthError(c, fiber.StatusBadRequest, "invalid_grant", "refresh token was revoked")
+	}
+
+	claims, err := tokenutils.ParseToken(refreshToken, "REFRESH_TOKEN_SIGNING_KEY")
+	if err != nil {
+		return oauthError(c, fiber.StatusBadRequest, "invalid_grant", "invalid refresh token")
+	}
+	userId, _ := claims["userId"].(string)
+	if clientId, _ := claims["client_id"].(string); clientId != client.ClientId || userId == "" {
+		return oauthError(c, fiber.StatusBadRequest, "invalid_grant", "refresh token was issued to another client")
+	}
+
+	authCred, err := cc.DbClient.AuthAccess.GetAuthCredentialByUserId(userId)
+	if err != nil {
+		log.Println("failed to read user credential.", err)
+		return oauthError(c, fiber.StatusBadRequest, "invalid_grant", "user not found")
+	} else if authCred.Disabled {
+		return oauthError(c, fiber.StatusBadRequest, "invalid_grant", "account is disabled")
+	} else if authCred.PasswordResetRequired {
+		return oauthError(c, fiber.StatusBadRequest, "invalid_grant", "password reset required")
+	}
+	issuedAt, _ := claims["iat"].(float64)
+	revoked, err := sessionutils.IsSessionRevoked(cc.CacheClient, userId, int64(issuedAt))
+	if err != nil {
+		log.Println("failed to lookup cache.", err)
+		return oauthError(c, fiber.StatusInternalServerError, "server_error", "failed to lookup cache")
+	} else if revoked {
+		return oauthError(c, fiber.StatusBadRequest, "invalid_grant", "refresh token was revoked")
+	}
+	// tokens from before the scopes of the client were cut can't be refreshed
+	revoked, err = sessionutils.IsClientTokenRevoked(cc.CacheClient, client.ClientId, int64(issuedAt))
+	if err != nil {
+		log.Println("failed to lookup cache.", err)
+		return oauthError(c, fiber.StatusInternalServerError, "server_error", "failed to lookup cache")
+	} else if revoked {
+		return oauthError(c, fiber.StatusBadRequest, "invalid_grant", "refresh token was revoked")
+	}
+	grantId, _ := claims["grant_id"].(string)
+	if grantId == "" {
+		// refresh tokens from before grants were tracked start one
+		if grantId, err = tokenutils.GenerateOpaqueToken(16); err != nil {
+			log.Println("failed to generate grant id.", err)
+			return oauthError(c, fiber.StatusInternalServerError, "server_error", "failed to generate grant id")
+		}
+	} else if revoked, err := sessionutils.IsGrantRevoked(cc.CacheClient, grantId); err != nil {
+		log.Println("failed to lookup cache.", err)
+		return oauthError(c, fiber.StatusInternalServerError, "server_error", "failed to lookup cache")
+	} else if revoked {
+		return oauthError(c, fiber.StatusBadRequest, "invalid_grant", "refresh token was revoked")
+	}
+
+	// refresh tokens of clients are rotated, the used one is blacklisted. only
+	// the request that sets the blacklist entry gets new tokens, so concurrent
+	// requests with the same token can't both succeed
+	refreshMaxAgeInSeconds, _ := strconv.Atoi(os.Getenv("REFRESH_TOKEN_MAX_AGE_IN_SECONDS"))
+	first, err := cc.CacheClient.SetNX(refreshToken, "blacklist:refresh", time.Second*time.Duration(refreshMaxAgeInSeconds))
+	if err != nil {
+		log.Println("failed to write to cache.", err)
+		return oauthError(c, fiber.StatusInternalServerError, "server_error", "failed to write to cache")
+	} else if !first {
+		log.Println("refresh token used twice.", "userId:", userId, "clientId:", client.ClientId)
+		return oauthError(c, fiber.StatusBadRequest, "invalid_grant", "refresh token was already used")
+	}
+
+	scope, _ := claims["scope"].(string)
+	authTime, _ := claims["auth_time"].(float64)
+	return issueTokens(c, client, userId, strings.Fields(scope), "", int64(authTime), grantId)
+}
+
+// issueTokens responds with a goth token pair scoped to client, plus an id
+// token when the openid scope was granted.
+func issueTokens(c *fiber.Ctx, client *oauthmodels.OauthClient, userId string, scopes []string, nonce string, authTime int64, grantId string) error {
+	scope := strings.Join(scopes, " ")
+	clientClaims := jwt.MapClaims{"client_id": client.ClientId, "scope": scope, "grant_id": grantId}
+
+	accessToken, err := tokenutils.CreateNewAccessToken(userId, clientClaims)
+	if err != nil {
+		log.Println("failed to generate access token.", err)
+		return oauthError(c, fiber.StatusInternalServerError, "server_error", "failed to generate access token")
+	}
+	refreshToken, err := tokenutils.CreateNewRefreshToken(userId, tokenutils.MergeClaims(clientClaims, jwt.MapClaims{"auth_time": authTime}))
+	if err != nil {
+		log.Println("failed to generate refresh token.", err)
+		return oauthError(c, fiber.StatusInternalServerError, "server_error", "failed to generate refresh token")
+	}
+	expiresIn, _ := strconv.Atoi(os.Getenv("ACCESS_TOKEN_MAX_AGE_IN_SECONDS"))
+
+	body := fiber.Map{
+		"access_token":  accessToken,
+		"token_type":    "Bearer",
+		"expires_in":    expiresIn,
+		"refresh_token": refreshToken,
+		"scope":         scope,
+	}
+
+	if rbacutils.Contains(scopes, oauthmodels.ScopeOpenId) {
+		cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+		userInfo, err := cc.DbClient.UserAccess.GetAUser(userId)
+		if err != nil {
+			log.Println("failed to read user.", err)
+			return oauthError(c, fiber.StatusInternalServerError, "server_error", "failed to read user")
+		}
+
+		now := time.Now()
+		idClaims := jwt.MapClaims{
+			"iss":       GetIssuer(c),
+			"sub":       userId,
+			"aud":       client.ClientId,
+			"iat":       now.Unix(),
+			"exp":       now.Add(time.Second * time.Duration(expiresIn)).Unix(),
+			"auth_time": authTime,
+		}
+		if nonce != "" {
+			idClaims["nonce"] = nonce
+		}
+		idToken, err := oidcutils.SignToken(tokenutils.MergeClaims(idClaims, oidcutils.GetUserClaims(userInfo, scopes)))
+		if err != nil {
+			log.Println("failed to sign id token.", err)
+			return oauthError(c, fiber.StatusInternalServerError, "server_error", "failed to sign id token")
+		}
+		body["id_token"] = idToken
+	}
+
+	log.Println("issued oauth tokens.", "userId:", userId, "clientId:", client.ClientId)
+	c.Set("Cache-Control", "no-store")
+	c.Set("Pragma", "no-cache")
+	return c.Status(fiber.StatusOK).JSON(body)
+}
+
+func UserInfo(c *fiber.Ctx) error {
+	commonCtx := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx)
+	dbclient := commonCtx.Clients.DbClient
+
+	userInfo, err := dbclient.UserAccess.GetAUser(commonCtx.UserId)
+	if err == customerrors.ErrNotFound {
+		msg := "no such user found."
+		log.Println(msg, "userId:", commonCtx.UserId)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to read user."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	// goth's own tokens have no scopes and see everything
+	scopes := commonCtx.Scopes
+	if commonCtx.ClientId == "" {
+		scopes = supportedScopes
+	}
+	claims := oidcutils.GetUserClaims(userInfo, scopes)
+	claims["sub"] = userInfo.UserId
+	return c.Status(fiber.StatusOK).JSON(claims)
+}
+
+func containsAll(values, required []string) bool {
+	for _, value := range required {
+		if !rbacutils.Contains(values, value) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,537 @@
+package orgapi
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	customerrors "github.com/alubhorta/goth/custom/errors"
+	orgaccess "github.com/alubhorta/goth/db/access/org"
+	commonmodels "github.com/alubhorta/goth/models/common"
+	orgmodels "github.com/alubhorta/goth/models/org"
+	emailutils "github.com/alubhorta/goth/utils/email"
+	sessionutils "github.com/alubhorta/goth/utils/session"
+	tokenutils "github.com/alubhorta/goth/utils/token"
+	validationutils "github.com/alubhorta/goth/utils/validation"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+)
+
+func isValidOrgRole(role string) bool {
+	return role == orgmodels.OrgRoleOwner || role == orgmodels.OrgRoleAdmin || role == orgmodels.OrgRoleMember
+}
+
+func CreateOrg(c *fiber.Ctx) error {
+	userId := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).UserId
+
+	input := new(orgmodels.CreateOrgInput)
+	if err := c.BodyParser(input); err != nil {
+		msg := "invalid input."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if strings.TrimSpace(input.Name) == "" {
+		msg := "invalid input - name is required."
+		log.Println(msg)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	dbclient := cc.DbClient
+
+	now := time.Now()
+	org := &orgmodels.Organization{
+		OrgId:      fmt.Sprintf("%v", uuid.New()),
+		Name:       strings.TrimSpace(input.Name),
+		OwnerId:    userId,
+		CreatedAt:  now,
+		ModifiedAt: now,
+	}
+	if err := dbclient.OrgAccess.CreateAnOrg(org); err != nil {
+		msg := "failed to create org."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully created org."
+	log.Println(msg, "orgId:", org.OrgId, "owner:", userId)
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"message": msg, "payload": fiber.Map{"org": org}})
+}
+
+func ListMyOrgs(c *fiber.Ctx) error {
+	userId := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).UserId
+
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	dbclient := cc.DbClient
+
+	memberships, err := dbclient.OrgAccess.ListMembershipsOfUser(userId)
+	if err != nil {
+		msg := "failed to list memberships."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	orgIds := []string{}
+	for _, membership := range memberships {
+		orgIds = append(orgIds, membership.OrgId)
+	}
+	orgs, err := dbclient.OrgAccess.GetOrgsByIds(orgIds)
+	if err != nil {
+		msg := "failed to list orgs."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	orgsById := map[string]*orgmodels.Organization{}
+	for _, org := range orgs {
+		orgsById[org.OrgId] = org
+	}
+	results := []fiber.Map{}
+	for _, membership := range memberships {
+		if org, ok := orgsById[membership.OrgId]; ok {
+			results = append(results, fiber.Map{"org": org, "role": membership.Role})
+		}
+	}
+
+	msg := "successfully listed orgs."
+	log.Println(msg, "userId:", userId)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": fiber.Map{"orgs": results}})
+}
+
+func GetOrg(c *fiber.Ctx) error {
+	orgId := c.Params("orgId")
+
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	dbclient := cc.DbClient
+
+	org, err := dbclient.OrgAccess.GetAnOrg(orgId)
+	if err == customerrors.ErrNotFound {
+		msg := "no such org found."
+		log.Println(msg, "orgId:", orgId)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to get org."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully retrieved org."
+	log.Println(msg, "orgId:", orgId)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": fiber.Map{"org": org}})
+}
+
+func UpdateOrg(c *fiber.Ctx) error {
+	orgId := c.Params("orgId")
+
+	input := new(orgmodels.UpdateOrgInput)
+	if err := c.BodyParser(input); err != nil {
+		msg := "invalid input."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if strings.TrimSpace(input.Name) == "" {
+		msg := "invalid input - name is required."
+		log.Println(msg)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	input.Name = strings.TrimSpace(input.Name)
+
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	dbclient := cc.DbClient
+
+	err := dbclient.OrgAccess.UpdateAnOrg(orgId, input)
+	if err == customerrors.ErrNotFound {
+		msg := "no such org found."
+		log.Println(msg, "orgId:", orgId)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to update org."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully updated org."
+	log.Println(msg, "orgId:", orgId)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": nil})
+}
+
+func DeleteOrg(c *fiber.Ctx) error {
+	orgId := c.Params("orgId")
+
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	dbclient := cc.DbClient
+
+	err := dbclient.OrgAccess.DeleteAnOrg(orgId)
+	if err == customerrors.ErrNotFound {
+		msg := "no such org found."
+		log.Println(msg, "orgId:", orgId)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to delete org."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully deleted org."
+	log.Println(msg, "orgId:", orgId)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": nil})
+}
+
+func ListMembers(c *fiber.Ctx) error {
+	orgId := c.Params("orgId")
+
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	dbclient := cc.DbClient
+
+	members, err := dbclient.OrgAccess.ListMembersOfOrg(orgId)
+	if err != nil {
+		msg := "failed to list members."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully listed members."
+	log.Println(msg, "orgId:", orgId)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": fiber.Map{"members": members}})
+}
+
+func UpdateMember(c *fiber.Ctx) error {
+	commonCtx := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx)
+	orgId := c.Params("orgId")
+	memberId := c.Params("userId")
+
+	input := new(orgmodels.UpdateMembershipInput)
+	if err := c.BodyParser(input); err != nil {
+		msg := "invalid input."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if !isValidOrgRole(input.Role) {
+		msg := "invalid input - unknown org role."
+		log.Println(msg, input.Role)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	dbclient := commonCtx.Clients.DbClient
+
+	membership, err := dbclient.OrgAccess.GetMembership(orgId, memberId)
+	if err == customerrors.ErrNotFound {
+		msg := "no such member found."
+		log.Println(msg, "orgId:", orgId, "userId:", memberId)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to read from database."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	// only owners can hand out or take away ownership
+	if (input.Role == orgmodels.OrgRoleOwner || membership.Role == orgmodels.OrgRoleOwner) && commonCtx.OrgRole != orgmodels.OrgRoleOwner {
+		msg := "forbidden - only owners can change ownership."
+		log.Println(msg, "orgId:", orgId, "userId:", commonCtx.UserId)
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	if membership.Role == orgmodels.OrgRoleOwner && input.Role != orgmodels.OrgRoleOwner {
+		if isLast, err := isLastOwner(dbclient.OrgAccess, orgId); err != nil {
+			msg := "failed to read from database."
+			log.Println(msg, err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+		} else if isLast {
+			msg := "invalid input - an org must keep at least one owner."
+			log.Println(msg, "orgId:", orgId)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+		}
+	}
+
+	err = dbclient.OrgAccess.UpdateMembershipRole(orgId, memberId, input.Role)
+	if err != nil {
+		msg := "failed to update member."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully updated member."
+	log.Println(msg, "orgId:", orgId, "userId:", memberId, "role:", input.Role)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": nil})
+}
+
+func RemoveMember(c *fiber.Ctx) error {
+	commonCtx := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx)
+	orgId := c.Params("orgId")
+	memberId := c.Params("userId")
+
+	dbclient := commonCtx.Clients.DbClient
+
+	membership, err := dbclient.OrgAccess.GetMembership(orgId, memberId)
+	if err == customerrors.ErrNotFound {
+		msg := "no such member found."
+		log.Println(msg, "orgId:", orgId, "userId:", memberId)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to read from database."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	if membership.Role == orgmodels.OrgRoleOwner {
+		if commonCtx.OrgRole != orgmodels.OrgRoleOwner {
+			msg := "forbidden - only owners can remove owners."
+			log.Println(msg, "orgId:", orgId, "userId:", commonCtx.UserId)
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+		}
+		if isLast, err := isLastOwner(dbclient.OrgAccess, orgId); err != nil {
+			msg := "failed to read from database."
+			log.Println(msg, err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+		} else if isLast {
+			msg := "invalid input - an org must keep at least one owner."
+			log.Println(msg, "orgId:", orgId)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+		}
+	}
+
+	err = dbclient.OrgAccess.RemoveMembership(orgId, memberId)
+	if err != nil && err != customerrors.ErrNotFound {
+		msg := "failed to remove member."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully removed member."
+	log.Println(msg, "orgId:", orgId, "userId:", memberId)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": nil})
+}
+
+func isLastOwner(orgAccess *orgaccess.OrgAccess, orgId string) (bool, error) {
+	owners, err := orgAccess.CountOwners(orgId)
+	return owners <= 1, err
+}
+
+func Invite(c *fiber.Ctx) error {
+	commonCtx := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx)
+	orgId := c.Params("orgId")
+
+	input := new(orgmodels.InviteInput)
+	if err := c.BodyParser(input); err != nil {
+		msg := "invalid input."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if !validationutils.IsValidEmail(input.Email) {
+		msg := "invalid email provided."
+		log.Println(msg)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	input.Email = validationutils.NormalizeEmail(input.Email)
+	if input.Role == "" {
+		input.Role = orgmodels.OrgRoleMember
+	}
+	if !isValidOrgRole(input.Role) {
+		msg := "invalid input - unknown org role."
+		log.Println(msg, input.Role)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if input.Role == orgmodels.OrgRoleOwner && commonCtx.OrgRole != orgmodels.OrgRoleOwner {
+		msg := "forbidden - only owners can invite owners."
+		log.Println(msg, "orgId:", orgId, "userId:", commonCtx.UserId)
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	dbclient := commonCtx.Clients.DbClient
+
+	org, err := dbclient.OrgAccess.GetAnOrg(orgId)
+	if err == customerrors.ErrNotFound {
+		msg := "no such org found."
+		log.Println(msg, "orgId:", orgId)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to get org."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	token, err := tokenutils.GenerateOpaqueToken(32)
+	if err != nil {
+		msg := "failed to generate invitation token."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	maxAgeInHours, err := strconv.Atoi(os.Getenv("ORG_INVITATION_MAX_AGE_IN_HOURS"))
+	if err != nil || maxAgeInHours <= 0 {
+		maxAgeInHours = 72
+	}
+	now := time.Now()
+	invitation := &orgmodels.Invitation{
+		InvitationId: fmt.Sprintf("%v", uuid.New()),
+		OrgId:        orgId,
+		Email:        input.Email,
+		Role:         input.Role,
+		HashedToken:  tokenutils.HashOpaqueToken(token),
+		InvitedBy:    commonCtx.UserId,
+		ExpiresAt:    now.Add(time.Hour * time.Duration(maxAgeInHours)),
+		CreatedAt:    now,
+	}
+	if err := dbclient.OrgAccess.CreateInvitation(invitation); err != nil {
+		msg := "failed to create invitation."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	if err := emailutils.SendOrgInvitationMail(input.Email, org.Name, token); err != nil {
+		msg := "failed to send invitation via mail."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully sent invitation."
+	log.Println(msg, "orgId:", orgId, "invitationId:", invitation.InvitationId)
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"message": msg, "payload": fiber.Map{"invitation": invitation}})
+}
+
+func ListInvitations(c *fiber.Ctx) error {
+	orgId := c.Params("orgId")
+
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	dbclient := cc.DbClient
+
+	invitations, err := dbclient.OrgAccess.ListPendingInvitations(orgId)
+	if err != nil {
+		msg := "failed to list invitations."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully listed invitations."
+	log.Println(msg, "orgId:", orgId)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": fiber.Map{"invitations": invitations}})
+}
+
+func RevokeInvitation(c *fiber.Ctx) error {
+	orgId := c.Params("orgId")
+	invitationId := c.Params("invitationId")
+
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	dbclient := cc.DbClient
+
+	err := dbclient.OrgAccess.DeleteInvitation(orgId, invitationId)
+	if err == customerrors.ErrNotFound {
+		msg := "no such invitation found."
+		log.Println(msg, "orgId:", orgId, "invitationId:", invitationId)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to revoke invitation."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully revoked invitation."
+	log.Println(msg, "orgId:", orgId, "invitationId:", invitationId)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": nil})
+}
+
+func AcceptInvitation(c *fiber.Ctx) error {
+	userId := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).UserId
+
+	input := new(orgmodels.AcceptInvitationInput)
+	if err := c.BodyParser(input); err != nil || input.Token == "" {
+		msg := "invalid input."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	dbclient := cc.DbClient
+
+	// invitations are bound to the email they were sent to
+	authCred, err := dbclient.AuthAccess.GetAuthCredentialByUserId(userId)
+	if err != nil {
+		msg := "failed to get user credential."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	membership, err := dbclient.OrgAccess.AcceptInvitation(tokenutils.HashOpaqueToken(input.Token), authCred.Email, userId)
+	if err == customerrors.ErrNotFound {
+		msg := "not found - invalid, expired or already used invitation."
+		log.Println(msg, "userId:", userId)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err == customerrors.ErrDuplicateKey {
+		msg := "already a member of this org."
+		log.Println(msg, "userId:", userId)
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to accept invitation."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully joined org."
+	log.Println(msg, "orgId:", membership.OrgId, "userId:", userId)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": fiber.Map{"membership": membership}})
+}
+
+// SwitchOrg issues a new token pair with orgId as the active org.
+func SwitchOrg(c *fiber.Ctx) error {
+	commonCtx := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx)
+	userId := commonCtx.UserId
+	orgId := c.Params("orgId")
+
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	dbclient := cc.DbClient
+
+	membership, err := dbclient.OrgAccess.GetMembership(orgId, userId)
+	if err == customerrors.ErrNotFound {
+		msg := "forbidden - not a member of this org."
+		log.Println(msg, "userId:", userId, "orgId:", orgId)
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to read from database."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	authCred, err := dbclient.AuthAccess.GetAuthCredentialByUserId(userId)
+	if err != nil {
+		msg := "failed to get user credential."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	// switching orgs is no new authentication, the new tokens keep the old one
+	authClaims := jwt.MapClaims{}
+	if commonCtx.AuthTime > 0 {
+		authClaims = tokenutils.GetAuthClaims(time.Unix(commonCtx.AuthTime, 0), commonCtx.Amr...)
+	}
+	accessClaims := tokenutils.MergeClaims(tokenutils.GetUserClaims(authCred), tokenutils.GetOrgClaims(membership), authClaims)
+	accessToken, err := tokenutils.CreateNewAccessToken(userId, accessClaims)
+	if err != nil {
+		msg := "failed to generate access token."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	refreshToken, err := tokenutils.CreateNewRefreshToken(userId, tokenutils.MergeClaims(jwt.MapClaims{"orgId": orgId}, authClaims))
+	if err != nil {
+		msg := "failed to generate refresh token."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	tokens, err := sessionutils.GetTokensPayload(c, accessToken, refreshToken)
+	if err != nil {
+		msg := "failed to set session cookie."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully switched org."
+	log.Println(msg, "userId:", userId, "orgId:", orgId)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": msg,
+		"payload": fiber.Map{
+			"orgId":  orgId,
+			"role":   membership.Role,
+			"tokens": tokens,
+		},
+	})
+}
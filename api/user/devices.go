@@ -0,0 +1,58 @@
+package userapi
+
+import (
+	"log"
+
+	customerrors "github.com/alubhorta/goth/custom/errors"
+	auditmodels "github.com/alubhorta/goth/models/audit"
+	commonmodels "github.com/alubhorta/goth/models/common"
+	auditutils "github.com/alubhorta/goth/utils/audit"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ListDevices lists the devices the user logged in from, most recent first.
+func ListDevices(c *fiber.Ctx) error {
+	commonCtx := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx)
+	dbclient := commonCtx.Clients.DbClient
+
+	devices, err := dbclient.DeviceAccess.ListDevicesOfUser(commonCtx.UserId)
+	if err != nil {
+		msg := "failed to list devices."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully listed devices."
+	log.Println(msg, "userId:", commonCtx.UserId)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": fiber.Map{"devices": devices}})
+}
+
+// DeleteDevice forgets a known device, so the next login from it sends a new
+// device mail again.
+func DeleteDevice(c *fiber.Ctx) error {
+	commonCtx := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx)
+	if commonCtx.ApiKeyId != "" {
+		msg := "api keys can not remove devices."
+		log.Println(msg, "keyId:", commonCtx.ApiKeyId)
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	deviceId := c.Params("deviceId")
+	dbclient := commonCtx.Clients.DbClient
+
+	err := dbclient.DeviceAccess.DeleteDevice(commonCtx.UserId, deviceId)
+	if err == customerrors.ErrNotFound {
+		msg := "no such device found."
+		log.Println(msg, "deviceId:", deviceId)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to remove device."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully removed device."
+	log.Println(msg, "deviceId:", deviceId, "userId:", commonCtx.UserId)
+	auditutils.Record(c, auditmodels.ActionDeviceRemove, auditmodels.OutcomeSuccess, commonCtx.UserId, "", deviceId)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": nil})
+}
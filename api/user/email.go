@@ -0,0 +1,238 @@
+package userapi
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"time"
+
+	customerrors "github.com/alubhorta/goth/custom/errors"
+	auditmodels "github.com/alubhorta/goth/models/audit"
+	commonmodels "github.com/alubhorta/goth/models/common"
+	usermodels "github.com/alubhorta/goth/models/user"
+	auditutils "github.com/alubhorta/goth/utils/audit"
+	emailutils "github.com/alubhorta/goth/utils/email"
+	enumerationutils "github.com/alubhorta/goth/utils/enumeration"
+	otputils "github.com/alubhorta/goth/utils/otp"
+	passwordutils "github.com/alubhorta/goth/utils/password"
+	validationutils "github.com/alubhorta/goth/utils/validation"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+const emailChangeMaxAge = 15 * time.Minute
+const emailChangeMaxAttempts = 5
+
+// ChangeEmail starts an email change by sending a code to the new address,
+// and a notice to the current one. accounts with a password have to confirm it.
+func ChangeEmail(c *fiber.Ctx) error {
+	commonCtx := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx)
+	if commonCtx.ApiKeyId != "" {
+		msg := "api keys can not change the email address."
+		log.Println(msg, "keyId:", commonCtx.ApiKeyId)
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	input := new(usermodels.ChangeEmailInput)
+	if err := c.BodyParser(input); err != nil {
+		msg := "invalid input."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	if !validationutils.IsValidEmail(input.NewEmail) {
+		msg := "invalid email provided."
+		log.Println(msg)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	input.NewEmail = validationutils.NormalizeEmail(input.NewEmail)
+
+	cc := commonCtx.Clients
+	dbclient := cc.DbClient
+
+	authCred, err := dbclient.AuthAccess.GetAuthCredentialByUserId(commonCtx.UserId)
+	if err != nil {
+		msg := "failed to get user credential."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if authCred.HashedPassword != "" && !passwordutils.DoesPasswordMatchHash(authCred.HashedPassword, input.Password) {
+		msg := "invalid password provided."
+		log.Println(msg, "userId:", authCred.UserId)
+		auditutils.Record(c, auditmodels.ActionEmailChange, auditmodels.OutcomeFailure, authCred.UserId, authCred.Email, "invalid password")
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if input.NewEmail == authCred.Email {
+		msg := "invalid input - new email is the current one."
+		log.Println(msg)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	safeMode := enumerationutils.IsSafeMode()
+	if safeMode {
+		defer enumerationutils.PadResponse(time.Now())
+	}
+
+	_, err = dbclient.AuthAccess.GetAuthCredentialByEmail(input.NewEmail)
+	if err == nil && safeMode {
+		// answer as if a code was sent, and let the owner of the email know
+		log.Println("email change to an email in use.", "userId:", commonCtx.UserId)
+		auditutils.Record(c, auditmodels.ActionEmailChange, auditmodels.OutcomeFailure, authCred.UserId, input.NewEmail, "email already registered")
+		// the request buffers are reused once the handler returns
+		newEmail := utils.CopyString(input.NewEmail)
+		go func() {
+			if err := emailutils.SendEmailInUseMail(newEmail); err != nil {
+				log.Println("failed to send email in use mail.", err)
+			}
+		}()
+		return c.Status(fiber.StatusAccepted).JSON(fiber.Map{"message": "sent a confirmation code to the new email.", "payload": nil})
+	} else if err == nil {
+		msg := "email is already in use."
+		log.Println(msg)
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != customerrors.ErrNotFound {
+		msg := "failed to read from database."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	code, err := otputils.GenerateOTP(6)
+	if err != nil {
+		msg := "failed to generate code."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	pending := &usermodels.PendingEmailChange{
+		NewEmail:  input.NewEmail,
+		Code:      code,
+		ExpiresAt: time.Now().Add(emailChangeMaxAge).Unix(),
+	}
+	if err := savePendingEmailChange(c, commonCtx.UserId, pending); err != nil {
+		msg := "failed to write to cache."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	// a new code gets its own attempts
+	if err := cc.CacheClient.Del("emailChangeAttempts:" + commonCtx.UserId); err != nil {
+		log.Println("failed to write to cache.", err)
+	}
+
+	input.NewEmail = utils.CopyString(input.NewEmail)
+	sendMails := func() error {
+		if err := emailutils.SendEmailChangeCodeMail(input.NewEmail, code); err != nil {
+			return err
+		}
+		if err := emailutils.SendEmailChangeNoticeMail(authCred.Email, input.NewEmail); err != nil {
+			log.Println("failed to send email change notice.", err)
+		}
+		return nil
+	}
+	if safeMode {
+		// mailing in the background takes as long as for an email in use
+		go func() {
+			if err := sendMails(); err != nil {
+				log.Println("failed to send code via mail.", err)
+			}
+		}()
+	} else if err := sendMails(); err != nil {
+		msg := "failed to send code via mail."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "sent a confirmation code to the new email."
+	log.Println(msg, "userId:", commonCtx.UserId)
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{"message": msg, "payload": nil})
+}
+
+func savePendingEmailChange(c *fiber.Ctx, userId string, pending *usermodels.PendingEmailChange) error {
+	cacheClient := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients.CacheClient
+
+	ttl := time.Until(time.Unix(pending.ExpiresAt, 0))
+	if ttl <= 0 {
+		return cacheClient.Del("emailChange:" + userId)
+	}
+	val, err := json.Marshal(pending)
+	if err != nil {
+		return err
+	}
+	return cacheClient.Set("emailChange:"+userId, string(val), ttl)
+}
+
+// ConfirmEmailChange completes an email change with the code sent to the new
+// address. after too many wrong codes, the change has to be started again.
+func ConfirmEmailChange(c *fiber.Ctx) error {
+	commonCtx := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx)
+	cc := commonCtx.Clients
+	dbclient := cc.DbClient
+
+	input := new(usermodels.ConfirmEmailChangeInput)
+	if err := c.BodyParser(input); err != nil || input.Code == "" {
+		msg := "invalid input."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	val, err := cc.CacheClient.Get("emailChange:" + commonCtx.UserId)
+	if err == customerrors.ErrNotFound {
+		msg := "not found - no pending email change or expired code."
+		log.Println(msg)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to read from cache."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	pending := new(usermodels.PendingEmailChange)
+	if err := json.Unmarshal([]byte(val), pending); err != nil {
+		msg := "failed to read from cache."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	// counted before comparing, so concurrent guesses can't exceed the limit
+	attempts, err := cc.CacheClient.Incr("emailChangeAttempts:"+commonCtx.UserId, emailChangeMaxAge)
+	if err != nil {
+		msg := "failed to write to cache."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if attempts > emailChangeMaxAttempts {
+		if err := cc.CacheClient.Del("emailChange:" + commonCtx.UserId); err != nil {
+			log.Println("failed to write to cache.", err)
+		}
+		msg := "too many attempts - start the email change again."
+		log.Println(msg, "userId:", commonCtx.UserId)
+		auditutils.Record(c, auditmodels.ActionEmailChange, auditmodels.OutcomeFailure, commonCtx.UserId, pending.NewEmail, "too many attempts")
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	if subtle.ConstantTimeCompare([]byte(input.Code), []byte(pending.Code)) != 1 {
+		msg := "invalid input - code mismatch."
+		log.Println(msg, "userId:", commonCtx.UserId)
+		auditutils.Record(c, auditmodels.ActionEmailChange, auditmodels.OutcomeFailure, commonCtx.UserId, pending.NewEmail, "code mismatch")
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	authCred, err := dbclient.AuthAccess.GetAuthCredentialByUserId(commonCtx.UserId)
+	if err != nil {
+		msg := "failed to get user credential."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	err = dbclient.AuthAccess.UpdateEmail(commonCtx.UserId, authCred.Email, pending.NewEmail)
+	if err == customerrors.ErrDuplicateKey {
+		msg := "email is already in use."
+		log.Println(msg)
+		cc.CacheClient.Del("emailChange:" + commonCtx.UserId)
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to update email."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	cc.CacheClient.Del("emailChange:" + commonCtx.UserId)
+	cc.CacheClient.Del("emailChangeAttempts:" + commonCtx.UserId)
+
+	msg := "successfully changed email."
+	log.Println(msg, "userId:", commonCtx.UserId)
+	auditutils.Record(c, auditmodels.ActionEmailChange, auditmodels.OutcomeSuccess, commonCtx.UserId, pending.NewEmail, "from "+authCred.Email)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": fiber.Map{"email": pending.NewEmail}})
+}
@@ -0,0 +1,224 @@
+package userapi
+
+import (
+	"log"
+	"time"
+
+	customerrors "github.com/alubhorta/goth/custom/errors"
+	auditmodels "github.com/alubhorta/goth/models/audit"
+	commonmodels "github.com/alubhorta/goth/models/common"
+	usermodels "github.com/alubhorta/goth/models/user"
+	auditutils "github.com/alubhorta/goth/utils/audit"
+	enumerationutils "github.com/alubhorta/goth/utils/enumeration"
+	passwordutils "github.com/alubhorta/goth/utils/password"
+	smsutils "github.com/alubhorta/goth/utils/sms"
+	validationutils "github.com/alubhorta/goth/utils/validation"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+const phoneChangeMaxAge = 10 * time.Minute
+
+// ChangePhone starts adding or changing the phone number by sending a code to
+// it. accounts with a password have to confirm it.
+func ChangePhone(c *fiber.Ctx) error {
+	commonCtx := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx)
+	if commonCtx.ApiKeyId != "" {
+		msg := "api keys can not change the phone number."
+		log.Println(msg, "keyId:", commonCtx.ApiKeyId)
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if !smsutils.IsEnabled() {
+		msg := "sms is not enabled."
+		log.Println(msg)
+		return c.Status(fiber.StatusNotImplemented).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	input := new(usermodels.ChangePhoneInput)
+	if err := c.BodyParser(input); err != nil {
+		msg := "invalid input."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	if !validationutils.IsValidPhone(input.Phone) {
+		msg := "invalid phone number provided, expected the E.164 format like +14155550123."
+		log.Println(msg)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	input.Phone = validationutils.NormalizePhone(input.Phone)
+
+	cc := commonCtx.Clients
+	dbclient := cc.DbClient
+
+	authCred, err := dbclient.AuthAccess.GetAuthCredentialByUserId(commonCtx.UserId)
+	if err != nil {
+		msg := "failed to get user credential."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if authCred.HashedPassword != "" && !passwordutils.DoesPasswordMatchHash(authCred.HashedPassword, input.Password) {
+		msg := "invalid password provided."
+		log.Println(msg, "userId:", authCred.UserId)
+		auditutils.Record(c, auditmodels.ActionPhoneChange, auditmodels.OutcomeFailure, authCred.UserId, authCred.Email, "invalid password")
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if input.Phone == authCred.Phone {
+		msg := "invalid input - new phone number is the current one."
+		log.Println(msg)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	safeMode := enumerationutils.IsSafeMode()
+	if safeMode {
+		defer enumerationutils.PadResponse(time.Now())
+	}
+
+	// limited before the lookup, to answer alike for phone numbers in use
+	if err := smsutils.CheckSendLimits(cc.CacheClient, input.Phone, c.IP()); err == smsutils.ErrResendTooSoon {
+		msg := "a code was sent just now - wait a minute before requesting another."
+		log.Println(msg)
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err == smsutils.ErrTooManySends {
+		msg := "too many codes sent - try again later."
+		log.Println(msg, "ip:", c.IP())
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to write to cache."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	_, err = dbclient.AuthAccess.GetAuthCredentialByPhone(input.Phone)
+	if err == nil && safeMode {
+		// answer as if a code was sent
+		log.Println("phone change to a phone number in use.", "userId:", commonCtx.UserId)
+		auditutils.Record(c, auditmodels.ActionPhoneChange, auditmodels.OutcomeFailure, authCred.UserId, authCred.Email, "phone number already registered")
+		return c.Status(fiber.StatusAccepted).JSON(fiber.Map{"message": "sent a confirmation code to the phone number.", "payload": nil})
+	} else if err == nil {
+		msg := "phone number is already in use."
+		log.Println(msg)
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != customerrors.ErrNotFound {
+		msg := "failed to read from database."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	code, err := smsutils.CreateCode(cc.CacheClient, "phoneChange:"+commonCtx.UserId, input.Phone, phoneChangeMaxAge)
+	if err == smsutils.ErrTooManyAttempts {
+		msg := "too many wrong codes - try again later."
+		log.Println(msg, "userId:", commonCtx.UserId)
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to write to cache."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	if safeMode {
+		// sending in the background takes as long as for a phone number in use
+		phone := utils.CopyString(input.Phone)
+		go func() {
+			if err := smsutils.SendCodeSms(phone, code); err != nil {
+				log.Println("failed to send code via sms.", err)
+			}
+		}()
+	} else if err := smsutils.SendCodeSms(input.Phone, code); err != nil {
+		msg := "failed to send code via sms."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "sent a confirmation code to the phone number."
+	log.Println(msg, "userId:", commonCtx.UserId)
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{"message": msg, "payload": nil})
+}
+
+// ConfirmPhoneChange completes a phone change with the code sent by sms.
+// after too many wrong codes, the change has to be started again.
+func ConfirmPhoneChange(c *fiber.Ctx) error {
+	commonCtx := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx)
+	cc := commonCtx.Clients
+	dbclient := cc.DbClient
+
+	input := new(usermodels.ConfirmPhoneChangeInput)
+	if err := c.BodyParser(input); err != nil || input.Code == "" {
+		msg := "invalid input."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	pending, err := smsutils.VerifyCode(cc.CacheClient, "phoneChange:"+commonCtx.UserId, input.Code)
+	if err == customerrors.ErrNotFound {
+		msg := "not found - no pending phone change or expired code."
+		log.Println(msg)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err == smsutils.ErrCodeMismatch {
+		msg := "invalid input - code mismatch."
+		log.Println(msg, "userId:", commonCtx.UserId)
+		auditutils.Record(c, auditmodels.ActionPhoneChange, auditmodels.OutcomeFailure, commonCtx.UserId, "", "code mismatch")
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err == smsutils.ErrTooManyAttempts {
+		msg := "too many wrong codes - try again later."
+		log.Println(msg, "userId:", commonCtx.UserId)
+		auditutils.Record(c, auditmodels.ActionPhoneChange, auditmodels.OutcomeFailure, commonCtx.UserId, "", "too many code attempts")
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to read from cache."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	authCred, err := dbclient.AuthAccess.GetAuthCredentialByUserId(commonCtx.UserId)
+	if err != nil {
+		msg := "failed to get user credential."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	err = dbclient.AuthAccess.UpdatePhone(commonCtx.UserId, authCred.Phone, pending.Phone)
+	if err == customerrors.ErrDuplicateKey {
+		msg := "phone number is already in use."
+		log.Println(msg)
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to update phone number."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully changed phone number."
+	log.Println(msg, "userId:", commonCtx.UserId)
+	auditutils.Record(c, auditmodels.ActionPhoneChange, auditmodels.OutcomeSuccess, commonCtx.UserId, authCred.Email, "to "+pending.Phone)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": fiber.Map{"phone": pending.Phone}})
+}
+
+// RemovePhone removes the phone number, which turns off sms login and resets
+// by sms for the account.
+func RemovePhone(c *fiber.Ctx) error {
+	commonCtx := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx)
+	if commonCtx.ApiKeyId != "" {
+		msg := "api keys can not change the phone number."
+		log.Println(msg, "keyId:", commonCtx.ApiKeyId)
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	dbclient := commonCtx.Clients.DbClient
+
+	authCred, err := dbclient.AuthAccess.GetAuthCredentialByUserId(commonCtx.UserId)
+	if err != nil {
+		msg := "failed to get user credential."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if authCred.Phone == "" {
+		msg := "no phone number to remove."
+		log.Println(msg)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	if err := dbclient.AuthAccess.UpdatePhone(commonCtx.UserId, authCred.Phone, ""); err != nil {
+		msg := "failed to update phone number."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully removed phone number."
+	log.Println(msg, "userId:", commonCtx.UserId)
+	auditutils.Record(c, auditmodels.ActionPhoneChange, auditmodels.OutcomeSuccess, commonCtx.UserId, authCred.Email, "removed "+authCred.Phone)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": nil})
+}
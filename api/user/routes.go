@@ -1,13 +1,22 @@
 package userapi
 
 import (
+	"fmt"
 	"log"
+	"time"
 
 	customerrors "github.com/alubhorta/goth/custom/errors"
+	auditmodels "github.com/alubhorta/goth/models/audit"
+	authmodels "github.com/alubhorta/goth/models/auth"
 	commonmodels "github.com/alubhorta/goth/models/common"
 	usermodels "github.com/alubhorta/goth/models/user"
+	auditutils "github.com/alubhorta/goth/utils/audit"
+	paginationutils "github.com/alubhorta/goth/utils/pagination"
+	rbacutils "github.com/alubhorta/goth/utils/rbac"
+	tokenutils "github.com/alubhorta/goth/utils/token"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
 )
 
 func GetOne(c *fiber.Ctx) error {
@@ -37,9 +46,9 @@ func GetOne(c *fiber.Ctx) error {
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": fiber.Map{"userInfo": aUser}})
 }
 
+// UpdateOne updates the profile, the email is changed through ChangeEmail
+// which verifies the new address.
 func UpdateOne(c *fiber.Ctx) error {
-	// TODO: allow update of email as well
-
 	userId := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).UserId
 	if userId == "" {
 		msg := "invalid user id provided."
@@ -75,10 +84,175 @@ func UpdateOne(c *fiber.Ctx) error {
 	} else if err != nil {
 		msg := "failed to update user."
 		log.Println(msg, err, "id: ", userId)
+		auditutils.Record(c, auditmodels.ActionProfileUpdate, auditmodels.OutcomeFailure, userId, "", err.Error())
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
 	}
 
 	msg := "successfully updated user."
 	log.Println(msg, "id: ", userId)
+	auditutils.Record(c, auditmodels.ActionProfileUpdate, auditmodels.OutcomeSuccess, userId, "", "")
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": nil})
+}
+
+func GetActivity(c *fiber.Ctx) error {
+	userId := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).UserId
+	if userId == "" {
+		msg := "invalid user id provided."
+		log.Println(msg, "userId not found in user context.")
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	dbclient := cc.DbClient
+
+	page, limit := paginationutils.GetPagination(c)
+	entries, total, err := dbclient.AuditAccess.QueryEntries(&auditmodels.AuditQuery{ActorId: userId}, page, limit)
+	if err != nil {
+		msg := "failed to get activity."
+		log.Println(msg, err, "id: ", userId)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully retrieved activity."
+	log.Println(msg, "id: ", userId)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": msg,
+		"payload": fiber.Map{
+			"entries": entries,
+			"page":    page,
+			"limit":   limit,
+			"total":   total,
+		},
+	})
+}
+
+func CreateApiKey(c *fiber.Ctx) error {
+	commonCtx := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx)
+	userId := commonCtx.UserId
+	if userId == "" {
+		msg := "invalid user id provided."
+		log.Println(msg, "userId not found in user context.")
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if commonCtx.ApiKeyId != "" {
+		msg := "api keys can not create other api keys."
+		log.Println(msg, "keyId:", commonCtx.ApiKeyId)
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	input := new(authmodels.CreateApiKeyInput)
+	if err := c.BodyParser(input); err != nil {
+		msg := "invalid input."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if input.Name == "" {
+		msg := "invalid input - missing required fields."
+		log.Println(msg)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if input.ExpiresInDays < 0 {
+		msg := "invalid input - expiresInDays can not be negative."
+		log.Println(msg)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	if input.Scopes == nil {
+		input.Scopes = []string{}
+	}
+	for _, scope := range input.Scopes {
+		if !rbacutils.Contains(commonCtx.Permissions, scope) {
+			msg := "invalid input - scopes must be permissions you have."
+			log.Println(msg, scope)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+		}
+	}
+
+	key, prefix, err := tokenutils.GenerateApiKey()
+	if err != nil {
+		msg := "failed to generate api key."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	now := time.Now()
+	apiKey := &authmodels.ApiKey{
+		KeyId:     fmt.Sprintf("%v", uuid.New()),
+		UserId:    userId,
+		Name:      input.Name,
+		Prefix:    prefix,
+		HashedKey: tokenutils.HashOpaqueToken(key),
+		Scopes:    input.Scopes,
+		CreatedAt: now,
+	}
+	if input.ExpiresInDays > 0 {
+		expiresAt := now.AddDate(0, 0, input.ExpiresInDays)
+		apiKey.ExpiresAt = &expiresAt
+	}
+
+	dbclient := commonCtx.Clients.DbClient
+	if err := dbclient.ApiKeyAccess.CreateApiKey(apiKey); err != nil {
+		msg := "failed to create api key."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully created api key. the key is only shown once."
+	log.Println(msg, "keyId:", apiKey.KeyId, "userId:", userId)
+	auditutils.Record(c, auditmodels.ActionApiKeyCreate, auditmodels.OutcomeSuccess, userId, "", "api key "+apiKey.KeyId)
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": msg,
+		"payload": fiber.Map{
+			"apiKey": apiKey,
+			"key":    key,
+		},
+	})
+}
+
+func ListApiKeys(c *fiber.Ctx) error {
+	userId := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).UserId
+	if userId == "" {
+		msg := "invalid user id provided."
+		log.Println(msg, "userId not found in user context.")
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	dbclient := cc.DbClient
+
+	apiKeys, err := dbclient.ApiKeyAccess.ListApiKeysOfUser(userId)
+	if err != nil {
+		msg := "failed to list api keys."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully listed api keys."
+	log.Println(msg, "userId:", userId)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": fiber.Map{"apiKeys": apiKeys}})
+}
+
+func RevokeApiKey(c *fiber.Ctx) error {
+	userId := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).UserId
+	if userId == "" {
+		msg := "invalid user id provided."
+		log.Println(msg, "userId not found in user context.")
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	keyId := c.Params("keyId")
+
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	dbclient := cc.DbClient
+
+	err := dbclient.ApiKeyAccess.DeleteApiKey(userId, keyId)
+	if err == customerrors.ErrNotFound {
+		msg := "no such api key found."
+		log.Println(msg, "keyId:", keyId)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to revoke api key."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully revoked api key."
+	log.Println(msg, "keyId:", keyId, "userId:", userId)
+	auditutils.Record(c, auditmodels.ActionApiKeyRevoke, auditmodels.OutcomeSuccess, userId, "", "api key "+keyId)
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": nil})
 }
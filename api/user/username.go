@@ -0,0 +1,125 @@
+package userapi
+
+import (
+	"log"
+	"time"
+
+	customerrors "github.com/alubhorta/goth/custom/errors"
+	auditmodels "github.com/alubhorta/goth/models/audit"
+	commonmodels "github.com/alubhorta/goth/models/common"
+	usermodels "github.com/alubhorta/goth/models/user"
+	auditutils "github.com/alubhorta/goth/utils/audit"
+	usernameutils "github.com/alubhorta/goth/utils/username"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// CheckUsername tells if a username can be taken, for forms to check it while
+// typing. a username reserved for its previous owner counts as taken.
+func CheckUsername(c *fiber.Ctx) error {
+	commonCtx := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx)
+	dbclient := commonCtx.Clients.DbClient
+
+	username := usernameutils.Normalize(c.Query("username"))
+	if err := usernameutils.GetPolicy().Validate(username); err != nil {
+		msg := "username is not available."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{
+			"message": msg,
+			"payload": fiber.Map{"username": username, "available": false, "reason": err.Error()},
+		})
+	}
+
+	taken, err := dbclient.AuthAccess.IsUsernameTaken(username, commonCtx.UserId)
+	if err != nil {
+		msg := "failed to read from database."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if taken {
+		msg := "username is not available."
+		log.Println(msg)
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{
+			"message": msg,
+			"payload": fiber.Map{"username": username, "available": false, "reason": "username is already taken"},
+		})
+	}
+
+	msg := "username is available."
+	log.Println(msg)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": msg,
+		"payload": fiber.Map{"username": username, "available": true, "reason": ""},
+	})
+}
+
+// ChangeUsername sets or changes the username, at most once per
+// USERNAME_CHANGE_COOLDOWN_DAYS. the old username stays reserved for the user
+// for USERNAME_RESERVATION_DAYS, so nobody else can take it over right away.
+func ChangeUsername(c *fiber.Ctx) error {
+	commonCtx := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx)
+	if commonCtx.ApiKeyId != "" {
+		msg := "api keys can not change the username."
+		log.Println(msg, "keyId:", commonCtx.ApiKeyId)
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	dbclient := commonCtx.Clients.DbClient
+
+	input := new(usermodels.ChangeUsernameInput)
+	if err := c.BodyParser(input); err != nil {
+		msg := "invalid input."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	policy := usernameutils.GetPolicy()
+	input.Username = usernameutils.Normalize(input.Username)
+	if err := policy.Validate(input.Username); err != nil {
+		msg := "invalid input - " + err.Error() + "."
+		log.Println(msg)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	authCred, err := dbclient.AuthAccess.GetAuthCredentialByUserId(commonCtx.UserId)
+	if err != nil {
+		msg := "failed to get user credential."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if input.Username == authCred.Username {
+		msg := "invalid input - new username is the current one."
+		log.Println(msg)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	if authCred.UsernameChangedAt != nil {
+		if nextChangeAt := authCred.UsernameChangedAt.Add(policy.ChangeCooldown); time.Now().Before(nextChangeAt) {
+			msg := "username was changed too recently."
+			log.Println(msg, "userId:", authCred.UserId)
+			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"message": msg, "payload": fiber.Map{"nextChangeAt": nextChangeAt}})
+		}
+	}
+
+	taken, err := dbclient.AuthAccess.IsUsernameTaken(input.Username, authCred.UserId)
+	if err != nil {
+		msg := "failed to read from database."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if taken {
+		msg := "username is already taken."
+		log.Println(msg)
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	err = dbclient.AuthAccess.UpdateUsername(authCred.UserId, authCred.Username, input.Username, time.Now().Add(policy.ReservationPeriod))
+	if err == customerrors.ErrDuplicateKey {
+		msg := "username is already taken."
+		log.Println(msg)
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if err != nil {
+		msg := "failed to update username."
+		log.Println(msg, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	msg := "successfully changed username."
+	log.Println(msg, "userId:", authCred.UserId)
+	auditutils.Record(c, auditmodels.ActionUsernameChange, auditmodels.OutcomeSuccess, authCred.UserId, authCred.Email, "from "+authCred.Username+" to "+input.Username)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"message": msg, "payload": fiber.Map{"username": input.Username}})
+}
@@ -0,0 +1,100 @@
+package apikeyaccess
+
+import (
+	"context"
+	"log"
+	"time"
+
+	customerrors "github.com/alubhorta/goth/custom/errors"
+	authmodels "github.com/alubhorta/goth/models/auth"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type ApiKeyAccess struct {
+	Collection *mongo.Collection
+}
+
+func (ac *ApiKeyAccess) CreateApiKey(apiKey *authmodels.ApiKey) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := ac.Collection.InsertOne(ctx, apiKey)
+	if mongo.IsDuplicateKeyError(err) {
+		log.Println("failed insert of api key.", err)
+		return customerrors.ErrDuplicateKey
+	}
+	return err
+}
+
+func (ac *ApiKeyAccess) GetApiKeyByPrefix(prefix string) (*authmodels.ApiKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	apiKey := new(authmodels.ApiKey)
+	err := ac.Collection.FindOne(ctx, bson.M{"prefix": prefix}).Decode(apiKey)
+	if err == mongo.ErrNoDocuments {
+		return nil, customerrors.ErrNotFound
+	}
+	return apiKey, err
+}
+
+func (ac *ApiKeyAccess) ListApiKeysOfUser(userId string) ([]*authmodels.ApiKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := ac.Collection.Find(
+		ctx,
+		bson.M{"userId": userId},
+		options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	apiKeys := []*authmodels.ApiKey{}
+	if err := cursor.All(ctx, &apiKeys); err != nil {
+		return nil, err
+	}
+	return apiKeys, nil
+}
+
+func (ac *ApiKeyAccess) DeleteApiKey(userId, keyId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := ac.Collection.DeleteOne(ctx, bson.M{"_id": keyId, "userId": userId})
+	if err != nil {
+		return err
+	} else if result.DeletedCount == 0 {
+		return customerrors.ErrNotFound
+	}
+	return nil
+}
+
+func (ac *ApiKeyAccess) DeleteApiKeysOfUser(userId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := ac.Collection.DeleteMany(ctx, bson.M{"userId": userId})
+	return err
+}
+
+func (ac *ApiKeyAccess) TouchApiKey(keyId string, usedAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := ac.Collection.UpdateOne(ctx, bson.M{"_id": keyId}, bson.M{"$set": bson.M{"lastUsedAt": usedAt}})
+	return err
+}
+
+// MoveApiKeys hands the api keys of a user over to the user it's merged into.
+func (ac *ApiKeyAccess) MoveApiKeys(fromUserId, toUserId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := ac.Collection.UpdateMany(ctx, bson.M{"userId": fromUserId}, bson.M{"$set": bson.M{"userId": toUserId}})
+	return err
+}
@@ -0,0 +1,85 @@
+package auditaccess
+
+import (
+	"context"
+	"time"
+
+	auditmodels "github.com/alubhorta/goth/models/audit"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AuditAccess is append-only on purpose: entries are never updated or deleted.
+type AuditAccess struct {
+	Collection *mongo.Collection
+}
+
+func (ac *AuditAccess) AppendEntry(entry *auditmodels.AuditEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := ac.Collection.InsertOne(ctx, entry)
+	return err
+}
+
+// QueryEntries returns the entries matching query, newest first, along with the
+// total number of matching entries. page is 1-based.
+func (ac *AuditAccess) QueryEntries(query *auditmodels.AuditQuery, page, limit int64) ([]*auditmodels.AuditEntry, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{}
+	if query.ActorId != "" {
+		filter["actorId"] = query.ActorId
+	}
+	if query.Email != "" {
+		filter["email"] = query.Email
+	}
+	if query.Action != "" {
+		filter["action"] = query.Action
+	}
+	if query.Outcome != "" {
+		filter["outcome"] = query.Outcome
+	}
+	if query.Ip != "" {
+		filter["ip"] = query.Ip
+	}
+	if query.MinRiskScore != nil {
+		filter["riskScore"] = bson.M{"$gte": *query.MinRiskScore}
+	}
+	if query.From != nil || query.To != nil {
+		createdAt := bson.M{}
+		if query.From != nil {
+			createdAt["$gte"] = *query.From
+		}
+		if query.To != nil {
+			createdAt["$lte"] = *query.To
+		}
+		filter["createdAt"] = createdAt
+	}
+
+	total, err := ac.Collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	cursor, err := ac.Collection.Find(
+		ctx,
+		filter,
+		options.Find().
+			SetSort(bson.D{{Key: "createdAt", Value: -1}}).
+			SetSkip((page-1)*limit).
+			SetLimit(limit),
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	entries := []*auditmodels.AuditEntry{}
+	if err := cursor.All(ctx, &entries); err != nil {
+		return nil, 0, err
+	}
+	return entries, total, nil
+}
@@ -6,21 +6,47 @@ import (
 	"time"
 
 	customerrors "github.com/alubhorta/goth/custom/errors"
+	outboxaccess "github.com/alubhorta/goth/db/access/outbox"
 	authmodels "github.com/alubhorta/goth/models/auth"
+	eventmodels "github.com/alubhorta/goth/models/event"
+	usermodels "github.com/alubhorta/goth/models/user"
+	validationutils "github.com/alubhorta/goth/utils/validation"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type AuthAccess struct {
 	Collection *mongo.Collection
+	// the email, username and phone are duplicated in the user collection,
+	// UpdateEmail, UpdateUsername and UpdatePhone change both
+	UserCollection *mongo.Collection
+	// replaced usernames, kept for their previous owner for a while
+	ReservationCollection *mongo.Collection
+	Outbox                *outboxaccess.OutboxAccess
 }
 
 func (ac *AuthAccess) CreateNewUserAuthCredential(credential *authmodels.UserAuthCredential) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	res, err := ac.Collection.InsertOne(ctx, &credential)
+	credential.EmailKey = validationutils.GetEmailKey(credential.Email)
+
+	// NOTE: never put the hashed password in an event payload
+	event := outboxaccess.NewEvent(eventmodels.TypeCredentialCreated, credential.UserId, map[string]interface{}{
+		"email": credential.Email,
+	})
+
+	var insertedId interface{}
+	err := ac.Outbox.WriteWithEvents(ctx, func(ctx context.Context) error {
+		res, err := ac.Collection.InsertOne(ctx, &credential)
+		if err != nil {
+			return err
+		}
+		insertedId = res.InsertedID
+		return nil
+	}, event)
 	if err != nil {
 		if mongo.IsDuplicateKeyError(err) {
 			log.Println("failed insert of user auth credential.", err)
@@ -29,7 +55,7 @@ func (ac *AuthAccess) CreateNewUserAuthCredential(credential *authmodels.UserAut
 		return err
 	}
 
-	log.Printf("created authCred with mongo_id=%v\n ; userId=%v\n", res.InsertedID, credential.UserId)
+	log.Printf("created authCred with mongo_id=%v\n ; userId=%v\n", insertedId, credential.UserId)
 
 	return nil
 }
@@ -39,7 +65,22 @@ func (ac *AuthAccess) GetAuthCredentialByEmail(email string) (*authmodels.UserAu
 	defer cancel()
 
 	authCred := new(authmodels.UserAuthCredential)
-	result := ac.Collection.FindOne(ctx, bson.M{"email": email})
+	result := ac.Collection.FindOne(ctx, bson.M{"emailKey": validationutils.GetEmailKey(email)})
+	err := result.Decode(authCred)
+	if err == mongo.ErrNoDocuments {
+		return nil, customerrors.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return authCred, nil
+}
+
+func (ac *AuthAccess) GetAuthCredentialByUserId(userId string) (*authmodels.UserAuthCredential, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	authCred := new(authmodels.UserAuthCredential)
+	result := ac.Collection.FindOne(ctx, bson.M{"_id": userId})
 	err := result.Decode(authCred)
 	if err == mongo.ErrNoDocuments {
 		return nil, customerrors.ErrNotFound
@@ -49,26 +90,64 @@ func (ac *AuthAccess) GetAuthCredentialByEmail(email string) (*authmodels.UserAu
 	return authCred, nil
 }
 
-func (ac *AuthAccess) UpdateUserAuthPassword(email, newHashedPassword string) error {
+// UpdateUserAuthPassword also keeps the replaced hash in the password history,
+// trimmed to the last historySize ones.
+func (ac *AuthAccess) UpdateUserAuthPassword(email, newHashedPassword string, historySize int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	authCred, err := ac.GetAuthCredentialByEmail(email)
+	if err != nil {
+		return err
+	}
+	event := outboxaccess.NewEvent(eventmodels.TypeCredentialPasswordChanged, authCred.UserId, map[string]interface{}{
+		"email": email,
+	})
+
+	update := bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: "hashedPassword", Value: newHashedPassword},
+			{Key: "passwordResetRequired", Value: false},
+			{Key: "modifiedAt", Value: time.Now()},
+		}},
+	}
+	if historySize > 0 && authCred.HashedPassword != "" {
+		update = append(update, bson.E{Key: "$push", Value: bson.D{
+			{Key: "passwordHistory", Value: bson.D{
+				{Key: "$each", Value: bson.A{authCred.HashedPassword}},
+				{Key: "$slice", Value: -historySize},
+			}},
+		}})
+	}
+
+	return ac.Outbox.WriteWithEvents(ctx, func(ctx context.Context) error {
+		result, err := ac.Collection.UpdateOne(ctx, bson.M{"_id": authCred.UserId}, update)
+		if err != nil {
+			return err
+		} else if result.MatchedCount == 0 {
+			return customerrors.ErrNotFound
+		}
+		return nil
+	}, event)
+}
+
+// RehashPassword replaces a hash with one of the same password made with newer
+// parameters, unless the password was changed meanwhile. it's no change to the
+// credential, so no event is written.
+func (ac *AuthAccess) RehashPassword(userId, oldHashedPassword, newHashedPassword string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	result, err := ac.Collection.UpdateOne(
 		ctx,
-		bson.M{"email": email},
-		bson.D{
-			{"$set", bson.D{
-				{Key: "hashedPassword", Value: newHashedPassword},
-				{Key: "modifiedAt", Value: time.Now()},
-			}},
-		},
+		bson.M{"_id": userId, "hashedPassword": oldHashedPassword},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "hashedPassword", Value: newHashedPassword}}}},
 	)
 	if err != nil {
 		return err
 	} else if result.MatchedCount == 0 {
 		return customerrors.ErrNotFound
 	}
-
 	return nil
 }
 
@@ -76,11 +155,438 @@ func (ac *AuthAccess) DeleteAnAuthCredential(userId string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	result, err := ac.Collection.DeleteOne(ctx, bson.M{"_id": userId})
+	event := outboxaccess.NewEvent(eventmodels.TypeCredentialDeleted, userId, map[string]interface{}{})
+
+	return ac.Outbox.WriteWithEvents(ctx, func(ctx context.Context) error {
+		result, err := ac.Collection.DeleteOne(ctx, bson.M{"_id": userId})
+		if err != nil {
+			return err
+		} else if result.DeletedCount == 0 {
+			return customerrors.ErrNotFound
+		}
+		return nil
+	}, event)
+}
+
+func (ac *AuthAccess) AddRole(userId, role string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	event := outboxaccess.NewEvent(eventmodels.TypeCredentialRoleGranted, userId, map[string]interface{}{
+		"role": role,
+	})
+
+	return ac.Outbox.WriteWithEvents(ctx, func(ctx context.Context) error {
+		result, err := ac.Collection.UpdateOne(
+			ctx,
+			bson.M{"_id": userId},
+			bson.D{
+				{Key: "$addToSet", Value: bson.D{{Key: "roles", Value: role}}},
+				{Key: "$set", Value: bson.D{{Key: "modifiedAt", Value: time.Now()}}},
+			},
+		)
+		if err != nil {
+			return err
+		} else if result.MatchedCount == 0 {
+			return customerrors.ErrNotFound
+		}
+		return nil
+	}, event)
+}
+
+func (ac *AuthAccess) RemoveRole(userId, role string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	event := outboxaccess.NewEvent(eventmodels.TypeCredentialRoleRevoked, userId, map[string]interface{}{
+		"role": role,
+	})
+
+	return ac.Outbox.WriteWithEvents(ctx, func(ctx context.Context) error {
+		result, err := ac.Collection.UpdateOne(
+			ctx,
+			bson.M{"_id": userId},
+			bson.D{
+				{Key: "$pull", Value: bson.D{{Key: "roles", Value: role}}},
+				{Key: "$set", Value: bson.D{{Key: "modifiedAt", Value: time.Now()}}},
+			},
+		)
+		if err != nil {
+			return err
+		} else if result.MatchedCount == 0 {
+			return customerrors.ErrNotFound
+		}
+		return nil
+	}, event)
+}
+
+func (ac *AuthAccess) SetDisabled(userId string, disabled bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	eventType := eventmodels.TypeCredentialEnabled
+	if disabled {
+		eventType = eventmodels.TypeCredentialDisabled
+	}
+	event := outboxaccess.NewEvent(eventType, userId, map[string]interface{}{})
+
+	return ac.Outbox.WriteWithEvents(ctx, func(ctx context.Context) error {
+		result, err := ac.Collection.UpdateOne(
+			ctx,
+			bson.M{"_id": userId},
+			bson.D{
+				{Key: "$set", Value: bson.D{
+					{Key: "disabled", Value: disabled},
+					{Key: "modifiedAt", Value: time.Now()},
+				}},
+			},
+		)
+		if err != nil {
+			return err
+		} else if result.MatchedCount == 0 {
+			return customerrors.ErrNotFound
+		}
+		return nil
+	}, event)
+}
+
+func (ac *AuthAccess) RequirePasswordReset(userId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	event := outboxaccess.NewEvent(eventmodels.TypeCredentialResetRequired, userId, map[string]interface{}{})
+
+	return ac.Outbox.WriteWithEvents(ctx, func(ctx context.Context) error {
+		result, err := ac.Collection.UpdateOne(
+			ctx,
+			bson.M{"_id": userId},
+			bson.D{
+				{Key: "$set", Value: bson.D{
+					{Key: "passwordResetRequired", Value: true},
+					{Key: "modifiedAt", Value: time.Now()},
+				}},
+			},
+		)
+		if err != nil {
+			return err
+		} else if result.MatchedCount == 0 {
+			return customerrors.ErrNotFound
+		}
+		return nil
+	}, event)
+}
+
+func (ac *AuthAccess) SetMfaEnabled(userId string, enabled bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	eventType := eventmodels.TypeCredentialMfaDisabled
+	if enabled {
+		eventType = eventmodels.TypeCredentialMfaEnabled
+	}
+	event := outboxaccess.NewEvent(eventType, userId, map[string]interface{}{})
+
+	return ac.Outbox.WriteWithEvents(ctx, func(ctx context.Context) error {
+		result, err := ac.Collection.UpdateOne(
+			ctx,
+			bson.M{"_id": userId},
+			bson.D{
+				{Key: "$set", Value: bson.D{
+					{Key: "mfaEnabled", Value: enabled},
+					{Key: "modifiedAt", Value: time.Now()},
+				}},
+			},
+		)
+		if err != nil {
+			return err
+		} else if result.MatchedCount == 0 {
+			return customerrors.ErrNotFound
+		}
+		return nil
+	}, event)
+}
+
+// UpdateEmail changes the email of the credential and the user info together,
+// returning customerrors.ErrDuplicateKey if either unique email index rejects
+// it. without transactions, the credential is changed back when the user info
+// can't be updated.
+func (ac *AuthAccess) UpdateEmail(userId, oldEmail, newEmail string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	event := outboxaccess.NewEvent(eventmodels.TypeCredentialEmailChanged, userId, map[string]interface{}{
+		"oldEmail": oldEmail,
+		"newEmail": newEmail,
+	})
+
+	setEmail := func(ctx context.Context, collection *mongo.Collection, email string) error {
+		fields := bson.D{
+			{Key: "email", Value: email},
+			{Key: "modifiedAt", Value: time.Now()},
+		}
+		if collection == ac.Collection {
+			fields = append(fields, bson.E{Key: "emailKey", Value: validationutils.GetEmailKey(email)})
+		}
+		result, err := collection.UpdateOne(ctx, bson.M{"_id": userId}, bson.D{{Key: "$set", Value: fields}})
+		if err != nil {
+			return err
+		} else if result.MatchedCount == 0 {
+			return customerrors.ErrNotFound
+		}
+		return nil
+	}
+
+	err := ac.Outbox.WriteWithEvents(ctx, func(ctx context.Context) error {
+		if err := setEmail(ctx, ac.Collection, newEmail); err != nil {
+			return err
+		}
+		if err := setEmail(ctx, ac.UserCollection, newEmail); err != nil {
+			if !ac.Outbox.SupportsTransactions {
+				if rollbackErr := setEmail(ctx, ac.Collection, oldEmail); rollbackErr != nil {
+					log.Println("failed to roll back email of auth credential.", rollbackErr, "userId:", userId)
+				}
+			}
+			return err
+		}
+		return nil
+	}, event)
+	if mongo.IsDuplicateKeyError(err) {
+		log.Println("failed update of email.", err)
+		return customerrors.ErrDuplicateKey
+	}
+	return err
+}
+
+// ListAuthCredentials reads all credentials, it's meant for maintenance jobs
+// like BackfillEmailKeys, not for requests.
+func (ac *AuthAccess) ListAuthCredentials() ([]*authmodels.UserAuthCredential, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	cursor, err := ac.Collection.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	authCreds := []*authmodels.UserAuthCredential{}
+	if err := cursor.All(ctx, &authCreds); err != nil {
+		return nil, err
+	}
+	return authCreds, nil
+}
+
+// SetNormalizedEmail replaces the email of a credential and its user info with
+// its normalized form, and sets the key of it. the address itself doesn't
+// change, so no event is written.
+func (ac *AuthAccess) SetNormalizedEmail(userId, normalized string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := ac.Outbox.WriteWithEvents(ctx, func(ctx context.Context) error {
+		_, err := ac.Collection.UpdateOne(ctx, bson.M{"_id": userId}, bson.D{
+			{Key: "$set", Value: bson.D{
+				{Key: "email", Value: normalized},
+				{Key: "emailKey", Value: validationutils.GetEmailKey(normalized)},
+			}},
+		})
+		if err != nil {
+			return err
+		}
+		_, err = ac.UserCollection.UpdateOne(ctx, bson.M{"_id": userId}, bson.D{
+			{Key: "$set", Value: bson.D{{Key: "email", Value: normalized}}},
+		})
+		return err
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		log.Println("failed to normalize email.", err, "userId:", userId)
+		return customerrors.ErrDuplicateKey
+	}
+	return err
+}
+
+// BackfillEmailKeys normalizes the emails of credentials stored before emails
+// were normalized, or under other EMAIL_PROVIDER_RULES. it returns
+// customerrors.ErrDuplicateKey when two accounts turn out to share a key, those
+// have to be merged with the migrate-emails command first.
+func (ac *AuthAccess) BackfillEmailKeys() error {
+	authCreds, err := ac.ListAuthCredentials()
 	if err != nil {
 		return err
-	} else if result.DeletedCount == 0 {
-		return customerrors.ErrNotFound
+	}
+
+	for _, authCred := range authCreds {
+		normalized := validationutils.NormalizeEmail(authCred.Email)
+		if normalized == "" {
+			log.Println("WARNING: can not normalize invalid email of auth credential.", "userId:", authCred.UserId)
+			continue
+		} else if normalized == authCred.Email && validationutils.GetEmailKey(normalized) == authCred.EmailKey {
+			continue
+		}
+		if err := ac.SetNormalizedEmail(authCred.UserId, normalized); err != nil {
+			return err
+		}
 	}
 	return nil
 }
+
+func (ac *AuthAccess) GetAuthCredentialByUsername(username string) (*authmodels.UserAuthCredential, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	authCred := new(authmodels.UserAuthCredential)
+	err := ac.Collection.FindOne(ctx, bson.M{"username": username}).Decode(authCred)
+	if err == mongo.ErrNoDocuments {
+		return nil, customerrors.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return authCred, nil
+}
+
+// IsUsernameTaken tells if a username belongs to, or is still reserved for,
+// another user than userId.
+func (ac *AuthAccess) IsUsernameTaken(username, userId string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	count, err := ac.Collection.CountDocuments(ctx, bson.M{"username": username, "_id": bson.M{"$ne": userId}})
+	if err != nil || count > 0 {
+		return count > 0, err
+	}
+	// expired reservations are only dropped by the ttl monitor once a minute
+	count, err = ac.ReservationCollection.CountDocuments(ctx, bson.M{
+		"_id":       username,
+		"userId":    bson.M{"$ne": userId},
+		"expiresAt": bson.M{"$gt": time.Now()},
+	})
+	return count > 0, err
+}
+
+// UpdateUsername changes the username of the credential and the user info
+// together, and reserves the old one for the user until reservedUntil. it
+// returns customerrors.ErrDuplicateKey if the new username was taken meanwhile.
+func (ac *AuthAccess) UpdateUsername(userId, oldUsername, newUsername string, reservedUntil time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	event := outboxaccess.NewEvent(eventmodels.TypeCredentialUsernameChanged, userId, map[string]interface{}{
+		"oldUsername": oldUsername,
+		"newUsername": newUsername,
+	})
+
+	now := time.Now()
+	err := ac.Outbox.WriteWithEvents(ctx, func(ctx context.Context) error {
+		result, err := ac.Collection.UpdateOne(ctx, bson.M{"_id": userId}, bson.D{
+			{Key: "$set", Value: bson.D{
+				{Key: "username", Value: newUsername},
+				{Key: "usernameChangedAt", Value: now},
+				{Key: "modifiedAt", Value: now},
+			}},
+		})
+		if err != nil {
+			return err
+		} else if result.MatchedCount == 0 {
+			return customerrors.ErrNotFound
+		}
+
+		_, err = ac.UserCollection.UpdateOne(ctx, bson.M{"_id": userId}, bson.D{
+			{Key: "$set", Value: bson.D{
+				{Key: "username", Value: newUsername},
+				{Key: "modifiedAt", Value: now},
+			}},
+		})
+		if err != nil {
+			if !ac.Outbox.SupportsTransactions {
+				rollback := bson.M{"$unset": bson.M{"username": ""}}
+				if oldUsername != "" {
+					rollback = bson.M{"$set": bson.M{"username": oldUsername}}
+				}
+				if _, rollbackErr := ac.Collection.UpdateOne(ctx, bson.M{"_id": userId}, rollback); rollbackErr != nil {
+					log.Println("failed to roll back username of auth credential.", rollbackErr, "userId:", userId)
+				}
+			}
+			return err
+		}
+
+		// a user taking back its own reserved username frees the reservation
+		if _, err := ac.ReservationCollection.DeleteOne(ctx, bson.M{"_id": newUsername, "userId": userId}); err != nil {
+			return err
+		}
+		if oldUsername == "" || !reservedUntil.After(now) {
+			return nil
+		}
+		_, err = ac.ReservationCollection.ReplaceOne(
+			ctx,
+			bson.M{"_id": oldUsername},
+			&usermodels.UsernameReservation{Username: oldUsername, UserId: userId, ExpiresAt: reservedUntil},
+			options.Replace().SetUpsert(true),
+		)
+		return err
+	}, event)
+	if mongo.IsDuplicateKeyError(err) {
+		log.Println("failed update of username.", err)
+		return customerrors.ErrDuplicateKey
+	}
+	return err
+}
+
+func (ac *AuthAccess) GetAuthCredentialByPhone(phone string) (*authmodels.UserAuthCredential, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	authCred := new(authmodels.UserAuthCredential)
+	err := ac.Collection.FindOne(ctx, bson.M{"phone": phone}).Decode(authCred)
+	if err == mongo.ErrNoDocuments {
+		return nil, customerrors.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return authCred, nil
+}
+
+// UpdatePhone sets the verified phone number of the credential and the user
+// info together, an empty newPhone removes it. it returns
+// customerrors.ErrDuplicateKey if another user has the phone number.
+func (ac *AuthAccess) UpdatePhone(userId, oldPhone, newPhone string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	event := outboxaccess.NewEvent(eventmodels.TypeCredentialPhoneChanged, userId, map[string]interface{}{
+		"oldPhone": oldPhone,
+		"newPhone": newPhone,
+	})
+
+	setPhone := func(ctx context.Context, collection *mongo.Collection, phone string) error {
+		update := bson.M{"$set": bson.M{"phone": phone, "modifiedAt": time.Now()}}
+		if phone == "" {
+			update = bson.M{"$unset": bson.M{"phone": ""}, "$set": bson.M{"modifiedAt": time.Now()}}
+		}
+		result, err := collection.UpdateOne(ctx, bson.M{"_id": userId}, update)
+		if err != nil {
+			return err
+		} else if result.MatchedCount == 0 {
+			return customerrors.ErrNotFound
+		}
+		return nil
+	}
+
+	err := ac.Outbox.WriteWithEvents(ctx, func(ctx context.Context) error {
+		if err := setPhone(ctx, ac.Collection, newPhone); err != nil {
+			return err
+		}
+		if err := setPhone(ctx, ac.UserCollection, newPhone); err != nil {
+			if !ac.Outbox.SupportsTransactions {
+				if rollbackErr := setPhone(ctx, ac.Collection, oldPhone); rollbackErr != nil {
+					log.Println("failed to roll back phone of auth credential.", rollbackErr, "userId:", userId)
+				}
+			}
+			return err
+		}
+		return nil
+	}, event)
+	if mongo.IsDuplicateKeyError(err) {
+		log.Println("failed update of phone.", err)
+		return customerrors.ErrDuplicateKey
+	}
+	return err
+}
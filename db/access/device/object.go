@@ -0,0 +1,95 @@
+package deviceaccess
+
+import (
+	"context"
+	"time"
+
+	customerrors "github.com/alubhorta/goth/custom/errors"
+	authmodels "github.com/alubhorta/goth/models/auth"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type DeviceAccess struct {
+	Collection *mongo.Collection
+}
+
+func GetDeviceId(userId, fingerprint string) string {
+	return userId + ":" + fingerprint
+}
+
+// TouchDevice records a login from device, telling if it wasn't known yet.
+func (ac *DeviceAccess) TouchDevice(device *authmodels.KnownDevice) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := ac.Collection.UpdateOne(
+		ctx,
+		bson.M{"_id": device.DeviceId},
+		bson.M{
+			"$set": bson.M{"lastIp": device.LastIp, "lastSeenAt": device.LastSeenAt},
+			"$setOnInsert": bson.M{
+				"userId":      device.UserId,
+				"name":        device.Name,
+				"ipSubnet":    device.IpSubnet,
+				"firstSeenAt": device.FirstSeenAt,
+			},
+		},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.UpsertedCount > 0, nil
+}
+
+func (ac *DeviceAccess) CountDevicesOfUser(userId string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return ac.Collection.CountDocuments(ctx, bson.M{"userId": userId})
+}
+
+func (ac *DeviceAccess) ListDevicesOfUser(userId string) ([]*authmodels.KnownDevice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := ac.Collection.Find(
+		ctx,
+		bson.M{"userId": userId},
+		options.Find().SetSort(bson.D{{Key: "lastSeenAt", Value: -1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	devices := []*authmodels.KnownDevice{}
+	if err := cursor.All(ctx, &devices); err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+// DeleteDevice forgets a device, so the next login from it counts as new.
+func (ac *DeviceAccess) DeleteDevice(userId, deviceId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := ac.Collection.DeleteOne(ctx, bson.M{"_id": deviceId, "userId": userId})
+	if err != nil {
+		return err
+	} else if result.DeletedCount == 0 {
+		return customerrors.ErrNotFound
+	}
+	return nil
+}
+
+func (ac *DeviceAccess) DeleteDevicesOfUser(userId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := ac.Collection.DeleteMany(ctx, bson.M{"userId": userId})
+	return err
+}
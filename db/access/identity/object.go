@@ -0,0 +1,130 @@
+package identityaccess
+
+import (
+	"context"
+	"log"
+	"time"
+
+	customerrors "github.com/alubhorta/goth/custom/errors"
+	outboxaccess "github.com/alubhorta/goth/db/access/outbox"
+	authmodels "github.com/alubhorta/goth/models/auth"
+	eventmodels "github.com/alubhorta/goth/models/event"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type IdentityAccess struct {
+	Collection *mongo.Collection
+	Outbox     *outboxaccess.OutboxAccess
+}
+
+func GetIdentityId(provider, subject string) string {
+	return provider + ":" + subject
+}
+
+func (ac *IdentityAccess) CreateIdentity(identity *authmodels.UserIdentity) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	event := outboxaccess.NewEvent(eventmodels.TypeIdentityLinked, identity.UserId, map[string]interface{}{
+		"provider": identity.Provider,
+		"email":    identity.Email,
+	})
+	err := ac.Outbox.WriteWithEvents(ctx, func(ctx context.Context) error {
+		_, err := ac.Collection.InsertOne(ctx, identity)
+		return err
+	}, event)
+	if mongo.IsDuplicateKeyError(err) {
+		log.Println("failed insert of user identity.", err)
+		return customerrors.ErrDuplicateKey
+	}
+	return err
+}
+
+func (ac *IdentityAccess) GetIdentity(provider, subject string) (*authmodels.UserIdentity, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	identity := new(authmodels.UserIdentity)
+	err := ac.Collection.FindOne(ctx, bson.M{"_id": GetIdentityId(provider, subject)}).Decode(identity)
+	if err == mongo.ErrNoDocuments {
+		return nil, customerrors.ErrNotFound
+	}
+	return identity, err
+}
+
+func (ac *IdentityAccess) ListIdentitiesOfUser(userId string) ([]*authmodels.UserIdentity, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := ac.Collection.Find(
+		ctx,
+		bson.M{"userId": userId},
+		options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	identities := []*authmodels.UserIdentity{}
+	if err := cursor.All(ctx, &identities); err != nil {
+		return nil, err
+	}
+	return identities, nil
+}
+
+func (ac *IdentityAccess) DeleteIdentity(userId, provider string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	event := outboxaccess.NewEvent(eventmodels.TypeIdentityUnlinked, userId, map[string]interface{}{
+		"provider": provider,
+	})
+	return ac.Outbox.WriteWithEvents(ctx, func(ctx context.Context) error {
+		result, err := ac.Collection.DeleteOne(ctx, bson.M{"userId": userId, "provider": provider})
+		if err != nil {
+			return err
+		} else if result.DeletedCount == 0 {
+			return customerrors.ErrNotFound
+		}
+		return nil
+	}, event)
+}
+
+// DeleteIdentitiesOfUser drops all provider links of a deleted user.
+func (ac *IdentityAccess) DeleteIdentitiesOfUser(userId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := ac.Collection.DeleteMany(ctx, bson.M{"userId": userId})
+	return err
+}
+
+// MoveIdentities hands the provider links of a user over to the user it's
+// merged into, except for providers that one is linked to already. it returns
+// how many were moved, the rest stay with fromUserId.
+func (ac *IdentityAccess) MoveIdentities(fromUserId, toUserId string) (int64, error) {
+	identities, err := ac.ListIdentitiesOfUser(toUserId)
+	if err != nil {
+		return 0, err
+	}
+	linked := []string{}
+	for _, identity := range identities {
+		linked = append(linked, identity.Provider)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := ac.Collection.UpdateMany(
+		ctx,
+		bson.M{"userId": fromUserId, "provider": bson.M{"$nin": linked}},
+		bson.M{"$set": bson.M{"userId": toUserId}},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
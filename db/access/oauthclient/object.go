@@ -0,0 +1,132 @@
+package oauthclientaccess
+
+import (
+	"context"
+	"log"
+	"time"
+
+	customerrors "github.com/alubhorta/goth/custom/errors"
+	oauthmodels "github.com/alubhorta/goth/models/oauth"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type OauthClientAccess struct {
+	Collection        *mongo.Collection
+	ConsentCollection *mongo.Collection
+}
+
+func GetConsentId(clientId, userId string) string {
+	return clientId + ":" + userId
+}
+
+func (ac *OauthClientAccess) CreateClient(client *oauthmodels.OauthClient) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := ac.Collection.InsertOne(ctx, client)
+	if mongo.IsDuplicateKeyError(err) {
+		log.Println("failed insert of oauth client.", err)
+		return customerrors.ErrDuplicateKey
+	}
+	return err
+}
+
+func (ac *OauthClientAccess) GetClient(clientId string) (*oauthmodels.OauthClient, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client := new(oauthmodels.OauthClient)
+	err := ac.Collection.FindOne(ctx, bson.M{"_id": clientId}).Decode(client)
+	if err == mongo.ErrNoDocuments {
+		return nil, customerrors.ErrNotFound
+	}
+	return client, err
+}
+
+func (ac *OauthClientAccess) ListClients() ([]*oauthmodels.OauthClient, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := ac.Collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	clients := []*oauthmodels.OauthClient{}
+	if err := cursor.All(ctx, &clients); err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+func (ac *OauthClientAccess) UpdateClientScopes(clientId string, scopes []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := ac.Collection.UpdateOne(ctx, bson.M{"_id": clientId}, bson.M{"$set": bson.M{"scopes": scopes}})
+	if err != nil {
+		return err
+	} else if result.MatchedCount == 0 {
+		return customerrors.ErrNotFound
+	}
+	return nil
+}
+
+// DeleteClient removes a client along with the consents granted to it.
+func (ac *OauthClientAccess) DeleteClient(clientId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := ac.Collection.DeleteOne(ctx, bson.M{"_id": clientId})
+	if err != nil {
+		return err
+	} else if result.DeletedCount == 0 {
+		return customerrors.ErrNotFound
+	}
+
+	_, err = ac.ConsentCollection.DeleteMany(ctx, bson.M{"clientId": clientId})
+	return err
+}
+
+func (ac *OauthClientAccess) GetConsent(clientId, userId string) (*oauthmodels.OauthConsent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	consent := new(oauthmodels.OauthConsent)
+	err := ac.ConsentCollection.FindOne(ctx, bson.M{"_id": GetConsentId(clientId, userId)}).Decode(consent)
+	if err == mongo.ErrNoDocuments {
+		return nil, customerrors.ErrNotFound
+	}
+	return consent, err
+}
+
+// SaveConsent adds scopes to the consent of userId for clientId.
+func (ac *OauthClientAccess) SaveConsent(clientId, userId string, scopes []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	_, err := ac.ConsentCollection.UpdateOne(
+		ctx,
+		bson.M{"_id": GetConsentId(clientId, userId)},
+		bson.M{
+			"$addToSet":    bson.M{"scopes": bson.M{"$each": scopes}},
+			"$set":         bson.M{"modifiedAt": now},
+			"$setOnInsert": bson.M{"clientId": clientId, "userId": userId, "createdAt": now},
+		},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// DeleteConsentsOfUser drops the consents of a deleted user.
+func (ac *OauthClientAccess) DeleteConsentsOfUser(userId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := ac.ConsentCollection.DeleteMany(ctx, bson.M{"userId": userId})
+	return err
+}
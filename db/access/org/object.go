@@ -0,0 +1,462 @@
+package orgaccess
+
+import (
+	"context"
+	"log"
+	"time"
+
+	customerrors "github.com/alubhorta/goth/custom/errors"
+	outboxaccess "github.com/alubhorta/goth/db/access/outbox"
+	eventmodels "github.com/alubhorta/goth/models/event"
+	orgmodels "github.com/alubhorta/goth/models/org"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type OrgAccess struct {
+	Collection           *mongo.Collection
+	MembershipCollection *mongo.Collection
+	InvitationCollection *mongo.Collection
+	Outbox               *outboxaccess.OutboxAccess
+}
+
+func GetMembershipId(orgId, userId string) string {
+	return orgId + ":" + userId
+}
+
+// CreateAnOrg stores org together with the membership of its owner.
+func (ac *OrgAccess) CreateAnOrg(org *orgmodels.Organization) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	owner := &orgmodels.Membership{
+		MembershipId: GetMembershipId(org.OrgId, org.OwnerId),
+		OrgId:        org.OrgId,
+		UserId:       org.OwnerId,
+		Role:         orgmodels.OrgRoleOwner,
+		CreatedAt:    org.CreatedAt,
+		ModifiedAt:   org.CreatedAt,
+	}
+	event := outboxaccess.NewEvent(eventmodels.TypeOrgCreated, org.OwnerId, map[string]interface{}{
+		"orgId": org.OrgId,
+		"name":  org.Name,
+	})
+
+	err := ac.Outbox.WriteWithEvents(ctx, func(ctx context.Context) error {
+		if _, err := ac.Collection.InsertOne(ctx, org); err != nil {
+			return err
+		}
+		_, err := ac.MembershipCollection.InsertOne(ctx, owner)
+		return err
+	}, event)
+	if mongo.IsDuplicateKeyError(err) {
+		log.Println("failed insert of org.", err)
+		return customerrors.ErrDuplicateKey
+	}
+	return err
+}
+
+func (ac *OrgAccess) GetAnOrg(orgId string) (*orgmodels.Organization, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	org := new(orgmodels.Organization)
+	err := ac.Collection.FindOne(ctx, bson.M{"_id": orgId}).Decode(org)
+	if err == mongo.ErrNoDocuments {
+		return nil, customerrors.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return org, nil
+}
+
+func (ac *OrgAccess) GetOrgsByIds(orgIds []string) ([]*orgmodels.Organization, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := ac.Collection.Find(ctx, bson.M{"_id": bson.M{"$in": orgIds}})
+	if err != nil {
+		return nil, err
+	}
+
+	orgs := []*orgmodels.Organization{}
+	if err := cursor.All(ctx, &orgs); err != nil {
+		return nil, err
+	}
+	return orgs, nil
+}
+
+func (ac *OrgAccess) UpdateAnOrg(orgId string, input *orgmodels.UpdateOrgInput) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	event := outboxaccess.NewEvent(eventmodels.TypeOrgUpdated, "", map[string]interface{}{
+		"orgId": orgId,
+		"name":  input.Name,
+	})
+
+	return ac.Outbox.WriteWithEvents(ctx, func(ctx context.Context) error {
+		result, err := ac.Collection.UpdateOne(
+			ctx,
+			bson.M{"_id": orgId},
+			bson.D{
+				{Key: "$set", Value: bson.D{
+					{Key: "name", Value: input.Name},
+					{Key: "modifiedAt", Value: time.Now()},
+				}},
+			},
+		)
+		if err != nil {
+			return err
+		} else if result.MatchedCount == 0 {
+			return customerrors.ErrNotFound
+		}
+		return nil
+	}, event)
+}
+
+// DeleteAnOrg removes org along with all of its memberships and invitations.
+func (ac *OrgAccess) DeleteAnOrg(orgId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	event := outboxaccess.NewEvent(eventmodels.TypeOrgDeleted, "", map[string]interface{}{
+		"orgId": orgId,
+	})
+
+	return ac.Outbox.WriteWithEvents(ctx, func(ctx context.Context) error {
+		result, err := ac.Collection.DeleteOne(ctx, bson.M{"_id": orgId})
+		if err != nil {
+			return err
+		} else if result.DeletedCount == 0 {
+			return customerrors.ErrNotFound
+		}
+		if _, err := ac.MembershipCollection.DeleteMany(ctx, bson.M{"orgId": orgId}); err != nil {
+			return err
+		}
+		_, err = ac.InvitationCollection.DeleteMany(ctx, bson.M{"orgId": orgId})
+		return err
+	}, event)
+}
+
+func (ac *OrgAccess) GetMembership(orgId, userId string) (*orgmodels.Membership, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	membership := new(orgmodels.Membership)
+	err := ac.MembershipCollection.FindOne(ctx, bson.M{"_id": GetMembershipId(orgId, userId)}).Decode(membership)
+	if err == mongo.ErrNoDocuments {
+		return nil, customerrors.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return membership, nil
+}
+
+func (ac *OrgAccess) ListMembershipsOfUser(userId string) ([]*orgmodels.Membership, error) {
+	return ac.findMemberships(bson.M{"userId": userId})
+}
+
+func (ac *OrgAccess) ListMembersOfOrg(orgId string) ([]*orgmodels.Membership, error) {
+	return ac.findMemberships(bson.M{"orgId": orgId})
+}
+
+func (ac *OrgAccess) findMemberships(filter bson.M) ([]*orgmodels.Membership, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := ac.MembershipCollection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	memberships := []*orgmodels.Membership{}
+	if err := cursor.All(ctx, &memberships); err != nil {
+		return nil, err
+	}
+	return memberships, nil
+}
+
+func (ac *OrgAccess) CountOwners(orgId string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return ac.MembershipCollection.CountDocuments(ctx, bson.M{"orgId": orgId, "role": orgmodels.OrgRoleOwner})
+}
+
+func (ac *OrgAccess) UpdateMembershipRole(orgId, userId, role string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	event := outboxaccess.NewEvent(eventmodels.TypeOrgMemberUpdated, userId, map[string]interface{}{
+		"orgId": orgId,
+		"role":  role,
+	})
+
+	return ac.Outbox.WriteWithEvents(ctx, func(ctx context.Context) error {
+		result, err := ac.MembershipCollection.UpdateOne(
+			ctx,
+			bson.M{"_id": GetMembershipId(orgId, userId)},
+			bson.D{
+				{Key: "$set", Value: bson.D{
+					{Key: "role", Value: role},
+					{Key: "modifiedAt", Value: time.Now()},
+				}},
+			},
+		)
+		if err != nil {
+			return err
+		} else if result.MatchedCount == 0 {
+			return customerrors.ErrNotFound
+		}
+		return nil
+	}, event)
+}
+
+func (ac *OrgAccess) RemoveMembership(orgId, userId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	event := outboxaccess.NewEvent(eventmodels.TypeOrgMemberRemoved, userId, map[string]interface{}{
+		"orgId": orgId,
+	})
+
+	return ac.Outbox.WriteWithEvents(ctx, func(ctx context.Context) error {
+		result, err := ac.MembershipCollection.DeleteOne(ctx, bson.M{"_id": GetMembershipId(orgId, userId)})
+		if err != nil {
+			return err
+		} else if result.DeletedCount == 0 {
+			return customerrors.ErrNotFound
+		}
+		return nil
+	}, event)
+}
+
+// DeleteMembershipsOfUser removes every membership of a deleted user, the
+// orgs themselves stay.
+func (ac *OrgAccess) DeleteMembershipsOfUser(userId string) error {
+	memberships, err := ac.ListMembershipsOfUser(userId)
+	if err != nil || len(memberships) == 0 {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	events := []*eventmodels.Event{}
+	for _, membership := range memberships {
+		events = append(events, outboxaccess.NewEvent(eventmodels.TypeOrgMemberRemoved, userId, map[string]interface{}{
+			"orgId": membership.OrgId,
+		}))
+	}
+	return ac.Outbox.WriteWithEvents(ctx, func(ctx context.Context) error {
+		_, err := ac.MembershipCollection.DeleteMany(ctx, bson.M{"userId": userId})
+		return err
+	}, events...)
+}
+
+func (ac *OrgAccess) CreateInvitation(invitation *orgmodels.Invitation) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := ac.InvitationCollection.InsertOne(ctx, invitation)
+	return err
+}
+
+func (ac *OrgAccess) ListPendingInvitations(orgId string) ([]*orgmodels.Invitation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := ac.InvitationCollection.Find(
+		ctx,
+		bson.M{"orgId": orgId, "acceptedAt": nil, "expiresAt": bson.M{"$gt": time.Now()}},
+		options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	invitations := []*orgmodels.Invitation{}
+	if err := cursor.All(ctx, &invitations); err != nil {
+		return nil, err
+	}
+	return invitations, nil
+}
+
+func (ac *OrgAccess) DeleteInvitation(orgId, invitationId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := ac.InvitationCollection.DeleteOne(ctx, bson.M{"_id": invitationId, "orgId": orgId})
+	if err != nil {
+		return err
+	} else if result.DeletedCount == 0 {
+		return customerrors.ErrNotFound
+	}
+	return nil
+}
+
+// AcceptInvitation consumes the pending invitation matching hashedToken and
+// email, and adds userId to the org with the invited role. it returns
+// customerrors.ErrDuplicateKey for members, and leaves the invitation pending.
+func (ac *OrgAccess) AcceptInvitation(hashedToken, email, userId string) (*orgmodels.Membership, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the event payload is filled in once the invitation is read
+	event := outboxaccess.NewEvent(eventmodels.TypeOrgMemberAdded, userId, map[string]interface{}{})
+
+	filter := bson.M{
+		"hashedToken": hashedToken,
+		"email":       email,
+		"acceptedAt":  nil,
+		"expiresAt":   bson.M{"$gt": time.Now()},
+	}
+
+	// members keep the invitation, it's only used up by joining
+	pending := new(orgmodels.Invitation)
+	err := ac.InvitationCollection.FindOne(ctx, filter).Decode(pending)
+	if err == mongo.ErrNoDocuments {
+		return nil, customerrors.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	count, err := ac.MembershipCollection.CountDocuments(ctx, bson.M{"_id": GetMembershipId(pending.OrgId, userId)})
+	if err != nil {
+		return nil, err
+	} else if count > 0 {
+		return nil, customerrors.ErrDuplicateKey
+	}
+
+	var membership *orgmodels.Membership
+	err = ac.Outbox.WriteWithEvents(ctx, func(ctx context.Context) error {
+		now := time.Now()
+		invitation := new(orgmodels.Invitation)
+		err := ac.InvitationCollection.FindOneAndUpdate(
+			ctx,
+			bson.M{"_id": pending.InvitationId, "acceptedAt": nil},
+			bson.M{"$set": bson.M{"acceptedAt": now}},
+		).Decode(invitation)
+		if err == mongo.ErrNoDocuments {
+			return customerrors.ErrNotFound
+		} else if err != nil {
+			return err
+		}
+
+		membership = &orgmodels.Membership{
+			MembershipId: GetMembershipId(invitation.OrgId, userId),
+			OrgId:        invitation.OrgId,
+			UserId:       userId,
+			Role:         invitation.Role,
+			CreatedAt:    now,
+			ModifiedAt:   now,
+		}
+		event.Payload["orgId"] = membership.OrgId
+		event.Payload["role"] = membership.Role
+		if _, err := ac.MembershipCollection.InsertOne(ctx, membership); err != nil {
+			// a membership created meanwhile must not use up the invitation
+			if !ac.Outbox.SupportsTransactions {
+				if _, rollbackErr := ac.InvitationCollection.UpdateOne(ctx, bson.M{"_id": invitation.InvitationId}, bson.M{"$set": bson.M{"acceptedAt": nil}}); rollbackErr != nil {
+					log.Println("failed to roll back acceptance of invitation.", rollbackErr, "invitationId:", invitation.InvitationId)
+				}
+			}
+			return err
+		}
+		return nil
+	}, event)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, customerrors.ErrDuplicateKey
+	} else if err != nil {
+		return nil, err
+	}
+	return membership, nil
+}
+
+var orgRoleRanks = map[string]int{
+	orgmodels.OrgRoleMember: 1,
+	orgmodels.OrgRoleAdmin:  2,
+	orgmodels.OrgRoleOwner:  3,
+}
+
+// MoveMemberships hands the memberships and owned orgs of a user over to the
+// user it's merged into. where both are members of an org, the higher role is kept.
+func (ac *OrgAccess) MoveMemberships(fromUserId, toUserId string) error {
+	memberships, err := ac.ListMembershipsOfUser(fromUserId)
+	if err != nil {
+		return err
+	}
+	for _, membership := range memberships {
+		if err := ac.moveMembership(membership, toUserId); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err = ac.Collection.UpdateMany(
+		ctx,
+		bson.M{"ownerId": fromUserId},
+		bson.M{"$set": bson.M{"ownerId": toUserId, "modifiedAt": time.Now()}},
+	)
+	return err
+}
+
+func (ac *OrgAccess) moveMembership(membership *orgmodels.Membership, toUserId string) error {
+	existing, err := ac.GetMembership(membership.OrgId, toUserId)
+	if err != nil && err != customerrors.ErrNotFound {
+		return err
+	}
+
+	role := membership.Role
+	if existing != nil && orgRoleRanks[existing.Role] >= orgRoleRanks[role] {
+		role = existing.Role
+	}
+	events := []*eventmodels.Event{
+		outboxaccess.NewEvent(eventmodels.TypeOrgMemberRemoved, membership.UserId, map[string]interface{}{
+			"orgId": membership.OrgId,
+		}),
+	}
+	if existing == nil {
+		events = append(events, outboxaccess.NewEvent(eventmodels.TypeOrgMemberAdded, toUserId, map[string]interface{}{
+			"orgId": membership.OrgId,
+			"role":  role,
+		}))
+	} else if role != existing.Role {
+		events = append(events, outboxaccess.NewEvent(eventmodels.TypeOrgMemberUpdated, toUserId, map[string]interface{}{
+			"orgId": membership.OrgId,
+			"role":  role,
+		}))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return ac.Outbox.WriteWithEvents(ctx, func(ctx context.Context) error {
+		if _, err := ac.MembershipCollection.DeleteOne(ctx, bson.M{"_id": membership.MembershipId}); err != nil {
+			return err
+		}
+		now := time.Now()
+		if existing == nil {
+			_, err := ac.MembershipCollection.InsertOne(ctx, &orgmodels.Membership{
+				MembershipId: GetMembershipId(membership.OrgId, toUserId),
+				OrgId:        membership.OrgId,
+				UserId:       toUserId,
+				Role:         role,
+				CreatedAt:    membership.CreatedAt,
+				ModifiedAt:   now,
+			})
+			return err
+		} else if role != existing.Role {
+			_, err := ac.MembershipCollection.UpdateOne(
+				ctx,
+				bson.M{"_id": existing.MembershipId},
+				bson.M{"$set": bson.M{"role": role, "modifiedAt": now}},
+			)
+			return err
+		}
+		return nil
+	}, events...)
+}
@@ -0,0 +1,123 @@
+package outboxaccess
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	eventmodels "github.com/alubhorta/goth/models/event"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type OutboxAccess struct {
+	Collection *mongo.Collection
+	// transactions are only available on replica sets and sharded clusters.
+	// on a standalone server the writes in WriteWithEvents run sequentially.
+	SupportsTransactions bool
+}
+
+func NewEvent(eventType, userId string, payload map[string]interface{}) *eventmodels.Event {
+	return &eventmodels.Event{
+		EventId:     fmt.Sprintf("%v", uuid.New()),
+		Type:        eventType,
+		UserId:      userId,
+		Payload:     payload,
+		Status:      eventmodels.StatusPending,
+		DeliveredTo: []string{},
+		CreatedAt:   time.Now(),
+	}
+}
+
+// WriteWithEvents runs write and stores events in the outbox within the same
+// transaction, so an event is recorded if and only if the write succeeds.
+func (oa *OutboxAccess) WriteWithEvents(ctx context.Context, write func(ctx context.Context) error, events ...*eventmodels.Event) error {
+	writeAll := func(ctx context.Context) error {
+		if err := write(ctx); err != nil {
+			return err
+		}
+		for _, event := range events {
+			if _, err := oa.Collection.InsertOne(ctx, event); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if !oa.SupportsTransactions {
+		return writeAll(ctx)
+	}
+
+	session, err := oa.Collection.Database().Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		return nil, writeAll(sessCtx)
+	})
+	return err
+}
+
+func (oa *OutboxAccess) GetPendingEvents(limit int64) ([]*eventmodels.Event, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := oa.Collection.Find(
+		ctx,
+		bson.M{"status": eventmodels.StatusPending},
+		options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}}).SetLimit(limit),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	events := []*eventmodels.Event{}
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (oa *OutboxAccess) MarkDeliveredTo(eventId, sinkName string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := oa.Collection.UpdateOne(
+		ctx,
+		bson.M{"_id": eventId},
+		bson.M{"$addToSet": bson.M{"deliveredTo": sinkName}},
+	)
+	return err
+}
+
+func (oa *OutboxAccess) MarkDelivered(eventId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := oa.Collection.UpdateOne(
+		ctx,
+		bson.M{"_id": eventId},
+		bson.M{"$set": bson.M{"status": eventmodels.StatusDelivered, "deliveredAt": time.Now()}},
+	)
+	return err
+}
+
+func (oa *OutboxAccess) MarkFailedAttempt(eventId, errMsg string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := oa.Collection.UpdateOne(
+		ctx,
+		bson.M{"_id": eventId},
+		bson.M{
+			"$set": bson.M{"lastError": errMsg},
+			"$inc": bson.M{"attempts": 1},
+		},
+	)
+	return err
+}
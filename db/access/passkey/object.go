@@ -0,0 +1,111 @@
+package passkeyaccess
+
+import (
+	"context"
+	"log"
+	"time"
+
+	customerrors "github.com/alubhorta/goth/custom/errors"
+	authmodels "github.com/alubhorta/goth/models/auth"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type PasskeyAccess struct {
+	Collection *mongo.Collection
+}
+
+func (pc *PasskeyAccess) CreatePasskey(passkey *authmodels.Passkey) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := pc.Collection.InsertOne(ctx, passkey)
+	if mongo.IsDuplicateKeyError(err) {
+		log.Println("failed insert of passkey.", err)
+		return customerrors.ErrDuplicateKey
+	}
+	return err
+}
+
+func (pc *PasskeyAccess) GetPasskey(passkeyId string) (*authmodels.Passkey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	passkey := new(authmodels.Passkey)
+	err := pc.Collection.FindOne(ctx, bson.M{"_id": passkeyId}).Decode(passkey)
+	if err == mongo.ErrNoDocuments {
+		return nil, customerrors.ErrNotFound
+	}
+	return passkey, err
+}
+
+func (pc *PasskeyAccess) ListPasskeysOfUser(userId string) ([]*authmodels.Passkey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := pc.Collection.Find(
+		ctx,
+		bson.M{"userId": userId},
+		options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	passkeys := []*authmodels.Passkey{}
+	if err := cursor.All(ctx, &passkeys); err != nil {
+		return nil, err
+	}
+	return passkeys, nil
+}
+
+// UpdateSignCount only moves the counter forward, so concurrent logins with a
+// cloned authenticator can't both succeed.
+func (pc *PasskeyAccess) UpdateSignCount(passkeyId string, previous, signCount uint32, usedAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := pc.Collection.UpdateOne(
+		ctx,
+		bson.M{"_id": passkeyId, "signCount": previous},
+		bson.M{"$set": bson.M{"signCount": signCount, "lastUsedAt": usedAt}},
+	)
+	if err != nil {
+		return err
+	} else if result.MatchedCount == 0 {
+		return customerrors.ErrNotFound
+	}
+	return nil
+}
+
+func (pc *PasskeyAccess) DeletePasskey(userId, passkeyId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := pc.Collection.DeleteOne(ctx, bson.M{"_id": passkeyId, "userId": userId})
+	if err != nil {
+		return err
+	} else if result.DeletedCount == 0 {
+		return customerrors.ErrNotFound
+	}
+	return nil
+}
+
+func (pc *PasskeyAccess) DeletePasskeysOfUser(userId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := pc.Collection.DeleteMany(ctx, bson.M{"userId": userId})
+	return err
+}
+
+// MovePasskeys hands the passkeys of a user over to the user it's merged into.
+func (pc *PasskeyAccess) MovePasskeys(fromUserId, toUserId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := pc.Collection.UpdateMany(ctx, bson.M{"userId": fromUserId}, bson.M{"$set": bson.M{"userId": toUserId}})
+	return err
+}
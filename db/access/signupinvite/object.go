@@ -0,0 +1,99 @@
+package signupinviteaccess
+
+import (
+	"context"
+	"time"
+
+	customerrors "github.com/alubhorta/goth/custom/errors"
+	authmodels "github.com/alubhorta/goth/models/auth"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type SignupInviteAccess struct {
+	Collection *mongo.Collection
+}
+
+func (ac *SignupInviteAccess) CreateInvite(invite *authmodels.SignupInvite) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := ac.Collection.InsertOne(ctx, invite)
+	return err
+}
+
+func (ac *SignupInviteAccess) ListPendingInvites() ([]*authmodels.SignupInvite, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := ac.Collection.Find(
+		ctx,
+		bson.M{"usedAt": nil, "expiresAt": bson.M{"$gt": time.Now()}},
+		options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	invites := []*authmodels.SignupInvite{}
+	if err := cursor.All(ctx, &invites); err != nil {
+		return nil, err
+	}
+	return invites, nil
+}
+
+func (ac *SignupInviteAccess) DeleteInvite(inviteId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := ac.Collection.DeleteOne(ctx, bson.M{"_id": inviteId})
+	if err != nil {
+		return err
+	} else if result.DeletedCount == 0 {
+		return customerrors.ErrNotFound
+	}
+	return nil
+}
+
+// ConsumeInvite atomically marks the unused, unexpired invite matching
+// hashedCode as used. invites bound to an email only match that email.
+func (ac *SignupInviteAccess) ConsumeInvite(hashedCode, email, userId string) (*authmodels.SignupInvite, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	invite := new(authmodels.SignupInvite)
+	err := ac.Collection.FindOneAndUpdate(
+		ctx,
+		bson.M{
+			"hashedCode": hashedCode,
+			"usedAt":     nil,
+			"expiresAt":  bson.M{"$gt": now},
+			"email":      bson.M{"$in": bson.A{"", email}},
+		},
+		bson.M{"$set": bson.M{"usedAt": now, "usedBy": userId}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(invite)
+	if err == mongo.ErrNoDocuments {
+		return nil, customerrors.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return invite, nil
+}
+
+// ReleaseInvite makes a consumed invite usable again, for when the signup it
+// was consumed for failed.
+func (ac *SignupInviteAccess) ReleaseInvite(inviteId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := ac.Collection.UpdateOne(
+		ctx,
+		bson.M{"_id": inviteId},
+		bson.M{"$set": bson.M{"usedAt": nil, "usedBy": ""}},
+	)
+	return err
+}
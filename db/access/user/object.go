@@ -3,17 +3,23 @@ package useraccess
 import (
 	"context"
 	"log"
+	"regexp"
 	"time"
 
 	customerrors "github.com/alubhorta/goth/custom/errors"
+	outboxaccess "github.com/alubhorta/goth/db/access/outbox"
+	eventmodels "github.com/alubhorta/goth/models/event"
 	usermodels "github.com/alubhorta/goth/models/user"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type UserAccess struct {
 	Collection *mongo.Collection
+	Outbox     *outboxaccess.OutboxAccess
 }
 
 func (ac *UserAccess) CreateAUser(userId string, input *usermodels.CreateUserInfoInput) error {
@@ -24,6 +30,7 @@ func (ac *UserAccess) CreateAUser(userId string, input *usermodels.CreateUserInf
 	userInfo := usermodels.UserInfo{
 		UserId:        userId,
 		Email:         input.Email,
+		Username:      input.Username,
 		FirstName:     input.FirstName,
 		LastName:      input.LastName,
 		Bio:           "",
@@ -31,7 +38,22 @@ func (ac *UserAccess) CreateAUser(userId string, input *usermodels.CreateUserInf
 		CreatedAt:     now,
 		ModifiedAt:    now,
 	}
-	res, err := ac.Collection.InsertOne(ctx, &userInfo)
+	event := outboxaccess.NewEvent(eventmodels.TypeUserCreated, userId, map[string]interface{}{
+		"email":     input.Email,
+		"username":  input.Username,
+		"firstName": input.FirstName,
+		"lastName":  input.LastName,
+	})
+
+	var insertedId interface{}
+	err := ac.Outbox.WriteWithEvents(ctx, func(ctx context.Context) error {
+		res, err := ac.Collection.InsertOne(ctx, &userInfo)
+		if err != nil {
+			return err
+		}
+		insertedId = res.InsertedID
+		return nil
+	}, event)
 	if err != nil {
 		if mongo.IsDuplicateKeyError(err) {
 			log.Println("failed insert of user.", err)
@@ -40,7 +62,7 @@ func (ac *UserAccess) CreateAUser(userId string, input *usermodels.CreateUserInf
 		return err
 	}
 
-	log.Printf("created user with mongo_id=%v\n ; userId=%v\n", res.InsertedID, userId)
+	log.Printf("created user with mongo_id=%v\n ; userId=%v\n", insertedId, userId)
 
 	return nil
 }
@@ -61,45 +83,98 @@ func (ac *UserAccess) GetAUser(userId string) (*usermodels.UserInfo, error) {
 	return userInfo, nil
 }
 
-func (ac *UserAccess) UpdateAUser(userId string, input *usermodels.UpdateUserInfoInput) error {
+// SearchUsers returns users whose email or name contains query (case-insensitive),
+// newest first, along with the total number of matches. page is 1-based.
+func (ac *UserAccess) SearchUsers(query string, page, limit int64) ([]*usermodels.UserInfo, int64, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	result, err := ac.Collection.UpdateOne(
+	filter := bson.M{}
+	if query != "" {
+		pattern := primitive.Regex{Pattern: regexp.QuoteMeta(query), Options: "i"}
+		filter["$or"] = bson.A{
+			bson.M{"email": pattern},
+			bson.M{"firstName": pattern},
+			bson.M{"lastName": pattern},
+		}
+	}
+
+	total, err := ac.Collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	cursor, err := ac.Collection.Find(
 		ctx,
-		bson.M{"_id": userId},
-		bson.D{
-			{"$set", bson.D{
-				{Key: "firstName", Value: input.FirstName},
-				{Key: "lastName", Value: input.LastName},
-				{Key: "bio", Value: input.Bio},
-				{Key: "profileImgUrl", Value: input.ProfileImgUrl},
-				{Key: "modifiedAt", Value: time.Now()},
-			}},
-		},
+		filter,
+		options.Find().
+			SetSort(bson.D{{Key: "createdAt", Value: -1}}).
+			SetSkip((page-1)*limit).
+			SetLimit(limit),
 	)
 	if err != nil {
-		if mongo.IsDuplicateKeyError(err) {
-			log.Println("failed update of user.", err)
-			return customerrors.ErrDuplicateKey
-		}
-		return err
-	} else if result.MatchedCount == 0 {
-		return customerrors.ErrNotFound
+		return nil, 0, err
 	}
 
-	return nil
+	users := []*usermodels.UserInfo{}
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, 0, err
+	}
+	return users, total, nil
 }
 
-func (ac *UserAccess) DeleteAUser(userId string) error {
+func (ac *UserAccess) UpdateAUser(userId string, input *usermodels.UpdateUserInfoInput) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	result, err := ac.Collection.DeleteOne(ctx, bson.M{"_id": userId})
-	if err != nil {
-		return err
-	} else if result.DeletedCount == 0 {
-		return customerrors.ErrNotFound
+	event := outboxaccess.NewEvent(eventmodels.TypeUserUpdated, userId, map[string]interface{}{
+		"firstName":     input.FirstName,
+		"lastName":      input.LastName,
+		"bio":           input.Bio,
+		"profileImgUrl": input.ProfileImgUrl,
+	})
+
+	err := ac.Outbox.WriteWithEvents(ctx, func(ctx context.Context) error {
+		result, err := ac.Collection.UpdateOne(
+			ctx,
+			bson.M{"_id": userId},
+			bson.D{
+				{Key: "$set", Value: bson.D{
+					{Key: "firstName", Value: input.FirstName},
+					{Key: "lastName", Value: input.LastName},
+					{Key: "bio", Value: input.Bio},
+					{Key: "profileImgUrl", Value: input.ProfileImgUrl},
+					{Key: "modifiedAt", Value: time.Now()},
+				}},
+			},
+		)
+		if err != nil {
+			return err
+		} else if result.MatchedCount == 0 {
+			return customerrors.ErrNotFound
+		}
+		return nil
+	}, event)
+	if mongo.IsDuplicateKeyError(err) {
+		log.Println("failed update of user.", err)
+		return customerrors.ErrDuplicateKey
 	}
-	return nil
+	return err
+}
+
+func (ac *UserAccess) DeleteAUser(userId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	event := outboxaccess.NewEvent(eventmodels.TypeUserDeleted, userId, map[string]interface{}{})
+
+	return ac.Outbox.WriteWithEvents(ctx, func(ctx context.Context) error {
+		result, err := ac.Collection.DeleteOne(ctx, bson.M{"_id": userId})
+		if err != nil {
+			return err
+		} else if result.DeletedCount == 0 {
+			return customerrors.ErrNotFound
+		}
+		return nil
+	}, event)
 }
@@ -53,6 +53,41 @@ func (rc *RedisClient) Set(key, val string, expiration time.Duration) error {
 	return nil
 }
 
+func (rc *RedisClient) Del(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return rc.client.Del(ctx, key).Err()
+}
+
+// Take gets and deletes key in one transaction, for values that must only be
+// used once.
+func (rc *RedisClient) Take(key string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var get *redis.StringCmd
+	_, err := rc.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		get = pipe.Get(ctx, key)
+		pipe.Del(ctx, key)
+		return nil
+	})
+	if err == redis.Nil {
+		return "", customerrors.ErrNotFound
+	} else if err != nil {
+		return "", err
+	}
+	return get.Val(), nil
+}
+
+// SetNX sets key only when it doesn't exist yet, it returns whether it did.
+func (rc *RedisClient) SetNX(key, value string, expiration time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return rc.client.SetNX(ctx, key, value, expiration).Result()
+}
+
 func (rc *RedisClient) Exists(key string) (bool, error) {
 	_, err := rc.Get(key)
 	if err == customerrors.ErrNotFound {
@@ -64,6 +99,50 @@ func (rc *RedisClient) Exists(key string) (bool, error) {
 	}
 }
 
+// Incr counts up key and restarts its expiration, for counters over a sliding
+// window.
+func (rc *RedisClient) Incr(key string, expiration time.Duration) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var incr *redis.IntCmd
+	_, err := rc.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		incr = pipe.Incr(ctx, key)
+		pipe.Expire(ctx, key, expiration)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return incr.Val(), nil
+}
+
+// AddToSet adds member to the set at key and restarts its expiration, it
+// returns the number of distinct members.
+func (rc *RedisClient) AddToSet(key, member string, expiration time.Duration) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var card *redis.IntCmd
+	_, err := rc.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, key, member)
+		pipe.Expire(ctx, key, expiration)
+		card = pipe.SCard(ctx, key)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return card.Val(), nil
+}
+
+func (rc *RedisClient) XAdd(stream string, values map[string]interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return rc.client.XAdd(ctx, &redis.XAddArgs{Stream: stream, Values: values}).Err()
+}
+
 func (rc *RedisClient) Cleanup() {
 	log.Println("closing redis...")
 	rc.client.Close()
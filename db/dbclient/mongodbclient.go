@@ -6,7 +6,16 @@ import (
 	"log"
 	"os"
 
+	apikeyaccess "github.com/alubhorta/goth/db/access/apikey"
+	auditaccess "github.com/alubhorta/goth/db/access/audit"
 	authaccess "github.com/alubhorta/goth/db/access/auth"
+	deviceaccess "github.com/alubhorta/goth/db/access/device"
+	identityaccess "github.com/alubhorta/goth/db/access/identity"
+	oauthclientaccess "github.com/alubhorta/goth/db/access/oauthclient"
+	orgaccess "github.com/alubhorta/goth/db/access/org"
+	outboxaccess "github.com/alubhorta/goth/db/access/outbox"
+	passkeyaccess "github.com/alubhorta/goth/db/access/passkey"
+	signupinviteaccess "github.com/alubhorta/goth/db/access/signupinvite"
 	useraccess "github.com/alubhorta/goth/db/access/user"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -16,9 +25,18 @@ import (
 )
 
 type MongoDbClient struct {
-	_client    *mongo.Client
-	UserAccess *useraccess.UserAccess
-	AuthAccess *authaccess.AuthAccess
+	_client            *mongo.Client
+	UserAccess         *useraccess.UserAccess
+	AuthAccess         *authaccess.AuthAccess
+	OutboxAccess       *outboxaccess.OutboxAccess
+	AuditAccess        *auditaccess.AuditAccess
+	OrgAccess          *orgaccess.OrgAccess
+	SignupInviteAccess *signupinviteaccess.SignupInviteAccess
+	IdentityAccess     *identityaccess.IdentityAccess
+	OauthClientAccess  *oauthclientaccess.OauthClientAccess
+	ApiKeyAccess       *apikeyaccess.ApiKeyAccess
+	PasskeyAccess      *passkeyaccess.PasskeyAccess
+	DeviceAccess       *deviceaccess.DeviceAccess
 }
 
 func (dbClient *MongoDbClient) Init() {
@@ -41,43 +59,273 @@ func (dbClient *MongoDbClient) Init() {
 
 	userCollectionName := "user"
 	authCredCollectionName := "userAuthCredential"
+	outboxCollectionName := "outbox"
+	auditCollectionName := "auditLog"
+	orgCollectionName := "org"
+	orgMembershipCollectionName := "orgMembership"
+	orgInvitationCollectionName := "orgInvitation"
+	signupInviteCollectionName := "signupInvite"
+	identityCollectionName := "userIdentity"
+	oauthClientCollectionName := "oauthClient"
+	oauthConsentCollectionName := "oauthConsent"
+	apiKeyCollectionName := "apiKey"
+	passkeyCollectionName := "passkey"
+	usernameReservationCollectionName := "usernameReservation"
+	knownDeviceCollectionName := "knownDevice"
 
 	dbClient._client = _mongoclient
-	dbClient.UserAccess = &useraccess.UserAccess{Collection: db.Collection(userCollectionName)}
-	dbClient.AuthAccess = &authaccess.AuthAccess{Collection: db.Collection(authCredCollectionName)}
+	dbClient.OutboxAccess = &outboxaccess.OutboxAccess{Collection: db.Collection(outboxCollectionName)}
+	dbClient.UserAccess = &useraccess.UserAccess{Collection: db.Collection(userCollectionName), Outbox: dbClient.OutboxAccess}
+	dbClient.AuthAccess = &authaccess.AuthAccess{
+		Collection:            db.Collection(authCredCollectionName),
+		UserCollection:        db.Collection(userCollectionName),
+		ReservationCollection: db.Collection(usernameReservationCollectionName),
+		Outbox:                dbClient.OutboxAccess,
+	}
+	dbClient.AuditAccess = &auditaccess.AuditAccess{Collection: db.Collection(auditCollectionName)}
+	dbClient.OrgAccess = &orgaccess.OrgAccess{
+		Collection:           db.Collection(orgCollectionName),
+		MembershipCollection: db.Collection(orgMembershipCollectionName),
+		InvitationCollection: db.Collection(orgInvitationCollectionName),
+		Outbox:               dbClient.OutboxAccess,
+	}
+	dbClient.SignupInviteAccess = &signupinviteaccess.SignupInviteAccess{Collection: db.Collection(signupInviteCollectionName)}
+	dbClient.IdentityAccess = &identityaccess.IdentityAccess{Collection: db.Collection(identityCollectionName), Outbox: dbClient.OutboxAccess}
+	dbClient.OauthClientAccess = &oauthclientaccess.OauthClientAccess{
+		Collection:        db.Collection(oauthClientCollectionName),
+		ConsentCollection: db.Collection(oauthConsentCollectionName),
+	}
+	dbClient.ApiKeyAccess = &apikeyaccess.ApiKeyAccess{Collection: db.Collection(apiKeyCollectionName)}
+	dbClient.PasskeyAccess = &passkeyaccess.PasskeyAccess{Collection: db.Collection(passkeyCollectionName)}
+	dbClient.DeviceAccess = &deviceaccess.DeviceAccess{Collection: db.Collection(knownDeviceCollectionName)}
 
 	if err := dbClient._client.Ping(ctx, readpref.Primary()); err != nil {
 		log.Fatalln(err)
 	}
 	log.Println("successfully connected and pinged mongodb! :)")
 
+	// transactions require a replica set member or a mongos router
+	hello := bson.M{}
+	if err := db.RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello); err != nil {
+		log.Fatalln("failed to run hello command.", err)
+	}
+	_, isReplicaSet := hello["setName"]
+	dbClient.OutboxAccess.SupportsTransactions = isReplicaSet || hello["msg"] == "isdbgrid"
+	if !dbClient.OutboxAccess.SupportsTransactions {
+		log.Println("WARNING: mongodb does not support transactions, outbox events are written without atomicity guarantees.")
+	}
+
 	// ensure indices
+	// usernames and phone numbers are optional, so only unique among the users having one
+	uniqueUsernameIndex := mongo.IndexModel{
+		Keys: bson.D{{Key: "username", Value: 1}},
+		Options: options.Index().SetUnique(true).SetPartialFilterExpression(
+			bson.M{"username": bson.M{"$type": "string"}},
+		),
+	}
+	uniquePhoneIndex := mongo.IndexModel{
+		Keys: bson.D{{Key: "phone", Value: 1}},
+		Options: options.Index().SetUnique(true).SetPartialFilterExpression(
+			bson.M{"phone": bson.M{"$type": "string"}},
+		),
+	}
+
 	usersCol := dbClient._client.Database(dbName).Collection(userCollectionName)
-	idxName, err := usersCol.Indexes().CreateOne(
+	idxNames, err := usersCol.Indexes().CreateMany(
+		ctx,
+		[]mongo.IndexModel{
+			{
+				Keys:    bson.D{{Key: "email", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			},
+			uniqueUsernameIndex,
+			uniquePhoneIndex,
+		},
+	)
+	if err != nil {
+		log.Fatalln("failed to ensure index.", err)
+	}
+	log.Printf("ensuring db indices %v on %v collection \n", idxNames, userCollectionName)
+
+	usersAuthCredCol := dbClient._client.Database(dbName).Collection(authCredCollectionName)
+	idxNames, err = usersAuthCredCol.Indexes().CreateMany(
+		ctx,
+		[]mongo.IndexModel{
+			{
+				Keys:    bson.D{{Key: "email", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			},
+			{
+				// credentials from before emails were normalized have no key until
+				// the migrate-emails command ran
+				Keys: bson.D{{Key: "emailKey", Value: 1}},
+				Options: options.Index().SetUnique(true).SetPartialFilterExpression(
+					bson.M{"emailKey": bson.M{"$type": "string"}},
+				),
+			},
+			uniqueUsernameIndex,
+			uniquePhoneIndex,
+		},
+	)
+	if err != nil {
+		log.Fatalln("failed to ensure index.", err)
+	}
+	log.Printf("ensuring db indices %v on %v collection \n", idxNames, authCredCollectionName)
+
+	outboxCol := dbClient._client.Database(dbName).Collection(outboxCollectionName)
+	idxNames, err = outboxCol.Indexes().CreateMany(
+		ctx,
+		[]mongo.IndexModel{
+			{Keys: bson.D{{Key: "status", Value: 1}, {Key: "createdAt", Value: 1}}},
+			{
+				// delivered events are kept for a week for debugging, then dropped
+				Keys:    bson.D{{Key: "deliveredAt", Value: 1}},
+				Options: options.Index().SetExpireAfterSeconds(7 * 24 * 60 * 60),
+			},
+		},
+	)
+	if err != nil {
+		log.Fatalln("failed to ensure index.", err)
+	}
+	log.Printf("ensuring db indices %v on %v collection \n", idxNames, outboxCollectionName)
+
+	auditCol := dbClient._client.Database(dbName).Collection(auditCollectionName)
+	idxNames, err = auditCol.Indexes().CreateMany(
+		ctx,
+		[]mongo.IndexModel{
+			{Keys: bson.D{{Key: "actorId", Value: 1}, {Key: "createdAt", Value: -1}}},
+			{Keys: bson.D{{Key: "createdAt", Value: -1}}},
+		},
+	)
+	if err != nil {
+		log.Fatalln("failed to ensure index.", err)
+	}
+	log.Printf("ensuring db indices %v on %v collection \n", idxNames, auditCollectionName)
+
+	orgMembershipCol := dbClient._client.Database(dbName).Collection(orgMembershipCollectionName)
+	idxNames, err = orgMembershipCol.Indexes().CreateMany(
+		ctx,
+		[]mongo.IndexModel{
+			{Keys: bson.D{{Key: "userId", Value: 1}}},
+			{Keys: bson.D{{Key: "orgId", Value: 1}, {Key: "role", Value: 1}}},
+		},
+	)
+	if err != nil {
+		log.Fatalln("failed to ensure index.", err)
+	}
+	log.Printf("ensuring db indices %v on %v collection \n", idxNames, orgMembershipCollectionName)
+
+	orgInvitationCol := dbClient._client.Database(dbName).Collection(orgInvitationCollectionName)
+	idxNames, err = orgInvitationCol.Indexes().CreateMany(
+		ctx,
+		[]mongo.IndexModel{
+			{
+				Keys:    bson.D{{Key: "hashedToken", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			},
+			{Keys: bson.D{{Key: "orgId", Value: 1}}},
+		},
+	)
+	if err != nil {
+		log.Fatalln("failed to ensure index.", err)
+	}
+	log.Printf("ensuring db indices %v on %v collection \n", idxNames, orgInvitationCollectionName)
+
+	signupInviteCol := dbClient._client.Database(dbName).Collection(signupInviteCollectionName)
+	idxName, err := signupInviteCol.Indexes().CreateOne(
 		ctx,
 		mongo.IndexModel{
-			Keys:    bson.D{{Key: "email", Value: 1}},
+			Keys:    bson.D{{Key: "hashedCode", Value: 1}},
 			Options: options.Index().SetUnique(true),
 		},
 	)
 	if err != nil {
 		log.Fatalln("failed to ensure index.", err)
 	}
-	log.Printf("ensuring db index %v on %v collection \n", idxName, userCollectionName)
+	log.Printf("ensuring db index %v on %v collection \n", idxName, signupInviteCollectionName)
 
-	usersAuthCredCol := dbClient._client.Database(dbName).Collection(authCredCollectionName)
-	idxName, err = usersAuthCredCol.Indexes().CreateOne(
+	// a user can link at most one account per provider
+	identityCol := dbClient._client.Database(dbName).Collection(identityCollectionName)
+	idxName, err = identityCol.Indexes().CreateOne(
 		ctx,
 		mongo.IndexModel{
-			Keys:    bson.D{{Key: "email", Value: 1}},
+			Keys:    bson.D{{Key: "userId", Value: 1}, {Key: "provider", Value: 1}},
 			Options: options.Index().SetUnique(true),
 		},
 	)
 	if err != nil {
 		log.Fatalln("failed to ensure index.", err)
 	}
-	log.Printf("ensuring db index %v on %v collection \n", idxName, authCredCollectionName)
+	log.Printf("ensuring db index %v on %v collection \n", idxName, identityCollectionName)
+
+	oauthConsentCol := dbClient._client.Database(dbName).Collection(oauthConsentCollectionName)
+	idxNames, err = oauthConsentCol.Indexes().CreateMany(
+		ctx,
+		[]mongo.IndexModel{
+			{Keys: bson.D{{Key: "clientId", Value: 1}}},
+			{Keys: bson.D{{Key: "userId", Value: 1}}},
+		},
+	)
+	if err != nil {
+		log.Fatalln("failed to ensure index.", err)
+	}
+	log.Printf("ensuring db indices %v on %v collection \n", idxNames, oauthConsentCollectionName)
 
+	apiKeyCol := dbClient._client.Database(dbName).Collection(apiKeyCollectionName)
+	idxNames, err = apiKeyCol.Indexes().CreateMany(
+		ctx,
+		[]mongo.IndexModel{
+			{
+				Keys:    bson.D{{Key: "prefix", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			},
+			{Keys: bson.D{{Key: "userId", Value: 1}}},
+		},
+	)
+	if err != nil {
+		log.Fatalln("failed to ensure index.", err)
+	}
+	log.Printf("ensuring db indices %v on %v collection \n", idxNames, apiKeyCollectionName)
+
+	passkeyCol := dbClient._client.Database(dbName).Collection(passkeyCollectionName)
+	idxName, err = passkeyCol.Indexes().CreateOne(
+		ctx,
+		mongo.IndexModel{Keys: bson.D{{Key: "userId", Value: 1}}},
+	)
+	if err != nil {
+		log.Fatalln("failed to ensure index.", err)
+	}
+	log.Printf("ensuring db index %v on %v collection \n", idxName, passkeyCollectionName)
+
+	usernameReservationCol := dbClient._client.Database(dbName).Collection(usernameReservationCollectionName)
+	idxName, err = usernameReservationCol.Indexes().CreateOne(
+		ctx,
+		mongo.IndexModel{
+			Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	)
+	if err != nil {
+		log.Fatalln("failed to ensure index.", err)
+	}
+	log.Printf("ensuring db index %v on %v collection \n", idxName, usernameReservationCollectionName)
+
+	knownDeviceCol := dbClient._client.Database(dbName).Collection(knownDeviceCollectionName)
+	idxNames, err = knownDeviceCol.Indexes().CreateMany(
+		ctx,
+		[]mongo.IndexModel{
+			{Keys: bson.D{{Key: "userId", Value: 1}}},
+			{
+				// devices unused for half a year are forgotten, and count as new again
+				Keys:    bson.D{{Key: "lastSeenAt", Value: 1}},
+				Options: options.Index().SetExpireAfterSeconds(180 * 24 * 60 * 60),
+			},
+		},
+	)
+	if err != nil {
+		log.Fatalln("failed to ensure index.", err)
+	}
+	log.Printf("ensuring db indices %v on %v collection \n", idxNames, knownDeviceCollectionName)
 }
 
 func (dbClient *MongoDbClient) Cleanup(dbCtx context.Context) {
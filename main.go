@@ -2,16 +2,34 @@ package main
 
 import (
 	"context"
+	"flag"
 	"log"
 	"os"
 	"os/signal"
+	"time"
 
+	adminapi "github.com/alubhorta/goth/api/admin"
 	authapi "github.com/alubhorta/goth/api/auth"
+	oauthapi "github.com/alubhorta/goth/api/oauth"
+	orgapi "github.com/alubhorta/goth/api/org"
 	userapi "github.com/alubhorta/goth/api/user"
 	"github.com/alubhorta/goth/db/cacheclient"
 	"github.com/alubhorta/goth/db/dbclient"
+	csrfmw "github.com/alubhorta/goth/middleware/csrf"
 	tokenmw "github.com/alubhorta/goth/middleware/token"
 	commonmodels "github.com/alubhorta/goth/models/common"
+	oauthmodels "github.com/alubhorta/goth/models/oauth"
+	orgmodels "github.com/alubhorta/goth/models/org"
+	migrateutils "github.com/alubhorta/goth/utils/migrate"
+	oidcutils "github.com/alubhorta/goth/utils/oidc"
+	outboxutils "github.com/alubhorta/goth/utils/outbox"
+	passwordutils "github.com/alubhorta/goth/utils/password"
+	rbacutils "github.com/alubhorta/goth/utils/rbac"
+	riskutils "github.com/alubhorta/goth/utils/risk"
+	sessionutils "github.com/alubhorta/goth/utils/session"
+	signuputils "github.com/alubhorta/goth/utils/signup"
+	smsutils "github.com/alubhorta/goth/utils/sms"
+	usernameutils "github.com/alubhorta/goth/utils/username"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
@@ -21,9 +39,26 @@ import (
 func main() {
 	godotenv.Load()
 
+	// fail fast on misconfigured policies
+	log.Println("signup mode:", signuputils.GetPolicy().Mode)
+	log.Println("password hashing:", passwordutils.GetHashConfig().Algorithm, "; min length:", passwordutils.GetPolicy().MinLength)
+	log.Println("username change cooldown:", usernameutils.GetPolicy().ChangeCooldown)
+	if smsutils.IsEnabled() {
+		log.Println("sms provider:", smsutils.GetSender().Name())
+	}
+	if riskutils.GetPolicy().Enabled {
+		log.Println("risk scoring: challenge from", riskutils.GetPolicy().ChallengeScore, "; block from", riskutils.GetPolicy().BlockScore)
+	}
+
 	app := fiber.New()
 
-	app.Use(cors.New())
+	// cross-origin frontends need credentialed requests for the refresh cookie
+	corsConfig := cors.Config{}
+	if sessionutils.IsCookieMode() && os.Getenv("CORS_ALLOW_ORIGINS") != "" {
+		corsConfig.AllowOrigins = os.Getenv("CORS_ALLOW_ORIGINS")
+		corsConfig.AllowCredentials = true
+	}
+	app.Use(cors.New(corsConfig))
 
 	dbclient := &dbclient.MongoDbClient{}
 	dbclient.Init()
@@ -31,6 +66,28 @@ func main() {
 	redisClient := &cacheclient.RedisClient{}
 	redisClient.Init()
 
+	// `goth migrate-emails [-apply]` merges accounts with duplicate emails and
+	// normalizes the emails stored before, instead of serving
+	if len(os.Args) > 1 && os.Args[1] == "migrate-emails" {
+		flags := flag.NewFlagSet("migrate-emails", flag.ExitOnError)
+		apply := flags.Bool("apply", false, "merge the duplicate accounts and normalize the emails instead of only listing them")
+		flags.Parse(os.Args[2:])
+		migrateutils.MigrateEmails(dbclient, redisClient, *apply)
+		redisClient.Cleanup()
+		dbclient.Cleanup(context.Background())
+		return
+	}
+
+	sinks, err := outboxutils.GetSinksFromEnv(redisClient)
+	if err != nil {
+		log.Fatalln("failed to setup outbox sinks.", err)
+	}
+	outboxRelay := outboxutils.NewRelayFromEnv(dbclient.OutboxAccess, sinks)
+	outboxRelay.Start()
+
+	adminapi.EnsureBootstrapAdmin(dbclient)
+	oidcutils.LoadSigningKey()
+
 	commonClients := &commonmodels.CommonClients{
 		DbClient:    dbclient,
 		CacheClient: redisClient,
@@ -50,6 +107,7 @@ func main() {
 	// ensure cleanup
 	cleanupFunc := func() {
 		log.Println("running cleanup tasks...")
+		outboxRelay.Stop()
 		redisClient.Cleanup()
 		dbclient.Cleanup(userCtx)
 		app.Shutdown()
@@ -70,18 +128,116 @@ func main() {
 func setupRoutes(app *fiber.App) {
 	app.Get("/", index)
 
+	// sensitive changes need a login or reauthentication within the last minutes
+	recentAuth := tokenmw.RequiresRecentAuth(5 * time.Minute)
+
 	// auth routes
 	app.Post("/api/v1/auth/signup", authapi.Signup)
 	app.Post("/api/v1/auth/login", authapi.Login)
-	app.Post("/api/v1/auth/logout", authapi.Logout)
-	app.Post("/api/v1/auth/refresh", authapi.Refresh)
+	app.Post("/api/v1/auth/login/challenge", authapi.LoginChallenge)
+	app.Post("/api/v1/auth/logout", csrfmw.RequiresCsrf, authapi.Logout)
+	app.Post("/api/v1/auth/refresh", csrfmw.RequiresCsrf, authapi.Refresh)
+	app.Delete("/api/v1/auth/refresh", csrfmw.RequiresCsrf, authapi.Logout)
 	app.Post("/api/v1/auth/reset/init", authapi.ResetPasswordInit)
 	app.Post("/api/v1/auth/reset/verify", authapi.ResetPasswordVerify)
-	app.Delete("/api/v1/auth/delete", tokenmw.ParseTokenUserId, tokenmw.RequiresAuth, authapi.DeleteAccount)
+	app.Post("/api/v1/auth/sms/login/begin", authapi.SmsLoginBegin)
+	app.Post("/api/v1/auth/sms/login", authapi.SmsLogin)
+	app.Post("/api/v1/auth/devices/report", authapi.ReportDevice)
+	app.Put("/api/v1/auth/password", tokenmw.ParseTokenUserId, tokenmw.RequiresAuth, authapi.ChangePassword)
+	app.Delete("/api/v1/auth/delete", tokenmw.ParseTokenUserId, tokenmw.RequiresAuth, recentAuth, authapi.DeleteAccount)
+	app.Post("/api/v1/auth/reauth", tokenmw.ParseTokenUserId, tokenmw.RequiresAuth, authapi.Reauth)
+	app.Post("/api/v1/auth/reauth/passkey/begin", tokenmw.ParseTokenUserId, tokenmw.RequiresAuth, authapi.ReauthPasskeyBegin)
+
+	// passkey routes
+	app.Post("/api/v1/auth/passkeys/login/begin", authapi.PasskeyLoginBegin)
+	app.Post("/api/v1/auth/passkeys/login", authapi.PasskeyLogin)
+	app.Post("/api/v1/auth/passkeys/register/begin", tokenmw.ParseTokenUserId, tokenmw.RequiresAuth, recentAuth, authapi.RegisterPasskeyBegin)
+	app.Post("/api/v1/auth/passkeys", tokenmw.ParseTokenUserId, tokenmw.RequiresAuth, recentAuth, authapi.RegisterPasskey)
+	app.Get("/api/v1/auth/passkeys", tokenmw.ParseTokenUserId, tokenmw.RequiresAuth, authapi.ListPasskeys)
+	app.Delete("/api/v1/auth/passkeys/:passkeyId", tokenmw.ParseTokenUserId, tokenmw.RequiresAuth, recentAuth, authapi.DeletePasskey)
+	app.Put("/api/v1/auth/mfa", tokenmw.ParseTokenUserId, tokenmw.RequiresAuth, recentAuth, authapi.UpdateMfa)
+
+	// social login routes
+	app.Get("/api/v1/auth/oauth/identities", tokenmw.ParseTokenUserId, tokenmw.RequiresAuth, authapi.ListIdentities)
+	app.Get("/api/v1/auth/oauth/:provider/authorize", authapi.OauthAuthorize)
+	app.Get("/api/v1/auth/oauth/:provider/callback", authapi.OauthCallback)
+	app.Post("/api/v1/auth/oauth/:provider/link", tokenmw.ParseTokenUserId, tokenmw.RequiresAuth, recentAuth, authapi.OauthLink)
+	app.Delete("/api/v1/auth/oauth/:provider/link", tokenmw.ParseTokenUserId, tokenmw.RequiresAuth, authapi.OauthUnlink)
+
+	// device authorization routes
+	app.Get("/api/v1/auth/device", tokenmw.ParseTokenUserId, tokenmw.RequiresAuth, oauthapi.GetDevice)
+	app.Post("/api/v1/auth/device", tokenmw.ParseTokenUserId, tokenmw.RequiresAuth, oauthapi.DecideDevice)
 
 	// user routes
-	app.Get("/api/v1/user", tokenmw.ParseTokenUserId, tokenmw.RequiresAuth, userapi.GetOne)
-	app.Put("/api/v1/user", tokenmw.ParseTokenUserId, tokenmw.RequiresAuth, userapi.UpdateOne)
+	app.Get("/api/v1/user", tokenmw.ParseTokenUserId, tokenmw.AllowApiKey(tokenmw.RequiresAuth), userapi.GetOne)
+	app.Put("/api/v1/user", tokenmw.ParseTokenUserId, tokenmw.AllowApiKey(tokenmw.RequiresAuth), userapi.UpdateOne)
+	app.Post("/api/v1/user/email", tokenmw.ParseTokenUserId, tokenmw.RequiresAuth, recentAuth, userapi.ChangeEmail)
+	app.Post("/api/v1/user/email/confirm", tokenmw.ParseTokenUserId, tokenmw.RequiresAuth, userapi.ConfirmEmailChange)
+	app.Get("/api/v1/user/username/available", userapi.CheckUsername)
+	app.Put("/api/v1/user/username", tokenmw.ParseTokenUserId, tokenmw.RequiresAuth, userapi.ChangeUsername)
+	app.Post("/api/v1/user/phone", tokenmw.ParseTokenUserId, tokenmw.RequiresAuth, recentAuth, userapi.ChangePhone)
+	app.Post("/api/v1/user/phone/confirm", tokenmw.ParseTokenUserId, tokenmw.RequiresAuth, recentAuth, userapi.ConfirmPhoneChange)
+	app.Delete("/api/v1/user/phone", tokenmw.ParseTokenUserId, tokenmw.RequiresAuth, recentAuth, userapi.RemovePhone)
+	app.Get("/api/v1/user/devices", tokenmw.ParseTokenUserId, tokenmw.RequiresAuth, userapi.ListDevices)
+	app.Delete("/api/v1/user/devices/:deviceId", tokenmw.ParseTokenUserId, tokenmw.RequiresAuth, userapi.DeleteDevice)
+	app.Get("/api/v1/user/activity", tokenmw.ParseTokenUserId, tokenmw.AllowApiKey(tokenmw.RequiresAuth), userapi.GetActivity)
+	app.Post("/api/v1/user/api-keys", tokenmw.ParseTokenUserId, tokenmw.RequiresAuth, recentAuth, userapi.CreateApiKey)
+	app.Get("/api/v1/user/api-keys", tokenmw.ParseTokenUserId, tokenmw.AllowApiKey(tokenmw.RequiresAuth), userapi.ListApiKeys)
+	app.Delete("/api/v1/user/api-keys/:keyId", tokenmw.ParseTokenUserId, tokenmw.RequiresAuth, userapi.RevokeApiKey)
+
+	// org routes
+	anyOrgRole := tokenmw.RequireOrgRole(orgmodels.OrgRoleOwner, orgmodels.OrgRoleAdmin, orgmodels.OrgRoleMember)
+	orgManagers := tokenmw.RequireOrgRole(orgmodels.OrgRoleOwner, orgmodels.OrgRoleAdmin)
+	orgOwners := tokenmw.RequireOrgRole(orgmodels.OrgRoleOwner)
+	app.Post("/api/v1/orgs", tokenmw.ParseTokenUserId, tokenmw.RequiresAuth, orgapi.CreateOrg)
+	app.Get("/api/v1/orgs", tokenmw.ParseTokenUserId, tokenmw.AllowApiKey(tokenmw.RequiresAuth), orgapi.ListMyOrgs)
+	app.Post("/api/v1/orgs/invitations/accept", tokenmw.ParseTokenUserId, tokenmw.RequiresAuth, orgapi.AcceptInvitation)
+	app.Post("/api/v1/orgs/:orgId/switch", tokenmw.ParseTokenUserId, tokenmw.RequiresAuth, orgapi.SwitchOrg)
+	app.Get("/api/v1/orgs/:orgId", tokenmw.ParseTokenUserId, tokenmw.RequiresAuth, anyOrgRole, orgapi.GetOrg)
+	app.Put("/api/v1/orgs/:orgId", tokenmw.ParseTokenUserId, tokenmw.RequiresAuth, orgManagers, orgapi.UpdateOrg)
+	app.Delete("/api/v1/orgs/:orgId", tokenmw.ParseTokenUserId, tokenmw.RequiresAuth, orgOwners, orgapi.DeleteOrg)
+	app.Get("/api/v1/orgs/:orgId/members", tokenmw.ParseTokenUserId, tokenmw.RequiresAuth, anyOrgRole, orgapi.ListMembers)
+	app.Put("/api/v1/orgs/:orgId/members/:userId", tokenmw.ParseTokenUserId, tokenmw.RequiresAuth, orgManagers, orgapi.UpdateMember)
+	app.Delete("/api/v1/orgs/:orgId/members/:userId", tokenmw.ParseTokenUserId, tokenmw.RequiresAuth, orgManagers, orgapi.RemoveMember)
+	app.Post("/api/v1/orgs/:orgId/invitations", tokenmw.ParseTokenUserId, tokenmw.RequiresAuth, orgManagers, orgapi.Invite)
+	app.Get("/api/v1/orgs/:orgId/invitations", tokenmw.ParseTokenUserId, tokenmw.RequiresAuth, orgManagers, orgapi.ListInvitations)
+	app.Delete("/api/v1/orgs/:orgId/invitations/:invitationId", tokenmw.ParseTokenUserId, tokenmw.RequiresAuth, orgManagers, orgapi.RevokeInvitation)
+
+	// admin routes
+	app.Get("/api/v1/admin/audit", tokenmw.ParseTokenPrincipal, tokenmw.AllowApiKey(tokenmw.RequiresPrincipalAuth), tokenmw.RequirePermission(rbacutils.PermAuditRead), adminapi.QueryAudit)
+	app.Post("/api/v1/admin/users/:userId/roles", tokenmw.ParseTokenPrincipal, tokenmw.AllowApiKey(tokenmw.RequiresPrincipalAuth), tokenmw.RequirePermission(rbacutils.PermRolesWrite), adminapi.GrantRole)
+	app.Delete("/api/v1/admin/users/:userId/roles/:role", tokenmw.ParseTokenPrincipal, tokenmw.AllowApiKey(tokenmw.RequiresPrincipalAuth), tokenmw.RequirePermission(rbacutils.PermRolesWrite), adminapi.RevokeRole)
+	app.Get("/api/v1/admin/users", tokenmw.ParseTokenPrincipal, tokenmw.AllowApiKey(tokenmw.RequiresPrincipalAuth), tokenmw.RequirePermission(rbacutils.PermUsersRead), adminapi.ListUsers)
+	app.Get("/api/v1/admin/users/:userId", tokenmw.ParseTokenPrincipal, tokenmw.AllowApiKey(tokenmw.RequiresPrincipalAuth), tokenmw.RequirePermission(rbacutils.PermUsersRead), adminapi.GetUser)
+	app.Post("/api/v1/admin/users/:userId/disable", tokenmw.ParseTokenPrincipal, tokenmw.AllowApiKey(tokenmw.RequiresPrincipalAuth), tokenmw.RequirePermission(rbacutils.PermUsersWrite), adminapi.DisableUser)
+	app.Post("/api/v1/admin/users/:userId/enable", tokenmw.ParseTokenPrincipal, tokenmw.AllowApiKey(tokenmw.RequiresPrincipalAuth), tokenmw.RequirePermission(rbacutils.PermUsersWrite), adminapi.EnableUser)
+	app.Post("/api/v1/admin/users/:userId/force-password-reset", tokenmw.ParseTokenPrincipal, tokenmw.AllowApiKey(tokenmw.RequiresPrincipalAuth), tokenmw.RequirePermission(rbacutils.PermUsersWrite), adminapi.ForcePasswordReset)
+	app.Post("/api/v1/admin/users/:userId/revoke-sessions", tokenmw.ParseTokenPrincipal, tokenmw.AllowApiKey(tokenmw.RequiresPrincipalAuth), tokenmw.RequirePermission(rbacutils.PermUsersWrite), adminapi.RevokeSessions)
+	app.Delete("/api/v1/admin/users/:userId", tokenmw.ParseTokenPrincipal, tokenmw.AllowApiKey(tokenmw.RequiresPrincipalAuth), tokenmw.RequirePermission(rbacutils.PermUsersWrite), adminapi.DeleteUser)
+	app.Post("/api/v1/admin/invites", tokenmw.ParseTokenPrincipal, tokenmw.AllowApiKey(tokenmw.RequiresPrincipalAuth), tokenmw.RequirePermission(rbacutils.PermInvitesWrite), adminapi.CreateSignupInvite)
+	app.Get("/api/v1/admin/invites", tokenmw.ParseTokenPrincipal, tokenmw.AllowApiKey(tokenmw.RequiresPrincipalAuth), tokenmw.RequirePermission(rbacutils.PermInvitesWrite), adminapi.ListSignupInvites)
+	app.Delete("/api/v1/admin/invites/:inviteId", tokenmw.ParseTokenPrincipal, tokenmw.AllowApiKey(tokenmw.RequiresPrincipalAuth), tokenmw.RequirePermission(rbacutils.PermInvitesWrite), adminapi.RevokeSignupInvite)
+	app.Post("/api/v1/admin/clients", tokenmw.ParseTokenPrincipal, tokenmw.AllowApiKey(tokenmw.RequiresPrincipalAuth), tokenmw.RequirePermission(rbacutils.PermClientsWrite), adminapi.CreateOauthClient)
+	app.Get("/api/v1/admin/clients", tokenmw.ParseTokenPrincipal, tokenmw.AllowApiKey(tokenmw.RequiresPrincipalAuth), tokenmw.RequirePermission(rbacutils.PermClientsWrite), adminapi.ListOauthClients)
+	app.Put("/api/v1/admin/clients/:clientId/scopes", tokenmw.ParseTokenPrincipal, tokenmw.AllowApiKey(tokenmw.RequiresPrincipalAuth), tokenmw.RequirePermission(rbacutils.PermClientsWrite), adminapi.UpdateOauthClientScopes)
+	app.Delete("/api/v1/admin/clients/:clientId", tokenmw.ParseTokenPrincipal, tokenmw.AllowApiKey(tokenmw.RequiresPrincipalAuth), tokenmw.RequirePermission(rbacutils.PermClientsWrite), adminapi.DeleteOauthClient)
+
+	// openid connect provider routes
+	app.Get("/.well-known/openid-configuration", oauthapi.Discovery)
+	app.Get("/oauth/jwks", oauthapi.Jwks)
+	app.Get("/oauth/authorize", oauthapi.Authorize)
+	app.Post("/oauth/authorize/login", oauthapi.AuthorizeLogin)
+	app.Post("/oauth/authorize/passkey", oauthapi.AuthorizePasskey)
+	app.Post("/oauth/authorize/consent", oauthapi.AuthorizeConsent)
+	app.Post("/oauth/token", oauthapi.Token)
+	app.Post("/oauth/introspect", oauthapi.Introspect)
+	app.Post("/oauth/revoke", oauthapi.Revoke)
+	app.Post("/oauth/device_authorization", oauthapi.DeviceAuthorization)
+	app.Get("/oauth/device", oauthapi.DevicePage)
+	app.Post("/oauth/device", oauthapi.DeviceVerify)
+	app.Post("/oauth/device/passkey", oauthapi.DevicePasskey)
+	app.Get("/oauth/userinfo", tokenmw.ParseTokenUserId, tokenmw.RequiresAuthOrScope(oauthmodels.ScopeOpenId), oauthapi.UserInfo)
+	app.Post("/oauth/userinfo", tokenmw.ParseTokenUserId, tokenmw.RequiresAuthOrScope(oauthmodels.ScopeOpenId), oauthapi.UserInfo)
 }
 
 func index(c *fiber.Ctx) error {
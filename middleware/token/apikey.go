@@ -0,0 +1,82 @@
+package tokenmiddleware
+
+import (
+	"context"
+	"crypto/subtle"
+	"log"
+	"time"
+
+	commonmodels "github.com/alubhorta/goth/models/common"
+	rbacutils "github.com/alubhorta/goth/utils/rbac"
+	tokenutils "github.com/alubhorta/goth/utils/token"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// parseApiKey authenticates a personal api key in place of an access token.
+// the key may only use those permissions of its owner that are in its scopes.
+func parseApiKey(c *fiber.Ctx, key string) error {
+	prevCtx := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx)
+	dbclient := prevCtx.Clients.DbClient
+
+	prefix, ok := tokenutils.GetApiKeyPrefix(key)
+	if !ok {
+		msg := "invalid api key provided."
+		log.Println(msg)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	apiKey, err := dbclient.ApiKeyAccess.GetApiKeyByPrefix(prefix)
+	if err != nil || subtle.ConstantTimeCompare([]byte(tokenutils.HashOpaqueToken(key)), []byte(apiKey.HashedKey)) != 1 {
+		msg := "invalid api key provided."
+		log.Println(msg, err, "prefix:", prefix)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	now := time.Now()
+	if apiKey.ExpiresAt != nil && apiKey.ExpiresAt.Before(now) {
+		msg := "expired api key used."
+		log.Println(msg, "keyId:", apiKey.KeyId)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	authCred, err := dbclient.AuthAccess.GetAuthCredentialByUserId(apiKey.UserId)
+	if err != nil {
+		msg := "invalid api key provided."
+		log.Println(msg, err, "keyId:", apiKey.KeyId)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if authCred.Disabled {
+		msg := "account is disabled."
+		log.Println(msg, "userId:", authCred.UserId)
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+	} else if authCred.PasswordResetRequired {
+		msg := "password reset required - reset your password to continue."
+		log.Println(msg, "userId:", authCred.UserId)
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
+	roles, permissions := rbacutils.GetScopedAccess(authCred.Roles, authCred.Permissions, apiKey.Scopes)
+
+	// last use is informational, so it is only written once a minute
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) > time.Minute {
+		if err := dbclient.ApiKeyAccess.TouchApiKey(apiKey.KeyId, now); err != nil {
+			log.Println("failed to update api key last use.", err)
+		}
+	}
+
+	newCtx := context.WithValue(
+		context.Background(),
+		commonmodels.CommonCtx{},
+		&commonmodels.CommonCtx{
+			Clients:     prevCtx.Clients,
+			UserId:      apiKey.UserId,
+			IssuedAt:    apiKey.CreatedAt.Unix(),
+			Roles:       roles,
+			Permissions: permissions,
+			Scopes:      apiKey.Scopes,
+			ApiKeyId:    apiKey.KeyId,
+		},
+	)
+	c.SetUserContext(newCtx)
+
+	return c.Next()
+}
@@ -8,11 +8,24 @@ import (
 	"strings"
 
 	commonmodels "github.com/alubhorta/goth/models/common"
+	tokenutils "github.com/alubhorta/goth/utils/token"
+
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v4"
 )
 
 func ParseTokenUserId(c *fiber.Ctx) error {
+	return parseToken(c, true)
+}
+
+// ParseTokenPrincipal is ParseTokenUserId that also accepts tokens of machine
+// clients, which have a client_id instead of a userId. the scopes of such a
+// token are its permissions.
+func ParseTokenPrincipal(c *fiber.Ctx) error {
+	return parseToken(c, false)
+}
+
+func parseToken(c *fiber.Ctx, requireUser bool) error {
 	authHeader := c.Request().Header.Peek("Authorization")
 	authHeaderCopy := make([]byte, len(authHeader))
 	copy(authHeaderCopy, authHeader)
@@ -26,6 +39,9 @@ func ParseTokenUserId(c *fiber.Ctx) error {
 	}
 
 	accessToken := splitted[1]
+	if tokenutils.IsApiKey(accessToken) {
+		return parseApiKey(c, accessToken)
+	}
 	// NOTE: possible to refactor token parsing from header into tokenutils func
 	token, err := jwt.Parse(accessToken, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
@@ -48,20 +64,44 @@ func ParseTokenUserId(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
 	}
 
+	// tokens issued to oauth clients carry the client and its granted scopes
+	clientId, _ := claims["client_id"].(string)
+	scope, _ := claims["scope"].(string)
+	grantId, _ := claims["grant_id"].(string)
+
 	userId, ok := claims["userId"].(string)
-	if !ok || len(userId) <= 0 {
+	if (!ok || len(userId) <= 0) && (requireUser || clientId == "") {
 		msg := "invalid user id provided in claim."
 		log.Println(msg, err)
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": msg, "payload": nil})
 	}
 
+	issuedAt, _ := claims["iat"].(float64)
+	authTime, _ := claims["auth_time"].(float64)
+	orgId, _ := claims["orgId"].(string)
+	orgRole, _ := claims["orgRole"].(string)
+	permissions := tokenutils.GetStringSliceClaim(claims, "permissions")
+	if userId == "" {
+		permissions = strings.Fields(scope)
+	}
+
 	prevCtx := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx)
 	newCtx := context.WithValue(
 		context.Background(),
 		commonmodels.CommonCtx{},
 		&commonmodels.CommonCtx{
-			Clients: prevCtx.Clients,
-			UserId:  userId,
+			Clients:     prevCtx.Clients,
+			UserId:      userId,
+			IssuedAt:    int64(issuedAt),
+			AuthTime:    int64(authTime),
+			Amr:         tokenutils.GetStringSliceClaim(claims, "amr"),
+			Roles:       tokenutils.GetStringSliceClaim(claims, "roles"),
+			Permissions: permissions,
+			OrgId:       orgId,
+			OrgRole:     orgRole,
+			ClientId:    clientId,
+			Scopes:      strings.Fields(scope),
+			GrantId:     grantId,
 		},
 	)
 	c.SetUserContext(newCtx)
@@ -0,0 +1,51 @@
+package tokenmiddleware
+
+import (
+	"context"
+	"log"
+
+	customerrors "github.com/alubhorta/goth/custom/errors"
+	commonmodels "github.com/alubhorta/goth/models/common"
+	rbacutils "github.com/alubhorta/goth/utils/rbac"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// RequireOrgRole scopes a route to the org in its :orgId param. the org must be
+// the active org of the access token, and the user's current membership role
+// must be one of roles. it must run after ParseTokenUserId and RequiresAuth.
+func RequireOrgRole(roles ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		commonCtx := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx)
+		orgId := c.Params("orgId")
+
+		if commonCtx.OrgId == "" || commonCtx.OrgId != orgId {
+			msg := "forbidden - org is not the active org, switch to it first."
+			log.Println(msg, "userId:", commonCtx.UserId, "orgId:", orgId)
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+		}
+
+		// the role in the token may be stale, so the membership is authoritative
+		dbclient := commonCtx.Clients.DbClient
+		membership, err := dbclient.OrgAccess.GetMembership(orgId, commonCtx.UserId)
+		if err == customerrors.ErrNotFound {
+			msg := "forbidden - not a member of this org."
+			log.Println(msg, "userId:", commonCtx.UserId, "orgId:", orgId)
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+		} else if err != nil {
+			msg := "failed to read from database."
+			log.Println(msg, err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+		} else if !rbacutils.Contains(roles, membership.Role) {
+			msg := "forbidden - missing required org role."
+			log.Println(msg, "userId:", commonCtx.UserId, "orgId:", orgId, "required any of:", roles)
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+		}
+
+		newCommonCtx := *commonCtx
+		newCommonCtx.OrgRole = membership.Role
+		c.SetUserContext(context.WithValue(context.Background(), commonmodels.CommonCtx{}, &newCommonCtx))
+
+		return c.Next()
+	}
+}
@@ -0,0 +1,47 @@
+package tokenmiddleware
+
+import (
+	"log"
+
+	commonmodels "github.com/alubhorta/goth/models/common"
+	rbacutils "github.com/alubhorta/goth/utils/rbac"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// RequireRole only lets through users having at least one of roles.
+// it must run after ParseTokenUserId and RequiresAuth.
+func RequireRole(roles ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		commonCtx := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx)
+
+		for _, role := range roles {
+			if rbacutils.Contains(commonCtx.Roles, role) {
+				return c.Next()
+			}
+		}
+
+		msg := "forbidden - missing required role."
+		log.Println(msg, "userId:", commonCtx.UserId, "required any of:", roles)
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+}
+
+// RequirePermission only lets through users, or machine clients, having all of
+// permissions. it must run after ParseTokenUserId and RequiresAuth, or after
+// ParseTokenPrincipal and RequiresPrincipalAuth.
+func RequirePermission(permissions ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		commonCtx := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx)
+
+		for _, permission := range permissions {
+			if !rbacutils.Contains(commonCtx.Permissions, permission) {
+				msg := "forbidden - missing required permission."
+				log.Println(msg, "userId:", commonCtx.UserId, "clientId:", commonCtx.ClientId, "missing:", permission)
+				return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+			}
+		}
+
+		return c.Next()
+	}
+}
@@ -7,12 +7,73 @@ import (
 
 	customerrors "github.com/alubhorta/goth/custom/errors"
 	commonmodels "github.com/alubhorta/goth/models/common"
+	rbacutils "github.com/alubhorta/goth/utils/rbac"
+	sessionutils "github.com/alubhorta/goth/utils/session"
 
 	"github.com/gofiber/fiber/v2"
 	jwtware "github.com/gofiber/jwt/v3"
 )
 
 func RequiresAuth(c *fiber.Ctx) error {
+	// tokens of oauth clients are limited to the routes their scopes allow
+	if clientId := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).ClientId; clientId != "" {
+		msg := "token issued to an oauth client can not be used here."
+		log.Println(msg, "clientId:", clientId)
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	return verifyToken(c)
+}
+
+// RequiresAuthOrScope is RequiresAuth that also accepts tokens issued to an
+// oauth client, as long as the client was granted scope.
+func RequiresAuthOrScope(scope string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		commonCtx := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx)
+		if commonCtx.ClientId != "" && !rbacutils.Contains(commonCtx.Scopes, scope) {
+			msg := "insufficient scope - requires " + scope + "."
+			log.Println(msg, "clientId:", commonCtx.ClientId)
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+		}
+		return verifyToken(c)
+	}
+}
+
+// RequiresPrincipalAuth is RequiresAuth that also accepts tokens of machine
+// clients parsed by ParseTokenPrincipal. tokens of clients acting for a user
+// are still rejected, pair it with RequirePermission.
+func RequiresPrincipalAuth(c *fiber.Ctx) error {
+	commonCtx := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx)
+	if commonCtx.ClientId != "" && commonCtx.UserId != "" {
+		msg := "token issued to an oauth client can not be used here."
+		log.Println(msg, "clientId:", commonCtx.ClientId)
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+	return verifyToken(c)
+}
+
+// AllowApiKey lets api keys through auth, one of the RequiresAuth middlewares,
+// which otherwise refuses them. only routes meant for scripts opt in, like
+// reading the user or the admin routes a key was scoped for.
+func AllowApiKey(auth fiber.Handler) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		// api keys were fully verified when parsed, and outlive sessions
+		if c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).ApiKeyId != "" {
+			return c.Next()
+		}
+		return auth(c)
+	}
+}
+
+// verifyToken checks the bearer token against the logout blacklist, disabled
+// accounts, revoked sessions and revoked clients, then validates its
+// signature and expiry.
+func verifyToken(c *fiber.Ctx) error {
+	if keyId := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).ApiKeyId; keyId != "" {
+		msg := "api keys can not be used here."
+		log.Println(msg, "keyId:", keyId)
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+	}
+
 	authHeader := c.Request().Header.Peek("Authorization")
 	authHeaderCopy := make([]byte, len(authHeader))
 	copy(authHeaderCopy, authHeader)
@@ -22,8 +83,8 @@ func RequiresAuth(c *fiber.Ctx) error {
 	if len(splitted) == 2 {
 		accessToken := splitted[1]
 
-		cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
-		cacheClient := cc.CacheClient
+		commonCtx := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx)
+		cacheClient := commonCtx.Clients.CacheClient
 
 		res, err := cacheClient.Get(accessToken)
 		if err != nil && err != customerrors.ErrNotFound {
@@ -35,6 +96,56 @@ func RequiresAuth(c *fiber.Ctx) error {
 			log.Println(msg)
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": msg, "payload": nil})
 		}
+
+		if commonCtx.UserId != "" {
+			disabled, err := sessionutils.IsUserDisabled(cacheClient, commonCtx.UserId)
+			if err != nil {
+				msg := "failed to lookup cache."
+				log.Println(msg, err)
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+			} else if disabled {
+				msg := "account is disabled."
+				log.Println(msg, "userId:", commonCtx.UserId)
+				return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+			}
+
+			revoked, err := sessionutils.IsSessionRevoked(cacheClient, commonCtx.UserId, commonCtx.IssuedAt)
+			if err != nil {
+				msg := "failed to lookup cache."
+				log.Println(msg, err)
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+			} else if revoked {
+				msg := "revoked token used."
+				log.Println(msg, "userId:", commonCtx.UserId)
+				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": msg, "payload": nil})
+			}
+		}
+
+		if commonCtx.ClientId != "" {
+			revoked, err := sessionutils.IsClientTokenRevoked(cacheClient, commonCtx.ClientId, commonCtx.IssuedAt)
+			if err != nil {
+				msg := "failed to lookup cache."
+				log.Println(msg, err)
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+			} else if revoked {
+				msg := "revoked token used."
+				log.Println(msg, "clientId:", commonCtx.ClientId)
+				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": msg, "payload": nil})
+			}
+		}
+
+		if commonCtx.GrantId != "" {
+			revoked, err := sessionutils.IsGrantRevoked(cacheClient, commonCtx.GrantId)
+			if err != nil {
+				msg := "failed to lookup cache."
+				log.Println(msg, err)
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": msg, "payload": nil})
+			} else if revoked {
+				msg := "revoked token used."
+				log.Println(msg, "clientId:", commonCtx.ClientId)
+				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": msg, "payload": nil})
+			}
+		}
 	} else {
 		msg := "invalid token provided."
 		log.Println(msg)
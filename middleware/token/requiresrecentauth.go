@@ -0,0 +1,32 @@
+package tokenmiddleware
+
+import (
+	"log"
+	"time"
+
+	commonmodels "github.com/alubhorta/goth/models/common"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// RequiresRecentAuth only lets through users who logged in or re-authenticated
+// at /api/v1/auth/reauth within maxAge, so a stolen token alone can't be used
+// for sensitive changes. it must run after ParseTokenUserId and RequiresAuth.
+func RequiresRecentAuth(maxAge time.Duration) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		commonCtx := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx)
+		if commonCtx.ApiKeyId != "" {
+			msg := "api keys can not be used here."
+			log.Println(msg, "keyId:", commonCtx.ApiKeyId)
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": msg, "payload": nil})
+		}
+
+		if commonCtx.AuthTime == 0 || time.Since(time.Unix(commonCtx.AuthTime, 0)) > maxAge {
+			msg := "recent authentication required - reauthenticate to continue."
+			log.Println(msg, "userId:", commonCtx.UserId, "authTime:", commonCtx.AuthTime)
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": msg, "payload": fiber.Map{"reauthRequired": true}})
+		}
+
+		return c.Next()
+	}
+}
@@ -0,0 +1,78 @@
+package auditmodels
+
+import "time"
+
+const (
+	ActionSignup         = "signup"
+	ActionLogin          = "login"
+	ActionLogout         = "logout"
+	ActionRefresh        = "refresh"
+	ActionResetInit      = "reset_init"
+	ActionResetVerify    = "reset_verify"
+	ActionPasswordChange = "password_change"
+	ActionProfileUpdate  = "profile_update"
+	ActionEmailChange    = "email_change"
+	ActionUsernameChange = "username_change"
+	ActionPhoneChange    = "phone_change"
+	ActionAccountDelete  = "account_delete"
+	ActionRoleGrant      = "role_grant"
+	ActionRoleRevoke     = "role_revoke"
+	ActionAccountDisable = "account_disable"
+	ActionAccountEnable  = "account_enable"
+	ActionForceReset     = "force_password_reset"
+	ActionRevokeSessions = "revoke_sessions"
+	ActionInviteCreate   = "invite_create"
+	ActionInviteRevoke   = "invite_revoke"
+	ActionOauthLogin     = "oauth_login"
+	ActionOauthLink      = "oauth_link"
+	ActionOauthUnlink    = "oauth_unlink"
+	ActionOauthConsent   = "oauth_consent"
+	ActionClientCreate   = "client_create"
+	ActionClientDelete   = "client_delete"
+	ActionClientScopes   = "client_scopes"
+	ActionApiKeyCreate   = "api_key_create"
+	ActionApiKeyRevoke   = "api_key_revoke"
+	ActionDeviceApprove  = "device_approve"
+	ActionDeviceDeny     = "device_deny"
+	ActionPasskeyAdd     = "passkey_add"
+	ActionPasskeyRemove  = "passkey_remove"
+	ActionMfaEnable      = "mfa_enable"
+	ActionMfaDisable     = "mfa_disable"
+	ActionNewDevice      = "new_device"
+	ActionDeviceReport   = "device_report"
+	ActionDeviceRemove   = "device_remove"
+	ActionReauth         = "reauth"
+)
+
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	// risk scoring asked for a second factor or a new login
+	OutcomeChallenge = "challenge"
+)
+
+type AuditEntry struct {
+	EntryId   string `json:"entryId" bson:"_id"`
+	Action    string `json:"action" bson:"action"`
+	Outcome   string `json:"outcome" bson:"outcome"`
+	ActorId   string `json:"actorId" bson:"actorId"`
+	Email     string `json:"email" bson:"email"`
+	Ip        string `json:"ip" bson:"ip"`
+	UserAgent string `json:"userAgent" bson:"userAgent"`
+	Reason    string `json:"reason" bson:"reason"`
+	// RiskScore is set for logins and refreshes when risk scoring is enabled
+	RiskScore *int      `json:"riskScore,omitempty" bson:"riskScore,omitempty"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+}
+
+type AuditQuery struct {
+	ActorId string
+	Email   string
+	Action  string
+	Outcome string
+	Ip      string
+	// MinRiskScore only matches risk scored entries of at least this score
+	MinRiskScore *int
+	From         *time.Time
+	To           *time.Time
+}
@@ -2,23 +2,58 @@ package authmodels
 
 import "time"
 
+// UserAuthCredential is unique by EmailKey, see validationutils.GetEmailKey,
+// and by the optional Username and Phone. PasswordHistory holds the previous hashed
+// passwords, newest last.
 type UserAuthCredential struct {
-	UserId         string    `json:"userId" bson:"_id"`
-	Email          string    `json:"email" bson:"email"`
-	HashedPassword string    `json:"hashedPassword" bson:"hashedPassword"`
-	CreatedAt      time.Time `json:"createdAt" bson:"createdAt"`
-	ModifiedAt     time.Time `json:"modifiedAt" bson:"modifiedAt"`
+	UserId                string     `json:"userId" bson:"_id"`
+	Email                 string     `json:"email" bson:"email"`
+	EmailKey              string     `json:"-" bson:"emailKey,omitempty"`
+	Username              string     `json:"username" bson:"username,omitempty"`
+	UsernameChangedAt     *time.Time `json:"usernameChangedAt" bson:"usernameChangedAt,omitempty"`
+	Phone                 string     `json:"phone" bson:"phone,omitempty"`
+	HashedPassword        string     `json:"hashedPassword" bson:"hashedPassword"`
+	PasswordHistory       []string   `json:"-" bson:"passwordHistory"`
+	Roles                 []string   `json:"roles" bson:"roles"`
+	Permissions           []string   `json:"permissions" bson:"permissions"`
+	Disabled              bool       `json:"disabled" bson:"disabled"`
+	PasswordResetRequired bool       `json:"passwordResetRequired" bson:"passwordResetRequired"`
+	MfaEnabled            bool       `json:"mfaEnabled" bson:"mfaEnabled"`
+	CreatedAt             time.Time  `json:"createdAt" bson:"createdAt"`
+	ModifiedAt            time.Time  `json:"modifiedAt" bson:"modifiedAt"`
 }
 
 type SignupInput struct {
-	Email     string `json:"email"`
-	FirstName string `json:"firstName"`
-	LastName  string `json:"lastName"`
-	Password  string `json:"password"`
+	Email      string `json:"email"`
+	Username   string `json:"username"`
+	FirstName  string `json:"firstName"`
+	LastName   string `json:"lastName"`
+	Password   string `json:"password"`
+	InviteCode string `json:"inviteCode"`
 }
 
+type SignupInvite struct {
+	InviteId   string     `json:"inviteId" bson:"_id"`
+	HashedCode string     `json:"-" bson:"hashedCode"`
+	Email      string     `json:"email" bson:"email"`
+	Role       string     `json:"role" bson:"role"`
+	CreatedBy  string     `json:"createdBy" bson:"createdBy"`
+	ExpiresAt  time.Time  `json:"expiresAt" bson:"expiresAt"`
+	UsedAt     *time.Time `json:"usedAt" bson:"usedAt"`
+	UsedBy     string     `json:"usedBy" bson:"usedBy"`
+	CreatedAt  time.Time  `json:"createdAt" bson:"createdAt"`
+}
+
+type CreateSignupInviteInput struct {
+	Email          string `json:"email"`
+	Role           string `json:"role"`
+	ExpiresInHours int    `json:"expiresInHours"`
+}
+
+// LoginInput identifies the user by either Email or Username.
 type LoginInput struct {
 	Email    string `json:"email"`
+	Username string `json:"username"`
 	Password string `json:"password"`
 }
 
@@ -31,12 +66,167 @@ type RefreshInput struct {
 	RefreshToken string `json:"refreshToken"`
 }
 
+type ChangePasswordInput struct {
+	CurrentPassword     string `json:"currentPassword"`
+	NewPassword         string `json:"newPassword"`
+	RevokeOtherSessions bool   `json:"revokeOtherSessions"`
+}
+
+// ResetInitInput identifies the user by either Email, to get the code by mail,
+// or by the verified Phone, to get it by sms.
 type ResetInitInput struct {
 	Email string `json:"email"`
+	Phone string `json:"phone"`
 }
 
 type ResetVerifyInput struct {
 	Email       string `json:"email"`
+	Phone       string `json:"phone"`
 	Otp         string `json:"otp"`
 	NewPassword string `json:"newPassword"`
 }
+
+type GrantRoleInput struct {
+	Role string `json:"role"`
+}
+
+// UserIdentity links an account at an external oauth/oidc provider to a user.
+type UserIdentity struct {
+	IdentityId string    `json:"identityId" bson:"_id"`
+	UserId     string    `json:"userId" bson:"userId"`
+	Provider   string    `json:"provider" bson:"provider"`
+	Subject    string    `json:"subject" bson:"subject"`
+	Email      string    `json:"email" bson:"email"`
+	CreatedAt  time.Time `json:"createdAt" bson:"createdAt"`
+}
+
+// ApiKey is a long-lived personal access token, looked up by its prefix. its
+// Scopes are the permissions of the owner it may use.
+type ApiKey struct {
+	KeyId      string     `json:"keyId" bson:"_id"`
+	UserId     string     `json:"userId" bson:"userId"`
+	Name       string     `json:"name" bson:"name"`
+	Prefix     string     `json:"prefix" bson:"prefix"`
+	HashedKey  string     `json:"-" bson:"hashedKey"`
+	Scopes     []string   `json:"scopes" bson:"scopes"`
+	ExpiresAt  *time.Time `json:"expiresAt" bson:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt" bson:"lastUsedAt"`
+	CreatedAt  time.Time  `json:"createdAt" bson:"createdAt"`
+}
+
+type CreateApiKeyInput struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expiresInDays"`
+}
+
+// Passkey is a WebAuthn credential of a user. its id is the base64url of the
+// credential id the authenticator chose.
+type Passkey struct {
+	PasskeyId  string     `json:"passkeyId" bson:"_id"`
+	UserId     string     `json:"userId" bson:"userId"`
+	Name       string     `json:"name" bson:"name"`
+	PublicKey  []byte     `json:"-" bson:"publicKey"`
+	SignCount  uint32     `json:"-" bson:"signCount"`
+	LastUsedAt *time.Time `json:"lastUsedAt" bson:"lastUsedAt"`
+	CreatedAt  time.Time  `json:"createdAt" bson:"createdAt"`
+}
+
+// PublicKeyCredential is the JSON form of a WebAuthn credential response, with
+// binary fields as base64url.
+type PublicKeyCredential struct {
+	Id       string `json:"id"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+type RegisterPasskeyInput struct {
+	Name       string              `json:"name"`
+	Credential PublicKeyCredential `json:"credential"`
+}
+
+type PasskeyLoginBeginInput struct {
+	MfaToken string `json:"mfaToken"`
+}
+
+type PasskeyLoginInput struct {
+	MfaToken   string              `json:"mfaToken"`
+	Credential PublicKeyCredential `json:"credential"`
+}
+
+type UpdateMfaInput struct {
+	Enabled bool `json:"enabled"`
+}
+
+// WebauthnCeremony is a started registration or login, cached under its
+// challenge. UserId is empty for passwordless logins, where the user is only
+// known from the passkey.
+type WebauthnCeremony struct {
+	Type   string `json:"type"`
+	UserId string `json:"userId"`
+	Mfa    bool   `json:"mfa"`
+}
+
+type SmsLoginBeginInput struct {
+	Phone string `json:"phone"`
+}
+
+type SmsLoginInput struct {
+	Phone string `json:"phone"`
+	Code  string `json:"code"`
+}
+
+// PendingSmsCode is cached until the code sent by sms to Phone is verified.
+type PendingSmsCode struct {
+	Phone string `json:"phone"`
+	Code  string `json:"code"`
+}
+
+// KnownDevice is a device a user logged in from, DeviceId is made of the
+// userId and the deviceutils.Fingerprint of the device.
+type KnownDevice struct {
+	DeviceId    string    `json:"deviceId" bson:"_id"`
+	UserId      string    `json:"userId" bson:"userId"`
+	Name        string    `json:"name" bson:"name"`
+	IpSubnet    string    `json:"ipSubnet" bson:"ipSubnet"`
+	LastIp      string    `json:"lastIp" bson:"lastIp"`
+	FirstSeenAt time.Time `json:"firstSeenAt" bson:"firstSeenAt"`
+	LastSeenAt  time.Time `json:"lastSeenAt" bson:"lastSeenAt"`
+}
+
+// PendingDeviceReport is cached for the "this wasn't me" link of a new device mail.
+type PendingDeviceReport struct {
+	UserId   string `json:"userId"`
+	DeviceId string `json:"deviceId"`
+}
+
+type ReportDeviceInput struct {
+	Token string `json:"token"`
+}
+
+// PendingLoginChallenge is cached until the code mailed for a risky login is
+// verified, RiskScore goes into the audit log of the completed login.
+type PendingLoginChallenge struct {
+	UserId    string `json:"userId"`
+	Code      string `json:"code"`
+	RiskScore int    `json:"riskScore"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+type LoginChallengeInput struct {
+	ChallengeToken string `json:"challengeToken"`
+	Code           string `json:"code"`
+}
+
+// ReauthInput proves the user once more, with Password or with a passkey
+// Credential from a ceremony started at /api/v1/auth/reauth/passkey/begin.
+type ReauthInput struct {
+	Password   string               `json:"password"`
+	Credential *PublicKeyCredential `json:"credential"`
+}
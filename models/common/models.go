@@ -6,8 +6,21 @@ import (
 )
 
 type CommonCtx struct {
-	Clients *CommonClients
-	UserId  string
+	Clients  *CommonClients
+	UserId   string
+	IssuedAt int64
+	// AuthTime is when the user last authenticated, 0 when unknown
+	AuthTime    int64
+	Amr         []string
+	Roles       []string
+	Permissions []string
+	OrgId       string
+	OrgRole     string
+	ClientId    string
+	Scopes      []string
+	// GrantId ties the tokens of a client to the authorization they came from
+	GrantId  string
+	ApiKeyId string
 }
 
 type CommonClients struct {
@@ -0,0 +1,48 @@
+package eventmodels
+
+import "time"
+
+const (
+	TypeUserCreated               = "user.created"
+	TypeUserUpdated               = "user.updated"
+	TypeUserDeleted               = "user.deleted"
+	TypeCredentialCreated         = "credential.created"
+	TypeCredentialPasswordChanged = "credential.password_changed"
+	TypeCredentialDeleted         = "credential.deleted"
+	TypeCredentialRoleGranted     = "credential.role_granted"
+	TypeCredentialRoleRevoked     = "credential.role_revoked"
+	TypeCredentialDisabled        = "credential.disabled"
+	TypeCredentialEnabled         = "credential.enabled"
+	TypeCredentialResetRequired   = "credential.password_reset_required"
+	TypeCredentialMfaEnabled      = "credential.mfa_enabled"
+	TypeCredentialMfaDisabled     = "credential.mfa_disabled"
+	TypeCredentialEmailChanged    = "credential.email_changed"
+	TypeCredentialUsernameChanged = "credential.username_changed"
+	TypeCredentialPhoneChanged    = "credential.phone_changed"
+	TypeIdentityLinked            = "identity.linked"
+	TypeIdentityUnlinked          = "identity.unlinked"
+	TypeOrgCreated                = "org.created"
+	TypeOrgUpdated                = "org.updated"
+	TypeOrgDeleted                = "org.deleted"
+	TypeOrgMemberAdded            = "org.member_added"
+	TypeOrgMemberUpdated          = "org.member_updated"
+	TypeOrgMemberRemoved          = "org.member_removed"
+)
+
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+)
+
+type Event struct {
+	EventId     string                 `json:"eventId" bson:"_id"`
+	Type        string                 `json:"type" bson:"type"`
+	UserId      string                 `json:"userId" bson:"userId"`
+	Payload     map[string]interface{} `json:"payload" bson:"payload"`
+	Status      string                 `json:"status" bson:"status"`
+	DeliveredTo []string               `json:"deliveredTo" bson:"deliveredTo"`
+	Attempts    int                    `json:"attempts" bson:"attempts"`
+	LastError   string                 `json:"lastError" bson:"lastError"`
+	CreatedAt   time.Time              `json:"createdAt" bson:"createdAt"`
+	DeliveredAt *time.Time             `json:"deliveredAt" bson:"deliveredAt,omitempty"`
+}
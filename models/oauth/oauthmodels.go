@@ -0,0 +1,91 @@
+package oauthmodels
+
+import "time"
+
+const (
+	GrantAuthorizationCode = "authorization_code"
+	GrantRefreshToken      = "refresh_token"
+	GrantClientCredentials = "client_credentials"
+	GrantDeviceCode        = "urn:ietf:params:oauth:grant-type:device_code"
+)
+
+// GrantTypes lists every supported grant type.
+var GrantTypes = []string{GrantAuthorizationCode, GrantRefreshToken, GrantClientCredentials, GrantDeviceCode}
+
+const (
+	DeviceStatusPending  = "pending"
+	DeviceStatusApproved = "approved"
+	DeviceStatusDenied   = "denied"
+)
+
+const (
+	ScopeOpenId  = "openid"
+	ScopeProfile = "profile"
+	ScopeEmail   = "email"
+)
+
+// OauthClient is an application registered to delegate login to goth, or a
+// machine client getting tokens of its own with the client_credentials grant.
+// public clients (e.g. SPAs and native apps) have no secret and rely on PKCE
+// alone. Scopes are the permissions a machine client may request.
+type OauthClient struct {
+	ClientId     string    `json:"clientId" bson:"_id"`
+	HashedSecret string    `json:"-" bson:"hashedSecret"`
+	Name         string    `json:"name" bson:"name"`
+	RedirectUris []string  `json:"redirectUris" bson:"redirectUris"`
+	Public       bool      `json:"public" bson:"public"`
+	GrantTypes   []string  `json:"grantTypes" bson:"grantTypes"`
+	Scopes       []string  `json:"scopes" bson:"scopes"`
+	CreatedBy    string    `json:"createdBy" bson:"createdBy"`
+	CreatedAt    time.Time `json:"createdAt" bson:"createdAt"`
+}
+
+type CreateOauthClientInput struct {
+	Name         string   `json:"name"`
+	RedirectUris []string `json:"redirectUris"`
+	Public       bool     `json:"public"`
+	GrantTypes   []string `json:"grantTypes"`
+	Scopes       []string `json:"scopes"`
+}
+
+type UpdateOauthClientScopesInput struct {
+	Scopes []string `json:"scopes"`
+}
+
+// OauthConsent remembers the scopes a user granted to a client.
+type OauthConsent struct {
+	ConsentId  string    `json:"consentId" bson:"_id"`
+	ClientId   string    `json:"clientId" bson:"clientId"`
+	UserId     string    `json:"userId" bson:"userId"`
+	Scopes     []string  `json:"scopes" bson:"scopes"`
+	CreatedAt  time.Time `json:"createdAt" bson:"createdAt"`
+	ModifiedAt time.Time `json:"modifiedAt" bson:"modifiedAt"`
+}
+
+// AuthorizationRequest is a validated /oauth/authorize request, cached while
+// the user logs in and consents. UserId and AuthTime are set after login.
+type AuthorizationRequest struct {
+	ClientId      string   `json:"clientId"`
+	RedirectUri   string   `json:"redirectUri"`
+	Scopes        []string `json:"scopes"`
+	State         string   `json:"state"`
+	Nonce         string   `json:"nonce"`
+	CodeChallenge string   `json:"codeChallenge"`
+	UserId        string   `json:"userId"`
+	AuthTime      int64    `json:"authTime"`
+}
+
+// DeviceAuthorization is a pending device authorization grant, cached under
+// the hash of its device code until it is approved, denied or expires.
+type DeviceAuthorization struct {
+	ClientId  string `json:"clientId"`
+	UserCode  string `json:"userCode"`
+	Status    string `json:"status"`
+	UserId    string `json:"userId"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+type DeviceDecisionInput struct {
+	UserCode string `json:"userCode"`
+	Approve  bool   `json:"approve"`
+}
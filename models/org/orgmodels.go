@@ -0,0 +1,59 @@
+package orgmodels
+
+import "time"
+
+const (
+	OrgRoleOwner  = "owner"
+	OrgRoleAdmin  = "admin"
+	OrgRoleMember = "member"
+)
+
+type Organization struct {
+	OrgId      string    `json:"orgId" bson:"_id"`
+	Name       string    `json:"name" bson:"name"`
+	OwnerId    string    `json:"ownerId" bson:"ownerId"`
+	CreatedAt  time.Time `json:"createdAt" bson:"createdAt"`
+	ModifiedAt time.Time `json:"modifiedAt" bson:"modifiedAt"`
+}
+
+type Membership struct {
+	MembershipId string    `json:"membershipId" bson:"_id"`
+	OrgId        string    `json:"orgId" bson:"orgId"`
+	UserId       string    `json:"userId" bson:"userId"`
+	Role         string    `json:"role" bson:"role"`
+	CreatedAt    time.Time `json:"createdAt" bson:"createdAt"`
+	ModifiedAt   time.Time `json:"modifiedAt" bson:"modifiedAt"`
+}
+
+type Invitation struct {
+	InvitationId string     `json:"invitationId" bson:"_id"`
+	OrgId        string     `json:"orgId" bson:"orgId"`
+	Email        string     `json:"email" bson:"email"`
+	Role         string     `json:"role" bson:"role"`
+	HashedToken  string     `json:"-" bson:"hashedToken"`
+	InvitedBy    string     `json:"invitedBy" bson:"invitedBy"`
+	ExpiresAt    time.Time  `json:"expiresAt" bson:"expiresAt"`
+	AcceptedAt   *time.Time `json:"acceptedAt" bson:"acceptedAt"`
+	CreatedAt    time.Time  `json:"createdAt" bson:"createdAt"`
+}
+
+type CreateOrgInput struct {
+	Name string `json:"name"`
+}
+
+type UpdateOrgInput struct {
+	Name string `json:"name"`
+}
+
+type UpdateMembershipInput struct {
+	Role string `json:"role"`
+}
+
+type InviteInput struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+type AcceptInvitationInput struct {
+	Token string `json:"token"`
+}
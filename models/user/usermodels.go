@@ -5,6 +5,8 @@ import "time"
 type UserInfo struct {
 	UserId        string    `json:"userId" bson:"_id"`
 	Email         string    `json:"email" bson:"email"`
+	Username      string    `json:"username" bson:"username,omitempty"`
+	Phone         string    `json:"phone" bson:"phone,omitempty"`
 	FirstName     string    `json:"firstName" bson:"firstName"`
 	LastName      string    `json:"lastName" bson:"lastName"`
 	Bio           string    `json:"bio" bson:"bio"`
@@ -15,6 +17,7 @@ type UserInfo struct {
 
 type CreateUserInfoInput struct {
 	Email     string `json:"email"`
+	Username  string `json:"username"`
 	FirstName string `json:"firstName"`
 	LastName  string `json:"lastName"`
 }
@@ -25,3 +28,41 @@ type UpdateUserInfoInput struct {
 	Bio           string `json:"bio"`
 	ProfileImgUrl string `json:"profileImgUrl"`
 }
+
+type ChangeEmailInput struct {
+	NewEmail string `json:"newEmail"`
+	Password string `json:"password"`
+}
+
+type ConfirmEmailChangeInput struct {
+	Code string `json:"code"`
+}
+
+// PendingEmailChange is cached per user until the code sent to the new
+// address is confirmed.
+type PendingEmailChange struct {
+	NewEmail  string `json:"newEmail"`
+	Code      string `json:"code"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+type ChangePhoneInput struct {
+	Phone    string `json:"phone"`
+	Password string `json:"password"`
+}
+
+type ConfirmPhoneChangeInput struct {
+	Code string `json:"code"`
+}
+
+type ChangeUsernameInput struct {
+	Username string `json:"username"`
+}
+
+// UsernameReservation keeps a replaced username for its previous owner until
+// ExpiresAt, so nobody else can pose as them right after a change.
+type UsernameReservation struct {
+	Username  string    `json:"username" bson:"_id"`
+	UserId    string    `json:"userId" bson:"userId"`
+	ExpiresAt time.Time `json:"expiresAt" bson:"expiresAt"`
+}
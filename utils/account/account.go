@@ -0,0 +1,74 @@
+package accountutils
+
+import (
+	"log"
+
+	orgaccess "github.com/alubhorta/goth/db/access/org"
+	commonmodels "github.com/alubhorta/goth/models/common"
+	orgmodels "github.com/alubhorta/goth/models/org"
+	sessionutils "github.com/alubhorta/goth/utils/session"
+)
+
+// GetSoleOwnedOrgs returns the ids of the orgs userId is the only owner of,
+// which would be left without one if the account was deleted.
+func GetSoleOwnedOrgs(orgAccess *orgaccess.OrgAccess, userId string) ([]string, error) {
+	memberships, err := orgAccess.ListMembershipsOfUser(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	orgIds := []string{}
+	for _, membership := range memberships {
+		if membership.Role != orgmodels.OrgRoleOwner {
+			continue
+		}
+		owners, err := orgAccess.CountOwners(membership.OrgId)
+		if err != nil {
+			return nil, err
+		} else if owners <= 1 {
+			orgIds = append(orgIds, membership.OrgId)
+		}
+	}
+	return orgIds, nil
+}
+
+// DeleteAccount signs userId out everywhere, then deletes its credential and
+// user info along with its org memberships, provider links, consents, api
+// keys, passkeys and known devices. it returns customerrors.ErrNotFound when
+// there is no credential. the sessions are revoked first, so a failure leaves
+// the account as it was.
+func DeleteAccount(clients *commonmodels.CommonClients, userId string) error {
+	dbclient := clients.DbClient
+
+	if err := sessionutils.RevokeAllSessions(clients.CacheClient, userId); err != nil {
+		return err
+	}
+
+	// TODO: [transaction safety] - find out a way to delete  both documents atomically
+	if err := dbclient.AuthAccess.DeleteAnAuthCredential(userId); err != nil {
+		return err
+	}
+	if err := dbclient.UserAccess.DeleteAUser(userId); err != nil {
+		log.Println("failed to delete user info.", err, "id:", userId)
+	}
+
+	if err := dbclient.OrgAccess.DeleteMembershipsOfUser(userId); err != nil {
+		log.Println("failed to delete org memberships.", err, "id:", userId)
+	}
+	if err := dbclient.IdentityAccess.DeleteIdentitiesOfUser(userId); err != nil {
+		log.Println("failed to delete linked oauth identities.", err, "id:", userId)
+	}
+	if err := dbclient.OauthClientAccess.DeleteConsentsOfUser(userId); err != nil {
+		log.Println("failed to delete oauth consents.", err, "id:", userId)
+	}
+	if err := dbclient.ApiKeyAccess.DeleteApiKeysOfUser(userId); err != nil {
+		log.Println("failed to delete api keys.", err, "id:", userId)
+	}
+	if err := dbclient.PasskeyAccess.DeletePasskeysOfUser(userId); err != nil {
+		log.Println("failed to delete passkeys.", err, "id:", userId)
+	}
+	if err := dbclient.DeviceAccess.DeleteDevicesOfUser(userId); err != nil {
+		log.Println("failed to delete known devices.", err, "id:", userId)
+	}
+	return nil
+}
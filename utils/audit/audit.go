@@ -0,0 +1,50 @@
+package auditutils
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	auditmodels "github.com/alubhorta/goth/models/audit"
+	commonmodels "github.com/alubhorta/goth/models/common"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// Record appends a security event for the current request to the audit log.
+// a failure to record is logged but never fails the request itself.
+func Record(c *fiber.Ctx, action, outcome, actorId, email, reason string) {
+	record(c, action, outcome, actorId, email, reason, nil)
+}
+
+// RecordRisk is Record for a login or refresh that was risk scored.
+func RecordRisk(c *fiber.Ctx, action, outcome, actorId, email, reason string, riskScore int) {
+	record(c, action, outcome, actorId, email, reason, &riskScore)
+}
+
+func record(c *fiber.Ctx, action, outcome, actorId, email, reason string, riskScore *int) {
+	commonCtx := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx)
+	dbclient := commonCtx.Clients.DbClient
+
+	// machine clients act without a user
+	if actorId == "" && commonCtx.UserId == "" && commonCtx.ClientId != "" {
+		actorId = "client:" + commonCtx.ClientId
+	}
+
+	entry := &auditmodels.AuditEntry{
+		EntryId:   fmt.Sprintf("%v", uuid.New()),
+		Action:    action,
+		Outcome:   outcome,
+		ActorId:   actorId,
+		Email:     email,
+		Ip:        c.IP(),
+		UserAgent: c.Get(fiber.HeaderUserAgent),
+		Reason:    reason,
+		RiskScore: riskScore,
+		CreatedAt: time.Now(),
+	}
+	if err := dbclient.AuditAccess.AppendEntry(entry); err != nil {
+		log.Println("failed to record audit entry.", err, "action:", action, "outcome:", outcome)
+	}
+}
@@ -0,0 +1,70 @@
+package deviceutils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"strings"
+)
+
+// browsers and operating systems by the user agent tokens telling them apart,
+// checked in order as e.g. edge and opera also claim to be chrome and safari
+var browserTokens = []struct{ token, name string }{
+	{"edg/", "Edge"},
+	{"opr/", "Opera"},
+	{"firefox/", "Firefox"},
+	{"fxios/", "Firefox"},
+	{"crios/", "Chrome"},
+	{"chrome/", "Chrome"},
+	{"safari/", "Safari"},
+}
+
+var osTokens = []struct{ token, name string }{
+	{"windows", "Windows"},
+	{"iphone", "iOS"},
+	{"ipad", "iOS"},
+	{"android", "Android"},
+	{"cros", "ChromeOS"},
+	{"mac os", "macOS"},
+	{"linux", "Linux"},
+}
+
+// Describe names the browser and operating system of a user agent, without
+// versions, like "Firefox on Windows".
+func Describe(userAgent string) string {
+	lowered := strings.ToLower(userAgent)
+	browser, os := "Unknown browser", "unknown OS"
+	for _, candidate := range browserTokens {
+		if strings.Contains(lowered, candidate.token) {
+			browser = candidate.name
+			break
+		}
+	}
+	for _, candidate := range osTokens {
+		if strings.Contains(lowered, candidate.token) {
+			os = candidate.name
+			break
+		}
+	}
+	return browser + " on " + os
+}
+
+// GetIpSubnet is the /24 network of an ipv4 or the /48 network of an ipv6
+// address, which stays the same across the address changes of most providers.
+func GetIpSubnet(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	} else if ipv4 := parsed.To4(); ipv4 != nil {
+		return (&net.IPNet{IP: ipv4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: parsed.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+}
+
+// Fingerprint identifies a device by its browser, operating system and
+// subnet, so browser updates or a new address from the same provider don't
+// make it a new device.
+func Fingerprint(userAgent, ip string) string {
+	sum := sha256.Sum256([]byte(Describe(userAgent) + "|" + GetIpSubnet(ip)))
+	return hex.EncodeToString(sum[:16])
+}
@@ -2,9 +2,11 @@ package emailutils
 
 import (
 	"errors"
+	"html"
 	"log"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/sendgrid/sendgrid-go"
 	"github.com/sendgrid/sendgrid-go/helpers/mail"
@@ -42,3 +44,99 @@ func SendOtpMail(toEmail, otp string) error {
 
 	return SendMail(toEmail, fromEmail, subject, htmlBody)
 }
+
+func SendOrgInvitationMail(toEmail, orgName, token string) error {
+	subject := "You're invited to join " + orgName + " | GOTH"
+	fromEmail := os.Getenv("FROM_EMAIL_ADDRESS")
+
+	// ORG_INVITATION_URL is the page of your app that accepts invitations, e.g.
+	// https://app.example.com/invitations/accept?token=
+	link := os.Getenv("ORG_INVITATION_URL") + token
+	htmlBody := "<p>You have been invited to join <strong>" + html.EscapeString(orgName) + "</strong>.</p>" +
+		"<p>Accept the invitation here: <a href=\"" + link + "\">" + link + "</a></p>"
+
+	return SendMail(toEmail, fromEmail, subject, htmlBody)
+}
+
+func SendPasswordChangedMail(toEmail string) error {
+	subject := "Your password was changed | GOTH"
+	fromEmail := os.Getenv("FROM_EMAIL_ADDRESS")
+	htmlBody := "<p>The password of your account was just changed.</p>" +
+		"<p>If this wasn't you, reset your password right away and review your account activity.</p>"
+
+	return SendMail(toEmail, fromEmail, subject, htmlBody)
+}
+
+func SendEmailChangeCodeMail(toEmail, code string) error {
+	subject := "Confirm your new email address | GOTH"
+	fromEmail := os.Getenv("FROM_EMAIL_ADDRESS")
+	htmlBody := "<p>Your email change confirmation code is: <strong>" + code + "</strong></p>"
+
+	return SendMail(toEmail, fromEmail, subject, htmlBody)
+}
+
+func SendEmailChangeNoticeMail(toEmail, newEmail string) error {
+	subject := "Your email address is being changed | GOTH"
+	fromEmail := os.Getenv("FROM_EMAIL_ADDRESS")
+	htmlBody := "<p>A change of your account's email address to <strong>" + html.EscapeString(newEmail) + "</strong> was requested.</p>" +
+		"<p>If this wasn't you, change your password right away and review your account activity.</p>"
+
+	return SendMail(toEmail, fromEmail, subject, htmlBody)
+}
+
+func SendWelcomeMail(toEmail string) error {
+	subject := "Welcome to GOTH"
+	fromEmail := os.Getenv("FROM_EMAIL_ADDRESS")
+	htmlBody := "<p>Your account was created, you can sign in now.</p>"
+
+	return SendMail(toEmail, fromEmail, subject, htmlBody)
+}
+
+// SendSignupAttemptMail tells the owner of a registered email about a signup
+// with it, which the signup response does not reveal in enumeration-safe mode.
+func SendSignupAttemptMail(toEmail string) error {
+	subject := "Someone tried to sign up with your email | GOTH"
+	fromEmail := os.Getenv("FROM_EMAIL_ADDRESS")
+	htmlBody := "<p>Someone tried to create an account with your email, which already has an account.</p>" +
+		"<p>If this was you, sign in instead, or reset your password if you forgot it. otherwise you can ignore this email.</p>"
+
+	return SendMail(toEmail, fromEmail, subject, htmlBody)
+}
+
+// SendEmailInUseMail tells the owner of a registered email that another account
+// tried to change its email to it.
+func SendEmailInUseMail(toEmail string) error {
+	subject := "Someone tried to use your email | GOTH"
+	fromEmail := os.Getenv("FROM_EMAIL_ADDRESS")
+	htmlBody := "<p>Another account tried to change its email to this address, which already has an account. its email was not changed.</p>" +
+		"<p>If this was you, sign in to this account instead. otherwise you can ignore this email.</p>"
+
+	return SendMail(toEmail, fromEmail, subject, htmlBody)
+}
+
+// SendNewDeviceMail tells about a login from a device not seen before, with a
+// link to report it when it wasn't the user.
+func SendNewDeviceMail(toEmail, deviceName, ip string, at time.Time, token string) error {
+	subject := "New sign-in to your account | GOTH"
+	fromEmail := os.Getenv("FROM_EMAIL_ADDRESS")
+
+	// DEVICE_REPORT_URL is the page of your app that reports a device, e.g.
+	// https://app.example.com/devices/report?token=
+	link := os.Getenv("DEVICE_REPORT_URL") + token
+	htmlBody := "<p>Your account was signed in to from a new device.</p>" +
+		"<p><strong>" + html.EscapeString(deviceName) + "</strong> from " + html.EscapeString(ip) + " at " + at.UTC().Format(time.RFC1123) + "</p>" +
+		"<p>If this was you, you can ignore this email. otherwise sign it out and secure your account here: <a href=\"" + link + "\">" + link + "</a></p>"
+
+	return SendMail(toEmail, fromEmail, subject, htmlBody)
+}
+
+// SendLoginChallengeMail sends the code that completes a login that looked
+// unusual.
+func SendLoginChallengeMail(toEmail, code string) error {
+	subject := "Confirm your sign-in | GOTH"
+	fromEmail := os.Getenv("FROM_EMAIL_ADDRESS")
+	htmlBody := "<p>A sign-in to your account looked unusual. confirm it with the code: <strong>" + code + "</strong></p>" +
+		"<p>If this wasn't you, change your password right away.</p>"
+
+	return SendMail(toEmail, fromEmail, subject, htmlBody)
+}
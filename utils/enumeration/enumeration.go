@@ -0,0 +1,45 @@
+package enumerationutils
+
+import (
+	"crypto/rand"
+	"math/big"
+	"os"
+	"strconv"
+	"time"
+)
+
+const defaultMinResponseTime = 400 * time.Millisecond
+
+// IsSafeMode tells if ENUMERATION_SAFE_MODE is on, where auth endpoints answer
+// the same for registered and unknown emails. the real outcome is only in the
+// audit log, or sent to the email itself.
+func IsSafeMode() bool {
+	safeMode, _ := strconv.ParseBool(os.Getenv("ENUMERATION_SAFE_MODE"))
+	return safeMode
+}
+
+// getMinResponseTime is the ENUMERATION_SAFE_MIN_RESPONSE_MS env.
+func getMinResponseTime() time.Duration {
+	ms, err := strconv.Atoi(os.Getenv("ENUMERATION_SAFE_MIN_RESPONSE_MS"))
+	if err != nil || ms < 0 {
+		return defaultMinResponseTime
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// PadResponse waits until the minimum response time has passed since start,
+// plus some jitter, so the work done for registered and unknown emails can't
+// be told apart by timing. it does nothing outside of safe mode.
+func PadResponse(start time.Time) {
+	if !IsSafeMode() {
+		return
+	}
+	minResponseTime := getMinResponseTime()
+	jitter := time.Duration(0)
+	if max := int64(minResponseTime / 10); max > 0 {
+		if n, err := rand.Int(rand.Reader, big.NewInt(max)); err == nil {
+			jitter = time.Duration(n.Int64())
+		}
+	}
+	time.Sleep(time.Until(start.Add(minResponseTime + jitter)))
+}
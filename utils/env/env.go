@@ -0,0 +1,21 @@
+package envutils
+
+import (
+	"log"
+	"os"
+	"strconv"
+)
+
+// GetInt reads a number from the env, the fallback is used when it's unset.
+// it's meant for config read at startup, so an invalid number is fatal.
+func GetInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalln("invalid "+key+", expected a number:", value)
+	}
+	return parsed
+}
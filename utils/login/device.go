@@ -0,0 +1,74 @@
+package loginutils
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	deviceaccess "github.com/alubhorta/goth/db/access/device"
+	auditmodels "github.com/alubhorta/goth/models/audit"
+	authmodels "github.com/alubhorta/goth/models/auth"
+	commonmodels "github.com/alubhorta/goth/models/common"
+	auditutils "github.com/alubhorta/goth/utils/audit"
+	deviceutils "github.com/alubhorta/goth/utils/device"
+	emailutils "github.com/alubhorta/goth/utils/email"
+	tokenutils "github.com/alubhorta/goth/utils/token"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+const deviceReportMaxAge = 7 * 24 * time.Hour
+
+// CheckDevice remembers the device of a login, and mails the user when it
+// wasn't seen before. the first device of a user is remembered silently.
+// failures are only logged, they never fail the login.
+func CheckDevice(c *fiber.Ctx, authCred *authmodels.UserAuthCredential) {
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+	deviceAccess := cc.DbClient.DeviceAccess
+
+	userAgent, ip := c.Get(fiber.HeaderUserAgent), c.IP()
+	now := time.Now()
+	device := &authmodels.KnownDevice{
+		DeviceId:    deviceaccess.GetDeviceId(authCred.UserId, deviceutils.Fingerprint(userAgent, ip)),
+		UserId:      authCred.UserId,
+		Name:        deviceutils.Describe(userAgent),
+		IpSubnet:    deviceutils.GetIpSubnet(ip),
+		LastIp:      ip,
+		FirstSeenAt: now,
+		LastSeenAt:  now,
+	}
+
+	count, err := deviceAccess.CountDevicesOfUser(authCred.UserId)
+	if err != nil {
+		log.Println("failed to count known devices.", err)
+		return
+	}
+	isNew, err := deviceAccess.TouchDevice(device)
+	if err != nil {
+		log.Println("failed to remember login device.", err)
+		return
+	} else if !isNew || count == 0 {
+		return
+	}
+
+	token, err := tokenutils.GenerateOpaqueToken(32)
+	if err != nil {
+		log.Println("failed to generate device report token.", err)
+		return
+	}
+	report, _ := json.Marshal(authmodels.PendingDeviceReport{UserId: authCred.UserId, DeviceId: device.DeviceId})
+	if err := cc.CacheClient.Set("deviceReport:"+tokenutils.HashOpaqueToken(token), string(report), deviceReportMaxAge); err != nil {
+		log.Println("failed to write to cache.", err)
+		return
+	}
+
+	log.Println("login from a new device.", "userId:", authCred.UserId, "device:", device.Name)
+	auditutils.Record(c, auditmodels.ActionNewDevice, auditmodels.OutcomeSuccess, authCred.UserId, authCred.Email, device.Name)
+	email, name := utils.CopyString(authCred.Email), utils.CopyString(device.Name)
+	go func() {
+		if err := emailutils.SendNewDeviceMail(email, name, ip, now, token); err != nil {
+			log.Println("failed to send new device mail.", err)
+		}
+	}()
+}
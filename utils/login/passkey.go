@@ -0,0 +1,67 @@
+package loginutils
+
+import (
+	"encoding/json"
+	"time"
+
+	customerrors "github.com/alubhorta/goth/custom/errors"
+	"github.com/alubhorta/goth/db/cacheclient"
+	authmodels "github.com/alubhorta/goth/models/auth"
+	tokenutils "github.com/alubhorta/goth/utils/token"
+	webauthnutils "github.com/alubhorta/goth/utils/webauthn"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const CeremonyMaxAge = 5 * time.Minute
+
+const (
+	CeremonyRegister = "register"
+	CeremonyLogin    = "login"
+	CeremonyReauth   = "reauth"
+)
+
+// StartCeremony caches a ceremony under a new challenge, which the browser
+// signs into clientDataJSON and so identifies the ceremony again on finish.
+func StartCeremony(cacheClient *cacheclient.RedisClient, ceremony *authmodels.WebauthnCeremony) (string, error) {
+	challenge, err := tokenutils.GenerateOpaqueToken(32)
+	if err != nil {
+		return "", err
+	}
+	val, err := json.Marshal(ceremony)
+	if err != nil {
+		return "", err
+	}
+	if err := cacheClient.Set("webauthnChallenge:"+challenge, string(val), CeremonyMaxAge); err != nil {
+		return "", err
+	}
+	return challenge, nil
+}
+
+// FinishCeremony consumes the ceremony whose challenge clientDataJSON carries,
+// so every challenge is only ever verified once.
+func FinishCeremony(cacheClient *cacheclient.RedisClient, clientDataJSON []byte, ceremonyType string) (*authmodels.WebauthnCeremony, string, error) {
+	challenge, err := webauthnutils.GetChallenge(clientDataJSON)
+	if err != nil {
+		return nil, "", customerrors.ErrNotFound
+	}
+	val, err := cacheClient.Take("webauthnChallenge:" + challenge)
+	if err != nil {
+		return nil, "", err
+	}
+	ceremony := new(authmodels.WebauthnCeremony)
+	if err := json.Unmarshal([]byte(val), ceremony); err != nil {
+		return nil, "", err
+	} else if ceremony.Type != ceremonyType {
+		return nil, "", customerrors.ErrNotFound
+	}
+	return ceremony, challenge, nil
+}
+
+func GetCredentialDescriptors(passkeys []*authmodels.Passkey) []fiber.Map {
+	descriptors := []fiber.Map{}
+	for _, passkey := range passkeys {
+		descriptors = append(descriptors, fiber.Map{"type": "public-key", "id": passkey.PasskeyId})
+	}
+	return descriptors
+}
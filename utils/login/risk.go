@@ -0,0 +1,51 @@
+package loginutils
+
+import (
+	"log"
+
+	authmodels "github.com/alubhorta/goth/models/auth"
+	commonmodels "github.com/alubhorta/goth/models/common"
+	riskutils "github.com/alubhorta/goth/utils/risk"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// RecordFailure counts a failed login with the account identifier for risk
+// scoring, userId is empty for unknown accounts.
+func RecordFailure(c *fiber.Ctx, userId, account string) {
+	if !riskutils.GetPolicy().Enabled {
+		return
+	}
+	cacheClient := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients.CacheClient
+
+	if userId != "" {
+		if err := riskutils.RecordFailure(cacheClient, userId); err != nil {
+			log.Println("failed to record login failure.", err)
+		}
+	}
+	if _, err := riskutils.CountIpAccount(cacheClient, c.IP(), account); err != nil {
+		log.Println("failed to count accounts of ip.", err)
+	}
+}
+
+// Assess risk scores a login that got the password right. it's nil when risk
+// scoring is disabled, or failed, which lets the login through as before.
+func Assess(c *fiber.Ctx, authCred *authmodels.UserAuthCredential, account string) *riskutils.Assessment {
+	if !riskutils.GetPolicy().Enabled {
+		return nil
+	}
+	cc := c.UserContext().Value(commonmodels.CommonCtx{}).(*commonmodels.CommonCtx).Clients
+
+	devices, err := cc.DbClient.DeviceAccess.ListDevicesOfUser(authCred.UserId)
+	if err != nil {
+		log.Println("failed to list known devices for risk scoring.", err)
+		return nil
+	}
+	assessment, err := riskutils.AssessLogin(cc.CacheClient, authCred.UserId, account, c.IP(), c.Get(fiber.HeaderUserAgent), devices)
+	if err != nil {
+		log.Println("failed to assess login risk.", err)
+		return nil
+	}
+	log.Println("assessed login.", assessment, "decision:", assessment.Decision, "userId:", authCred.UserId)
+	return assessment
+}
@@ -0,0 +1,204 @@
+package migrateutils
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	customerrors "github.com/alubhorta/goth/custom/errors"
+	"github.com/alubhorta/goth/db/cacheclient"
+	"github.com/alubhorta/goth/db/dbclient"
+	authmodels "github.com/alubhorta/goth/models/auth"
+	usermodels "github.com/alubhorta/goth/models/user"
+	rbacutils "github.com/alubhorta/goth/utils/rbac"
+	sessionutils "github.com/alubhorta/goth/utils/session"
+	validationutils "github.com/alubhorta/goth/utils/validation"
+)
+
+// MigrateEmails finds the accounts whose emails share a key since emails are
+// normalized, like Bob@Example.com and bob@example.com, and merges each group
+// into one account, then normalizes the emails of all accounts. it only logs
+// what it would do unless apply is set.
+//
+// the kept account is the oldest one with a password, or the oldest one when
+// none has a password. roles, provider links, passkeys, api keys and org
+// memberships of the others are moved to it, and so are their username, phone
+// and profile fields where the kept account has none. then the others are
+// signed out and deleted, their passwords, permissions and oauth consents are
+// dropped.
+func MigrateEmails(dbclient *dbclient.MongoDbClient, cacheClient *cacheclient.RedisClient, apply bool) {
+	authCreds, err := dbclient.AuthAccess.ListAuthCredentials()
+	if err != nil {
+		log.Fatalln("failed to list auth credentials.", err)
+	}
+
+	groups := map[string][]*authmodels.UserAuthCredential{}
+	keys := []string{}
+	unnormalized := 0
+	for _, authCred := range authCreds {
+		key := validationutils.GetEmailKey(authCred.Email)
+		if key == "" {
+			log.Println("WARNING: skipping invalid email of auth credential.", "userId:", authCred.UserId)
+			continue
+		}
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], authCred)
+		if validationutils.NormalizeEmail(authCred.Email) != authCred.Email || key != authCred.EmailKey {
+			unnormalized++
+		}
+	}
+
+	merged := 0
+	for _, key := range keys {
+		group := groups[key]
+		if len(group) < 2 {
+			continue
+		}
+		sort.SliceStable(group, func(i, j int) bool {
+			if (group[i].HashedPassword != "") != (group[j].HashedPassword != "") {
+				return group[i].HashedPassword != ""
+			}
+			return group[i].CreatedAt.Before(group[j].CreatedAt)
+		})
+
+		keeper := group[0]
+		log.Printf("email key %v: keeping userId=%v email=%v\n", key, keeper.UserId, keeper.Email)
+		for _, duplicate := range group[1:] {
+			log.Printf("email key %v: merging userId=%v email=%v\n", key, duplicate.UserId, duplicate.Email)
+			if !apply {
+				continue
+			}
+			if err := mergeAccount(dbclient, cacheClient, keeper, duplicate); err != nil {
+				log.Fatalln("failed to merge account.", err, "userId:", duplicate.UserId)
+			}
+			merged++
+		}
+	}
+
+	if !apply {
+		log.Println("emails to normalize:", unnormalized)
+		log.Println("dry run, nothing was changed. run with -apply to merge the accounts above and normalize the emails.")
+		return
+	}
+	if err := dbclient.AuthAccess.BackfillEmailKeys(); err != nil {
+		log.Fatalln("failed to normalize emails.", err)
+	}
+	log.Println("merged accounts:", merged, "; normalized emails:", unnormalized)
+}
+
+func mergeAccount(dbclient *dbclient.MongoDbClient, cacheClient *cacheclient.RedisClient, keeper, duplicate *authmodels.UserAuthCredential) error {
+	// tokens of the duplicate must not outlive its account
+	if err := sessionutils.RevokeAllSessions(cacheClient, duplicate.UserId); err != nil {
+		return err
+	}
+
+	for _, role := range duplicate.Roles {
+		if rbacutils.Contains(keeper.Roles, role) {
+			continue
+		}
+		if err := dbclient.AuthAccess.AddRole(keeper.UserId, role); err != nil {
+			return err
+		}
+		keeper.Roles = append(keeper.Roles, role)
+	}
+
+	moved, err := dbclient.IdentityAccess.MoveIdentities(duplicate.UserId, keeper.UserId)
+	if err != nil {
+		return err
+	}
+	log.Println("moved provider links:", moved, "userId:", duplicate.UserId)
+	if err := dbclient.PasskeyAccess.MovePasskeys(duplicate.UserId, keeper.UserId); err != nil {
+		return err
+	}
+	if err := dbclient.ApiKeyAccess.MoveApiKeys(duplicate.UserId, keeper.UserId); err != nil {
+		return err
+	}
+	if err := dbclient.OrgAccess.MoveMemberships(duplicate.UserId, keeper.UserId); err != nil {
+		return err
+	}
+	if err := mergeProfile(dbclient, keeper.UserId, duplicate.UserId); err != nil {
+		return err
+	}
+
+	// links to providers the keeper has already are left over
+	if err := dbclient.IdentityAccess.DeleteIdentitiesOfUser(duplicate.UserId); err != nil {
+		return err
+	}
+	if err := dbclient.OauthClientAccess.DeleteConsentsOfUser(duplicate.UserId); err != nil {
+		return err
+	}
+	if err := dbclient.DeviceAccess.DeleteDevicesOfUser(duplicate.UserId); err != nil {
+		return err
+	}
+	if err := dbclient.AuthAccess.DeleteAnAuthCredential(duplicate.UserId); err != nil {
+		return err
+	}
+	if err := dbclient.UserAccess.DeleteAUser(duplicate.UserId); err != nil {
+		return err
+	}
+
+	// usernames and phones are unique, so they can only move once the
+	// duplicate is gone. a failure is logged with the value to restore it by hand
+	if duplicate.Username != "" {
+		if keeper.Username != "" {
+			log.Println("dropped username of merged account.", "username:", duplicate.Username, "userId:", duplicate.UserId)
+		} else if err := dbclient.AuthAccess.UpdateUsername(keeper.UserId, "", duplicate.Username, time.Time{}); err != nil {
+			log.Println("failed to move username of merged account.", err, "username:", duplicate.Username, "userId:", keeper.UserId)
+			return err
+		} else {
+			keeper.Username = duplicate.Username
+		}
+	}
+	if duplicate.Phone != "" {
+		if keeper.Phone != "" {
+			log.Println("dropped phone of merged account.", "phone:", duplicate.Phone, "userId:", duplicate.UserId)
+		} else if err := dbclient.AuthAccess.UpdatePhone(keeper.UserId, "", duplicate.Phone); err != nil {
+			log.Println("failed to move phone of merged account.", err, "phone:", duplicate.Phone, "userId:", keeper.UserId)
+			return err
+		} else {
+			keeper.Phone = duplicate.Phone
+		}
+	}
+	return nil
+}
+
+// mergeProfile fills the empty profile fields of the keeper with those of the
+// duplicate, and logs the ones that differ, which are dropped.
+func mergeProfile(dbclient *dbclient.MongoDbClient, keeperId, duplicateId string) error {
+	keeperInfo, err := dbclient.UserAccess.GetAUser(keeperId)
+	if err != nil {
+		return err
+	}
+	duplicateInfo, err := dbclient.UserAccess.GetAUser(duplicateId)
+	if err == customerrors.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	input := &usermodels.UpdateUserInfoInput{
+		FirstName:     keeperInfo.FirstName,
+		LastName:      keeperInfo.LastName,
+		Bio:           keeperInfo.Bio,
+		ProfileImgUrl: keeperInfo.ProfileImgUrl,
+	}
+	changed := false
+	merge := func(name string, kept *string, other string) {
+		if *kept == "" && other != "" {
+			*kept, changed = other, true
+		} else if other != "" && other != *kept {
+			log.Println("dropped profile field of merged account.", name+":", other, "userId:", duplicateId)
+		}
+	}
+	merge("firstName", &input.FirstName, duplicateInfo.FirstName)
+	merge("lastName", &input.LastName, duplicateInfo.LastName)
+	merge("bio", &input.Bio, duplicateInfo.Bio)
+	merge("profileImgUrl", &input.ProfileImgUrl, duplicateInfo.ProfileImgUrl)
+
+	if !changed {
+		return nil
+	}
+	return dbclient.UserAccess.UpdateAUser(keeperId, input)
+}
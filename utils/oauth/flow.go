@@ -0,0 +1,216 @@
+package oauthutils
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	validationutils "github.com/alubhorta/goth/utils/validation"
+)
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// Identity is what goth needs to know about a user authenticated by a provider.
+type Identity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	FirstName     string
+	LastName      string
+}
+
+// GetPkceChallenge derives the S256 code challenge of a PKCE code verifier.
+func GetPkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (p *Provider) GetAuthorizeUrl(state, codeVerifier string) string {
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", p.ClientId)
+	query.Set("redirect_uri", p.GetRedirectUri())
+	query.Set("scope", strings.Join(p.Scopes, " "))
+	query.Set("state", state)
+	query.Set("code_challenge", GetPkceChallenge(codeVerifier))
+	query.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(p.AuthUrl, "?") {
+		separator = "&"
+	}
+	return p.AuthUrl + separator + query.Encode()
+}
+
+// ExchangeCode trades an authorization code for the provider's access token.
+func (p *Provider) ExchangeCode(code, codeVerifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.GetRedirectUri())
+	form.Set("client_id", p.ClientId)
+	form.Set("client_secret", p.ClientSecret)
+	form.Set("code_verifier", codeVerifier)
+
+	req, err := http.NewRequest(http.MethodPost, p.TokenUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	body := struct {
+		AccessToken      string `json:"access_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}{}
+	if err := doJSON(req, &body); err != nil {
+		return "", err
+	} else if body.Error != "" {
+		return "", fmt.Errorf("token exchange failed: %v %v", body.Error, body.ErrorDescription)
+	} else if body.AccessToken == "" {
+		return "", errors.New("token exchange failed: no access token returned")
+	}
+	return body.AccessToken, nil
+}
+
+// FetchIdentity returns the identity with a normalized email, which is empty
+// when the provider's email is invalid.
+func (p *Provider) FetchIdentity(accessToken string) (*Identity, error) {
+	fetch := p.fetchOidcIdentity
+	if p.Kind == KindGithub {
+		fetch = p.fetchGithubIdentity
+	}
+	identity, err := fetch(accessToken)
+	if err != nil {
+		return nil, err
+	}
+	identity.Email = validationutils.NormalizeEmail(identity.Email)
+	return identity, nil
+}
+
+func (p *Provider) fetchOidcIdentity(accessToken string) (*Identity, error) {
+	req, err := p.newUserInfoRequest(p.UserInfoUrl, accessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := struct {
+		Sub           string      `json:"sub"`
+		Email         string      `json:"email"`
+		EmailVerified interface{} `json:"email_verified"`
+		GivenName     string      `json:"given_name"`
+		FamilyName    string      `json:"family_name"`
+		Name          string      `json:"name"`
+	}{}
+	if err := doJSON(req, &claims); err != nil {
+		return nil, err
+	} else if claims.Sub == "" {
+		return nil, errors.New("userinfo response has no subject")
+	}
+
+	identity := &Identity{
+		Subject:   claims.Sub,
+		Email:     claims.Email,
+		FirstName: claims.GivenName,
+		LastName:  claims.FamilyName,
+	}
+	// some providers send email_verified as a string
+	switch verified := claims.EmailVerified.(type) {
+	case bool:
+		identity.EmailVerified = verified
+	case string:
+		identity.EmailVerified, _ = strconv.ParseBool(verified)
+	}
+	if identity.FirstName == "" {
+		identity.FirstName, identity.LastName = splitName(claims.Name)
+	}
+	return identity, nil
+}
+
+func (p *Provider) fetchGithubIdentity(accessToken string) (*Identity, error) {
+	req, err := p.newUserInfoRequest(p.UserInfoUrl, accessToken)
+	if err != nil {
+		return nil, err
+	}
+	user := struct {
+		Id    int64  `json:"id"`
+		Login string `json:"login"`
+		Name  string `json:"name"`
+	}{}
+	if err := doJSON(req, &user); err != nil {
+		return nil, err
+	} else if user.Id == 0 {
+		return nil, errors.New("github user response has no id")
+	}
+
+	identity := &Identity{Subject: strconv.FormatInt(user.Id, 10)}
+	identity.FirstName, identity.LastName = splitName(user.Name)
+	if identity.FirstName == "" {
+		identity.FirstName = user.Login
+	}
+
+	// the profile email may be private or unverified, so use the primary one
+	req, err = p.newUserInfoRequest(strings.TrimSuffix(p.UserInfoUrl, "/")+"/emails", accessToken)
+	if err != nil {
+		return nil, err
+	}
+	emails := []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}{}
+	if err := doJSON(req, &emails); err != nil {
+		return nil, err
+	}
+	for _, email := range emails {
+		if email.Primary {
+			identity.Email = email.Email
+			identity.EmailVerified = email.Verified
+		}
+	}
+	return identity, nil
+}
+
+func (p *Provider) newUserInfoRequest(url, accessToken string) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+	return req, nil
+}
+
+func doJSON(req *http.Request, out interface{}) error {
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("%v responded with status %v: %v", req.URL.Host, res.StatusCode, string(body))
+	}
+	return json.Unmarshal(body, out)
+}
+
+func splitName(name string) (string, string) {
+	parts := strings.SplitN(strings.TrimSpace(name), " ", 2)
+	if len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return parts[0], ""
+}
@@ -0,0 +1,271 @@
+package oauthutils
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testClientId     = "goth-client"
+	testClientSecret = "goth-secret"
+	testCode         = "the-code"
+	testVerifier     = "the-code-verifier-of-at-least-43-characters-x"
+	testAccessToken  = "provider-access-token"
+)
+
+// mockOidcServer is an oidc provider that issues testAccessToken for testCode,
+// and describes userinfo as its user. failDiscovery makes the discovery
+// document fail that many times first.
+type mockOidcServer struct {
+	*httptest.Server
+	userinfo      map[string]interface{}
+	failDiscovery int32
+	discoveries   int32
+}
+
+func newMockOidcServer(t *testing.T) *mockOidcServer {
+	m := &mockOidcServer{
+		userinfo: map[string]interface{}{
+			"sub":            "subject-1",
+			"email":          "Bob@Example.com",
+			"email_verified": true,
+			"given_name":     "Bob",
+			"family_name":    "Smith",
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&m.discoveries, 1)
+		if atomic.AddInt32(&m.failDiscovery, -1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.URL,
+			"authorization_endpoint": m.URL + "/authorize",
+			"token_endpoint":         m.URL + "/token",
+			"userinfo_endpoint":      m.URL + "/userinfo",
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Method != http.MethodPost || r.Form.Get("grant_type") != "authorization_code" ||
+			r.Form.Get("client_id") != testClientId || r.Form.Get("client_secret") != testClientSecret {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		}
+		if r.Form.Get("code") != testCode || r.Form.Get("code_verifier") != testVerifier {
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": "bad code"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"access_token": testAccessToken, "token_type": "Bearer"})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+testAccessToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(m.userinfo)
+	})
+
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+func (m *mockOidcServer) newProvider() *Provider {
+	return &Provider{
+		Name:         "mock",
+		Kind:         KindOidc,
+		ClientId:     testClientId,
+		ClientSecret: testClientSecret,
+		Issuer:       m.URL,
+		Scopes:       []string{"openid", "email", "profile"},
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	m := newMockOidcServer(t)
+	provider := m.newProvider()
+
+	if err := provider.discover(); err != nil {
+		t.Fatal("discovery failed:", err)
+	}
+	if provider.AuthUrl != m.URL+"/authorize" || provider.TokenUrl != m.URL+"/token" || provider.UserInfoUrl != m.URL+"/userinfo" {
+		t.Fatal("endpoints not discovered:", provider.AuthUrl, provider.TokenUrl, provider.UserInfoUrl)
+	}
+	if err := provider.discover(); err != nil || m.discoveries != 1 {
+		t.Fatal("discovery should only run once, ran", m.discoveries, err)
+	}
+}
+
+func TestDiscoveryKeepsConfiguredEndpoints(t *testing.T) {
+	m := newMockOidcServer(t)
+	provider := m.newProvider()
+	provider.AuthUrl = "https://login.example.com/authorize"
+
+	if err := provider.discover(); err != nil {
+		t.Fatal("discovery failed:", err)
+	}
+	if provider.AuthUrl != "https://login.example.com/authorize" || provider.TokenUrl != m.URL+"/token" {
+		t.Fatal("configured endpoint overwritten:", provider.AuthUrl, provider.TokenUrl)
+	}
+}
+
+func TestDiscoveryRetriesAfterFailure(t *testing.T) {
+	defer func(delay time.Duration) { discoveryRetryDelay = delay }(discoveryRetryDelay)
+	discoveryRetryDelay = time.Hour
+
+	m := newMockOidcServer(t)
+	m.failDiscovery = 1
+	provider := m.newProvider()
+
+	if err := provider.discover(); err == nil {
+		t.Fatal("expected the first discovery to fail")
+	}
+	// within the delay the failure is returned without asking again
+	if err := provider.discover(); err == nil || m.discoveries != 1 {
+		t.Fatal("discovery retried too early, ran", m.discoveries, err)
+	}
+
+	discoveryRetryDelay = 0
+	if err := provider.discover(); err != nil {
+		t.Fatal("discovery not retried:", err)
+	}
+	if provider.TokenUrl != m.URL+"/token" || m.discoveries != 2 {
+		t.Fatal("endpoints not discovered on retry, ran", m.discoveries)
+	}
+}
+
+func TestConcurrentDiscovery(t *testing.T) {
+	m := newMockOidcServer(t)
+	provider := m.newProvider()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := provider.discover(); err != nil {
+				t.Error("discovery failed:", err)
+				return
+			}
+			if !strings.HasPrefix(provider.GetAuthorizeUrl("state", testVerifier), m.URL+"/authorize?") {
+				t.Error("authorize url without the discovered endpoint")
+			}
+		}()
+	}
+	wg.Wait()
+	if m.discoveries != 1 {
+		t.Fatal("discovery should run once, ran", m.discoveries)
+	}
+}
+
+func TestAuthorizeUrl(t *testing.T) {
+	t.Setenv("OAUTH_REDIRECT_BASE_URL", "https://auth.example.com/")
+	m := newMockOidcServer(t)
+	provider := m.newProvider()
+	if err := provider.discover(); err != nil {
+		t.Fatal("discovery failed:", err)
+	}
+
+	parsed, err := url.Parse(provider.GetAuthorizeUrl("the-state", testVerifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := parsed.Query()
+	expected := map[string]string{
+		"response_type":         "code",
+		"client_id":             testClientId,
+		"redirect_uri":          "https://auth.example.com/api/v1/auth/oauth/mock/callback",
+		"scope":                 "openid email profile",
+		"state":                 "the-state",
+		"code_challenge":        GetPkceChallenge(testVerifier),
+		"code_challenge_method": "S256",
+	}
+	for key, value := range expected {
+		if query.Get(key) != value {
+			t.Error("unexpected", key+":", query.Get(key))
+		}
+	}
+}
+
+func TestExchangeCodeAndFetchIdentity(t *testing.T) {
+	m := newMockOidcServer(t)
+	provider := m.newProvider()
+	if err := provider.discover(); err != nil {
+		t.Fatal("discovery failed:", err)
+	}
+
+	accessToken, err := provider.ExchangeCode(testCode, testVerifier)
+	if err != nil || accessToken != testAccessToken {
+		t.Fatal("code exchange failed:", accessToken, err)
+	}
+	identity, err := provider.FetchIdentity(accessToken)
+	if err != nil {
+		t.Fatal("fetching identity failed:", err)
+	}
+	if identity.Subject != "subject-1" || identity.Email != "bob@example.com" || !identity.EmailVerified ||
+		identity.FirstName != "Bob" || identity.LastName != "Smith" {
+		t.Fatalf("unexpected identity: %+v", identity)
+	}
+}
+
+func TestExchangeCodeErrors(t *testing.T) {
+	m := newMockOidcServer(t)
+	provider := m.newProvider()
+	if err := provider.discover(); err != nil {
+		t.Fatal("discovery failed:", err)
+	}
+
+	if _, err := provider.ExchangeCode("wrong-code", testVerifier); err == nil {
+		t.Fatal("expected a wrong code to fail")
+	}
+	if _, err := provider.ExchangeCode(testCode, "wrong-verifier"); err == nil {
+		t.Fatal("expected a wrong code verifier to fail")
+	}
+	provider.ClientSecret = "wrong-secret"
+	if _, err := provider.ExchangeCode(testCode, testVerifier); err == nil {
+		t.Fatal("expected a wrong client secret to fail")
+	}
+}
+
+func TestFetchIdentityClaims(t *testing.T) {
+	m := newMockOidcServer(t)
+	provider := m.newProvider()
+	if err := provider.discover(); err != nil {
+		t.Fatal("discovery failed:", err)
+	}
+
+	// a string email_verified and only a full name
+	m.userinfo = map[string]interface{}{"sub": "subject-2", "email": "alice@example.com", "email_verified": "false", "name": "Alice van Dyke"}
+	identity, err := provider.FetchIdentity(testAccessToken)
+	if err != nil {
+		t.Fatal("fetching identity failed:", err)
+	}
+	if identity.EmailVerified || identity.FirstName != "Alice" || identity.LastName != "van Dyke" {
+		t.Fatalf("unexpected identity: %+v", identity)
+	}
+
+	m.userinfo = map[string]interface{}{"sub": "subject-3", "email": "not an email", "email_verified": true}
+	if identity, err := provider.FetchIdentity(testAccessToken); err != nil || identity.Email != "" {
+		t.Fatalf("expected an invalid email to be dropped: %+v %v", identity, err)
+	}
+
+	m.userinfo = map[string]interface{}{"email": "carol@example.com"}
+	if _, err := provider.FetchIdentity(testAccessToken); err == nil {
+		t.Fatal("expected a userinfo response without subject to fail")
+	}
+	if _, err := provider.FetchIdentity("wrong-token"); err == nil {
+		t.Fatal("expected a wrong access token to fail")
+	}
+}
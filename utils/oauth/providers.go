@@ -0,0 +1,183 @@
+package oauthutils
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	KindOidc   = "oidc"
+	KindGithub = "github"
+)
+
+var ErrUnknownProvider = errors.New("unknown oauth provider")
+
+type Provider struct {
+	Name         string
+	Kind         string
+	ClientId     string
+	ClientSecret string
+	Issuer       string
+	AuthUrl      string
+	TokenUrl     string
+	UserInfoUrl  string
+	Scopes       []string
+
+	// the endpoints are only written under discoverMu, and read once discover returned
+	discoverMu      sync.Mutex
+	discovered      bool
+	discoverErr     error
+	lastDiscoveryAt time.Time
+}
+
+// how long a failed discovery is not retried, so a provider that is down isn't
+// asked on every login
+var discoveryRetryDelay = 10 * time.Second
+
+// presets fill in whatever a well-known provider doesn't need configured.
+var presets = map[string]*Provider{
+	"google": {
+		Kind:   KindOidc,
+		Issuer: "https://accounts.google.com",
+		Scopes: []string{"openid", "email", "profile"},
+	},
+	"github": {
+		Kind:        KindGithub,
+		AuthUrl:     "https://github.com/login/oauth/authorize",
+		TokenUrl:    "https://github.com/login/oauth/access_token",
+		UserInfoUrl: "https://api.github.com/user",
+		Scopes:      []string{"read:user", "user:email"},
+	},
+}
+
+var providers map[string]*Provider
+var providersOnce sync.Once
+
+// GetProvider returns the provider configured under name. providers are listed
+// in the comma separated OAUTH_PROVIDERS env, and each one is configured by
+// OAUTH_<NAME>_* env variables.
+func GetProvider(name string) (*Provider, error) {
+	providersOnce.Do(loadProviders)
+
+	provider, ok := providers[name]
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+	if err := provider.discover(); err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
+
+func loadProviders() {
+	providers = map[string]*Provider{}
+
+	for _, name := range strings.Split(os.Getenv("OAUTH_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		provider := &Provider{Name: name, Kind: KindOidc, Scopes: []string{"openid", "email", "profile"}}
+		if preset, ok := presets[name]; ok {
+			provider.Kind = preset.Kind
+			provider.Issuer = preset.Issuer
+			provider.AuthUrl = preset.AuthUrl
+			provider.TokenUrl = preset.TokenUrl
+			provider.UserInfoUrl = preset.UserInfoUrl
+			provider.Scopes = preset.Scopes
+		}
+
+		envPrefix := "OAUTH_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		provider.ClientId = os.Getenv(envPrefix + "CLIENT_ID")
+		provider.ClientSecret = os.Getenv(envPrefix + "CLIENT_SECRET")
+		if val := os.Getenv(envPrefix + "ISSUER"); val != "" {
+			provider.Issuer = strings.TrimSuffix(val, "/")
+		}
+		if val := os.Getenv(envPrefix + "AUTH_URL"); val != "" {
+			provider.AuthUrl = val
+		}
+		if val := os.Getenv(envPrefix + "TOKEN_URL"); val != "" {
+			provider.TokenUrl = val
+		}
+		if val := os.Getenv(envPrefix + "USERINFO_URL"); val != "" {
+			provider.UserInfoUrl = val
+		}
+		if val := os.Getenv(envPrefix + "SCOPES"); val != "" {
+			provider.Scopes = strings.Split(val, " ")
+		}
+
+		if provider.ClientId == "" {
+			log.Fatalln("missing", envPrefix+"CLIENT_ID", "for oauth provider", name)
+		}
+		providers[name] = provider
+		log.Println("configured oauth provider:", name)
+	}
+}
+
+// discover fills in the endpoints of an oidc provider from its discovery
+// document, unless they were configured explicitly. once it succeeded it
+// doesn't run again, a failure is retried after discoveryRetryDelay.
+func (p *Provider) discover() error {
+	p.discoverMu.Lock()
+	defer p.discoverMu.Unlock()
+
+	if p.discovered {
+		return nil
+	} else if p.Kind != KindOidc || p.Issuer == "" || (p.AuthUrl != "" && p.TokenUrl != "" && p.UserInfoUrl != "") {
+		p.discovered = true
+		return nil
+	} else if p.discoverErr != nil && time.Since(p.lastDiscoveryAt) < discoveryRetryDelay {
+		return p.discoverErr
+	}
+
+	p.lastDiscoveryAt = time.Now()
+	p.discoverErr = p.fetchDiscovery()
+	if p.discoverErr != nil {
+		log.Println("failed oidc discovery.", p.discoverErr, "provider:", p.Name)
+		return p.discoverErr
+	}
+	p.discovered = true
+	return nil
+}
+
+func (p *Provider) fetchDiscovery() error {
+	req, err := http.NewRequest(http.MethodGet, p.Issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return err
+	}
+	config := struct {
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	}{}
+	if err := doJSON(req, &config); err != nil {
+		return err
+	}
+
+	authUrl, tokenUrl, userInfoUrl := p.AuthUrl, p.TokenUrl, p.UserInfoUrl
+	if authUrl == "" {
+		authUrl = config.AuthorizationEndpoint
+	}
+	if tokenUrl == "" {
+		tokenUrl = config.TokenEndpoint
+	}
+	if userInfoUrl == "" {
+		userInfoUrl = config.UserinfoEndpoint
+	}
+	if authUrl == "" || tokenUrl == "" || userInfoUrl == "" {
+		return errors.New("oidc discovery document is missing endpoints")
+	}
+	p.AuthUrl, p.TokenUrl, p.UserInfoUrl = authUrl, tokenUrl, userInfoUrl
+	return nil
+}
+
+// GetRedirectUri is the callback url registered with the provider.
+func (p *Provider) GetRedirectUri() string {
+	return strings.TrimSuffix(os.Getenv("OAUTH_REDIRECT_BASE_URL"), "/") + "/api/v1/auth/oauth/" + p.Name + "/callback"
+}
@@ -0,0 +1,30 @@
+package oidcutils
+
+import (
+	"strings"
+
+	usermodels "github.com/alubhorta/goth/models/user"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// GetUserClaims returns the standard OIDC claims of userInfo that the given
+// scopes grant access to.
+func GetUserClaims(userInfo *usermodels.UserInfo, scopes []string) jwt.MapClaims {
+	claims := jwt.MapClaims{}
+	for _, scope := range scopes {
+		switch scope {
+		case "profile":
+			claims["name"] = strings.TrimSpace(userInfo.FirstName + " " + userInfo.LastName)
+			claims["given_name"] = userInfo.FirstName
+			claims["family_name"] = userInfo.LastName
+			if userInfo.ProfileImgUrl != "" {
+				claims["picture"] = userInfo.ProfileImgUrl
+			}
+			claims["updated_at"] = userInfo.ModifiedAt.Unix()
+		case "email":
+			claims["email"] = userInfo.Email
+		}
+	}
+	return claims
+}
@@ -0,0 +1,103 @@
+package oidcutils
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"log"
+	"math/big"
+	"os"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+var signingKey *rsa.PrivateKey
+var signingKeyId string
+var signingKeyOnce sync.Once
+
+// LoadSigningKey loads the RSA key that signs id tokens from the PEM file set
+// in OIDC_SIGNING_KEY_FILE. without one, a key is generated on startup, which
+// invalidates all id tokens on restart and can't be shared between replicas.
+func LoadSigningKey() {
+	signingKeyOnce.Do(func() {
+		keyFile := os.Getenv("OIDC_SIGNING_KEY_FILE")
+		if keyFile == "" {
+			log.Println("WARNING: OIDC_SIGNING_KEY_FILE is not set, generating an ephemeral id token signing key.")
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			if err != nil {
+				log.Fatalln("failed to generate signing key.", err)
+			}
+			signingKey = key
+		} else {
+			key, err := readPrivateKey(keyFile)
+			if err != nil {
+				log.Fatalln("failed to load signing key.", err)
+			}
+			signingKey = key
+		}
+
+		der, err := x509.MarshalPKIXPublicKey(&signingKey.PublicKey)
+		if err != nil {
+			log.Fatalln("failed to encode signing key.", err)
+		}
+		sum := sha256.Sum256(der)
+		signingKeyId = base64.RawURLEncoding.EncodeToString(sum[:12])
+	})
+}
+
+func readPrivateKey(keyFile string) (*rsa.PrivateKey, error) {
+	contents, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, errors.New("no PEM block found in " + keyFile)
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("signing key must be an RSA key")
+	}
+	return key, nil
+}
+
+// SignToken signs claims with the id token signing key.
+func SignToken(claims jwt.MapClaims) (string, error) {
+	LoadSigningKey()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = signingKeyId
+	return token.SignedString(signingKey)
+}
+
+// GetJwks returns the public signing key as a JSON Web Key Set.
+func GetJwks() map[string]interface{} {
+	LoadSigningKey()
+
+	publicKey := signingKey.PublicKey
+	return map[string]interface{}{
+		"keys": []map[string]interface{}{
+			{
+				"kty": "RSA",
+				"use": "sig",
+				"alg": "RS256",
+				"kid": signingKeyId,
+				"n":   base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes()),
+			},
+		},
+	}
+}
@@ -0,0 +1,120 @@
+package outboxutils
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	outboxaccess "github.com/alubhorta/goth/db/access/outbox"
+	eventmodels "github.com/alubhorta/goth/models/event"
+)
+
+// Relay periodically publishes pending outbox events to all sinks and marks
+// them delivered once every sink has accepted them. delivery is at-least-once.
+type Relay struct {
+	Outbox    *outboxaccess.OutboxAccess
+	Sinks     []Sink
+	Interval  time.Duration
+	BatchSize int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewRelayFromEnv(outbox *outboxaccess.OutboxAccess, sinks []Sink) *Relay {
+	intervalInSeconds, err := strconv.Atoi(os.Getenv("OUTBOX_POLL_INTERVAL_IN_SECONDS"))
+	if err != nil || intervalInSeconds <= 0 {
+		intervalInSeconds = 5
+	}
+
+	return &Relay{
+		Outbox:    outbox,
+		Sinks:     sinks,
+		Interval:  time.Second * time.Duration(intervalInSeconds),
+		BatchSize: 100,
+	}
+}
+
+func (r *Relay) Start() {
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+
+	go func() {
+		defer close(r.done)
+
+		ticker := time.NewTicker(r.Interval)
+		defer ticker.Stop()
+
+		for {
+			r.relayPending()
+
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	log.Println("started outbox relay with", len(r.Sinks), "sink(s).")
+}
+
+func (r *Relay) Stop() {
+	if r.stop == nil {
+		return
+	}
+	log.Println("stopping outbox relay...")
+	close(r.stop)
+	<-r.done
+}
+
+func (r *Relay) relayPending() {
+	if len(r.Sinks) == 0 {
+		return
+	}
+
+	events, err := r.Outbox.GetPendingEvents(r.BatchSize)
+	if err != nil {
+		log.Println("failed to read pending outbox events.", err)
+		return
+	}
+
+	for _, event := range events {
+		if err := r.publish(event); err != nil {
+			log.Println("failed to publish outbox event.", err, "eventId:", event.EventId)
+			if err := r.Outbox.MarkFailedAttempt(event.EventId, err.Error()); err != nil {
+				log.Println("failed to record outbox delivery attempt.", err, "eventId:", event.EventId)
+			}
+			continue
+		}
+
+		if err := r.Outbox.MarkDelivered(event.EventId); err != nil {
+			log.Println("failed to mark outbox event delivered.", err, "eventId:", event.EventId)
+		}
+	}
+}
+
+// publish sends the event to every sink that has not received it yet.
+func (r *Relay) publish(event *eventmodels.Event) error {
+	for _, sink := range r.Sinks {
+		if containsString(event.DeliveredTo, sink.Name()) {
+			continue
+		}
+		if err := sink.Publish(event); err != nil {
+			return err
+		}
+		if err := r.Outbox.MarkDeliveredTo(event.EventId, sink.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,143 @@
+package outboxutils
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/alubhorta/goth/db/cacheclient"
+	eventmodels "github.com/alubhorta/goth/models/event"
+)
+
+// Sink is a destination that outbox events are published to.
+// Publish may be called more than once for the same event, consumers should
+// deduplicate on the event id.
+type Sink interface {
+	Name() string
+	Publish(event *eventmodels.Event) error
+}
+
+type StdoutSink struct{}
+
+func (s *StdoutSink) Name() string {
+	return "stdout"
+}
+
+func (s *StdoutSink) Publish(event *eventmodels.Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(body))
+	return nil
+}
+
+type WebhookSink struct {
+	Url string
+	// when set, the body is signed with HMAC-SHA256 in the X-Goth-Signature header
+	Secret string
+	client *http.Client
+}
+
+func (s *WebhookSink) Name() string {
+	return "webhook"
+}
+
+func (s *WebhookSink) Publish(event *eventmodels.Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Goth-Event-Id", event.EventId)
+	req.Header.Set("X-Goth-Event-Type", event.Type)
+	if s.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(s.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Goth-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	if s.client == nil {
+		s.client = &http.Client{Timeout: 10 * time.Second}
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %v", res.StatusCode)
+	}
+	return nil
+}
+
+type RedisStreamSink struct {
+	CacheClient *cacheclient.RedisClient
+	Stream      string
+}
+
+func (s *RedisStreamSink) Name() string {
+	return "redis"
+}
+
+func (s *RedisStreamSink) Publish(event *eventmodels.Event) error {
+	payload, err := json.Marshal(event.Payload)
+	if err != nil {
+		return err
+	}
+
+	return s.CacheClient.XAdd(s.Stream, map[string]interface{}{
+		"eventId":   event.EventId,
+		"type":      event.Type,
+		"userId":    event.UserId,
+		"payload":   string(payload),
+		"createdAt": event.CreatedAt.Format(time.RFC3339Nano),
+	})
+}
+
+// GetSinksFromEnv builds the sinks listed in the comma separated OUTBOX_SINKS env.
+func GetSinksFromEnv(cacheClient *cacheclient.RedisClient) ([]Sink, error) {
+	sinks := []Sink{}
+
+	for _, name := range strings.Split(os.Getenv("OUTBOX_SINKS"), ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+			continue
+		case "stdout":
+			sinks = append(sinks, &StdoutSink{})
+		case "webhook":
+			url := os.Getenv("OUTBOX_WEBHOOK_URL")
+			if url == "" {
+				return nil, fmt.Errorf("OUTBOX_WEBHOOK_URL is required for the webhook sink")
+			}
+			sinks = append(sinks, &WebhookSink{Url: url, Secret: os.Getenv("OUTBOX_WEBHOOK_SECRET")})
+		case "redis":
+			stream := os.Getenv("OUTBOX_REDIS_STREAM")
+			if stream == "" {
+				stream = "goth:events"
+			}
+			sinks = append(sinks, &RedisStreamSink{CacheClient: cacheClient, Stream: stream})
+		default:
+			return nil, fmt.Errorf("unknown outbox sink: %v", name)
+		}
+	}
+
+	if len(sinks) == 0 {
+		log.Println("no outbox sinks configured, events will stay pending in the outbox.")
+	}
+	return sinks, nil
+}
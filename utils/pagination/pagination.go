@@ -0,0 +1,28 @@
+package paginationutils
+
+import (
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const DEFAULT_LIMIT = 20
+const MAX_LIMIT = 100
+
+// GetPagination reads the 1-based `page` and `limit` query params, falling back
+// to sane defaults for missing or out of range values.
+func GetPagination(c *fiber.Ctx) (int64, int64) {
+	page, err := strconv.ParseInt(c.Query("page"), 10, 64)
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	limit, err := strconv.ParseInt(c.Query("limit"), 10, 64)
+	if err != nil || limit < 1 {
+		limit = DEFAULT_LIMIT
+	} else if limit > MAX_LIMIT {
+		limit = MAX_LIMIT
+	}
+
+	return page, limit
+}
@@ -0,0 +1,126 @@
+package passwordutils
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+var ErrInvalidBreachedHash = errors.New("invalid breached password hash, expected 40 hex characters")
+var ErrUnsortedBreachedList = errors.New("breached password hashes are not sorted")
+
+// a hash, a ":count" suffix and a line break fit in here
+const maxBreachedLineLength = 64
+
+// breachedList looks up SHA-1 hashes of breached passwords in a file sorted
+// by hash, like the ordered Have I Been Pwned download, with a binary search
+// on disk. the file can be much larger than the memory, a lookup reads a few
+// dozen lines of it.
+type breachedList struct {
+	file *os.File
+	size int64
+}
+
+// openBreachedList opens a file of one uppercase or lowercase SHA-1 hash per
+// line, with an optional ":count" suffix as in the Have I Been Pwned
+// downloads, sorted by hash. a few lines are checked, the rest is trusted.
+func openBreachedList(path string) (*breachedList, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	list := &breachedList{file: file, size: info.Size()}
+
+	previous := ""
+	for _, offset := range []int64{0, list.size / 4, list.size / 2, list.size * 3 / 4, list.size - 1} {
+		hash, _, err := list.lineAt(offset)
+		if err != nil {
+			file.Close()
+			return nil, err
+		} else if hash == "" {
+			continue
+		} else if _, err := hex.DecodeString(hash); err != nil || len(hash) != 40 {
+			file.Close()
+			return nil, ErrInvalidBreachedHash
+		} else if hash < previous {
+			file.Close()
+			return nil, ErrUnsortedBreachedList
+		}
+		previous = hash
+	}
+	return list, nil
+}
+
+// lineAt reads the first line starting at or after offset, returning its
+// uppercase hash and where it starts. the hash is empty past the last line.
+func (l *breachedList) lineAt(offset int64) (string, int64, error) {
+	start := offset
+	if offset > 0 {
+		// offset may be in the middle of a line, the line break before the
+		// next one tells where it starts
+		start = offset - 1
+	}
+	if start >= l.size {
+		return "", l.size, nil
+	}
+
+	buf := make([]byte, 2*maxBreachedLineLength)
+	n, err := l.file.ReadAt(buf, start)
+	if err != nil && err != io.EOF {
+		return "", 0, err
+	}
+	buf = buf[:n]
+	if offset > 0 {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			if n == len(buf) {
+				return "", 0, ErrInvalidBreachedHash
+			}
+			return "", l.size, nil
+		}
+		buf, start = buf[i+1:], start+int64(i+1)
+	}
+	if i := bytes.IndexByte(buf, '\n'); i >= 0 {
+		buf = buf[:i]
+	} else if len(buf) > maxBreachedLineLength {
+		return "", 0, ErrInvalidBreachedHash
+	}
+
+	line := strings.TrimSpace(string(buf))
+	return strings.ToUpper(strings.SplitN(line, ":", 2)[0]), start, nil
+}
+
+func (l *breachedList) contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	target := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	// the first offset whose line has a hash of at least target
+	lo, hi := int64(0), l.size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		hash, start, err := l.lineAt(mid)
+		if err != nil {
+			return false, err
+		}
+		if start >= l.size || hash >= target {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+
+	hash, _, err := l.lineAt(lo)
+	if err != nil {
+		return false, err
+	}
+	return hash == target, nil
+}
@@ -1,13 +1,390 @@
 package passwordutils
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	envutils "github.com/alubhorta/goth/utils/env"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	AlgorithmArgon2id = "argon2id"
+	AlgorithmScrypt   = "scrypt"
+	AlgorithmBcrypt   = "bcrypt"
+)
+
+const saltLength = 16
+const keyLength = 32
+
+var ErrInvalidHash = errors.New("invalid encoded password hash")
+
+// Hasher hashes passwords into self describing strings, which carry the
+// algorithm and its parameters, so hashes of older settings stay verifiable.
+type Hasher interface {
+	Hash(password []byte, peppered bool) (string, error)
+	// Verify tells if the password matches, and if the hash was peppered
+	Verify(encodedHash string, password []byte) (matches bool, peppered bool, err error)
+	// IsOutdated tells if a hash of this algorithm uses other parameters
+	IsOutdated(encodedHash string) bool
+	// Validate checks the configured parameters
+	Validate() error
+}
+
+type HashConfig struct {
+	Algorithm string
+	Hashers   map[string]Hasher
+	// a server side secret mixed into every new hash, kept out of the database
+	pepper []byte
+}
+
+var hashConfig *HashConfig
+var hashConfigOnce sync.Once
+
+// GetHashConfig returns the password hashing configured by the PASSWORD_HASH_*
+// env, read once. argon2id is the default, scrypt and bcrypt are supported too.
+func GetHashConfig() *HashConfig {
+	hashConfigOnce.Do(func() {
+		hashConfig = &HashConfig{
+			Algorithm: strings.ToLower(strings.TrimSpace(os.Getenv("PASSWORD_HASH_ALGORITHM"))),
+			Hashers: map[string]Hasher{
+				AlgorithmArgon2id: &argon2idHasher{
+					memory:  uint32(envutils.GetInt("PASSWORD_HASH_ARGON2_MEMORY_KIB", 19*1024)),
+					time:    uint32(envutils.GetInt("PASSWORD_HASH_ARGON2_ITERATIONS", 2)),
+					threads: uint8(envutils.GetInt("PASSWORD_HASH_ARGON2_PARALLELISM", 1)),
+				},
+				AlgorithmScrypt: &scryptHasher{
+					logN: envutils.GetInt("PASSWORD_HASH_SCRYPT_LOG_N", 17),
+					r:    envutils.GetInt("PASSWORD_HASH_SCRYPT_R", 8),
+					p:    envutils.GetInt("PASSWORD_HASH_SCRYPT_P", 1),
+				},
+				AlgorithmBcrypt: &bcryptHasher{cost: envutils.GetInt("PASSWORD_HASH_BCRYPT_COST", bcrypt.DefaultCost)},
+			},
+			pepper: []byte(os.Getenv("PASSWORD_PEPPER")),
+		}
+		if hashConfig.Algorithm == "" {
+			hashConfig.Algorithm = AlgorithmArgon2id
+		} else if _, ok := hashConfig.Hashers[hashConfig.Algorithm]; !ok {
+			log.Fatalln("invalid PASSWORD_HASH_ALGORITHM, expected one of argon2id, scrypt or bcrypt:", hashConfig.Algorithm)
+		}
+		if err := hashConfig.Hashers[hashConfig.Algorithm].Validate(); err != nil {
+			log.Fatalln("invalid PASSWORD_HASH_* parameters.", err)
+		}
+		if len(hashConfig.pepper) != 0 && hashConfig.Algorithm == AlgorithmBcrypt {
+			log.Fatalln("PASSWORD_PEPPER is not supported with bcrypt, use argon2id or scrypt.")
+		}
+	})
+	return hashConfig
+}
+
+// getHasher picks the hasher for an encoded hash by its algorithm id.
+func (hc *HashConfig) getHasher(encodedHash string) (Hasher, string) {
+	parts := strings.SplitN(encodedHash, "$", 3)
+	if len(parts) < 3 || parts[0] != "" {
+		return nil, ""
+	}
+	switch parts[1] {
+	case "argon2id":
+		return hc.Hashers[AlgorithmArgon2id], AlgorithmArgon2id
+	case "scrypt":
+		return hc.Hashers[AlgorithmScrypt], AlgorithmScrypt
+	case "2a", "2b", "2y":
+		return hc.Hashers[AlgorithmBcrypt], AlgorithmBcrypt
+	}
+	return nil, ""
+}
+
+func (hc *HashConfig) applyPepper(password []byte) []byte {
+	mac := hmac.New(sha256.New, hc.pepper)
+	mac.Write(password)
+	return mac.Sum(nil)
+}
 
 func GetHashedPassword(password string) (string, error) {
-	hashedPass, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	return string(hashedPass), err
+	hc := GetHashConfig()
+	peppered := len(hc.pepper) != 0
+	input := []byte(password)
+	if peppered {
+		input = hc.applyPepper(input)
+	}
+	return hc.Hashers[hc.Algorithm].Hash(input, peppered)
 }
 
 func DoesPasswordMatchHash(originalHashedPassword, testPassword string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(originalHashedPassword), []byte(testPassword))
-	return err == nil
+	hc := GetHashConfig()
+	hasher, _ := hc.getHasher(originalHashedPassword)
+	if hasher == nil {
+		return false
+	}
+
+	// the pp=1 marker is read without hashing, so the password is hashed once
+	_, peppered, err := hasher.Verify(originalHashedPassword, nil)
+	if err != nil {
+		log.Println("failed to verify password hash.", err)
+		return false
+	}
+	input := []byte(testPassword)
+	if peppered {
+		if len(hc.pepper) == 0 {
+			log.Println("failed to verify a peppered password hash, PASSWORD_PEPPER is not set.")
+			return false
+		}
+		input = hc.applyPepper(input)
+	}
+
+	matches, _, err := hasher.Verify(originalHashedPassword, input)
+	if err != nil {
+		log.Println("failed to verify password hash.", err)
+		return false
+	}
+	return matches
+}
+
+// NeedsRehash tells if a hash was made with another algorithm, other
+// parameters or without the current pepper, and should be replaced on the next
+// successful login.
+func NeedsRehash(hashedPassword string) bool {
+	hc := GetHashConfig()
+	hasher, algorithm := hc.getHasher(hashedPassword)
+	if hasher == nil || algorithm != hc.Algorithm {
+		return true
+	}
+	if hasher.IsOutdated(hashedPassword) {
+		return true
+	}
+	_, peppered, err := hasher.Verify(hashedPassword, nil)
+	return err != nil || peppered != (len(hc.pepper) != 0)
+}
+
+func generateSalt() ([]byte, error) {
+	salt := make([]byte, saltLength)
+	_, err := rand.Read(salt)
+	return salt, err
+}
+
+// phcHash is the $id$params$salt$key format of the password hashing
+// competition, with params like m=19456,t=2,p=1. pp=1 marks a peppered hash.
+type phcHash struct {
+	id      string
+	version string
+	params  map[string]int
+	salt    []byte
+	key     []byte
+}
+
+func parsePhcHash(encodedHash string) (*phcHash, error) {
+	parts := strings.Split(encodedHash, "$")
+	if len(parts) < 5 || len(parts) > 6 || parts[0] != "" {
+		return nil, ErrInvalidHash
+	}
+	phc := &phcHash{id: parts[1], params: map[string]int{}}
+	if len(parts) == 6 {
+		// the optional version, like v=19 of argon2
+		phc.version = parts[2]
+		parts = append(parts[:2], parts[3:]...)
+	}
+	for _, param := range strings.Split(parts[2], ",") {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			return nil, ErrInvalidHash
+		}
+		value, err := strconv.Atoi(kv[1])
+		if err != nil || value < 0 {
+			return nil, ErrInvalidHash
+		}
+		phc.params[kv[0]] = value
+	}
+
+	var err error
+	if phc.salt, err = base64.RawStdEncoding.DecodeString(parts[3]); err != nil {
+		return nil, ErrInvalidHash
+	}
+	if phc.key, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil || len(phc.key) == 0 {
+		return nil, ErrInvalidHash
+	}
+	return phc, nil
+}
+
+func formatPhcHash(id, version, params string, peppered bool, salt, key []byte) string {
+	if peppered {
+		params += ",pp=1"
+	}
+	segments := []string{"", id}
+	if version != "" {
+		segments = append(segments, version)
+	}
+	segments = append(segments, params, base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+	return strings.Join(segments, "$")
+}
+
+type argon2idHasher struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+}
+
+func (h *argon2idHasher) Validate() error {
+	if h.memory < 8*uint32(h.threads) || h.time < 1 || h.threads < 1 {
+		return errors.New("argon2id needs at least 1 iteration, 1 thread and 8 KiB of memory per thread")
+	}
+	return nil
+}
+
+func (h *argon2idHasher) Hash(password []byte, peppered bool) (string, error) {
+	salt, err := generateSalt()
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey(password, salt, h.time, h.memory, h.threads, keyLength)
+	params := fmt.Sprintf("m=%v,t=%v,p=%v", h.memory, h.time, h.threads)
+	return formatPhcHash("argon2id", fmt.Sprintf("v=%v", argon2.Version), params, peppered, salt, key), nil
+}
+
+func (h *argon2idHasher) Verify(encodedHash string, password []byte) (bool, bool, error) {
+	phc, err := parsePhcHash(encodedHash)
+	if err != nil {
+		return false, false, err
+	} else if phc.version != fmt.Sprintf("v=%v", argon2.Version) {
+		return false, false, ErrInvalidHash
+	}
+	memory, time, threads := phc.params["m"], phc.params["t"], phc.params["p"]
+	// bound the parameters, a tampered hash must not exhaust the server
+	if time < 1 || threads < 1 || threads > 255 || memory < 8*threads || memory > 4*1024*1024 || time > 100 {
+		return false, false, ErrInvalidHash
+	}
+	peppered := phc.params["pp"] == 1
+	if password == nil {
+		return false, peppered, nil
+	}
+
+	key := argon2.IDKey(password, phc.salt, uint32(time), uint32(memory), uint8(threads), uint32(len(phc.key)))
+	return subtle.ConstantTimeCompare(key, phc.key) == 1, peppered, nil
+}
+
+func (h *argon2idHasher) IsOutdated(encodedHash string) bool {
+	phc, err := parsePhcHash(encodedHash)
+	return err != nil ||
+		phc.params["m"] != int(h.memory) || phc.params["t"] != int(h.time) || phc.params["p"] != int(h.threads) ||
+		len(phc.key) != keyLength
+}
+
+type scryptHasher struct {
+	logN int
+	r    int
+	p    int
+}
+
+func (h *scryptHasher) Validate() error {
+	if h.logN < 1 || h.logN > 24 || h.r < 1 || h.p < 1 || h.r*h.p >= 1<<30 {
+		return errors.New("scrypt needs a log N of 1 to 24, and an r and p of at least 1")
+	}
+	return nil
+}
+
+func (h *scryptHasher) Hash(password []byte, peppered bool) (string, error) {
+	salt, err := generateSalt()
+	if err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key(password, salt, 1<<h.logN, h.r, h.p, keyLength)
+	if err != nil {
+		return "", err
+	}
+	params := fmt.Sprintf("ln=%v,r=%v,p=%v", h.logN, h.r, h.p)
+	return formatPhcHash("scrypt", "", params, peppered, salt, key), nil
+}
+
+func (h *scryptHasher) Verify(encodedHash string, password []byte) (bool, bool, error) {
+	phc, err := parsePhcHash(encodedHash)
+	if err != nil {
+		return false, false, err
+	}
+	logN, r, p := phc.params["ln"], phc.params["r"], phc.params["p"]
+	// bound the parameters, a tampered hash must not exhaust the server
+	if logN < 1 || logN > 24 || r < 1 || r > 64 || p < 1 || p > 16 {
+		return false, false, ErrInvalidHash
+	}
+	peppered := phc.params["pp"] == 1
+	if password == nil {
+		return false, peppered, nil
+	}
+
+	key, err := scrypt.Key(password, phc.salt, 1<<logN, r, p, len(phc.key))
+	if err != nil {
+		return false, false, err
+	}
+	return subtle.ConstantTimeCompare(key, phc.key) == 1, peppered, nil
+}
+
+func (h *scryptHasher) IsOutdated(encodedHash string) bool {
+	phc, err := parsePhcHash(encodedHash)
+	return err != nil ||
+		phc.params["ln"] != h.logN || phc.params["r"] != h.r || phc.params["p"] != h.p ||
+		len(phc.key) != keyLength
+}
+
+// bcryptHasher keeps hashes of earlier versions verifiable. bcrypt only looks
+// at the first 72 bytes of a password, and it can't carry the pepper marker.
+type bcryptHasher struct {
+	cost int
+}
+
+func (h *bcryptHasher) Validate() error {
+	if h.cost < bcrypt.MinCost || h.cost > bcrypt.MaxCost {
+		return fmt.Errorf("bcrypt needs a cost of %v to %v", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	return nil
+}
+
+func (h *bcryptHasher) Hash(password []byte, peppered bool) (string, error) {
+	if peppered {
+		return "", errors.New("bcrypt hashes can't be peppered")
+	}
+	hashedPass, err := bcrypt.GenerateFromPassword(password, h.cost)
+	return string(hashedPass), err
+}
+
+func (h *bcryptHasher) Verify(encodedHash string, password []byte) (bool, bool, error) {
+	if password == nil {
+		_, err := bcrypt.Cost([]byte(encodedHash))
+		return false, false, err
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(encodedHash), password)
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, false, nil
+	}
+	return err == nil, false, err
+}
+
+func (h *bcryptHasher) IsOutdated(encodedHash string) bool {
+	cost, err := bcrypt.Cost([]byte(encodedHash))
+	return err != nil || cost != h.cost
+}
+
+var dummyHash string
+var dummyHashOnce sync.Once
+
+// SimulateVerify takes as long as verifying a password against a real hash, for
+// logins of unknown emails to not answer faster than those of registered ones.
+func SimulateVerify(password string) {
+	dummyHashOnce.Do(func() {
+		var err error
+		if dummyHash, err = GetHashedPassword("dummy password to spend time on"); err != nil {
+			log.Println("could not hash dummy password.", err)
+		}
+	})
+	DoesPasswordMatchHash(dummyHash, password)
 }
@@ -0,0 +1,243 @@
+package passwordutils
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+
+	envutils "github.com/alubhorta/goth/utils/env"
+)
+
+// bcrypt only looks at the first 72 bytes of a password, the other hashers
+// take any length but hashing huge passwords is a cheap way to load the server
+const maxBcryptPasswordLength = 72
+const maxPasswordLength = 1024
+const defaultMaxPasswordLength = 128
+
+const (
+	ClassLower  = "lower"
+	ClassUpper  = "upper"
+	ClassDigit  = "digit"
+	ClassSymbol = "symbol"
+)
+
+// violation codes, stable for clients to map to their own messages
+const (
+	CodeTooShort         = "too_short"
+	CodeTooLong          = "too_long"
+	CodeMissingLower     = "missing_lower"
+	CodeMissingUpper     = "missing_upper"
+	CodeMissingDigit     = "missing_digit"
+	CodeMissingSymbol    = "missing_symbol"
+	CodeTooWeak          = "too_weak"
+	CodeContainsUserInfo = "contains_user_info"
+	CodeBreached         = "breached"
+	CodeReused           = "reused"
+)
+
+type Violation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// PolicyError lists every rule a password breaks, not only the first one.
+type PolicyError struct {
+	Violations []Violation
+}
+
+func (e *PolicyError) Error() string {
+	messages := []string{}
+	for _, violation := range e.Violations {
+		messages = append(messages, violation.Message)
+	}
+	return strings.Join(messages, "; ")
+}
+
+// GetViolations returns the violations of a policy error, nil for other errors.
+func GetViolations(err error) []Violation {
+	policyErr := new(PolicyError)
+	if errors.As(err, &policyErr) {
+		return policyErr.Violations
+	}
+	return nil
+}
+
+type Policy struct {
+	MinLength       int
+	MaxLength       int
+	RequiredClasses []string
+	// the minimum EstimateStrength score, 0 turns the check off
+	MinStrength int
+	// how many previous passwords of a user can't be reused, 0 turns it off
+	HistorySize int
+	breached    *breachedList
+}
+
+var policy *Policy
+var policyOnce sync.Once
+
+// GetPolicy returns the password policy configured by the PASSWORD_* env, read once.
+func GetPolicy() *Policy {
+	policyOnce.Do(func() {
+		maxLength, defaultMaxLength := maxPasswordLength, defaultMaxPasswordLength
+		if GetHashConfig().Algorithm == AlgorithmBcrypt {
+			maxLength, defaultMaxLength = maxBcryptPasswordLength, maxBcryptPasswordLength
+		}
+		policy = &Policy{
+			MinLength:       envutils.GetInt("PASSWORD_MIN_LENGTH", 6),
+			MaxLength:       envutils.GetInt("PASSWORD_MAX_LENGTH", defaultMaxLength),
+			RequiredClasses: []string{},
+			MinStrength:     envutils.GetInt("PASSWORD_MIN_STRENGTH", 0),
+			HistorySize:     envutils.GetInt("PASSWORD_HISTORY_SIZE", 0),
+		}
+		if policy.MinLength < 1 || policy.MaxLength < policy.MinLength || policy.MaxLength > maxLength {
+			log.Fatalln("invalid PASSWORD_MIN_LENGTH or PASSWORD_MAX_LENGTH, the max length can be at most", maxLength)
+		} else if policy.MinStrength < 0 || policy.MinStrength > 4 {
+			log.Fatalln("invalid PASSWORD_MIN_STRENGTH, expected 0 to 4:", policy.MinStrength)
+		} else if policy.HistorySize < 0 {
+			log.Fatalln("invalid PASSWORD_HISTORY_SIZE:", policy.HistorySize)
+		}
+
+		for _, class := range strings.Split(os.Getenv("PASSWORD_REQUIRED_CLASSES"), ",") {
+			class = strings.ToLower(strings.TrimSpace(class))
+			if class == "" {
+				continue
+			} else if class != ClassLower && class != ClassUpper && class != ClassDigit && class != ClassSymbol {
+				log.Fatalln("invalid PASSWORD_REQUIRED_CLASSES, expected lower, upper, digit or symbol:", class)
+			}
+			policy.RequiredClasses = append(policy.RequiredClasses, class)
+		}
+
+		if path := os.Getenv("PASSWORD_BREACHED_FILE"); path != "" {
+			breached, err := openBreachedList(path)
+			if err != nil {
+				log.Fatalln("failed to open PASSWORD_BREACHED_FILE.", err)
+			}
+			policy.breached = breached
+			log.Println("opened breached password hashes, bytes:", breached.size)
+		}
+	})
+	return policy
+}
+
+// ValidatePolicy checks a new password against the password policy. the
+// userInputs are the email and names of the user, which the password must not
+// contain.
+func ValidatePolicy(password string, userInputs ...string) error {
+	return GetPolicy().Validate(password, userInputs...)
+}
+
+func (p *Policy) Validate(password string, userInputs ...string) error {
+	violations := []Violation{}
+	add := func(code, message string) {
+		violations = append(violations, Violation{Code: code, Message: message})
+	}
+
+	if len(password) < p.MinLength {
+		add(CodeTooShort, fmt.Sprintf("password must be at least %v characters", p.MinLength))
+	} else if len(password) > p.MaxLength {
+		add(CodeTooLong, fmt.Sprintf("password must be at most %v bytes", p.MaxLength))
+	}
+
+	for _, class := range p.RequiredClasses {
+		if !hasClass(password, class) {
+			switch class {
+			case ClassLower:
+				add(CodeMissingLower, "password must contain a lowercase letter")
+			case ClassUpper:
+				add(CodeMissingUpper, "password must contain an uppercase letter")
+			case ClassDigit:
+				add(CodeMissingDigit, "password must contain a digit")
+			case ClassSymbol:
+				add(CodeMissingSymbol, "password must contain a symbol")
+			}
+		}
+	}
+
+	tokens := getUserInputTokens(userInputs)
+	if containsUserInput(password, tokens) {
+		add(CodeContainsUserInfo, "password must not contain your name or email")
+	}
+
+	if p.MinStrength > 0 && EstimateStrength(password, userInputs...) < p.MinStrength {
+		add(CodeTooWeak, "password is too easy to guess")
+	}
+
+	if p.breached != nil {
+		// a failed lookup lets the password through, like a policy without the file
+		if breached, err := p.breached.contains(password); err != nil {
+			log.Println("failed to look up breached password hashes.", err)
+		} else if breached {
+			add(CodeBreached, "password has appeared in a data breach")
+		}
+	}
+
+	if len(violations) != 0 {
+		return &PolicyError{Violations: violations}
+	}
+	return nil
+}
+
+// CheckReuse rejects a password that matches any of the given hashes, which
+// are the current and previous hashed passwords of a user.
+func CheckReuse(password string, hashedPasswords ...string) error {
+	for _, hashedPassword := range hashedPasswords {
+		if hashedPassword != "" && DoesPasswordMatchHash(hashedPassword, password) {
+			return &PolicyError{Violations: []Violation{{Code: CodeReused, Message: "password was used recently"}}}
+		}
+	}
+	return nil
+}
+
+func hasClass(password, class string) bool {
+	for _, r := range password {
+		switch {
+		case class == ClassLower && unicode.IsLower(r),
+			class == ClassUpper && unicode.IsUpper(r),
+			class == ClassDigit && unicode.IsDigit(r),
+			class == ClassSymbol && !unicode.IsLetter(r) && !unicode.IsDigit(r):
+			return true
+		}
+	}
+	return false
+}
+
+// getUserInputTokens splits emails and names into lowercase words, only the
+// local part of an email is used so common domains are not forbidden.
+func getUserInputTokens(userInputs []string) []string {
+	tokens := []string{}
+	for _, input := range userInputs {
+		input = strings.ToLower(strings.TrimSpace(input))
+		if at := strings.LastIndex(input, "@"); at != -1 {
+			input = input[:at]
+			if len(input) >= 3 {
+				tokens = append(tokens, input)
+			}
+		}
+		words := strings.FieldsFunc(input, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		for _, word := range words {
+			// short names like "al" would forbid too many passwords
+			if len(word) >= 3 {
+				tokens = append(tokens, word)
+			}
+		}
+	}
+	return tokens
+}
+
+func containsUserInput(password string, tokens []string) bool {
+	lowered := strings.ToLower(password)
+	unleeted := unleet(lowered)
+	for _, token := range tokens {
+		if strings.Contains(lowered, token) || strings.Contains(unleeted, token) {
+			return true
+		}
+	}
+	return false
+}
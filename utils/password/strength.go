@@ -0,0 +1,201 @@
+package passwordutils
+
+import (
+	"math"
+	"strings"
+)
+
+// the most common passwords and words in them, ordered by frequency. the rank
+// in this list is used as the number of guesses an attacker needs.
+var commonPasswords = []string{
+	"123456", "password", "12345678", "qwerty", "123456789", "12345", "1234",
+	"111111", "1234567", "dragon", "123123", "baseball", "abc123", "football",
+	"monkey", "letmein", "696969", "shadow", "master", "666666", "qwertyuiop",
+	"123321", "mustang", "1234567890", "michael", "654321", "superman",
+	"1qaz2wsx", "7777777", "121212", "000000", "qazwsx", "123qwe", "killer",
+	"trustno1", "jordan", "jennifer", "zxcvbnm", "asdfgh", "hunter", "buster",
+	"soccer", "harley", "batman", "andrew", "tigger", "sunshine", "iloveyou",
+	"2000", "charlie", "robert", "thomas", "hockey", "ranger", "daniel",
+	"starwars", "klaster", "112233", "george", "computer", "michelle",
+	"jessica", "pepper", "1111", "zxcvbn", "555555", "11111111", "131313",
+	"freedom", "777777", "pass", "maggie", "159753", "aaaaaa", "ginger",
+	"princess", "joshua", "cheese", "amanda", "summer", "love", "ashley",
+	"nicole", "chelsea", "biteme", "matthew", "access", "yankees", "987654321",
+	"dallas", "austin", "thunder", "taylor", "matrix", "welcome", "admin",
+	"login", "passw0rd", "secret", "hello", "flower", "qwerty123",
+	"football1", "whatever", "winter", "spring", "autumn", "changeme",
+	"administrator", "root", "guest", "test", "user", "default", "abcdef",
+}
+
+// rows of a qwerty keyboard, walking along them makes easy to type passwords
+var keyboardRows = []string{"`1234567890-=", "qwertyuiop[]\\", "asdfghjkl;'", "zxcvbnm,./"}
+
+var leetReplacer = strings.NewReplacer(
+	"4", "a", "@", "a", "8", "b", "(", "c", "3", "e", "6", "g", "1", "i", "!", "i",
+	"0", "o", "$", "s", "5", "s", "7", "t", "+", "t", "2", "z",
+)
+
+func unleet(password string) string {
+	return leetReplacer.Replace(password)
+}
+
+type match struct {
+	start   int
+	end     int
+	guesses float64
+}
+
+// EstimateStrength scores how hard a password is to guess, from 0 (too
+// guessable) to 4 (very unguessable), like zxcvbn does. the password is split
+// into the cheapest sequence of common words, user inputs, repeats, sequences,
+// keyboard walks and years, and the characters in between are brute forced.
+func EstimateStrength(password string, userInputs ...string) int {
+	guessesLog10 := estimateGuessesLog10(password, getUserInputTokens(userInputs))
+	switch {
+	case guessesLog10 < 3:
+		return 0
+	case guessesLog10 < 6:
+		return 1
+	case guessesLog10 < 8:
+		return 2
+	case guessesLog10 < 10:
+		return 3
+	default:
+		return 4
+	}
+}
+
+func estimateGuessesLog10(password string, userInputTokens []string) float64 {
+	chars := []rune(password)
+	matches := findMatches(chars, userInputTokens)
+
+	// minimum log10 of the guesses to get the first i characters
+	minimum := make([]float64, len(chars)+1)
+	for i := 1; i <= len(chars); i++ {
+		// a brute forced character is one of about 10 likely ones
+		minimum[i] = minimum[i-1] + 1
+		for _, m := range matches {
+			if m.end == i {
+				minimum[i] = math.Min(minimum[i], minimum[m.start]+math.Log10(m.guesses))
+			}
+		}
+	}
+	return minimum[len(chars)]
+}
+
+func findMatches(chars []rune, userInputTokens []string) []match {
+	matches := []match{}
+	lowered := []rune(strings.ToLower(string(chars)))
+	if len(lowered) != len(chars) {
+		lowered = chars
+	}
+
+	// dictionary words, also with l33t substitutions undone
+	dictionary := map[string]float64{}
+	for rank, word := range commonPasswords {
+		if _, ok := dictionary[word]; !ok {
+			dictionary[word] = float64(rank + 1)
+		}
+	}
+	for _, token := range userInputTokens {
+		dictionary[token] = 1
+	}
+	for i := range lowered {
+		for j := i + 3; j <= len(lowered); j++ {
+			word := string(lowered[i:j])
+			if rank, ok := dictionary[word]; ok {
+				matches = append(matches, match{start: i, end: j, guesses: rank * variations(chars[i:j])})
+			} else if rank, ok := dictionary[unleet(word)]; ok {
+				// the variations of a l33t word are about twice as many
+				matches = append(matches, match{start: i, end: j, guesses: 2 * rank * variations(chars[i:j])})
+			}
+		}
+	}
+
+	for i := 0; i < len(lowered); {
+		// repeats of the same character
+		j := i + 1
+		for j < len(lowered) && lowered[j] == lowered[i] {
+			j++
+		}
+		if j-i >= 3 {
+			matches = append(matches, match{start: i, end: j, guesses: 26 * float64(j-i)})
+		}
+
+		// sequences like abc, 987 or 2468
+		if i+1 < len(lowered) {
+			delta := lowered[i+1] - lowered[i]
+			k := i + 1
+			for k+1 < len(lowered) && lowered[k+1]-lowered[k] == delta {
+				k++
+			}
+			if delta != 0 && delta >= -5 && delta <= 5 && k-i+1 >= 3 {
+				matches = append(matches, match{start: i, end: k + 1, guesses: 20 * float64(k-i+1)})
+			}
+		}
+		i = j
+	}
+
+	// keyboard walks along a row, in either direction
+	for i := range lowered {
+		for _, row := range keyboardRows {
+			for _, walk := range []string{row, reverse(row)} {
+				j := i
+				position := strings.IndexRune(walk, lowered[i])
+				for position != -1 && j < len(lowered) && position+(j-i) < len(walk) && rune(walk[position+(j-i)]) == lowered[j] {
+					j++
+				}
+				if j-i >= 4 {
+					matches = append(matches, match{start: i, end: j, guesses: 40 * float64(j-i)})
+				}
+			}
+		}
+	}
+
+	// years from 1900 to 2099
+	for i := 0; i+4 <= len(lowered); i++ {
+		year := string(lowered[i : i+4])
+		if (strings.HasPrefix(year, "19") || strings.HasPrefix(year, "20")) && isDigits(year) {
+			matches = append(matches, match{start: i, end: i + 4, guesses: 200})
+		}
+	}
+	return matches
+}
+
+// variations is the factor for the capitalization of a word, where only
+// capitalizing the first letter or all of them adds little.
+func variations(word []rune) float64 {
+	lower, upper := 0, 0
+	for _, r := range word {
+		if strings.ToLower(string(r)) != string(r) {
+			upper++
+		} else if strings.ToUpper(string(r)) != string(r) {
+			lower++
+		}
+	}
+	switch {
+	case upper == 0:
+		return 1
+	case lower == 0 || (upper == 1 && strings.ToLower(string(word[0])) != string(word[0])):
+		return 2
+	default:
+		return math.Pow(2, float64(upper))
+	}
+}
+
+func reverse(value string) string {
+	runes := []rune(value)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
+
+func isDigits(value string) bool {
+	for _, r := range value {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,117 @@
+package rbacutils
+
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+const (
+	PermAuditRead    = "audit:read"
+	PermRolesWrite   = "roles:write"
+	PermUsersRead    = "users:read"
+	PermUsersWrite   = "users:write"
+	PermInvitesWrite = "invites:write"
+	PermClientsWrite = "clients:write"
+)
+
+// RolePermissions maps every known role to the permissions it grants.
+var RolePermissions = map[string][]string{
+	RoleUser: {},
+	RoleAdmin: {
+		PermAuditRead,
+		PermRolesWrite,
+		PermUsersRead,
+		PermUsersWrite,
+		PermInvitesWrite,
+		PermClientsWrite,
+	},
+}
+
+// AllPermissions lists every known permission.
+var AllPermissions = []string{
+	PermAuditRead,
+	PermRolesWrite,
+	PermUsersRead,
+	PermUsersWrite,
+	PermInvitesWrite,
+	PermClientsWrite,
+}
+
+func IsValidPermission(permission string) bool {
+	return Contains(AllPermissions, permission)
+}
+
+func IsValidRole(role string) bool {
+	_, ok := RolePermissions[role]
+	return ok
+}
+
+// GetEffectiveRoles falls back to the default user role for credentials
+// created before roles existed.
+func GetEffectiveRoles(roles []string) []string {
+	if len(roles) == 0 {
+		return []string{RoleUser}
+	}
+	return roles
+}
+
+// GetEffectivePermissions returns the union of the permissions granted by
+// roles and the directly granted permissions, without duplicates.
+func GetEffectivePermissions(roles, permissions []string) []string {
+	seen := map[string]bool{}
+	effective := []string{}
+
+	add := func(perm string) {
+		if !seen[perm] {
+			seen[perm] = true
+			effective = append(effective, perm)
+		}
+	}
+	for _, role := range GetEffectiveRoles(roles) {
+		for _, perm := range RolePermissions[role] {
+			add(perm)
+		}
+	}
+	for _, perm := range permissions {
+		add(perm)
+	}
+
+	return effective
+}
+
+// GetScopedAccess limits the roles and permissions of a user to scopes, for
+// an api key. a role only counts when scopes cover all that it grants.
+func GetScopedAccess(roles, permissions, scopes []string) ([]string, []string) {
+	scopedPermissions := []string{}
+	for _, permission := range GetEffectivePermissions(roles, permissions) {
+		if Contains(scopes, permission) {
+			scopedPermissions = append(scopedPermissions, permission)
+		}
+	}
+	scopedRoles := []string{}
+	for _, role := range GetEffectiveRoles(roles) {
+		if ContainsAll(scopes, RolePermissions[role]) {
+			scopedRoles = append(scopedRoles, role)
+		}
+	}
+	return scopedRoles, scopedPermissions
+}
+
+func Contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ContainsAll is true when values has every one of wanted.
+func ContainsAll(values, wanted []string) bool {
+	for _, value := range wanted {
+		if !Contains(values, value) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,131 @@
+package riskutils
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type Location struct {
+	Latitude  float64
+	Longitude float64
+}
+
+type geoIpRange struct {
+	first, last [16]byte
+	latitude    float32
+	longitude   float32
+}
+
+// ranges of all loaded networks, sorted by their first address
+var geoIpRanges []geoIpRange
+
+// loadGeoIp reads comma separated csv files with a header naming at least the
+// network, latitude and longitude columns, like the GeoLite2 city blocks.
+func loadGeoIp(paths string) error {
+	for _, path := range strings.Split(paths, ",") {
+		if err := loadGeoIpFile(strings.TrimSpace(path)); err != nil {
+			return err
+		}
+	}
+	sort.Slice(geoIpRanges, func(i, j int) bool {
+		return bytes.Compare(geoIpRanges[i].first[:], geoIpRanges[j].first[:]) < 0
+	})
+	return nil
+}
+
+func loadGeoIpFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.ReuseRecord = true
+	header, err := reader.Read()
+	if err != nil {
+		return err
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	networkCol, ok1 := columns["network"]
+	latitudeCol, ok2 := columns["latitude"]
+	longitudeCol, ok3 := columns["longitude"]
+	if !ok1 || !ok2 || !ok3 {
+		return errors.New("expected network, latitude and longitude columns in " + path)
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		_, network, err := net.ParseCIDR(record[networkCol])
+		if err != nil {
+			return err
+		}
+		// networks without a location are of no use
+		latitude, err1 := strconv.ParseFloat(record[latitudeCol], 32)
+		longitude, err2 := strconv.ParseFloat(record[longitudeCol], 32)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+
+		r := geoIpRange{latitude: float32(latitude), longitude: float32(longitude)}
+		first := network.IP.To16()
+		copy(r.first[:], first)
+		copy(r.last[:], first)
+		// the mask of an ipv4 network is 4 bytes, and covers the last 4 of the 16
+		offset := 16 - len(network.Mask)
+		for i, b := range network.Mask {
+			r.last[offset+i] |= ^b
+		}
+		geoIpRanges = append(geoIpRanges, r)
+	}
+}
+
+// LookupIp locates an ip by the GEOIP_DB_FILE, it's nil for unknown ips or
+// without the file.
+func LookupIp(ip string) *Location {
+	parsed := net.ParseIP(ip).To16()
+	if parsed == nil || len(geoIpRanges) == 0 {
+		return nil
+	}
+
+	i := sort.Search(len(geoIpRanges), func(i int) bool {
+		return bytes.Compare(geoIpRanges[i].first[:], parsed) > 0
+	})
+	if i == 0 {
+		return nil
+	}
+	r := geoIpRanges[i-1]
+	if bytes.Compare(parsed, r.last[:]) > 0 {
+		return nil
+	}
+	return &Location{Latitude: float64(r.latitude), Longitude: float64(r.longitude)}
+}
+
+// DistanceKm is the great-circle distance between two locations.
+func DistanceKm(a, b *Location) float64 {
+	const earthRadiusKm = 6371
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+
+	dLat := toRad(b.Latitude - a.Latitude)
+	dLon := toRad(b.Longitude - a.Longitude)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(a.Latitude))*math.Cos(toRad(b.Latitude))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(h))
+}
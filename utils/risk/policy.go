@@ -0,0 +1,53 @@
+package riskutils
+
+import (
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	envutils "github.com/alubhorta/goth/utils/env"
+)
+
+type Policy struct {
+	Enabled bool
+	// scores from which a login needs a second factor or is refused
+	ChallengeScore int
+	BlockScore     int
+	// travel between two logins faster than this is impossible
+	MaxTravelSpeedKmh float64
+	// how long failed logins and the accounts tried from an ip are counted
+	Window time.Duration
+	// distinct accounts tried from one ip within Window before it's suspicious
+	IpAccountLimit int64
+}
+
+var policy *Policy
+var policyOnce sync.Once
+
+// GetPolicy returns the risk policy configured by the RISK_* env, read once.
+func GetPolicy() *Policy {
+	policyOnce.Do(func() {
+		policy = &Policy{
+			Enabled:           strings.ToLower(os.Getenv("RISK_ENABLED")) == "true",
+			ChallengeScore:    envutils.GetInt("RISK_CHALLENGE_SCORE", 40),
+			BlockScore:        envutils.GetInt("RISK_BLOCK_SCORE", 80),
+			MaxTravelSpeedKmh: float64(envutils.GetInt("RISK_MAX_TRAVEL_SPEED_KMH", 1000)),
+			Window:            time.Duration(envutils.GetInt("RISK_WINDOW_MINUTES", 15)) * time.Minute,
+			IpAccountLimit:    int64(envutils.GetInt("RISK_IP_ACCOUNT_LIMIT", 5)),
+		}
+		if policy.ChallengeScore < 1 || policy.BlockScore < policy.ChallengeScore {
+			log.Fatalln("invalid RISK_CHALLENGE_SCORE or RISK_BLOCK_SCORE, expected 1 <= challenge <= block.")
+		} else if policy.MaxTravelSpeedKmh < 1 || policy.Window < time.Minute || policy.IpAccountLimit < 1 {
+			log.Fatalln("invalid RISK_MAX_TRAVEL_SPEED_KMH, RISK_WINDOW_MINUTES or RISK_IP_ACCOUNT_LIMIT, expected >= 1.")
+		}
+
+		if path := os.Getenv("GEOIP_DB_FILE"); policy.Enabled && path != "" {
+			if err := loadGeoIp(path); err != nil {
+				log.Fatalln("failed to load GEOIP_DB_FILE.", err)
+			}
+		}
+	})
+	return policy
+}
@@ -0,0 +1,159 @@
+package riskutils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	customerrors "github.com/alubhorta/goth/custom/errors"
+	"github.com/alubhorta/goth/db/cacheclient"
+	authmodels "github.com/alubhorta/goth/models/auth"
+	deviceutils "github.com/alubhorta/goth/utils/device"
+)
+
+const (
+	DecisionAllow     = "allow"
+	DecisionChallenge = "challenge"
+	DecisionBlock     = "block"
+)
+
+// points a signal adds to the score, the thresholds of the policy are on the
+// same scale
+const (
+	scoreNewDevice        = 20
+	scoreNewIpRange       = 20
+	scoreImpossibleTravel = 60
+	scorePerFailure       = 10
+	scoreMaxFailures      = 30
+	scoreIpVelocity       = 40
+)
+
+// travels shorter than this are within the accuracy of geoip
+const minTravelKm = 100
+
+type Assessment struct {
+	Score    int
+	Signals  []string
+	Decision string
+}
+
+// String summarizes the assessment for the audit log, like
+// "risk 40: new device, new ip range".
+func (a *Assessment) String() string {
+	if len(a.Signals) == 0 {
+		return fmt.Sprintf("risk %v", a.Score)
+	}
+	return fmt.Sprintf("risk %v: %v", a.Score, strings.Join(a.Signals, ", "))
+}
+
+func (a *Assessment) add(score int, signal string) {
+	a.Score += score
+	a.Signals = append(a.Signals, signal)
+}
+
+func (a *Assessment) decide() {
+	p := GetPolicy()
+	switch {
+	case a.Score >= p.BlockScore:
+		a.Decision = DecisionBlock
+	case a.Score >= p.ChallengeScore:
+		a.Decision = DecisionChallenge
+	default:
+		a.Decision = DecisionAllow
+	}
+}
+
+// AssessLogin scores a login of userId with the account identifier it was
+// tried with, that got the password right. it's checked against the devices
+// known of the user (most recent first), the recent failed logins of the user
+// and the accounts recently tried from the ip.
+func AssessLogin(cacheClient *cacheclient.RedisClient, userId, account, ip, userAgent string, devices []*authmodels.KnownDevice) (*Assessment, error) {
+	assessment := &Assessment{}
+	assessDevice(assessment, ip, userAgent, devices)
+
+	val, err := cacheClient.Get("riskFailures:" + userId)
+	if err != nil && err != customerrors.ErrNotFound {
+		return nil, err
+	}
+	if failures, _ := strconv.Atoi(val); failures > 0 {
+		score := failures * scorePerFailure
+		if score > scoreMaxFailures {
+			score = scoreMaxFailures
+		}
+		assessment.add(score, fmt.Sprintf("%v recent failures", failures))
+	}
+
+	accounts, err := CountIpAccount(cacheClient, ip, account)
+	if err != nil {
+		return nil, err
+	}
+	if accounts > GetPolicy().IpAccountLimit {
+		assessment.add(scoreIpVelocity, fmt.Sprintf("%v accounts from ip", accounts))
+	}
+
+	assessment.decide()
+	return assessment, nil
+}
+
+// AssessRefresh scores a token refresh by where it comes from only, the
+// refresh token stands in for the password.
+func AssessRefresh(ip, userAgent string, devices []*authmodels.KnownDevice) *Assessment {
+	assessment := &Assessment{}
+	assessDevice(assessment, ip, userAgent, devices)
+	assessment.decide()
+	return assessment
+}
+
+// assessDevice checks the browser, network and location against the known
+// devices. the very first login of a user has nothing to compare to.
+func assessDevice(assessment *Assessment, ip, userAgent string, devices []*authmodels.KnownDevice) {
+	if len(devices) == 0 {
+		return
+	}
+
+	name, subnet := deviceutils.Describe(userAgent), deviceutils.GetIpSubnet(ip)
+	knownName, knownSubnet := false, false
+	for _, device := range devices {
+		knownName = knownName || device.Name == name
+		knownSubnet = knownSubnet || device.IpSubnet == subnet
+	}
+	if !knownName {
+		assessment.add(scoreNewDevice, "new device")
+	}
+	if !knownSubnet {
+		assessment.add(scoreNewIpRange, "new ip range")
+	}
+
+	last := devices[0]
+	if last.LastIp == ip {
+		return
+	}
+	from, to := LookupIp(last.LastIp), LookupIp(ip)
+	if from == nil || to == nil {
+		return
+	}
+	distance := DistanceKm(from, to)
+	hours := time.Since(last.LastSeenAt).Hours()
+	if distance >= minTravelKm && distance > GetPolicy().MaxTravelSpeedKmh*hours {
+		assessment.add(scoreImpossibleTravel, fmt.Sprintf("impossible travel of %.0fkm", distance))
+	}
+}
+
+// RecordFailure counts a failed login of userId within the window.
+func RecordFailure(cacheClient *cacheclient.RedisClient, userId string) error {
+	_, err := cacheClient.Incr("riskFailures:"+userId, GetPolicy().Window)
+	return err
+}
+
+// ClearFailures forgets the failed logins of userId after a successful one.
+func ClearFailures(cacheClient *cacheclient.RedisClient, userId string) error {
+	return cacheClient.Del("riskFailures:" + userId)
+}
+
+// CountIpAccount remembers a login attempt with the account identifier from
+// ip, known or not, and returns the number of distinct accounts tried from ip
+// within the window.
+func CountIpAccount(cacheClient *cacheclient.RedisClient, ip, account string) (int64, error) {
+	return cacheClient.AddToSet("riskIpAccounts:"+ip, account, GetPolicy().Window)
+}
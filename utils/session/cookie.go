@@ -0,0 +1,112 @@
+package sessionutils
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	tokenutils "github.com/alubhorta/goth/utils/token"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	RefreshCookieName = "goth_refresh"
+	CsrfCookieName    = "goth_csrf"
+	CsrfHeaderName    = "X-CSRF-Token"
+
+	// the refresh cookie is only ever sent to the routes that use it
+	RefreshCookiePath = "/api/v1/auth/refresh"
+)
+
+// IsCookieMode tells if SESSION_COOKIE_MODE is on, where browsers get their
+// refresh token as an HttpOnly cookie instead of in the response body.
+func IsCookieMode() bool {
+	cookieMode, _ := strconv.ParseBool(os.Getenv("SESSION_COOKIE_MODE"))
+	return cookieMode
+}
+
+// getCookieSameSite is the SESSION_COOKIE_SAMESITE env, Strict by default.
+// None is needed when the frontend is on another site than goth.
+func getCookieSameSite() string {
+	switch sameSite := os.Getenv("SESSION_COOKIE_SAMESITE"); sameSite {
+	case fiber.CookieSameSiteLaxMode, fiber.CookieSameSiteNoneMode:
+		return sameSite
+	default:
+		return fiber.CookieSameSiteStrictMode
+	}
+}
+
+// isCookieSecure is true unless SESSION_COOKIE_SECURE=false, which is only
+// meant for local development over plain http.
+func isCookieSecure() bool {
+	secure, err := strconv.ParseBool(os.Getenv("SESSION_COOKIE_SECURE"))
+	return err != nil || secure
+}
+
+// GetTokensPayload is the "tokens" of a login, signup or refresh response. in
+// cookie mode the refresh token is set as a cookie along with a new csrf token,
+// which is returned in place of the refresh token.
+func GetTokensPayload(c *fiber.Ctx, accessToken, refreshToken string) (fiber.Map, error) {
+	if !IsCookieMode() {
+		return fiber.Map{"access": accessToken, "refresh": refreshToken}, nil
+	}
+
+	refreshMaxAgeInSeconds, err := strconv.Atoi(os.Getenv("REFRESH_TOKEN_MAX_AGE_IN_SECONDS"))
+	if err != nil {
+		return nil, err
+	}
+	csrfToken, err := tokenutils.GenerateOpaqueToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Cookie(&fiber.Cookie{
+		Name:     RefreshCookieName,
+		Value:    refreshToken,
+		Path:     RefreshCookiePath,
+		Domain:   os.Getenv("SESSION_COOKIE_DOMAIN"),
+		MaxAge:   refreshMaxAgeInSeconds,
+		Secure:   isCookieSecure(),
+		HTTPOnly: true,
+		SameSite: getCookieSameSite(),
+	})
+	// readable by the frontend, which sends it back in the csrf header
+	c.Cookie(&fiber.Cookie{
+		Name:     CsrfCookieName,
+		Value:    csrfToken,
+		Path:     "/",
+		Domain:   os.Getenv("SESSION_COOKIE_DOMAIN"),
+		MaxAge:   refreshMaxAgeInSeconds,
+		Secure:   isCookieSecure(),
+		SameSite: getCookieSameSite(),
+	})
+	return fiber.Map{"access": accessToken, "csrf": csrfToken}, nil
+}
+
+// GetRefreshCookie returns the refresh token cookie, empty outside of cookie
+// mode.
+func GetRefreshCookie(c *fiber.Ctx) string {
+	if !IsCookieMode() {
+		return ""
+	}
+	return c.Cookies(RefreshCookieName)
+}
+
+// ClearCookies expires the session cookies in the browser.
+func ClearCookies(c *fiber.Ctx) {
+	if !IsCookieMode() {
+		return
+	}
+	for name, path := range map[string]string{RefreshCookieName: RefreshCookiePath, CsrfCookieName: "/"} {
+		c.Cookie(&fiber.Cookie{
+			Name:     name,
+			Path:     path,
+			Domain:   os.Getenv("SESSION_COOKIE_DOMAIN"),
+			Expires:  time.Unix(0, 0),
+			Secure:   isCookieSecure(),
+			HTTPOnly: name == RefreshCookieName,
+			SameSite: getCookieSameSite(),
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package sessionutils
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	customerrors "github.com/alubhorta/goth/custom/errors"
+	"github.com/alubhorta/goth/db/cacheclient"
+)
+
+// RevokeAllSessions invalidates every token issued to userId until now. the
+// marker lives as long as a refresh token, after which no such token is valid anyway.
+func RevokeAllSessions(cacheClient *cacheclient.RedisClient, userId string) error {
+	refreshMaxAgeInSeconds, err := strconv.Atoi(os.Getenv("REFRESH_TOKEN_MAX_AGE_IN_SECONDS"))
+	if err != nil {
+		return err
+	}
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	return cacheClient.Set("revokedBefore:"+userId, now, time.Second*time.Duration(refreshMaxAgeInSeconds))
+}
+
+// IsSessionRevoked tells if a token of userId issued at issuedAt (unix seconds)
+// was revoked by RevokeAllSessions.
+func IsSessionRevoked(cacheClient *cacheclient.RedisClient, userId string, issuedAt int64) (bool, error) {
+	val, err := cacheClient.Get("revokedBefore:" + userId)
+	if err == customerrors.ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	revokedBefore, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return false, err
+	}
+	return issuedAt < revokedBefore, nil
+}
+
+// RevokeClientTokens invalidates every token issued to clientId until now, for
+// itself or for users, when the client is deleted or loses scopes.
+func RevokeClientTokens(cacheClient *cacheclient.RedisClient, clientId string) error {
+	refreshMaxAgeInSeconds, err := strconv.Atoi(os.Getenv("REFRESH_TOKEN_MAX_AGE_IN_SECONDS"))
+	if err != nil {
+		return err
+	}
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	return cacheClient.Set("clientRevokedBefore:"+clientId, now, time.Second*time.Duration(refreshMaxAgeInSeconds))
+}
+
+// IsClientTokenRevoked tells if a token of clientId issued at issuedAt (unix
+// seconds) was revoked by RevokeClientTokens.
+func IsClientTokenRevoked(cacheClient *cacheclient.RedisClient, clientId string, issuedAt int64) (bool, error) {
+	val, err := cacheClient.Get("clientRevokedBefore:" + clientId)
+	if err == customerrors.ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	revokedBefore, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return false, err
+	}
+	return issuedAt < revokedBefore, nil
+}
+
+// the disabled flag mirrors UserAuthCredential.Disabled so that RequiresAuth
+// doesn't need a database lookup for every request.
+
+func MarkUserDisabled(cacheClient *cacheclient.RedisClient, userId string) error {
+	return cacheClient.Set("disabled:"+userId, "1", 0)
+}
+
+func UnmarkUserDisabled(cacheClient *cacheclient.RedisClient, userId string) error {
+	return cacheClient.Del("disabled:" + userId)
+}
+
+func IsUserDisabled(cacheClient *cacheclient.RedisClient, userId string) (bool, error) {
+	return cacheClient.Exists("disabled:" + userId)
+}
+
+// RevokeGrant invalidates the tokens an oauth client got under grantId, the
+// refresh tokens it rotated through and the access tokens issued with them.
+func RevokeGrant(cacheClient *cacheclient.RedisClient, grantId string) error {
+	refreshMaxAgeInSeconds, err := strconv.Atoi(os.Getenv("REFRESH_TOKEN_MAX_AGE_IN_SECONDS"))
+	if err != nil {
+		return err
+	}
+	return cacheClient.Set("grantRevoked:"+grantId, "1", time.Second*time.Duration(refreshMaxAgeInSeconds))
+}
+
+// IsGrantRevoked tells if the tokens of grantId were revoked by RevokeGrant.
+func IsGrantRevoked(cacheClient *cacheclient.RedisClient, grantId string) (bool, error) {
+	return cacheClient.Exists("grantRevoked:" + grantId)
+}
@@ -0,0 +1,136 @@
+package signuputils
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	ModeOpen   = "open"
+	ModeInvite = "invite"
+	ModeDomain = "domain"
+)
+
+var ErrDomainBlocked = errors.New("email domain is blocked")
+var ErrDomainNotAllowed = errors.New("email domain is not allowed")
+
+// a small built-in list of disposable email providers, extend it with
+// SIGNUP_BLOCKED_DOMAINS_FILE.
+var defaultBlockedDomains = []string{
+	"10minutemail.com",
+	"dispostable.com",
+	"getnada.com",
+	"guerrillamail.com",
+	"mailinator.com",
+	"maildrop.cc",
+	"sharklasers.com",
+	"temp-mail.org",
+	"tempmail.com",
+	"throwawaymail.com",
+	"trashmail.com",
+	"yopmail.com",
+}
+
+type Policy struct {
+	Mode           string
+	AllowedDomains []string
+	BlockedDomains map[string]bool
+}
+
+var policy *Policy
+var policyOnce sync.Once
+
+// GetPolicy returns the signup policy configured by the SIGNUP_* env, read once.
+func GetPolicy() *Policy {
+	policyOnce.Do(func() {
+		policy = &Policy{
+			Mode:           strings.ToLower(strings.TrimSpace(os.Getenv("SIGNUP_MODE"))),
+			AllowedDomains: []string{},
+			BlockedDomains: map[string]bool{},
+		}
+		if policy.Mode == "" {
+			policy.Mode = ModeOpen
+		} else if policy.Mode != ModeOpen && policy.Mode != ModeInvite && policy.Mode != ModeDomain {
+			log.Fatalln("invalid SIGNUP_MODE, expected one of open, invite or domain:", policy.Mode)
+		}
+
+		for _, domain := range strings.Split(os.Getenv("SIGNUP_ALLOWED_DOMAINS"), ",") {
+			if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+				policy.AllowedDomains = append(policy.AllowedDomains, domain)
+			}
+		}
+		if policy.Mode == ModeDomain && len(policy.AllowedDomains) == 0 {
+			log.Fatalln("SIGNUP_ALLOWED_DOMAINS is required when SIGNUP_MODE is domain.")
+		}
+
+		for _, domain := range defaultBlockedDomains {
+			policy.BlockedDomains[domain] = true
+		}
+		if path := os.Getenv("SIGNUP_BLOCKED_DOMAINS_FILE"); path != "" {
+			if err := policy.loadBlockedDomains(path); err != nil {
+				log.Fatalln("failed to load SIGNUP_BLOCKED_DOMAINS_FILE.", err)
+			}
+		}
+	})
+	return policy
+}
+
+// loadBlockedDomains reads one domain per line, ignoring blank lines and # comments.
+func (p *Policy) loadBlockedDomains(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if line != "" && !strings.HasPrefix(line, "#") {
+			p.BlockedDomains[line] = true
+		}
+	}
+	return scanner.Err()
+}
+
+func (p *Policy) RequiresInvite() bool {
+	return p.Mode == ModeInvite
+}
+
+// CheckEmailDomain rejects blocked domains in every mode, and domains outside
+// of the allow-list in domain mode. subdomains match their parent domain.
+func (p *Policy) CheckEmailDomain(email string) error {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return ErrDomainNotAllowed
+	}
+	domain := strings.ToLower(email[at+1:])
+
+	for candidate := domain; candidate != ""; candidate = parentDomain(candidate) {
+		if p.BlockedDomains[candidate] {
+			return ErrDomainBlocked
+		}
+	}
+
+	if p.Mode != ModeDomain {
+		return nil
+	}
+	for _, allowed := range p.AllowedDomains {
+		if domain == allowed || strings.HasSuffix(domain, "."+allowed) {
+			return nil
+		}
+	}
+	return ErrDomainNotAllowed
+}
+
+func parentDomain(domain string) string {
+	dot := strings.Index(domain, ".")
+	if dot < 0 {
+		return ""
+	}
+	return domain[dot+1:]
+}
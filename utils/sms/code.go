@@ -0,0 +1,117 @@
+package smsutils
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	customerrors "github.com/alubhorta/goth/custom/errors"
+	"github.com/alubhorta/goth/db/cacheclient"
+	authmodels "github.com/alubhorta/goth/models/auth"
+	otputils "github.com/alubhorta/goth/utils/otp"
+)
+
+// wrong codes are counted per phone number, and a resend doesn't reset them
+const (
+	codeMaxAttempts   = 5
+	codeAttemptWindow = time.Hour
+)
+
+// limits on sending codes, so sms can't be pumped to a number or from an ip
+const (
+	resendCooldown   = time.Minute
+	maxSendsPerPhone = 5
+	maxSendsPerIp    = 20
+	sendWindow       = time.Hour
+)
+
+var (
+	ErrCodeMismatch    = errors.New("code mismatch")
+	ErrTooManyAttempts = errors.New("too many wrong codes")
+	ErrResendTooSoon   = errors.New("resend too soon")
+	ErrTooManySends    = errors.New("too many codes sent")
+)
+
+// CheckSendLimits is called before sending any code by sms to phone on a
+// request from ip, it returns ErrResendTooSoon within the resend cooldown of
+// the phone, and ErrTooManySends once the phone or the ip reached the sends
+// of the window.
+func CheckSendLimits(cacheClient *cacheclient.RedisClient, phone, ip string) error {
+	ok, err := cacheClient.SetNX("smsCooldown:"+phone, "1", resendCooldown)
+	if err != nil {
+		return err
+	} else if !ok {
+		return ErrResendTooSoon
+	}
+
+	sends, err := cacheClient.Incr("smsSends:phone:"+phone, sendWindow)
+	if err != nil {
+		return err
+	} else if sends > maxSendsPerPhone {
+		return ErrTooManySends
+	}
+	sends, err = cacheClient.Incr("smsSends:ip:"+ip, sendWindow)
+	if err != nil {
+		return err
+	} else if sends > maxSendsPerIp {
+		return ErrTooManySends
+	}
+	return nil
+}
+
+// CreateCode caches a new code for phone under key, replacing a pending one.
+// it returns ErrTooManyAttempts while the wrong codes for phone are used up.
+func CreateCode(cacheClient *cacheclient.RedisClient, key, phone string, maxAge time.Duration) (string, error) {
+	val, err := cacheClient.Get("smsAttempts:" + phone)
+	if err != nil && err != customerrors.ErrNotFound {
+		return "", err
+	}
+	if attempts, _ := strconv.Atoi(val); attempts >= codeMaxAttempts {
+		return "", ErrTooManyAttempts
+	}
+
+	code, err := otputils.GenerateOTP(6)
+	if err != nil {
+		return "", err
+	}
+	pending, err := json.Marshal(&authmodels.PendingSmsCode{Phone: phone, Code: code})
+	if err != nil {
+		return "", err
+	}
+	return code, cacheClient.Set(key, string(pending), maxAge)
+}
+
+// VerifyCode checks a code against the one pending under key, which is used
+// up on success. every try counts against the phone of the pending code, and
+// once they are used up it returns ErrTooManyAttempts until the window
+// passes. it returns customerrors.ErrNotFound when there is no pending code.
+func VerifyCode(cacheClient *cacheclient.RedisClient, key, code string) (*authmodels.PendingSmsCode, error) {
+	val, err := cacheClient.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	pending := new(authmodels.PendingSmsCode)
+	if err := json.Unmarshal([]byte(val), pending); err != nil {
+		return nil, err
+	}
+
+	// counting before comparing keeps concurrent tries within the limit
+	attemptsKey := "smsAttempts:" + pending.Phone
+	attempts, err := cacheClient.Incr(attemptsKey, codeAttemptWindow)
+	if err != nil {
+		return nil, err
+	} else if attempts > codeMaxAttempts {
+		return nil, ErrTooManyAttempts
+	}
+
+	if subtle.ConstantTimeCompare([]byte(code), []byte(pending.Code)) != 1 {
+		return nil, ErrCodeMismatch
+	}
+	// a concurrent try with the same code may have used it up already
+	if _, err := cacheClient.Take(key); err != nil {
+		return nil, err
+	}
+	return pending, cacheClient.Del(attemptsKey)
+}
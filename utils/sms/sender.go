@@ -0,0 +1,132 @@
+package smsutils
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SmsSender delivers a text message to a phone number in E.164 format.
+type SmsSender interface {
+	Name() string
+	Send(toPhone, body string) error
+}
+
+// TwilioSender sends through the Twilio messages api, or any api compatible
+// with it at BaseUrl.
+type TwilioSender struct {
+	BaseUrl    string
+	AccountSid string
+	AuthToken  string
+	From       string
+	client     *http.Client
+}
+
+func (s *TwilioSender) Name() string {
+	return "twilio"
+}
+
+func (s *TwilioSender) Send(toPhone, body string) error {
+	form := url.Values{}
+	form.Set("To", toPhone)
+	form.Set("From", s.From)
+	form.Set("Body", body)
+
+	endpoint := strings.TrimSuffix(s.BaseUrl, "/") + "/2010-04-01/Accounts/" + url.PathEscape(s.AccountSid) + "/Messages.json"
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(s.AccountSid, s.AuthToken)
+
+	if s.client == nil {
+		s.client = &http.Client{Timeout: 10 * time.Second}
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("sms provider responded with status %v", res.StatusCode)
+	}
+	return nil
+}
+
+// LogSender doesn't send anything, it logs the messages or appends them to
+// Path, for local development and tests.
+type LogSender struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (s *LogSender) Name() string {
+	return "log"
+}
+
+func (s *LogSender) Send(toPhone, body string) error {
+	line := fmt.Sprintf("%v sms to %v: %v\n", time.Now().Format(time.RFC3339), toPhone, body)
+	if s.Path == "" {
+		log.Print(line)
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	file, err := os.OpenFile(s.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.WriteString(line)
+	return err
+}
+
+var sender SmsSender
+var senderOnce sync.Once
+
+// GetSender returns the sender configured by SMS_PROVIDER, read once. it is
+// nil when SMS_PROVIDER is not set, which turns off all sms features.
+func GetSender() SmsSender {
+	senderOnce.Do(func() {
+		switch provider := strings.ToLower(strings.TrimSpace(os.Getenv("SMS_PROVIDER"))); provider {
+		case "":
+			return
+		case "twilio":
+			twilio := &TwilioSender{
+				BaseUrl:    os.Getenv("SMS_TWILIO_BASE_URL"),
+				AccountSid: os.Getenv("SMS_TWILIO_ACCOUNT_SID"),
+				AuthToken:  os.Getenv("SMS_TWILIO_AUTH_TOKEN"),
+				From:       os.Getenv("SMS_FROM"),
+			}
+			if twilio.BaseUrl == "" {
+				twilio.BaseUrl = "https://api.twilio.com"
+			}
+			if twilio.AccountSid == "" || twilio.AuthToken == "" || twilio.From == "" {
+				log.Fatalln("SMS_TWILIO_ACCOUNT_SID, SMS_TWILIO_AUTH_TOKEN and SMS_FROM are required for the twilio sms provider.")
+			}
+			sender = twilio
+		case "log":
+			sender = &LogSender{Path: os.Getenv("SMS_LOG_FILE")}
+		default:
+			log.Fatalln("invalid SMS_PROVIDER, expected one of twilio or log:", provider)
+		}
+	})
+	return sender
+}
+
+func IsEnabled() bool {
+	return GetSender() != nil
+}
+
+func SendCodeSms(toPhone, code string) error {
+	// NOTE: feel free to update the message as per your requirements
+	return GetSender().Send(toPhone, "Your GOTH verification code is: "+code)
+}
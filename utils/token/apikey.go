@@ -0,0 +1,39 @@
+package tokenutils
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+)
+
+const apiKeyPrefix = "goth_"
+
+// GenerateApiKey returns a new api key of the form goth_<prefix>_<secret>.
+// the prefix identifies the key for lookups and in listings.
+func GenerateApiKey() (key string, prefix string, err error) {
+	buffer := make([]byte, 4)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", "", err
+	}
+	prefix = hex.EncodeToString(buffer)
+
+	secret, err := GenerateOpaqueToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	return apiKeyPrefix + prefix + "_" + secret, prefix, nil
+}
+
+// IsApiKey tells api keys apart from JWTs in an Authorization header.
+func IsApiKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyPrefix)
+}
+
+// GetApiKeyPrefix extracts the lookup prefix of an api key.
+func GetApiKeyPrefix(key string) (string, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(key, apiKeyPrefix), "_", 2)
+	if len(parts) != 2 || len(parts[0]) != 8 || parts[1] == "" {
+		return "", false
+	}
+	return parts[0], true
+}
@@ -0,0 +1,25 @@
+package tokenutils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// GenerateOpaqueToken returns a url-safe random token with numBytes of entropy,
+// for things like invitation links that are looked up rather than verified.
+func GenerateOpaqueToken(numBytes int) (string, error) {
+	buffer := make([]byte, numBytes)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buffer), nil
+}
+
+// HashOpaqueToken is what gets stored in place of an opaque token. a fast hash
+// is fine here since the tokens are high entropy.
+func HashOpaqueToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -1,33 +1,66 @@
 package tokenutils
 
 import (
+	"fmt"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
+	authmodels "github.com/alubhorta/goth/models/auth"
+	orgmodels "github.com/alubhorta/goth/models/org"
+	rbacutils "github.com/alubhorta/goth/utils/rbac"
+
 	"github.com/golang-jwt/jwt/v4"
 )
 
-func CreateNewAccessToken(userId string) (string, error) {
-	token := jwt.New(jwt.SigningMethodHS256)
+// authentication methods of the amr claim, as registered by RFC 8176, and fed
+// for logins through another identity provider
+const (
+	AmrPassword  = "pwd"
+	AmrPasskey   = "hwk"
+	AmrSms       = "sms"
+	AmrOtp       = "otp"
+	AmrMfa       = "mfa"
+	AmrFederated = "fed"
+)
 
+// CreateNewAccessToken signs an access token for userId. extraClaims, if any,
+// are added on top of the standard claims.
+func CreateNewAccessToken(userId string, extraClaims jwt.MapClaims) (string, error) {
 	maxAgeInSeconds, err := strconv.Atoi(os.Getenv("ACCESS_TOKEN_MAX_AGE_IN_SECONDS"))
 	if err != nil {
 		return "", err
 	}
+	return createAccessToken(userId, extraClaims, time.Second*time.Duration(maxAgeInSeconds))
+}
+
+// CreateNewElevatedAccessToken signs an access token for userId that is only
+// valid for maxAge, handed out after a re-authentication.
+func CreateNewElevatedAccessToken(userId string, extraClaims jwt.MapClaims, maxAge time.Duration) (string, error) {
+	return createAccessToken(userId, extraClaims, maxAge)
+}
+
+func createAccessToken(userId string, extraClaims jwt.MapClaims, maxAge time.Duration) (string, error) {
+	token := jwt.New(jwt.SigningMethodHS256)
 
 	claims := token.Claims.(jwt.MapClaims)
+	for key, val := range extraClaims {
+		claims[key] = val
+	}
 	claims["userId"] = userId
 	// claims["jti"] = fmt.Sprintf("%v", uuid.New())
 	now := time.Now()
 	claims["iat"] = now.Unix()
-	claims["exp"] = now.Add(time.Second * time.Duration(maxAgeInSeconds)).Unix()
+	claims["exp"] = now.Add(maxAge).Unix()
 
 	signingKey := os.Getenv("ACCESS_TOKEN_SIGNING_KEY")
 	return token.SignedString([]byte(signingKey))
 }
 
-func CreateNewRefreshToken(userId string) (string, error) {
+// CreateNewRefreshToken signs a refresh token for userId. extraClaims, if any,
+// are added on top of the standard claims.
+func CreateNewRefreshToken(userId string, extraClaims jwt.MapClaims) (string, error) {
 	token := jwt.New(jwt.SigningMethodHS256)
 
 	maxAgeInSeconds, err := strconv.Atoi(os.Getenv("REFRESH_TOKEN_MAX_AGE_IN_SECONDS"))
@@ -36,6 +69,9 @@ func CreateNewRefreshToken(userId string) (string, error) {
 	}
 
 	claims := token.Claims.(jwt.MapClaims)
+	for key, val := range extraClaims {
+		claims[key] = val
+	}
 	claims["userId"] = userId
 	// claims["jti"] = fmt.Sprintf("%v", uuid.New())
 	now := time.Now()
@@ -45,3 +81,112 @@ func CreateNewRefreshToken(userId string) (string, error) {
 	signingKey := os.Getenv("REFRESH_TOKEN_SIGNING_KEY")
 	return token.SignedString([]byte(signingKey))
 }
+
+// CreateNewClientAccessToken signs an access token for a machine client acting
+// on its own behalf. it has no userId, and its scopes act as permissions.
+func CreateNewClientAccessToken(clientId string, scopes []string) (string, error) {
+	token := jwt.New(jwt.SigningMethodHS256)
+
+	maxAgeInSeconds, err := strconv.Atoi(os.Getenv("ACCESS_TOKEN_MAX_AGE_IN_SECONDS"))
+	if err != nil {
+		return "", err
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	claims["client_id"] = clientId
+	claims["scope"] = strings.Join(scopes, " ")
+	now := time.Now()
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(time.Second * time.Duration(maxAgeInSeconds)).Unix()
+
+	signingKey := os.Getenv("ACCESS_TOKEN_SIGNING_KEY")
+	return token.SignedString([]byte(signingKey))
+}
+
+// GetUserClaims returns the authorization claims of an access token for authCred.
+// refresh tokens don't carry them, so role changes apply on the next refresh.
+func GetUserClaims(authCred *authmodels.UserAuthCredential) jwt.MapClaims {
+	return jwt.MapClaims{
+		"roles":       rbacutils.GetEffectiveRoles(authCred.Roles),
+		"permissions": rbacutils.GetEffectivePermissions(authCred.Roles, authCred.Permissions),
+	}
+}
+
+// GetAuthClaims returns the claims telling when and how the user last
+// authenticated. refresh tokens carry them too, so that refreshed access
+// tokens keep the time of the login rather than of the refresh.
+func GetAuthClaims(authTime time.Time, amr ...string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"auth_time": authTime.Unix(),
+		"amr":       amr,
+	}
+}
+
+// CopyAuthClaims returns the auth claims of a parsed token, none for tokens
+// issued before they were introduced.
+func CopyAuthClaims(claims jwt.MapClaims) jwt.MapClaims {
+	authTime, ok := claims["auth_time"].(float64)
+	if !ok {
+		return jwt.MapClaims{}
+	}
+	return GetAuthClaims(time.Unix(int64(authTime), 0), GetStringSliceClaim(claims, "amr")...)
+}
+
+// GetOrgClaims returns the active org claims of an access token for membership.
+// only the org id goes into refresh tokens, the role is re-read on refresh.
+func GetOrgClaims(membership *orgmodels.Membership) jwt.MapClaims {
+	return jwt.MapClaims{
+		"orgId":   membership.OrgId,
+		"orgRole": membership.Role,
+	}
+}
+
+// MergeClaims returns a new set of claims holding all of the given claims,
+// later ones taking precedence.
+func MergeClaims(claimSets ...jwt.MapClaims) jwt.MapClaims {
+	merged := jwt.MapClaims{}
+	for _, claims := range claimSets {
+		for key, val := range claims {
+			merged[key] = val
+		}
+	}
+	return merged
+}
+
+// GetStringSliceClaim reads a claim holding a list of strings, as decoded from json.
+func GetStringSliceClaim(claims jwt.MapClaims, key string) []string {
+	values := []string{}
+
+	raw, ok := claims[key].([]interface{})
+	if !ok {
+		return values
+	}
+	for _, val := range raw {
+		if str, ok := val.(string); ok {
+			values = append(values, str)
+		}
+	}
+	return values
+}
+
+// ParseToken validates tokenString against the signing key stored in the
+// signingKeyEnv env variable and returns its claims.
+func ParseToken(tokenString, signingKeyEnv string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+
+		signingKey := os.Getenv(signingKeyEnv)
+		return []byte(signingKey), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, fmt.Errorf("invalid token or claim typecast error")
+	}
+	return claims, nil
+}
@@ -0,0 +1,123 @@
+package usernameutils
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	envutils "github.com/alubhorta/goth/utils/env"
+)
+
+var ErrTooShort = errors.New("username is too short")
+var ErrTooLong = errors.New("username is too long")
+var ErrInvalidChars = errors.New("username must start with a letter and only contain letters, digits and single dots or underscores between them")
+var ErrReserved = errors.New("username is reserved")
+
+// names that could be mistaken for the service itself or collide with routes
+// of a frontend, extend it with USERNAME_RESERVED_FILE.
+var defaultReservedNames = []string{
+	"about", "abuse", "account", "admin", "administrator", "api", "app", "auth",
+	"billing", "blog", "contact", "dashboard", "help", "hostmaster", "info",
+	"login", "logout", "mail", "me", "moderator", "news", "noreply", "null",
+	"official", "owner", "postmaster", "privacy", "profile", "root", "security",
+	"settings", "signin", "signup", "staff", "status", "support", "system",
+	"team", "terms", "undefined", "user", "users", "webmaster", "www",
+}
+
+type Policy struct {
+	MinLength int
+	MaxLength int
+	// how long after a change the username can't be changed again
+	ChangeCooldown time.Duration
+	// how long a replaced username stays reserved for its previous owner
+	ReservationPeriod time.Duration
+	ReservedNames     map[string]bool
+}
+
+var policy *Policy
+var policyOnce sync.Once
+
+// GetPolicy returns the username policy configured by the USERNAME_* env, read once.
+func GetPolicy() *Policy {
+	policyOnce.Do(func() {
+		policy = &Policy{
+			MinLength:         envutils.GetInt("USERNAME_MIN_LENGTH", 3),
+			MaxLength:         envutils.GetInt("USERNAME_MAX_LENGTH", 30),
+			ChangeCooldown:    time.Duration(envutils.GetInt("USERNAME_CHANGE_COOLDOWN_DAYS", 30)) * 24 * time.Hour,
+			ReservationPeriod: time.Duration(envutils.GetInt("USERNAME_RESERVATION_DAYS", 90)) * 24 * time.Hour,
+			ReservedNames:     map[string]bool{},
+		}
+		if policy.MinLength < 1 || policy.MaxLength < policy.MinLength {
+			log.Fatalln("invalid USERNAME_MIN_LENGTH or USERNAME_MAX_LENGTH, expected 1 <= min <= max.")
+		} else if policy.ChangeCooldown < 0 || policy.ReservationPeriod < 0 {
+			log.Fatalln("invalid USERNAME_CHANGE_COOLDOWN_DAYS or USERNAME_RESERVATION_DAYS, expected >= 0.")
+		}
+
+		for _, name := range defaultReservedNames {
+			policy.ReservedNames[name] = true
+		}
+		if path := os.Getenv("USERNAME_RESERVED_FILE"); path != "" {
+			if err := policy.loadReservedNames(path); err != nil {
+				log.Fatalln("failed to load USERNAME_RESERVED_FILE.", err)
+			}
+		}
+	})
+	return policy
+}
+
+// loadReservedNames reads one name per line, ignoring blank lines and # comments.
+func (p *Policy) loadReservedNames(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			p.ReservedNames[Normalize(line)] = true
+		}
+	}
+	return scanner.Err()
+}
+
+// Normalize is the form usernames are stored and compared in, they are case
+// insensitive like emails.
+func Normalize(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// Validate checks a normalized username. dots and underscores can't come in a
+// row or end it, and without an @ a username can't be taken for an email.
+func (p *Policy) Validate(username string) error {
+	if len(username) < p.MinLength {
+		return ErrTooShort
+	} else if len(username) > p.MaxLength {
+		return ErrTooLong
+	}
+
+	for i, r := range username {
+		switch {
+		case r >= 'a' && r <= 'z':
+		case r >= '0' && r <= '9' && i > 0:
+		case (r == '.' || r == '_') && i > 0 && i < len(username)-1 && !isSeparator(username[i-1]):
+		default:
+			return ErrInvalidChars
+		}
+	}
+
+	if p.ReservedNames[username] || p.ReservedNames[strings.NewReplacer(".", "", "_", "").Replace(username)] {
+		return ErrReserved
+	}
+	return nil
+}
+
+func isSeparator(char byte) bool {
+	return char == '.' || char == '_'
+}
@@ -1,8 +1,108 @@
 package validationutils
 
-import "net/mail"
+import (
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
 
+	"golang.org/x/text/unicode/norm"
+)
+
+// IsValidEmail accepts a plain address, without a display name, whose domain
+// can be converted to ascii.
 func IsValidEmail(email string) bool {
-	_, err := mail.ParseAddress(email)
-	return err == nil
+	return NormalizeEmail(email) != ""
+}
+
+// NormalizeEmail is the canonical form emails are stored and compared in, or
+// an empty string for an invalid email. the address is trimmed and lowercased,
+// and an internationalized domain is converted to punycode. nearly no mail
+// provider treats local parts case sensitive, so neither does goth.
+func NormalizeEmail(email string) string {
+	email = strings.TrimSpace(email)
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email {
+		return ""
+	}
+
+	at := strings.LastIndex(email, "@")
+	local, domain := strings.ToLower(email[:at]), toAsciiDomain(email[at+1:])
+	if local == "" || domain == "" {
+		return ""
+	}
+	return local + "@" + domain
+}
+
+func toAsciiDomain(domain string) string {
+	domain = strings.TrimSuffix(strings.ToLower(norm.NFC.String(domain)), ".")
+	labels := strings.Split(domain, ".")
+	for i, label := range labels {
+		if label == "" {
+			return ""
+		}
+		for _, r := range label {
+			if r >= 0x80 {
+				encoded, err := encodePunycode(label)
+				if err != nil {
+					return ""
+				}
+				labels[i] = "xn--" + encoded
+				break
+			}
+		}
+		if len(labels[i]) > 63 {
+			return ""
+		}
+	}
+	domain = strings.Join(labels, ".")
+	if len(domain) > 253 {
+		return ""
+	}
+	return domain
+}
+
+// providers that deliver mail for local+tag to local
+var plusTagDomains = map[string]bool{
+	"gmail.com":      true,
+	"outlook.com":    true,
+	"hotmail.com":    true,
+	"live.com":       true,
+	"icloud.com":     true,
+	"me.com":         true,
+	"protonmail.com": true,
+	"proton.me":      true,
+	"fastmail.com":   true,
+}
+
+// areProviderRulesOn tells if EMAIL_PROVIDER_RULES is on.
+func areProviderRulesOn() bool {
+	on, _ := strconv.ParseBool(os.Getenv("EMAIL_PROVIDER_RULES"))
+	return on
+}
+
+// GetEmailKey is the identity of an email, unique across accounts, or an empty
+// string for an invalid email. it's the normalized email, and with
+// EMAIL_PROVIDER_RULES also drops +tags of known providers and the dots gmail
+// ignores, so such variants of one mailbox can't sign up twice.
+func GetEmailKey(email string) string {
+	email = NormalizeEmail(email)
+	if email == "" || !areProviderRulesOn() {
+		return email
+	}
+
+	at := strings.LastIndex(email, "@")
+	local, domain := email[:at], email[at+1:]
+	if domain == "googlemail.com" {
+		domain = "gmail.com"
+	}
+	if plusTagDomains[domain] {
+		if plus := strings.Index(local, "+"); plus > 0 {
+			local = local[:plus]
+		}
+	}
+	if domain == "gmail.com" {
+		local = strings.ReplaceAll(local, ".", "")
+	}
+	return local + "@" + domain
 }
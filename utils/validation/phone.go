@@ -0,0 +1,31 @@
+package validationutils
+
+import "strings"
+
+// separators people write phone numbers with, dropped by NormalizePhone
+var phoneSeparators = strings.NewReplacer(" ", "", "-", "", ".", "", "(", "", ")", "")
+
+func IsValidPhone(phone string) bool {
+	return NormalizePhone(phone) != ""
+}
+
+// NormalizePhone is the E.164 form phone numbers are stored in, like
+// +14155550123, or an empty string for an invalid number. the country code is
+// required, as there is no default country to assume.
+func NormalizePhone(phone string) string {
+	phone = phoneSeparators.Replace(strings.TrimSpace(phone))
+	if !strings.HasPrefix(phone, "+") {
+		return ""
+	}
+
+	digits := phone[1:]
+	if len(digits) < 7 || len(digits) > 15 || digits[0] == '0' {
+		return ""
+	}
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return ""
+		}
+	}
+	return phone
+}
@@ -0,0 +1,133 @@
+package webauthnutils
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+var ErrInvalidCbor = errors.New("invalid cbor")
+
+// cbor nested deeper than this is not produced by any authenticator
+const maxCborDepth = 16
+
+// decodeCbor decodes the first CBOR item of data, returning it along with the
+// number of bytes it took. it covers what authenticators send: integers, byte
+// and text strings, arrays, maps with integer or text keys and simple values.
+// indefinite lengths are not supported.
+func decodeCbor(data []byte) (interface{}, int, error) {
+	return decodeCborItem(data, 0)
+}
+
+func decodeCborItem(data []byte, depth int) (interface{}, int, error) {
+	if depth > maxCborDepth || len(data) == 0 {
+		return nil, 0, ErrInvalidCbor
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+
+	arg, offset := uint64(info), 1
+	switch {
+	case info < 24:
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(data) < 1+size {
+			return nil, 0, ErrInvalidCbor
+		}
+		switch size {
+		case 1:
+			arg = uint64(data[1])
+		case 2:
+			arg = uint64(binary.BigEndian.Uint16(data[1:]))
+		case 4:
+			arg = uint64(binary.BigEndian.Uint32(data[1:]))
+		case 8:
+			arg = binary.BigEndian.Uint64(data[1:])
+		}
+		offset += size
+	default:
+		return nil, 0, ErrInvalidCbor
+	}
+	rest := data[offset:]
+
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, 0, ErrInvalidCbor
+		}
+		return int64(arg), offset, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, 0, ErrInvalidCbor
+		}
+		return -1 - int64(arg), offset, nil
+	case 2, 3:
+		if arg > uint64(len(rest)) {
+			return nil, 0, ErrInvalidCbor
+		}
+		value := make([]byte, arg)
+		copy(value, rest[:arg])
+		if major == 3 {
+			return string(value), offset + int(arg), nil
+		}
+		return value, offset + int(arg), nil
+	case 4:
+		// every item takes at least a byte, which bounds the allocation
+		if arg > uint64(len(rest)) {
+			return nil, 0, ErrInvalidCbor
+		}
+		items := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			item, n, err := decodeCborItem(data[offset:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			items = append(items, item)
+			offset += n
+		}
+		return items, offset, nil
+	case 5:
+		if arg > uint64(len(rest)) {
+			return nil, 0, ErrInvalidCbor
+		}
+		items := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			key, n, err := decodeCborItem(data[offset:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			offset += n
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, 0, ErrInvalidCbor
+			}
+			value, n, err := decodeCborItem(data[offset:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			items[key] = value
+			offset += n
+		}
+		return items, offset, nil
+	case 6:
+		// tags are skipped, only the tagged item matters
+		item, n, err := decodeCborItem(rest, depth+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		return item, offset + n, nil
+	default:
+		switch info {
+		case 20:
+			return false, offset, nil
+		case 21:
+			return true, offset, nil
+		case 22, 23:
+			return nil, offset, nil
+		case 25, 26, 27:
+			// floats are never needed, their value is dropped
+			return nil, offset, nil
+		}
+		return nil, 0, ErrInvalidCbor
+	}
+}
@@ -0,0 +1,111 @@
+package webauthnutils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+)
+
+// COSE algorithms offered at registration, in order of preference
+const (
+	AlgES256 = -7
+	AlgEdDSA = -8
+	AlgRS256 = -257
+)
+
+var SupportedAlgorithms = []int64{AlgES256, AlgEdDSA, AlgRS256}
+
+var ErrUnsupportedKey = errors.New("unsupported credential public key")
+
+// COSE key map labels, see RFC 9053
+const (
+	coseKeyType  = 1
+	coseKeyAlg   = 3
+	coseKeyCurve = -1
+	coseKeyX     = -2
+	coseKeyY     = -3
+	coseKeyN     = -1
+	coseKeyE     = -2
+
+	coseKtyOkp = 1
+	coseKtyEc2 = 2
+	coseKtyRsa = 3
+
+	coseCrvP256    = 1
+	coseCrvEd25519 = 6
+)
+
+// parsePublicKey reads a COSE encoded credential public key.
+func parsePublicKey(coseKey []byte) (crypto.PublicKey, int64, error) {
+	decoded, n, err := decodeCbor(coseKey)
+	if err != nil {
+		return nil, 0, err
+	} else if n != len(coseKey) {
+		return nil, 0, ErrInvalidCbor
+	}
+	keyMap, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, 0, ErrUnsupportedKey
+	}
+	kty, _ := keyMap[int64(coseKeyType)].(int64)
+	alg, _ := keyMap[int64(coseKeyAlg)].(int64)
+
+	switch {
+	case kty == coseKtyEc2 && alg == AlgES256:
+		crv, _ := keyMap[int64(coseKeyCurve)].(int64)
+		x, _ := keyMap[int64(coseKeyX)].([]byte)
+		y, _ := keyMap[int64(coseKeyY)].([]byte)
+		if crv != coseCrvP256 || len(x) != 32 || len(y) != 32 {
+			return nil, 0, ErrUnsupportedKey
+		}
+		publicKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !publicKey.Curve.IsOnCurve(publicKey.X, publicKey.Y) {
+			return nil, 0, ErrUnsupportedKey
+		}
+		return publicKey, alg, nil
+	case kty == coseKtyOkp && alg == AlgEdDSA:
+		crv, _ := keyMap[int64(coseKeyCurve)].(int64)
+		x, _ := keyMap[int64(coseKeyX)].([]byte)
+		if crv != coseCrvEd25519 || len(x) != ed25519.PublicKeySize {
+			return nil, 0, ErrUnsupportedKey
+		}
+		return ed25519.PublicKey(x), alg, nil
+	case kty == coseKtyRsa && alg == AlgRS256:
+		n, _ := keyMap[int64(coseKeyN)].([]byte)
+		e, _ := keyMap[int64(coseKeyE)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, 0, ErrUnsupportedKey
+		}
+		exponent := int(new(big.Int).SetBytes(e).Int64())
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}, alg, nil
+	}
+	return nil, 0, ErrUnsupportedKey
+}
+
+// verifySignature checks signature over data with a COSE encoded public key.
+func verifySignature(coseKey, data, signature []byte) error {
+	publicKey, alg, err := parsePublicKey(coseKey)
+	if err != nil {
+		return err
+	}
+
+	digest := sha256.Sum256(data)
+	valid := false
+	switch alg {
+	case AlgES256:
+		valid = ecdsa.VerifyASN1(publicKey.(*ecdsa.PublicKey), digest[:], signature)
+	case AlgEdDSA:
+		valid = ed25519.Verify(publicKey.(ed25519.PublicKey), data, signature)
+	case AlgRS256:
+		valid = rsa.VerifyPKCS1v15(publicKey.(*rsa.PublicKey), crypto.SHA256, digest[:], signature) == nil
+	}
+	if !valid {
+		return ErrInvalidSignature
+	}
+	return nil
+}
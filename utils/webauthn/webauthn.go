@@ -0,0 +1,240 @@
+package webauthnutils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+)
+
+const (
+	CeremonyCreate = "webauthn.create"
+	CeremonyGet    = "webauthn.get"
+)
+
+// authenticator data flags
+const (
+	flagUserPresent      = 0x01
+	flagUserVerified     = 0x04
+	flagAttestedCredData = 0x40
+	flagExtensionData    = 0x80
+)
+
+var (
+	ErrInvalidClientData  = errors.New("invalid client data")
+	ErrInvalidAuthData    = errors.New("invalid authenticator data")
+	ErrInvalidSignature   = errors.New("invalid signature")
+	ErrChallengeMismatch  = errors.New("challenge does not match")
+	ErrOriginMismatch     = errors.New("origin is not allowed")
+	ErrRpIdMismatch       = errors.New("relying party id does not match")
+	ErrUserNotPresent     = errors.New("user presence is required")
+	ErrUserNotVerified    = errors.New("user verification is required")
+	ErrSignCountRegressed = errors.New("sign count did not increase, the authenticator may be cloned")
+)
+
+// GetRpId is the WEBAUTHN_RP_ID env, the domain passkeys are bound to.
+func GetRpId() string {
+	if rpId := os.Getenv("WEBAUTHN_RP_ID"); rpId != "" {
+		return rpId
+	}
+	return "localhost"
+}
+
+// GetRpName is the WEBAUTHN_RP_NAME env, shown by authenticators.
+func GetRpName() string {
+	if rpName := os.Getenv("WEBAUTHN_RP_NAME"); rpName != "" {
+		return rpName
+	}
+	return "goth"
+}
+
+// GetOrigins is the comma separated WEBAUTHN_ORIGINS env, the origins of the
+// frontends allowed to run ceremonies.
+func GetOrigins() []string {
+	origins := []string{}
+	for _, origin := range strings.Split(os.Getenv("WEBAUTHN_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, strings.TrimSuffix(origin, "/"))
+		}
+	}
+	if len(origins) == 0 {
+		origins = []string{"http://localhost:3333"}
+	}
+	return origins
+}
+
+// DecodeBase64Url accepts the unpadded base64url of WebAuthn JSON, and the
+// padded variant some libraries send.
+func DecodeBase64Url(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// GetChallenge reads the challenge out of clientDataJSON, so the ceremony it
+// belongs to can be looked up before verification.
+func GetChallenge(clientDataJSON []byte) (string, error) {
+	data := new(clientData)
+	if err := json.Unmarshal(clientDataJSON, data); err != nil || data.Challenge == "" {
+		return "", ErrInvalidClientData
+	}
+	return data.Challenge, nil
+}
+
+func verifyClientData(clientDataJSON []byte, ceremony, challenge string) error {
+	data := new(clientData)
+	if err := json.Unmarshal(clientDataJSON, data); err != nil {
+		return ErrInvalidClientData
+	} else if data.Type != ceremony {
+		return ErrInvalidClientData
+	} else if subtle.ConstantTimeCompare([]byte(data.Challenge), []byte(challenge)) != 1 {
+		return ErrChallengeMismatch
+	}
+	for _, origin := range GetOrigins() {
+		if data.Origin == origin {
+			return nil
+		}
+	}
+	return ErrOriginMismatch
+}
+
+type authenticatorData struct {
+	rpIdHash     []byte
+	flags        byte
+	signCount    uint32
+	credentialId []byte
+	publicKey    []byte
+}
+
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, ErrInvalidAuthData
+	}
+	authData := &authenticatorData{
+		rpIdHash:  data[:32],
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	rest := data[37:]
+
+	if authData.flags&flagAttestedCredData != 0 {
+		// aaguid, credential id length and id, then the COSE public key
+		if len(rest) < 18 {
+			return nil, ErrInvalidAuthData
+		}
+		idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if idLength == 0 || idLength > 1023 || len(rest) < idLength {
+			return nil, ErrInvalidAuthData
+		}
+		authData.credentialId = rest[:idLength]
+		rest = rest[idLength:]
+
+		_, n, err := decodeCbor(rest)
+		if err != nil {
+			return nil, ErrInvalidAuthData
+		}
+		authData.publicKey = rest[:n]
+		rest = rest[n:]
+	}
+	if authData.flags&flagExtensionData != 0 {
+		_, n, err := decodeCbor(rest)
+		if err != nil {
+			return nil, ErrInvalidAuthData
+		}
+		rest = rest[n:]
+	}
+	if len(rest) != 0 {
+		return nil, ErrInvalidAuthData
+	}
+	return authData, nil
+}
+
+func (authData *authenticatorData) verify(requireUserVerification bool) error {
+	rpIdHash := sha256.Sum256([]byte(GetRpId()))
+	if !bytes.Equal(authData.rpIdHash, rpIdHash[:]) {
+		return ErrRpIdMismatch
+	} else if authData.flags&flagUserPresent == 0 {
+		return ErrUserNotPresent
+	} else if requireUserVerification && authData.flags&flagUserVerified == 0 {
+		return ErrUserNotVerified
+	}
+	return nil
+}
+
+// Credential is what gets stored of a registered passkey.
+type Credential struct {
+	Id        []byte
+	PublicKey []byte
+	SignCount uint32
+}
+
+// VerifyRegistration checks the response of navigator.credentials.create.
+// attestation is not requested, so the attestation statement is not checked
+// and any authenticator is accepted.
+func VerifyRegistration(clientDataJSON, attestationObject []byte, challenge string) (*Credential, error) {
+	if err := verifyClientData(clientDataJSON, CeremonyCreate, challenge); err != nil {
+		return nil, err
+	}
+
+	decoded, _, err := decodeCbor(attestationObject)
+	if err != nil {
+		return nil, err
+	}
+	attestation, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, ErrInvalidAuthData
+	}
+	rawAuthData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return nil, ErrInvalidAuthData
+	}
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	} else if err := authData.verify(false); err != nil {
+		return nil, err
+	} else if authData.credentialId == nil {
+		return nil, ErrInvalidAuthData
+	}
+	if _, _, err := parsePublicKey(authData.publicKey); err != nil {
+		return nil, err
+	}
+
+	return &Credential{Id: authData.credentialId, PublicKey: authData.publicKey, SignCount: authData.signCount}, nil
+}
+
+// VerifyAssertion checks the response of navigator.credentials.get against a
+// stored credential, and returns the new sign count to store.
+func VerifyAssertion(clientDataJSON, rawAuthData, signature []byte, challenge string, credential *Credential, requireUserVerification bool) (uint32, error) {
+	if err := verifyClientData(clientDataJSON, CeremonyGet, challenge); err != nil {
+		return 0, err
+	}
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return 0, err
+	} else if err := authData.verify(requireUserVerification); err != nil {
+		return 0, err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, rawAuthData...), clientDataHash[:]...)
+	if err := verifySignature(credential.PublicKey, signed, signature); err != nil {
+		return 0, err
+	}
+
+	// authenticators without a counter always send 0
+	if (authData.signCount != 0 || credential.SignCount != 0) && authData.signCount <= credential.SignCount {
+		return 0, ErrSignCountRegressed
+	}
+	return authData.signCount, nil
+}
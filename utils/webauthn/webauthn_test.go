@@ -0,0 +1,441 @@
+package webauthnutils
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+)
+
+const (
+	testRpId   = "example.com"
+	testOrigin = "https://app.example.com"
+)
+
+func setupEnv(t *testing.T) {
+	t.Setenv("WEBAUTHN_RP_ID", testRpId)
+	t.Setenv("WEBAUTHN_ORIGINS", testOrigin)
+}
+
+// cbor encoding, just enough to build what an authenticator sends
+
+func cborHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n <= 0xff:
+		return []byte{major<<5 | 24, byte(n)}
+	case n <= 0xffff:
+		head := []byte{major<<5 | 25, 0, 0}
+		binary.BigEndian.PutUint16(head[1:], uint16(n))
+		return head
+	default:
+		head := []byte{major<<5 | 26, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(head[1:], uint32(n))
+		return head
+	}
+}
+
+func cborInt(v int64) []byte {
+	if v < 0 {
+		return cborHead(1, uint64(-1-v))
+	}
+	return cborHead(0, uint64(v))
+}
+
+func cborBytes(b []byte) []byte {
+	return append(cborHead(2, uint64(len(b))), b...)
+}
+
+func cborText(s string) []byte {
+	return append(cborHead(3, uint64(len(s))), s...)
+}
+
+// cborMap takes already encoded keys and values, in turns
+func cborMap(pairs ...[]byte) []byte {
+	encoded := cborHead(5, uint64(len(pairs)/2))
+	for _, item := range pairs {
+		encoded = append(encoded, item...)
+	}
+	return encoded
+}
+
+// softAuthenticator is a passkey authenticator in software, with a P-256 key.
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialId []byte
+	signCount    uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentialId := make([]byte, 16)
+	if _, err := rand.Read(credentialId); err != nil {
+		t.Fatal(err)
+	}
+	return &softAuthenticator{key: key, credentialId: credentialId}
+}
+
+func (a *softAuthenticator) coseKey() []byte {
+	x := a.key.PublicKey.X.FillBytes(make([]byte, 32))
+	y := a.key.PublicKey.Y.FillBytes(make([]byte, 32))
+	return cborMap(
+		cborInt(coseKeyType), cborInt(coseKtyEc2),
+		cborInt(coseKeyAlg), cborInt(AlgES256),
+		cborInt(coseKeyCurve), cborInt(coseCrvP256),
+		cborInt(coseKeyX), cborBytes(x),
+		cborInt(coseKeyY), cborBytes(y),
+	)
+}
+
+func (a *softAuthenticator) authData(rpId string, flags byte, attested bool) []byte {
+	rpIdHash := sha256.Sum256([]byte(rpId))
+	data := append([]byte{}, rpIdHash[:]...)
+	data = append(data, flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:], a.signCount)
+	if attested {
+		data = append(data, make([]byte, 16)...) // aaguid
+		data = append(data, byte(len(a.credentialId)>>8), byte(len(a.credentialId)))
+		data = append(data, a.credentialId...)
+		data = append(data, a.coseKey()...)
+	}
+	return data
+}
+
+func clientDataJSON(t *testing.T, ceremony, challenge, origin string) []byte {
+	data, err := json.Marshal(map[string]string{"type": ceremony, "challenge": challenge, "origin": origin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func newChallenge(t *testing.T) string {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(challenge)
+}
+
+// register answers navigator.credentials.create.
+func (a *softAuthenticator) register(t *testing.T, challenge, origin, rpId string, flags byte) (clientData, attestationObject []byte) {
+	clientData = clientDataJSON(t, CeremonyCreate, challenge, origin)
+	attestationObject = cborMap(
+		cborText("fmt"), cborText("none"),
+		cborText("attStmt"), cborMap(),
+		cborText("authData"), cborBytes(a.authData(rpId, flags|flagAttestedCredData, true)),
+	)
+	return clientData, attestationObject
+}
+
+// assert answers navigator.credentials.get, counting up like a real one.
+func (a *softAuthenticator) assert(t *testing.T, challenge, origin, rpId string, flags byte) (clientData, authData, signature []byte) {
+	a.signCount++
+	clientData = clientDataJSON(t, CeremonyGet, challenge, origin)
+	authData = a.authData(rpId, flags, false)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return clientData, authData, signature
+}
+
+func registerCredential(t *testing.T, a *softAuthenticator) *Credential {
+	challenge := newChallenge(t)
+	clientData, attestationObject := a.register(t, challenge, testOrigin, testRpId, flagUserPresent|flagUserVerified)
+	credential, err := VerifyRegistration(clientData, attestationObject, challenge)
+	if err != nil {
+		t.Fatal("registration failed:", err)
+	}
+	return credential
+}
+
+func TestRegistrationAndLogin(t *testing.T) {
+	setupEnv(t)
+	a := newSoftAuthenticator(t)
+
+	credential := registerCredential(t, a)
+	if !bytes.Equal(credential.Id, a.credentialId) {
+		t.Fatal("unexpected credential id")
+	} else if !bytes.Equal(credential.PublicKey, a.coseKey()) {
+		t.Fatal("unexpected public key")
+	}
+
+	for i := 1; i <= 2; i++ {
+		challenge := newChallenge(t)
+		clientData, authData, signature := a.assert(t, challenge, testOrigin, testRpId, flagUserPresent|flagUserVerified)
+		signCount, err := VerifyAssertion(clientData, authData, signature, challenge, credential, true)
+		if err != nil {
+			t.Fatal("login failed:", err)
+		} else if signCount != uint32(i) {
+			t.Fatal("unexpected sign count", signCount)
+		}
+		credential.SignCount = signCount
+	}
+}
+
+func TestInvalidSignature(t *testing.T) {
+	setupEnv(t)
+	a := newSoftAuthenticator(t)
+	credential := registerCredential(t, a)
+
+	challenge := newChallenge(t)
+	clientData, authData, signature := a.assert(t, challenge, testOrigin, testRpId, flagUserPresent)
+	signature[len(signature)-1] ^= 0xff
+	if _, err := VerifyAssertion(clientData, authData, signature, challenge, credential, false); err != ErrInvalidSignature {
+		t.Fatal("expected ErrInvalidSignature, got", err)
+	}
+
+	// a valid signature of another authenticator
+	other := newSoftAuthenticator(t)
+	clientData, authData, signature = other.assert(t, challenge, testOrigin, testRpId, flagUserPresent)
+	if _, err := VerifyAssertion(clientData, authData, signature, challenge, credential, false); err != ErrInvalidSignature {
+		t.Fatal("expected ErrInvalidSignature, got", err)
+	}
+}
+
+func TestWrongOrigin(t *testing.T) {
+	setupEnv(t)
+	a := newSoftAuthenticator(t)
+
+	challenge := newChallenge(t)
+	clientData, attestationObject := a.register(t, challenge, "https://evil.example.com", testRpId, flagUserPresent)
+	if _, err := VerifyRegistration(clientData, attestationObject, challenge); err != ErrOriginMismatch {
+		t.Fatal("expected ErrOriginMismatch on registration, got", err)
+	}
+
+	credential := registerCredential(t, a)
+	challenge = newChallenge(t)
+	clientData, authData, signature := a.assert(t, challenge, "https://evil.example.com", testRpId, flagUserPresent)
+	if _, err := VerifyAssertion(clientData, authData, signature, challenge, credential, false); err != ErrOriginMismatch {
+		t.Fatal("expected ErrOriginMismatch on login, got", err)
+	}
+}
+
+func TestWrongRpId(t *testing.T) {
+	setupEnv(t)
+	a := newSoftAuthenticator(t)
+
+	challenge := newChallenge(t)
+	clientData, attestationObject := a.register(t, challenge, testOrigin, "evil.example.com", flagUserPresent)
+	if _, err := VerifyRegistration(clientData, attestationObject, challenge); err != ErrRpIdMismatch {
+		t.Fatal("expected ErrRpIdMismatch on registration, got", err)
+	}
+
+	credential := registerCredential(t, a)
+	challenge = newChallenge(t)
+	clientData, authData, signature := a.assert(t, challenge, testOrigin, "evil.example.com", flagUserPresent)
+	if _, err := VerifyAssertion(clientData, authData, signature, challenge, credential, false); err != ErrRpIdMismatch {
+		t.Fatal("expected ErrRpIdMismatch on login, got", err)
+	}
+}
+
+func TestUserPresenceAndVerification(t *testing.T) {
+	setupEnv(t)
+	a := newSoftAuthenticator(t)
+
+	challenge := newChallenge(t)
+	clientData, attestationObject := a.register(t, challenge, testOrigin, testRpId, 0)
+	if _, err := VerifyRegistration(clientData, attestationObject, challenge); err != ErrUserNotPresent {
+		t.Fatal("expected ErrUserNotPresent on registration, got", err)
+	}
+
+	credential := registerCredential(t, a)
+	tests := []struct {
+		name      string
+		flags     byte
+		requireUV bool
+		err       error
+	}{
+		{"missing up", flagUserVerified, false, ErrUserNotPresent},
+		{"missing uv", flagUserPresent, true, ErrUserNotVerified},
+		{"uv not required", flagUserPresent, false, nil},
+		{"up and uv", flagUserPresent | flagUserVerified, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			challenge := newChallenge(t)
+			clientData, authData, signature := a.assert(t, challenge, testOrigin, testRpId, tt.flags)
+			signCount, err := VerifyAssertion(clientData, authData, signature, challenge, credential, tt.requireUV)
+			if err != tt.err {
+				t.Fatal("expected", tt.err, "got", err)
+			} else if err == nil {
+				credential.SignCount = signCount
+			}
+		})
+	}
+}
+
+func TestSignCountRegression(t *testing.T) {
+	setupEnv(t)
+	a := newSoftAuthenticator(t)
+	credential := registerCredential(t, a)
+	credential.SignCount = 5
+
+	tests := []struct {
+		name      string
+		signCount uint32
+		err       error
+	}{
+		{"lower", 2, ErrSignCountRegressed},
+		{"same", 4, ErrSignCountRegressed},
+		{"zero after non-zero", ^uint32(0), ErrSignCountRegressed},
+		{"higher", 9, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// assert counts up once before signing
+			a.signCount = tt.signCount
+			challenge := newChallenge(t)
+			clientData, authData, signature := a.assert(t, challenge, testOrigin, testRpId, flagUserPresent)
+			if _, err := VerifyAssertion(clientData, authData, signature, challenge, credential, false); err != tt.err {
+				t.Fatal("expected", tt.err, "got", err)
+			}
+		})
+	}
+
+	// authenticators without a counter always send 0
+	credential.SignCount = 0
+	a.signCount = ^uint32(0)
+	challenge := newChallenge(t)
+	clientData, authData, signature := a.assert(t, challenge, testOrigin, testRpId, flagUserPresent)
+	if signCount, err := VerifyAssertion(clientData, authData, signature, challenge, credential, false); err != nil || signCount != 0 {
+		t.Fatal("expected counterless authenticator to pass, got", signCount, err)
+	}
+}
+
+func TestReusedChallenge(t *testing.T) {
+	setupEnv(t)
+	a := newSoftAuthenticator(t)
+	credential := registerCredential(t, a)
+
+	challenge := newChallenge(t)
+	clientData, authData, signature := a.assert(t, challenge, testOrigin, testRpId, flagUserPresent)
+	signCount, err := VerifyAssertion(clientData, authData, signature, challenge, credential, false)
+	if err != nil {
+		t.Fatal("login failed:", err)
+	}
+	credential.SignCount = signCount
+
+	// a replayed response fails for the next ceremony's challenge
+	if _, err := VerifyAssertion(clientData, authData, signature, newChallenge(t), credential, false); err != ErrChallengeMismatch {
+		t.Fatal("expected ErrChallengeMismatch, got", err)
+	}
+	// and for the same challenge, as its sign count is used up
+	if _, err := VerifyAssertion(clientData, authData, signature, challenge, credential, false); err != ErrSignCountRegressed {
+		t.Fatal("expected ErrSignCountRegressed, got", err)
+	}
+
+	// a registration response can't be used to login
+	clientData, _ = a.register(t, challenge, testOrigin, testRpId, flagUserPresent)
+	if _, err := VerifyAssertion(clientData, authData, signature, challenge, credential, false); err != ErrInvalidClientData {
+		t.Fatal("expected ErrInvalidClientData, got", err)
+	}
+
+	// the challenge is read from the client data to look up its ceremony
+	if got, err := GetChallenge(clientData); err != nil || got != challenge {
+		t.Fatal("unexpected challenge", got, err)
+	} else if _, err := GetChallenge([]byte(`{"type":"webauthn.get"}`)); err != ErrInvalidClientData {
+		t.Fatal("expected ErrInvalidClientData, got", err)
+	}
+}
+
+func TestMalformedAttestation(t *testing.T) {
+	setupEnv(t)
+	a := newSoftAuthenticator(t)
+
+	challenge := newChallenge(t)
+	clientData, attestationObject := a.register(t, challenge, testOrigin, testRpId, flagUserPresent)
+	for n := 0; n < len(attestationObject); n++ {
+		if _, err := VerifyRegistration(clientData, attestationObject[:n], challenge); err == nil {
+			t.Fatal("expected truncated attestation object of", n, "bytes to fail")
+		}
+	}
+
+	authData := a.authData(testRpId, flagUserPresent|flagAttestedCredData, true)
+	tests := []struct {
+		name     string
+		authData []byte
+	}{
+		{"too short", authData[:36]},
+		{"truncated credential id", authData[:37+18+4]},
+		{"truncated public key", authData[:len(authData)-1]},
+		{"trailing bytes", append(append([]byte{}, authData...), 0)},
+		{"no attested credential", a.authData(testRpId, flagUserPresent, false)},
+		{"extension flag without extensions", append(authData[:32:32], append([]byte{authData[32] | flagExtensionData}, authData[33:]...)...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attestationObject := cborMap(
+				cborText("fmt"), cborText("none"),
+				cborText("attStmt"), cborMap(),
+				cborText("authData"), cborBytes(tt.authData),
+			)
+			if _, err := VerifyRegistration(clientData, attestationObject, challenge); err == nil {
+				t.Fatal("expected registration to fail")
+			}
+		})
+	}
+
+	notAMap := cborBytes(authData)
+	if _, err := VerifyRegistration(clientData, notAMap, challenge); err != ErrInvalidAuthData {
+		t.Fatal("expected ErrInvalidAuthData, got", err)
+	}
+	unsupportedKey := cborMap(cborInt(coseKeyType), cborInt(coseKtyEc2), cborInt(coseKeyAlg), cborInt(-36))
+	if _, _, err := parsePublicKey(unsupportedKey); err != ErrUnsupportedKey {
+		t.Fatal("expected ErrUnsupportedKey, got", err)
+	}
+	if _, _, err := parsePublicKey(append(a.coseKey(), 0)); err != ErrInvalidCbor {
+		t.Fatal("expected ErrInvalidCbor for trailing bytes, got", err)
+	}
+}
+
+func TestMalformedCbor(t *testing.T) {
+	deep := bytes.Repeat([]byte{0x81}, maxCborDepth+2)
+	deep = append(deep, 0x00)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", []byte{}},
+		{"truncated argument", []byte{0x19, 0x01}},
+		{"reserved argument", []byte{0x1c}},
+		{"indefinite length", []byte{0x5f, 0x41, 0x00, 0xff}},
+		{"byte string longer than data", []byte{0x5a, 0xff, 0xff, 0xff, 0xff, 0x00}},
+		{"array longer than data", []byte{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"map longer than data", []byte{0xbb, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"map without value", []byte{0xa1, 0x01}},
+		{"map with byte string key", []byte{0xa1, 0x41, 0x00, 0x01}},
+		{"integer out of range", []byte{0x1b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"too deep", deep},
+		{"break outside indefinite item", []byte{0xff}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := decodeCbor(tt.data); err != ErrInvalidCbor {
+				t.Fatal("expected ErrInvalidCbor, got", err)
+			}
+		})
+	}
+
+	value, n, err := decodeCbor([]byte{0xa2, 0x01, 0x41, 0x2a, 0x63, 'k', 'e', 'y', 0x20, 0x00})
+	if err != nil || n != 9 {
+		t.Fatal("unexpected decoding", n, err)
+	}
+	decoded := value.(map[interface{}]interface{})
+	if !bytes.Equal(decoded[int64(1)].([]byte), []byte{0x2a}) || decoded["key"] != int64(-1) {
+		t.Fatal("unexpected decoded map", decoded)
+	}
+}